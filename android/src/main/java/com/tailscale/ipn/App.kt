@@ -14,6 +14,7 @@ import android.content.RestrictionsManager
 import android.content.SharedPreferences
 import android.content.pm.PackageManager
 import android.net.ConnectivityManager
+import android.net.NetworkCapabilities
 import android.net.Uri
 import android.os.Build
 import android.util.Log
@@ -321,6 +322,8 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     return getIsClientLoggingEnabled()
   }
 
+  override fun isDebugBuild(): Boolean = BuildConfig.DEBUG
+
   @Serializable
   data class AddrJson(
       val ip: String,
@@ -338,11 +341,70 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
       val pointToPoint: Boolean,
       val multicast: Boolean,
       val addrs: List<AddrJson>,
+      // The Android network of the interface, if any. See NetworkJson.
+      val transport: String? = null,
+      val metered: Boolean? = null,
+      val vpn: Boolean = false,
+      val defaultRoute: Boolean = false,
+      val gateways: List<String> = emptyList(),
+      val dnsServers: List<String> = emptyList(),
+  )
+
+  private data class NetworkJson(
+      val transport: String,
+      val metered: Boolean,
+      val vpn: Boolean,
+      val defaultRoute: Boolean,
+      val gateways: List<String>,
+      val dnsServers: List<String>,
   )
 
+  // networksByInterface returns what's known about the network of each interface that belongs to
+  // one, by interface name.
+  private fun networksByInterface(): Map<String, NetworkJson> {
+    if (!::connectivityManager.isInitialized) {
+      return emptyMap()
+    }
+    val out = HashMap<String, NetworkJson>()
+    for (network in connectivityManager.allNetworks) {
+      try {
+        val lp = connectivityManager.getLinkProperties(network) ?: continue
+        val name = lp.interfaceName ?: continue
+        val caps = connectivityManager.getNetworkCapabilities(network) ?: continue
+        val vpn = caps.hasTransport(NetworkCapabilities.TRANSPORT_VPN)
+        val transport =
+            when {
+              vpn -> "vpn"
+              caps.hasTransport(NetworkCapabilities.TRANSPORT_WIFI) -> "wifi"
+              caps.hasTransport(NetworkCapabilities.TRANSPORT_CELLULAR) -> "cellular"
+              caps.hasTransport(NetworkCapabilities.TRANSPORT_ETHERNET) -> "ethernet"
+              caps.hasTransport(NetworkCapabilities.TRANSPORT_BLUETOOTH) -> "bluetooth"
+              Build.VERSION.SDK_INT >= Build.VERSION_CODES.S &&
+                  caps.hasTransport(NetworkCapabilities.TRANSPORT_USB) -> "usb"
+              else -> "other"
+            }
+        val defaultRoutes = lp.routes.filter { it.isDefaultRoute }
+        out[name] =
+            NetworkJson(
+                transport = transport,
+                metered = !caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_NOT_METERED),
+                vpn = vpn,
+                defaultRoute = defaultRoutes.isNotEmpty(),
+                gateways =
+                    defaultRoutes.filter { it.hasGateway() }.mapNotNull { it.gateway?.hostAddress },
+                dnsServers = lp.dnsServers.mapNotNull { it.hostAddress },
+            )
+      } catch (e: Exception) {
+        TSLog.d("App", "getInterfacesAsJson: network $network: $e")
+      }
+    }
+    return out
+  }
+
   override fun getInterfacesAsJson(): String {
     val interfaces = Collections.list(NetworkInterface.getNetworkInterfaces())
     val out = ArrayList<InterfaceJson>(interfaces.size)
+    val networks = networksByInterface()
 
     for (nif in interfaces) {
       try {
@@ -353,6 +415,7 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
           val host = addr.hostAddress ?: continue
           addrs.add(AddrJson(ip = host, prefixLen = ia.networkPrefixLength.toInt()))
         }
+        val network = networks[nif.name]
 
         out.add(
             InterfaceJson(
@@ -365,6 +428,12 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
                 pointToPoint = nif.isPointToPoint,
                 multicast = nif.supportsMulticast(),
                 addrs = addrs,
+                transport = network?.transport,
+                metered = network?.metered,
+                vpn = network?.vpn ?: false,
+                defaultRoute = network?.defaultRoute ?: false,
+                gateways = network?.gateways ?: emptyList(),
+                dnsServers = network?.dnsServers ?: emptyList(),
             ))
       } catch (_: Exception) {
         continue
@@ -429,8 +498,8 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     }
   }
 
-  override fun hardwareAttestationKeyCreate(): String {
-    return getKeyStore().createKey()
+  override fun hardwareAttestationKeyCreate(challenge: ByteArray): String {
+    return getKeyStore().createKey(challenge)
   }
 
   @Throws(NoSuchKeyException::class)
@@ -453,6 +522,16 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     return getKeyStore().load(id)
   }
 
+  @Throws(NoSuchKeyException::class)
+  override fun hardwareAttestationKeyCertificateChain(id: String): ByteArray {
+    return getKeyStore().certificateChain(id)
+  }
+
+  @Throws(NoSuchKeyException::class)
+  override fun hardwareAttestationKeySecurityLevel(id: String): String {
+    return getKeyStore().securityLevel(id)
+  }
+
   override fun bindSocketToNetwork(fd: Int): Boolean {
     val net =
         NetworkChangeCallback.cachedDefaultNetwork
@@ -480,6 +559,22 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     }
   }
 
+  @Serializable
+  data class SplitTunnelAppsJson(
+      val allowSelected: Boolean,
+      val packages: List<String>,
+      val builtInDisallowed: List<String>,
+  )
+
+  override fun getSplitTunnelAppsJSON(): String {
+    val apps =
+        SplitTunnelAppsJson(
+            allowSelected = allowSelectedPackages(),
+            packages = selectedPackageNames(),
+            builtInDisallowed = builtInDisallowedPackageNames)
+    return Json.encodeToString(apps)
+  }
+
   override fun getUserCACertsPEM(): ByteArray {
     val ks = java.security.KeyStore.getInstance("AndroidCAStore")
     ks.load(null)
@@ -726,7 +821,7 @@ open class UninitializedApp : Application() {
 
     getUnencryptedPrefs().edit().putStringSet(SELECTED_APPS_KEY, packageNames.toSet()).apply()
 
-    this.restartVPN()
+    App.get().getLibtailscaleApp().notifySplitTunnelChanged()
   }
 
   fun switchUserSelectedPackages() {
@@ -736,7 +831,7 @@ open class UninitializedApp : Application() {
         .apply()
     getUnencryptedPrefs().edit().putStringSet(SELECTED_APPS_KEY, setOf()).apply()
 
-    this.restartVPN()
+    App.get().getLibtailscaleApp().notifySplitTunnelChanged()
   }
 
   fun selectedPackageNames(): List<String> {
@@ -4,10 +4,8 @@ package com.tailscale.ipn
 
 import android.app.PendingIntent
 import android.content.Intent
-import android.content.pm.PackageManager
 import android.net.VpnService
 import android.os.Build
-import android.system.OsConstants
 import com.tailscale.ipn.mdm.MDMSettings
 import com.tailscale.ipn.ui.model.Ipn
 import com.tailscale.ipn.ui.notifier.Notifier
@@ -108,6 +106,12 @@ open class IPNService : VpnService(), libtailscale.IPNService {
     stopSelf()
   }
 
+  override fun isAlwaysOnVPN(): Boolean =
+      Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q && isAlwaysOn
+
+  override fun isLockdownVPN(): Boolean =
+      Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q && isLockdownEnabled
+
   override fun onDestroy() {
     close()
     updateVpnStatus(false)
@@ -155,76 +159,16 @@ open class IPNService : VpnService(), libtailscale.IPNService {
         PendingIntent.FLAG_UPDATE_CURRENT or PendingIntent.FLAG_IMMUTABLE)
   }
 
-  private fun allowApp(b: Builder, name: String) {
-    try {
-      b.addAllowedApplication(name)
-    } catch (e: PackageManager.NameNotFoundException) {
-      TSLog.e(TAG, "Failed to add allowed application: $e")
-    }
-  }
-
-  private fun disallowApp(b: Builder, name: String) {
-    try {
-      b.addDisallowedApplication(name)
-    } catch (e: PackageManager.NameNotFoundException) {
-      TSLog.e(TAG, "Failed to add disallowed application: $e")
-    }
-  }
-
   override fun newBuilder(): VPNServiceBuilder {
-    val b: Builder =
-        Builder()
-            .setConfigureIntent(configIntent())
-            .allowFamily(OsConstants.AF_INET)
-            .allowFamily(OsConstants.AF_INET6)
+    val b: Builder = Builder().setConfigureIntent(configIntent())
     if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
       b.setMetered(false) // Inherit the metered status from the underlying networks.
     }
     b.setUnderlyingNetworks(null) // Use all available networks.
 
-    val mdmAllowed =
-        MDMSettings.includedPackages.flow.value.value?.split(",")?.map { it.trim() } ?: emptyList()
-    val mdmDisallowed =
-        MDMSettings.excludedPackages.flow.value.value?.split(",")?.map { it.trim() } ?: emptyList()
-
-    var packagesList: List<String>
-    var allowPackages: Boolean
-    if (mdmAllowed.isNotEmpty()) {
-      // An admin defined a list of packages that are exclusively allowed to be used via
-      // Tailscale, so only allow those.
-      packagesList = mdmAllowed
-      allowPackages = true
-      TSLog.d(TAG, "Included application packages were set via MDM: $mdmAllowed")
-    } else if (mdmDisallowed.isNotEmpty()) {
-      // An admin defined a list of packages that are excluded from accessing Tailscale,
-      // so ignore user definitions and only exclude those
-      packagesList = mdmDisallowed
-      allowPackages = false
-      TSLog.d(TAG, "Excluded application packages were set via MDM: $mdmDisallowed")
-    } else {
-      // Otherwise, prevent user manually disallowed apps from getting their traffic + DNS routed
-      // via Tailscale
-      packagesList = UninitializedApp.get().selectedPackageNames()
-      allowPackages = UninitializedApp.get().allowSelectedPackages()
-      TSLog.d(TAG, "Application packages were set by user: $packagesList")
-    }
-
-    if (allowPackages) {
-      for (packageName in packagesList) {
-        TSLog.d(TAG, "Including app: $packageName")
-        allowApp(b, packageName)
-      }
-    } else {
-      // Make sure to also exclude hard-coded apps that are known to cause issues
-      packagesList += UninitializedApp.get().builtInDisallowedPackageNames
-
-      for (packageName in packagesList) {
-        TSLog.d(TAG, "Disallowing app: $packageName")
-        disallowApp(b, packageName)
-      }
-    }
-
-    return VPNServiceBuilder(b)
+    // The apps using the VPN, the allowed address families and the other
+    // options are set by the backend.
+    return VPNServiceBuilder(b, this)
   }
 
   companion object {
@@ -3,13 +3,23 @@
 
 package com.tailscale.ipn
 
+import android.content.Context
+import android.net.ConnectivityManager
 import android.net.IpPrefix as AndroidIpPrefix
+import android.net.NetworkCapabilities
+import android.net.ProxyInfo
+import android.net.Uri
 import android.net.VpnService
 import android.os.Build
+import android.os.Process
 import java.net.InetAddress
+import libtailscale.Libtailscale
 import libtailscale.ParcelFileDescriptor
 
-class VPNServiceBuilder(private val builder: VpnService.Builder) : libtailscale.VPNServiceBuilder {
+class VPNServiceBuilder(
+    private val builder: VpnService.Builder,
+    private val context: Context,
+) : libtailscale.VPNServiceBuilder {
   override fun addAddress(p0: String, p1: Int) {
     builder.addAddress(p0, p1)
   }
@@ -31,12 +41,84 @@ class VPNServiceBuilder(private val builder: VpnService.Builder) : libtailscale.
     }
   }
 
+  override fun addAllowedApplication(p0: String) {
+    builder.addAllowedApplication(p0)
+  }
+
+  override fun addDisallowedApplication(p0: String) {
+    builder.addDisallowedApplication(p0)
+  }
+
+  override fun setHTTPProxy(p0: String, p1: Int, p2: String) {
+    if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
+      val exclusions = p2.split(",").filter { it.isNotEmpty() }
+      builder.setHttpProxy(ProxyInfo.buildDirectProxy(p0, p1, exclusions))
+    }
+  }
+
+  override fun setHTTPProxyPAC(p0: String) {
+    if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
+      builder.setHttpProxy(ProxyInfo.buildPacProxy(Uri.parse(p0)))
+    }
+  }
+
+  override fun allowBypass() {
+    builder.allowBypass()
+  }
+
+  override fun allowFamily(p0: Int) {
+    builder.allowFamily(p0)
+  }
+
   override fun addSearchDomain(p0: String) {
     builder.addSearchDomain(p0)
   }
 
-  override fun establish(): ParcelFileDescriptor? {
-    return builder.establish()?.let { ParcelFileDescriptor(it) }
+  override fun establish(): libtailscale.EstablishResult {
+    val fd =
+        try {
+          builder.establish()
+        } catch (e: SecurityException) {
+          val code =
+              if (e.message?.contains("INTERACT_ACROSS_USERS") == true)
+                  Libtailscale.EstablishErrorMultipleUsers
+              else Libtailscale.EstablishErrorPermissionRevoked
+          return EstablishResult(null, code, e.toString())
+        } catch (e: IllegalArgumentException) {
+          return EstablishResult(null, Libtailscale.EstablishErrorInvalidRoute, e.toString())
+        } catch (e: IllegalStateException) {
+          return EstablishResult(null, Libtailscale.EstablishErrorOther, e.toString())
+        }
+    if (fd != null) {
+      return EstablishResult(ParcelFileDescriptor(fd), Libtailscale.EstablishOK, "")
+    }
+    // establish returns null when the VPN isn't prepared, either because
+    // the permission was revoked or because another VPN app took over.
+    if (otherVPNActive()) {
+      return EstablishResult(
+          null, Libtailscale.EstablishErrorOtherVPN, "another VPN app holds the VPN")
+    }
+    return EstablishResult(
+        null, Libtailscale.EstablishErrorPermissionRevoked, "VPN service not prepared or revoked")
+  }
+
+  // otherVPNActive reports whether a VPN network owned by another app is up.
+  // Our own tunnel and the kill switch blackhole are VPN networks too, and
+  // may still be up while the permission is being revoked, so networks owned
+  // by this app don't count. Ownership is only known on Q and later; before
+  // that, this returns false so that the failure is reported as a revoked
+  // permission rather than mistaken for another VPN.
+  private fun otherVPNActive(): Boolean {
+    if (Build.VERSION.SDK_INT < Build.VERSION_CODES.Q) {
+      return false
+    }
+    val cm = context.getSystemService(ConnectivityManager::class.java) ?: return false
+    val myUid = Process.myUid()
+    @Suppress("DEPRECATION")
+    return cm.allNetworks.any {
+      val caps = cm.getNetworkCapabilities(it) ?: return@any false
+      caps.hasTransport(NetworkCapabilities.TRANSPORT_VPN) && caps.ownerUid != myUid
+    }
   }
 
   override fun setMTU(p0: Int) {
@@ -44,6 +126,18 @@ class VPNServiceBuilder(private val builder: VpnService.Builder) : libtailscale.
   }
 }
 
+class EstablishResult(
+    private val fd: libtailscale.ParcelFileDescriptor?,
+    private val code: Int,
+    private val message: String,
+) : libtailscale.EstablishResult {
+  override fun fileDescriptor(): libtailscale.ParcelFileDescriptor? = fd
+
+  override fun errorCode(): Int = code
+
+  override fun errorMessage(): String = message
+}
+
 class ParcelFileDescriptor(private val fd: android.os.ParcelFileDescriptor) : ParcelFileDescriptor {
   override fun detach(): Int {
     return fd.detachFd()
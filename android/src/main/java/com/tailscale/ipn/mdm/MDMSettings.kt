@@ -111,6 +111,23 @@ object MDMSettings {
   // Overrides the value provided by os.Hostname() in Go
   val hostname = StringMDMSetting("Hostname", "Device Hostname")
 
+  // Handled on the backend
+  val tunnelMTU = StringMDMSetting("TunnelMTU", "Tunnel MTU")
+
+  // Handled on the backend
+  val httpProxy = StringMDMSetting("HTTPProxy", "HTTP Proxy")
+  val httpProxyExclusions = StringMDMSetting("HTTPProxyExclusions", "HTTP Proxy Exclusions")
+  val httpProxyPACURL = StringMDMSetting("HTTPProxyPACURL", "HTTP Proxy PAC URL")
+  val allowVPNBypass = BooleanMDMSetting("AllowVPNBypass", "Allow Apps to Bypass the VPN")
+  val allowedAddressFamilies =
+      StringMDMSetting("AllowedAddressFamilies", "Address Families Allowed Without Routes")
+
+  // Handled on the backend
+  val routeAggregation = StringMDMSetting("RouteAggregation", "Route Aggregation")
+
+  // Handled on the backend
+  val killSwitch = BooleanMDMSetting("KillSwitch", "Block Traffic While Tailscale Is Not Connected")
+
   // Allows admins to skip the get started intro screen
   val onboardingFlow = ShowHideMDMSetting("OnboardingFlow", "Suppress the intro screen")
 
@@ -4,7 +4,10 @@ package com.tailscale.ipn.util
 
 import android.os.Build
 import android.security.keystore.KeyGenParameterSpec
+import android.security.keystore.KeyInfo
 import android.security.keystore.KeyProperties
+import java.io.ByteArrayOutputStream
+import java.security.KeyFactory
 import java.security.KeyPair
 import java.security.KeyPairGenerator
 import java.security.KeyStore
@@ -35,7 +38,9 @@ class HardwareKeyStore() {
     return id
   }
 
-  fun createKey(): String {
+  // createKey creates a key whose attestation certificate carries challenge,
+  // which binds it to the node it's created for.
+  fun createKey(challenge: ByteArray): String {
     if (Build.VERSION.SDK_INT < Build.VERSION_CODES.P) {
       throw HardwareKeysNotSupported()
     }
@@ -48,6 +53,10 @@ class HardwareKeyStore() {
               // Use DIGEST_NONE because hashing is done on the Go side.
               setDigests(KeyProperties.DIGEST_NONE)
               setIsStrongBoxBacked(true)
+              // Request an attestation certificate chain, so that the server
+              // can verify where the key lives, and which node it was
+              // created for.
+              setAttestationChallenge(challenge)
               build()
             }
 
@@ -83,6 +92,37 @@ class HardwareKeyStore() {
     return key.public.encoded
   }
 
+  // certificateChain returns the attestation certificate chain of the key as
+  // concatenated DER certificates, leaf first.
+  fun certificateChain(id: String): ByteArray {
+    val chain = keyStore.getCertificateChain(id) ?: throw NoSuchKeyException()
+    val out = ByteArrayOutputStream()
+    for (cert in chain) {
+      out.write(cert.encoded)
+    }
+    return out.toByteArray()
+  }
+
+  // securityLevel reports where the key lives: STRONGBOX,
+  // TRUSTED_ENVIRONMENT, SOFTWARE or UNKNOWN.
+  fun securityLevel(id: String): String {
+    val key = keyStoreKeys[id]?.private ?: throw NoSuchKeyException()
+    val info =
+        KeyFactory.getInstance(key.algorithm, "AndroidKeyStore")
+            .getKeySpec(key, KeyInfo::class.java)
+    if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.S) {
+      return when (info.securityLevel) {
+        KeyProperties.SECURITY_LEVEL_STRONGBOX -> "STRONGBOX"
+        KeyProperties.SECURITY_LEVEL_TRUSTED_ENVIRONMENT -> "TRUSTED_ENVIRONMENT"
+        KeyProperties.SECURITY_LEVEL_SOFTWARE -> "SOFTWARE"
+        else -> "UNKNOWN"
+      }
+    }
+    // Before Android 12, KeyInfo can't distinguish StrongBox from a TEE.
+    @Suppress("DEPRECATION")
+    return if (info.isInsideSecureHardware) "TRUSTED_ENVIRONMENT" else "SOFTWARE"
+  }
+
   fun load(id: String) {
     if (keyStoreKeys[id] != null) {
       // Already loaded.
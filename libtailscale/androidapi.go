@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// androidLocalAPIPrefix is the path prefix of the Android-specific LocalAPI
+// endpoints. They are served by the app itself, in front of the regular
+// LocalAPI handler, and are reachable only through [App.CallLocalAPI].
+const androidLocalAPIPrefix = "/localapi/v0/android/"
+
+// androidAPIHandler handles an Android-specific LocalAPI endpoint.
+type androidAPIHandler func(a *App, w http.ResponseWriter, r *http.Request)
+
+// androidAPIHandlers maps endpoint names, relative to androidLocalAPIPrefix,
+// to their handlers.
+var androidAPIHandlers = map[string]androidAPIHandler{
+	"policy":         (*App).servePolicyReport,
+	"attestation":    (*App).serveAttestation,
+	"tun":            (*App).serveTUNStats,
+	"capture":        (*App).serveCapture,
+	"capture-stream": (*App).serveCaptureStream,
+	"mtu":            (*App).serveMTU,
+	"apps":           (*App).serveApps,
+	"vpnoptions":     (*App).serveVPNOptions,
+	"killswitch":     (*App).serveKillSwitch,
+	"session":        (*App).serveSession,
+	"configs":        (*App).serveConfigs,
+	"plan":           (*App).serveVPNPlan,
+	"plan-history":   (*App).serveVPNPlanHistory,
+	"route":          (*App).serveRouteExplain,
+	"interfaces":     (*App).serveInterfaces,
+}
+
+// androidLocalAPI is an http.Handler that serves the Android-specific
+// endpoints and passes all other requests to next.
+type androidLocalAPI struct {
+	a    *App
+	next http.Handler
+}
+
+func (h *androidLocalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, androidLocalAPIPrefix)
+	if !ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	fn, ok := androidAPIHandlers[name]
+	if !ok {
+		http.Error(w, "unknown Android localapi endpoint", http.StatusNotFound)
+		return
+	}
+	fn(h.a, w, r)
+}
+
+// writeJSON writes v to w as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// serveAttestation serves the KeyStore attestation certificate chains and
+// security levels of the hardware attestation keys in use. Control gets the
+// same from the c2n handler, handleC2NAttestation.
+func (a *App) serveAttestation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.hwKeys == nil {
+		http.Error(w, "hardware attestation is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, a.hwKeys.attestations())
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	"github.com/tailscale/tailscale-android/libtailscale/splittunnel"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// The policy settings that select the apps using the VPN, as
+// comma-separated lists of package names.
+const (
+	includedPackagesPolicy = pkey.Key(mdmpolicy.IncludedPackageNames)
+	excludedPackagesPolicy = pkey.Key(mdmpolicy.ExcludedPackageNames)
+)
+
+// userSplitTunnelApps is the user's app selection, as returned by
+// AppContext.GetSplitTunnelAppsJSON.
+type userSplitTunnelApps struct {
+	AllowSelected     bool
+	Packages          []string
+	BuiltInDisallowed []string
+}
+
+// newSplitTunnel returns the filter of apps using the VPN, resolved from the
+// policy settings and the user's selection.
+func newSplitTunnel(a *App) *livesetting.Value[splittunnel.Filter] {
+	return newPolicySetting(a, "split tunnel", func() splittunnel.Filter {
+		in := splittunnel.Inputs{
+			PolicyIncluded: readAppsPolicy(a, includedPackagesPolicy),
+			PolicyExcluded: readAppsPolicy(a, excludedPackagesPolicy),
+		}
+		if js, err := a.appCtx.GetSplitTunnelAppsJSON(); err != nil {
+			log.Printf("split tunnel: reading the user's apps: %v", err)
+		} else if js != "" {
+			var u userSplitTunnelApps
+			if err := json.Unmarshal([]byte(js), &u); err != nil {
+				log.Printf("split tunnel: parsing the user's apps: %v", err)
+			}
+			in.UserAllow = u.AllowSelected
+			in.UserPackages = u.Packages
+			in.BuiltInDisallowed = u.BuiltInDisallowed
+		}
+		return splittunnel.Resolve(in)
+	}, splittunnel.Filter.Equal)
+}
+
+func readAppsPolicy(a *App, key pkey.Key) []string {
+	v, err := a.policyStore.ReadString(key)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("split tunnel: policy %q: %v", key, err)
+		}
+		return nil
+	}
+	return splittunnel.ParseList(v)
+}
+
+// applyApps adds the apps of f to builder. Apps that can't be added, usually
+// because they aren't installed, are logged and skipped.
+func applyApps(builder VPNServiceBuilder, f splittunnel.Filter, logf func(string, ...any)) {
+	var added int
+	for _, pkg := range f.Packages {
+		var err error
+		if f.Mode == splittunnel.Allow {
+			err = builder.AddAllowedApplication(pkg)
+		} else {
+			err = builder.AddDisallowedApplication(pkg)
+		}
+		if err != nil {
+			logf("updateTUN: %s app %q: %v", f.Mode, pkg, err)
+			continue
+		}
+		added++
+	}
+	logf("updateTUN: %s %d/%d apps, set by %s", f.Mode, added, len(f.Packages), f.Source)
+}
+
+// serveApps serves the filter of apps using the VPN.
+func (a *App) serveApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.splitTunnel.Get())
+}
@@ -12,12 +12,27 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
-
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/cfgqueue"
+	"github.com/tailscale/tailscale-android/libtailscale/hwkeys"
+	"github.com/tailscale/tailscale-android/libtailscale/ifaceparse"
+	"github.com/tailscale/tailscale-android/libtailscale/killswitch"
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/multitun"
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+	"github.com/tailscale/tailscale-android/libtailscale/splittunnel"
+	"github.com/tailscale/tailscale-android/libtailscale/tuncapture"
+	"github.com/tailscale/tailscale-android/libtailscale/vpncfg"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnopts"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnplan"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnsession"
 	"tailscale.com/drive/driveimpl"
+	"tailscale.com/envknob"
 	_ "tailscale.com/feature/condregister"
 	"tailscale.com/feature/taildrop"
 	"tailscale.com/hostinfo"
@@ -40,6 +55,10 @@ import (
 	"tailscale.com/wgengine/router"
 )
 
+// disableTUNCoalescing disables merging TCP segments written to the tun
+// device, in case the larger packets trip up something on the device.
+var disableTUNCoalescing = envknob.RegisterBool("TS_ANDROID_DISABLE_TUN_COALESCING")
+
 type App struct {
 	dataDir string
 
@@ -52,6 +71,14 @@ type App struct {
 
 	store             *stateStore
 	policyStore       *syspolicyStore
+	hwKeys            *hardwareKeys // nil if hardware attestation is disabled
+	capture           tuncapture.Capturer
+	tunMTU            *tunMTU
+	splitTunnel       *livesetting.Value[splittunnel.Filter]
+	vpnOptions        *vpnOptions
+	killSwitch        *killSwitch
+	routeAggregation  *livesetting.Value[rangescalc.Aggregation]
+	session           *vpnSession
 	logIDPublicAtomic atomic.Pointer[logid.PublicID]
 
 	localAPIHandler http.Handler
@@ -59,6 +86,15 @@ type App struct {
 	ready           sync.WaitGroup
 	backendMu       sync.Mutex
 
+	// vpnBackend is the backend once runBackend created it.
+	vpnBackend atomic.Pointer[backend]
+
+	// ifaces are the interfaces last reported by the app.
+	ifaces atomic.Pointer[[]ifaceparse.Interface]
+	// otherVPNWarned is whether interfacesChanged raised
+	// vpnOtherVPNWarnable.
+	otherVPNWarned atomic.Bool
+
 	// logger is the logtail logger whose uploads follow the user's
 	// IsClientLoggingEnabled preference. Populated once runBackend wires
 	// up the backend; nil before then.
@@ -96,10 +132,24 @@ type backend struct {
 	engine     wgengine.Engine
 	backend    *ipnlocal.LocalBackend
 	sys        *tsd.System
-	devices    *multiTUN
+	devices    *multitun.Device
 	settings   settingsFunc
 	lastCfg    *router.Config
 	lastDNSCfg *dns.OSConfig
+	mtu        *tunMTU
+	lastMTU    int // MTU of the current tun device
+	apps       *livesetting.Value[splittunnel.Filter]
+	lastApps   splittunnel.Filter // apps using the current tun device
+	opts       *vpnOptions
+	lastOpts   vpnopts.Options // options of the current tun device
+	ks         *killSwitch
+	ksAttempts killswitch.Attempts // paces attempts to engage the blackhole
+	ksRetry    <-chan time.Time    // receives when the next one is due
+	routeAgg   *livesetting.Value[rangescalc.Aggregation]
+	session    *vpnSession
+	facade     *VPNFacade
+	plans      *vpnplan.History          // plans applied by updateTUN
+	applied    atomic.Pointer[tunConfig] // config of the current tun device
 	netMon     *netmon.Monitor
 
 	logIDPublic logid.PublicID
@@ -111,6 +161,9 @@ type backend struct {
 	// when no nameservers are provided by Tailscale.
 	avoidEmptyDNS bool
 
+	// wantRunning is the WantRunning pref, as last notified.
+	wantRunning bool
+
 	appCtx AppContext
 }
 
@@ -129,27 +182,33 @@ func (a *App) runBackend(ctx context.Context, hardwareAttestation bool) error {
 		return a.deviceName(), nil
 	})
 
-	type configPair struct {
-		rcfg *router.Config
-		dcfg *dns.OSConfig
-	}
-	configs := make(chan configPair)
-	configErrs := make(chan error)
-	b, err := a.newBackend(a.dataDir, a.appCtx, a.store, func(rcfg *router.Config, dcfg *dns.OSConfig) error {
-		if rcfg == nil {
-			return nil
-		}
-		configs <- configPair{rcfg, dcfg}
-		return <-configErrs
-	})
+	// The engine's configs are applied by the loop below. The engine waits
+	// for them at most configWaitTimeout, and the loop waits at most
+	// establishTimeout for the VPN UI, after which the config is retried.
+	configs := cfgqueue.New[configPair]()
+	runningConfigs.Store(configs)
+	b, err := a.newBackend(a.dataDir, a.appCtx, a.store, setConfig(configs))
 	if err != nil {
 		return err
 	}
 	a.logIDPublicAtomic.Store(&b.logIDPublic)
 	a.logger.Store(b.logger)
+	a.vpnBackend.Store(b)
+	// Notify subscribers of the event bus of VPN session transitions.
+	sessionPub := eventbus.Publish[vpnsession.Transition](b.bus.Client("android.vpnsession"))
+	a.session.m.Observe(sessionPub.Publish)
 	a.backend = b.backend
+	// hwKeyChanged receives a value when a hardware attestation key was
+	// re-created, and must be registered with control.
+	hwKeyChanged := make(chan struct{}, 1)
 	if hardwareAttestation {
 		a.backend.SetHardwareAttested()
+		a.hwKeys.start(ctx, b.sys.HealthTracker.Get(), b.backend.NodeKey, func() {
+			select {
+			case hwKeyChanged <- struct{}{}:
+			default:
+			}
+		})
 	}
 	defer func() {
 		b.devices.Down()
@@ -166,7 +225,7 @@ func (a *App) runBackend(ctx context.Context, hardwareAttestation bool) error {
 	h := localapi.NewHandler(hc)
 	h.PermitRead = true
 	h.PermitWrite = true
-	a.localAPIHandler = h
+	a.localAPIHandler = &androidLocalAPI{a: a, next: h}
 
 	a.ready.Done()
 
@@ -178,37 +237,127 @@ func (a *App) runBackend(ctx context.Context, hardwareAttestation bool) error {
 	var (
 		cfg   configPair
 		state ipn.State
+		retry = &tunRetrier{b: b}
+		// registrar decides when re-created hardware attestation keys
+		// are registered with control.
+		registrar hwkeys.Registrar
+		// reregistered is non-nil while reregisterHardwareKey runs, and
+		// receives once it returns.
+		reregistered chan struct{}
 	)
+	// startReregister runs reregisterHardwareKey if ok. Start reconfigures
+	// the engine, which waits on this loop, so it runs on its own
+	// goroutine.
+	startReregister := func(ok bool) {
+		if !ok {
+			return
+		}
+		done := make(chan struct{})
+		reregistered = done
+		go func() {
+			defer close(done)
+			a.reregisterHardwareKey()
+		}()
+	}
+	// reconfigure re-establishes the VPN after a change to its settings
+	// outside of the router and DNS configs.
+	reconfigure := func(reason string) {
+		if state >= ipn.Starting && a.session.service() != nil && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
+			b.logger.Logf("%s, re-establishing VPN", reason)
+			if err := b.updateTUN(cfg.rcfg, cfg.dcfg); !retry.handle(err) {
+				a.closeVpnService(err, b)
+			}
+		}
+	}
 
 	stateCh := make(chan ipn.State)
+	wantRunningCh := make(chan bool)
 	go b.backend.WatchNotifications(ctx, ipn.NotifyInitialPrefs|ipn.NotifyInitialState|ipn.NotifyNoNetMap, func() {}, func(notify *ipn.Notify) bool {
 		if notify.State != nil {
+			if *notify.State == ipn.Running {
+				// The node key may have changed on login. This
+				// runs outside of LocalBackend's lock, unlike the
+				// loading of keys with the profile.
+				a.hwKeys.refreshNodeKey()
+			}
 			stateCh <- *notify.State
 		}
+		if notify.Prefs != nil && notify.Prefs.Valid() {
+			wantRunningCh <- notify.Prefs.WantRunning()
+		}
 		return true
 	})
 	for {
+		// Bring up or release the blackhole of the kill switch after every
+		// event, since any of them may connect or disconnect the tunnel.
+		b.enforceKillSwitch()
 		select {
 		case s := <-stateCh:
+			if s == ipn.Running && state != ipn.Running {
+				a.tunMTU.startProbe(b.backend, b.sys.ControlKnobs())
+			}
 			state = s
-			if state >= ipn.Starting && vpnService.service != nil && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
+			if state == ipn.NeedsLogin {
+				// Logging in registers the current key.
+				registrar.LoggedOut()
+			} else {
+				startReregister(registrar.SetIdle(state == ipn.Stopped))
+			}
+			if state >= ipn.Starting && a.session.service() != nil && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
 				// On state change, check if there are router or config changes requiring an update to VPNBuilder
-				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); err != nil {
-					if errors.Is(err, errMultipleUsers) {
-						// TODO: surface error to user
-					}
+				// Failures are surfaced to the user as health warnings by
+				// retry.handle.
+				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); !retry.handle(err) {
 					a.closeVpnService(err, b)
 				}
 			}
-		case c := <-configs:
+		case <-a.tunMTU.Changed():
+			reconfigure("tun MTU changed")
+		case <-a.splitTunnel.Changed():
+			reconfigure("split tunnel apps changed")
+		case <-a.vpnOptions.Changed():
+			reconfigure("VPN options changed")
+		case <-a.routeAggregation.Changed():
+			reconfigure("route aggregation changed")
+		case <-hwKeyChanged:
+			startReregister(registrar.Request())
+		case <-reregistered:
+			reregistered = nil
+			startReregister(registrar.Done())
+		case <-b.ksRetry:
+			b.ksRetry = nil
+		case b.wantRunning = <-wantRunningCh:
+		case <-a.killSwitch.Changed():
+		case <-configs.C():
+			c, t, ok := configs.Take()
+			if !ok {
+				break
+			}
 			cfg = c
-			if vpnService.service == nil || !b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
-				configErrs <- nil
+			if a.session.service() == nil || !b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
+				configs.Done(t, nil)
 				break
 			}
-			configErrs <- b.updateTUN(cfg.rcfg, cfg.dcfg)
+			err := b.updateTUN(cfg.rcfg, cfg.dcfg)
+			// Retryable errors are retried here, and all errors are
+			// returned to the engine, which logs them, unless it
+			// stopped waiting.
+			b.configApplied(configs.Done(t, err), err)
+			if !retry.handle(err) {
+				a.closeVpnService(err, b)
+			}
+		case <-retry.C:
+			retry.C = nil
+			if state >= ipn.Starting && a.session.service() != nil && cfg.rcfg != nil {
+				b.logger.Logf("retrying updateTUN")
+				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); !retry.handle(err) {
+					a.closeVpnService(err, b)
+				}
+			} else {
+				retry.cancel()
+			}
 		case s := <-onVPNRequested:
-			if vpnService.service != nil && vpnService.service.ID() == s.ID() {
+			if a.session.isService(s) {
 				// Still the same VPN instance, do nothing
 				break
 			}
@@ -243,22 +392,23 @@ func (a *App) runBackend(ctx context.Context, hardwareAttestation bool) error {
 			// See https://github.com/tailscale/corp/issues/13814
 			b.backend.DebugRebind()
 
-			vpnService.service = s
+			a.session.start(s)
 
 			if state >= ipn.Starting && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
-				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); err != nil {
+				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); !retry.handle(err) {
 					a.closeVpnService(err, b)
 				}
 			}
 		case s := <-onDisconnect:
-			if vpnService.service != nil && vpnService.service.ID() == s.ID() {
+			if a.session.isService(s) {
 				if b.devices.Down() {
 					log.Printf("tunnel brought down on disconnect")
 				}
 				b.CloseTUNs()
 				netns.SetAndroidProtectFunc(nil)
 				netns.SetAndroidBindToNetworkFunc(nil)
-				vpnService.service = nil
+				a.session.stop("VPN disconnected", nil)
+				retry.cancel()
 			}
 		case i := <-onDNSConfigChanged:
 			// TODO (barnstar): Consider using [dns.Manager.RecompileDNSConfig] here.
@@ -294,12 +444,24 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 	}
 
 	logf := logger.Logf(log.Printf)
+	mtu := a.tunMTU.current()
 	b := &backend{
-		devices:  newTUNDevices(),
+		devices:  multitun.New(mtu),
 		settings: settings,
+		mtu:      a.tunMTU,
+		apps:     a.splitTunnel,
+		opts:     a.vpnOptions,
+		ks:       a.killSwitch,
+		routeAgg: a.routeAggregation,
+		session:  a.session,
+		plans:    vpnplan.NewHistory(),
 		appCtx:   appCtx,
 		bus:      sys.Bus.Get(),
 	}
+	if disableTUNCoalescing() {
+		b.devices.SetTCPCoalescing(false)
+	}
+	tunDevice.Store(b.devices)
 
 	var logID logid.PrivateID
 	logID.UnmarshalText([]byte("dead0000dead0000dead0000dead0000dead0000dead0000dead0000dead0000"))
@@ -329,7 +491,9 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 	vf := &VPNFacade{
 		SetBoth:           b.setCfg,
 		GetBaseConfigFunc: b.getDNSBaseConfig,
+		InitialMTU:        uint32(mtu),
 	}
+	b.facade = vf
 	engine, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
 		Tun:            b.devices,
 		Router:         vf,
@@ -398,17 +562,93 @@ func (a *App) watchFileOpsChanges() {
 	}
 }
 
+// isConfigNonNilAndDifferent reports whether rcfg is non-nil and applying it
+// and dcfg would change the VPN. Only what the builder applies is compared,
+// and the changes are logged.
 func (b *backend) isConfigNonNilAndDifferent(rcfg *router.Config, dcfg *dns.OSConfig) bool {
-	if reflect.DeepEqual(rcfg, b.lastCfg) && reflect.DeepEqual(dcfg, b.lastDNSCfg) {
-		b.logger.Logf("isConfigNonNilAndDifferent: no change to Routes or DNS, ignore")
+	if rcfg == nil {
+		return false
+	}
+	if b.lastCfg == nil {
+		return true
+	}
+	diff := vpncfg.Diff(b.vpnConfig(b.lastCfg, b.lastDNSCfg, b.lastMTU), b.vpnConfig(rcfg, dcfg, b.mtu.current()))
+	if apps := b.apps.Get(); !apps.Equal(b.lastApps) {
+		diff = append(diff, fmt.Sprintf("apps: %+v -> %+v", b.lastApps, apps))
+	}
+	if opts := b.opts.Get().Options; !opts.Equal(b.lastOpts) {
+		diff = append(diff, fmt.Sprintf("VPN options: %+v -> %+v", b.lastOpts, opts))
+	}
+	if last := b.applied.Load(); last != nil && !last.useExclude() {
+		if agg := b.routeAgg.Get(); agg != last.agg {
+			diff = append(diff, fmt.Sprintf("route aggregation: %s -> %s", last.agg, agg))
+		}
+	}
+	if len(diff) == 0 {
+		b.logger.Logf("isConfigNonNilAndDifferent: no change to Routes, DNS, MTU, apps or VPN options, ignore")
 		return false
 	}
-	return rcfg != nil
+	b.logger.Logf("isConfigNonNilAndDifferent: %s", strings.Join(diff, "; "))
+	return true
+}
+
+// vpnConfig returns what updateTUN applies of rcfg and dcfg with the given MTU.
+func (b *backend) vpnConfig(rcfg *router.Config, dcfg *dns.OSConfig, mtu int) vpncfg.Config {
+	c := vpncfg.Config{
+		Routes:      rcfg.Routes,
+		LocalRoutes: rcfg.LocalRoutes,
+		Addrs:       rcfg.LocalAddrs,
+		MTU:         mtu,
+	}
+	if dcfg != nil {
+		c.Nameservers = dcfg.Nameservers
+		if b.avoidEmptyDNS && len(c.Nameservers) == 0 {
+			c.Nameservers = googleDNSServers
+		}
+		for _, dom := range dcfg.SearchDomains {
+			c.SearchDomains = append(c.SearchDomains, dom.WithoutTrailingDot())
+		}
+	}
+	return c
+}
+
+// reregisterHardwareKey restarts the control client, so that a hardware
+// attestation key that was re-created after failing validation gets
+// registered with control.
+//
+// The key is only sent to control when the control client registers, which
+// LocalBackend has it do when it starts, and exposes no other way to
+// trigger. With no options, Start keeps the current profile and prefs, and
+// the new control client registers with the persisted node key, so it
+// doesn't need the user to log in again. It drops the netmap until the new
+// control client gets one, though, so the runBackend loop only calls it
+// while the backend is Stopped, as decided by hwkeys.Registrar. Otherwise,
+// the key is registered when the profile is next loaded.
+func (a *App) reregisterHardwareKey() {
+	log.Printf("re-registering with control after hardware attestation key change")
+	if err := a.backend.Start(ipn.Options{}); err != nil {
+		log.Printf("reregisterHardwareKey: %v", err)
+	}
 }
 
 func (a *App) closeVpnService(err error, b *backend) {
 	log.Printf("VPN update failed: %v", err)
 
+	// Without the VPN permission, the kill switch can't establish its
+	// blackhole either.
+	code := establishErrorCode(err)
+	lostVPN := errors.Is(err, errVPNNotPrepared) || code == EstablishErrorOtherVPN || code == EstablishErrorPermissionRevoked
+	if b.killSwitchState().Armed() && !lostVPN {
+		// Keep WantRunning on and the VPN service up, so that the kill
+		// switch blackholes traffic until the tunnel can be brought up.
+		if b.devices.Down() {
+			log.Printf("tunnel brought down on VPN service error: %v", err)
+		}
+		b.CloseTUNs()
+		b.tryEngageBlackhole()
+		return
+	}
+
 	mp := new(ipn.MaskedPrefs)
 	mp.WantRunning = false
 	mp.WantRunningSet = true
@@ -422,6 +662,7 @@ func (a *App) closeVpnService(err error, b *backend) {
 	}
 	b.CloseTUNs()
 
-	vpnService.service.DisconnectVPN()
-	vpnService.service = nil
+	if s := a.session.stop("VPN update failed", err); s != nil {
+		s.DisconnectVPN()
+	}
 }
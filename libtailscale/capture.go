@@ -0,0 +1,240 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/pcapng"
+	"github.com/tailscale/tailscale-android/libtailscale/tuncapture"
+)
+
+const (
+	// captureDir is the directory under dataDir holding packet captures.
+	captureDir = "captures"
+	// captureFilePrefix is the name prefix of packet capture files.
+	captureFilePrefix = "tun"
+
+	defaultCaptureFileSize = 10 << 20
+	defaultCaptureFiles    = 5
+	maxCaptureFileSize     = 100 << 20
+	maxCaptureFiles        = 20
+)
+
+type captureStatus struct {
+	tuncapture.Status
+	Files []captureFile
+}
+
+type captureFile struct {
+	Name string
+	Size int64
+}
+
+// captureStatusOf returns the status of the capture c, and the capture
+// files in dir.
+func captureStatusOf(c *tuncapture.Capturer, dir string) (captureStatus, error) {
+	st := captureStatus{Status: c.Status()}
+	names, err := pcapng.RingFiles(dir, captureFilePrefix)
+	if err != nil {
+		return st, err
+	}
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		st.Files = append(st.Files, captureFile{Name: name, Size: fi.Size()})
+	}
+	return st, nil
+}
+
+// serveCapture serves the packet capture endpoint:
+//
+//   - GET returns the capture status and files, or with ?file=NAME,
+//     downloads a capture file.
+//   - POST ?action=start starts capturing to a ring of files under dataDir,
+//     limited by the optional maxFileSize and maxFiles parameters.
+//   - POST ?action=stop stops the capture.
+//   - DELETE removes the capture files.
+func (a *App) serveCapture(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join(a.dataDir, captureDir)
+	switch r.Method {
+	case http.MethodGet:
+		if name := r.FormValue("file"); name != "" {
+			names, _ := pcapng.RingFiles(dir, captureFilePrefix)
+			if !slices.Contains(names, name) {
+				http.Error(w, "no such capture file", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-pcapng")
+			http.ServeFile(w, r, filepath.Join(dir, name))
+			return
+		}
+		st, err := captureStatusOf(&a.capture, dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, st)
+	case http.MethodPost:
+		switch action := r.FormValue("action"); action {
+		case "start":
+			a.startFileCapture(w, r, dir)
+		case "stop":
+			if !a.capture.StopActive() {
+				http.Error(w, "no packet capture is running", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unknown action "+strconv.Quote(action), http.StatusBadRequest)
+		}
+	case http.MethodDelete:
+		if st := a.capture.Status(); st.Active && st.Mode == "file" {
+			http.Error(w, "stop the packet capture first", http.StatusConflict)
+			return
+		}
+		names, err := pcapng.RingFiles(dir, captureFilePrefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, name := range names {
+			os.Remove(filepath.Join(dir, name))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// captureLimit parses the integer form value key, defaulting to def and
+// bounded by limit.
+func captureLimit(r *http.Request, key string, def, limit int64) (int64, error) {
+	s := r.FormValue(key)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 || v > limit {
+		return 0, fmt.Errorf("invalid %s: must be between 1 and %d", key, limit)
+	}
+	return v, nil
+}
+
+func (a *App) startFileCapture(w http.ResponseWriter, r *http.Request, dir string) {
+	d := tunDevice.Load()
+	if d == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	size, err := captureLimit(r, "maxFileSize", defaultCaptureFileSize, maxCaptureFileSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files, err := captureLimit(r, "maxFiles", defaultCaptureFiles, maxCaptureFiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Claim the capture before touching the files of a previous one.
+	s, err := a.capture.Start(d, "file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	name, _ := d.Name()
+	ring, err := pcapng.NewRing(dir, captureFilePrefix, name, size, int(files))
+	if err != nil {
+		s.Abort()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in packet capture %s: %s", p, debug.Stack())
+				panic(p)
+			}
+		}()
+		s.Run(ring)
+		if err := ring.Close(); err != nil {
+			log.Printf("packet capture: closing file: %v", err)
+		}
+	}()
+	log.Printf("packet capture started: up to %d files of %d bytes", files, size)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// streamSink writes a pcapng stream to an HTTP response.
+type streamSink struct {
+	pw *pcapng.Writer
+	bw *bufio.Writer
+	f  http.Flusher
+}
+
+func (s *streamSink) WritePacket(t time.Time, dir pcapng.Direction, pkt []byte) error {
+	return s.pw.WritePacket(t, dir, pkt)
+}
+
+func (s *streamSink) Flush() error {
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+// serveCaptureStream streams a pcapng capture of the tun device until the
+// client disconnects or the capture is stopped.
+func (a *App) serveCaptureStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	d := tunDevice.Load()
+	if d == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	bw := bufio.NewWriter(w)
+	name, _ := d.Name()
+	pw, err := pcapng.NewWriter(bw, name)
+	if err != nil {
+		return
+	}
+	s, err := a.capture.Start(d, "stream")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer s.Halt()
+	go func() {
+		select {
+		case <-r.Context().Done():
+			s.Halt()
+		case <-s.Done():
+		}
+	}()
+
+	s.Run(&streamSink{pw: pw, bw: bw, f: f})
+}
@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package cfgqueue hands values from producers to a consumer that applies
+// them asynchronously. Values submitted while one is pending replace it, so
+// the consumer only applies the latest.
+package cfgqueue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by Queue.Wait if the value wasn't applied in time.
+var ErrTimeout = errors.New("timed out waiting for the value to be applied")
+
+// Ticket is the pending application of a value. Values coalesced into one
+// share their Ticket.
+type Ticket struct {
+	done  chan struct{} // closed once applied
+	err   error
+	start time.Time // when the consumer took the value
+}
+
+// Stats are the counters of a Queue.
+type Stats struct {
+	Submitted uint64
+	// Coalesced is the number of values replaced by a newer value before
+	// being applied.
+	Coalesced uint64
+	Applied   uint64
+	Failed    uint64
+	// TimedOut is the number of Wait calls that returned ErrTimeout.
+	TimedOut     uint64
+	LastErr      string        `json:",omitempty"`
+	LastDuration time.Duration // time taken to apply the last value
+	// Pending reports whether a value is waiting to be taken.
+	Pending bool
+}
+
+// Queue holds the latest value submitted and not yet taken by the consumer.
+// It's safe for concurrent use.
+type Queue[T any] struct {
+	c   chan struct{}
+	now func() time.Time
+
+	mu      sync.Mutex
+	val     T
+	pending *Ticket // nil if no value is pending
+	stats   Stats
+}
+
+// New returns an empty Queue.
+func New[T any]() *Queue[T] {
+	return &Queue[T]{c: make(chan struct{}, 1), now: time.Now}
+}
+
+// C returns a channel that receives a value when a value may be pending.
+func (q *Queue[T]) C() <-chan struct{} {
+	return q.c
+}
+
+// Submit makes v the pending value, replacing any older pending value, and
+// returns the Ticket of its application. It never blocks.
+func (q *Queue[T]) Submit(v T) *Ticket {
+	q.mu.Lock()
+	q.stats.Submitted++
+	if q.pending != nil {
+		q.stats.Coalesced++
+	} else {
+		q.pending = &Ticket{done: make(chan struct{})}
+	}
+	q.val = v
+	t := q.pending
+	q.mu.Unlock()
+
+	select {
+	case q.c <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+// Take returns the pending value and its Ticket, and clears it. It returns
+// ok false if no value is pending. The consumer must call Done with the
+// Ticket once it has applied the value.
+func (q *Queue[T]) Take() (v T, t *Ticket, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		return v, nil, false
+	}
+	v, t = q.val, q.pending
+	var zero T
+	q.val, q.pending = zero, nil
+	t.start = q.now()
+	return v, t, true
+}
+
+// Done records that the value of t was applied, with the resulting error,
+// and wakes its waiters. It returns the time taken to apply the value.
+func (q *Queue[T]) Done(t *Ticket, err error) time.Duration {
+	q.mu.Lock()
+	d := q.now().Sub(t.start)
+	q.stats.LastDuration = d
+	if err != nil {
+		q.stats.Failed++
+		q.stats.LastErr = err.Error()
+	} else {
+		q.stats.Applied++
+		q.stats.LastErr = ""
+	}
+	q.mu.Unlock()
+
+	t.err = err
+	close(t.done)
+	return d
+}
+
+// Wait waits up to timeout for the value of t to be applied, and returns the
+// error applying it, or ErrTimeout.
+func (q *Queue[T]) Wait(t *Ticket, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return t.err
+	case <-timer.C:
+		q.mu.Lock()
+		q.stats.TimedOut++
+		q.mu.Unlock()
+		return ErrTimeout
+	}
+}
+
+// Stats returns the counters of q.
+func (q *Queue[T]) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := q.stats
+	st.Pending = q.pending != nil
+	return st
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cfgqueue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatestWins(t *testing.T) {
+	q := New[int]()
+	t1 := q.Submit(1)
+	t2 := q.Submit(2)
+	t3 := q.Submit(3)
+	if t1 != t2 || t2 != t3 {
+		t.Error("coalesced values have different tickets")
+	}
+
+	<-q.C()
+	v, tk, ok := q.Take()
+	if !ok || v != 3 || tk != t3 {
+		t.Fatalf("Take = %v, %v, %v; want 3", v, tk, ok)
+	}
+	if _, _, ok := q.Take(); ok {
+		t.Error("second Take returned a value")
+	}
+
+	// A value submitted while one is being applied gets a new ticket.
+	t4 := q.Submit(4)
+	if t4 == t3 {
+		t.Error("value submitted during apply shares the applied ticket")
+	}
+	errApply := errors.New("establish failed")
+	q.Done(tk, errApply)
+	if err := q.Wait(t1, time.Second); err != errApply {
+		t.Errorf("Wait = %v, want %v", err, errApply)
+	}
+
+	_, tk, _ = q.Take()
+	q.Done(tk, nil)
+	if err := q.Wait(t4, time.Second); err != nil {
+		t.Errorf("Wait = %v", err)
+	}
+
+	st := q.Stats()
+	want := Stats{Submitted: 4, Coalesced: 2, Applied: 1, Failed: 1}
+	st.LastDuration = 0
+	if st != want {
+		t.Errorf("Stats = %+v, want %+v", st, want)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	q := New[int]()
+	tk := q.Submit(1)
+	if err := q.Wait(tk, time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Wait = %v, want ErrTimeout", err)
+	}
+	if st := q.Stats(); st.TimedOut != 1 || !st.Pending {
+		t.Errorf("Stats = %+v", st)
+	}
+	// The value is still applied after the waiter gave up.
+	v, tk2, ok := q.Take()
+	if !ok || v != 1 || tk2 != tk {
+		t.Fatalf("Take = %v, %v", v, ok)
+	}
+	q.Done(tk2, nil)
+}
+
+func TestSubmitNeverBlocks(t *testing.T) {
+	q := New[int]()
+	done := make(chan struct{})
+	go func() {
+		for i := range 1000 {
+			q.Submit(i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submit blocked without a consumer")
+	}
+	if v, _, _ := q.Take(); v != 999 {
+		t.Errorf("Take = %d, want 999", v)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	q := New[int]()
+	stop := make(chan struct{})
+	var consumer sync.WaitGroup
+	consumer.Add(1)
+	go func() {
+		defer consumer.Done()
+		for {
+			select {
+			case <-q.C():
+				if _, tk, ok := q.Take(); ok {
+					q.Done(tk, nil)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var producers sync.WaitGroup
+	for p := range 8 {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			for i := range 100 {
+				if err := q.Wait(q.Submit(p*100+i), 5*time.Second); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	producers.Wait()
+	close(stop)
+	consumer.Wait()
+
+	st := q.Stats()
+	if st.Submitted != 800 || st.Applied+st.Coalesced != 800 {
+		t.Errorf("Stats = %+v", st)
+	}
+}
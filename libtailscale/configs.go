@@ -0,0 +1,197 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/cfgqueue"
+	"github.com/tailscale/tailscale-android/libtailscale/tunretry"
+	"tailscale.com/health"
+	"tailscale.com/net/dns"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/wgengine/router"
+)
+
+// configWaitTimeout is how long the engine waits for a router and DNS config
+// to be applied to the VPN. Applying it takes JNI calls that may block on the
+// VPN UI, for instance while the user is asked for the VPN permission, so the
+// engine carries on after that time as if it succeeded, and the config is
+// applied in the background. Its outcome is then reported by
+// vpnConfigFailedWarnable.
+const configWaitTimeout = 2 * time.Second
+
+// establishTimeout bounds VpnService.Builder.establish, so that a stuck
+// establish can't hold up runBackend, and with it the other VPN changes.
+const establishTimeout = 10 * time.Second
+
+// errEstablishTimeout is returned when establish doesn't return in time, or
+// when a previous call is still stuck.
+var errEstablishTimeout = errors.New("VpnService.Builder.establish timed out")
+
+// establishStuck is set while an establish call that timed out is still
+// running. Later calls fail fast rather than piling up behind it.
+var establishStuck atomic.Bool
+
+var vpnConfigFailedWarnable = health.Register(&health.Warnable{
+	Code:     "android-vpn-config-failed",
+	Title:    "VPN configuration not applied",
+	Severity: health.SeverityMedium,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("Tailscale could not apply the latest network configuration to the VPN: %s", args[health.ArgError])
+	},
+})
+
+type configPair struct {
+	rcfg *router.Config
+	dcfg *dns.OSConfig
+}
+
+// configQueue holds the router and DNS configs set by the engine until
+// runBackend applies them. Configs set while one is pending replace it.
+type configQueue = cfgqueue.Queue[configPair]
+
+// runningConfigs is the config queue of the running backend, for metrics.
+// It's nil until the backend is created.
+var runningConfigs atomic.Pointer[configQueue]
+
+// setConfig returns the settingsFunc that submits configs to q.
+func setConfig(q *configQueue) settingsFunc {
+	return func(rcfg *router.Config, dcfg *dns.OSConfig) error {
+		if rcfg == nil {
+			return nil
+		}
+		err := q.Wait(q.Submit(configPair{rcfg, dcfg}), configWaitTimeout)
+		if errors.Is(err, cfgqueue.ErrTimeout) {
+			// The config is still being applied, and the engine would
+			// treat an error as a failure to apply it. Late failures
+			// are reported by vpnConfigFailedWarnable instead.
+			log.Printf("VPN config not applied after %v, applying it in the background", configWaitTimeout)
+			return nil
+		}
+		return err
+	}
+}
+
+// configApplied reports the outcome of applying a config that took d. Once
+// the engine stopped waiting, failures are only reported by the health
+// warning, which the next config applied clears.
+func (b *backend) configApplied(d time.Duration, err error) {
+	ht := b.sys.HealthTracker.Get()
+	switch {
+	case err == nil:
+		ht.SetHealthy(vpnConfigFailedWarnable)
+	case d > configWaitTimeout:
+		b.logger.Logf("applying VPN config took %v: %v", d.Round(time.Millisecond), err)
+		ht.SetUnhealthy(vpnConfigFailedWarnable, health.Args{health.ArgError: err.Error()})
+	}
+}
+
+// establish calls builder.Establish, waiting at most establishTimeout. On
+// timeout, it returns a retryable error, and the tun fd of a call that
+// completes later is closed, since the VPN it belongs to was given up on.
+func establish(builder VPNServiceBuilder) (EstablishResult, error) {
+	if establishStuck.Load() {
+		return nil, tunretry.Retryable(fmt.Errorf("%w (previous call still running)", errEstablishTimeout))
+	}
+	type result struct {
+		res EstablishResult
+		err error
+	}
+	var (
+		mu        sync.Mutex
+		abandoned bool
+		done      = make(chan result, 1)
+	)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in establish %s: %s", p, debug.Stack())
+				panic(p)
+			}
+		}()
+		res, err := builder.Establish()
+		mu.Lock()
+		defer mu.Unlock()
+		if !abandoned {
+			done <- result{res, err}
+			return
+		}
+		establishStuck.Store(false)
+		log.Printf("establish returned after timing out: %v", err)
+		if err != nil || res == nil || res.FileDescriptor() == nil {
+			return
+		}
+		if fd, err := res.FileDescriptor().Detach(); err == nil {
+			syscall.Close(int(fd))
+		}
+	}()
+
+	t := time.NewTimer(establishTimeout)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-t.C:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	select {
+	case r := <-done:
+		// The call completed just as the timer fired.
+		return r.res, r.err
+	default:
+	}
+	abandoned = true
+	establishStuck.Store(true)
+	return nil, tunretry.Retryable(fmt.Errorf("%w after %v", errEstablishTimeout, establishTimeout))
+}
+
+func configStat(f func(st cfgqueue.Stats) int64) func() int64 {
+	return func() int64 {
+		q := runningConfigs.Load()
+		if q == nil {
+			return 0
+		}
+		return f(q.Stats())
+	}
+}
+
+func init() {
+	for name, f := range map[string]func(cfgqueue.Stats) int64{
+		"android_vpn_configs_submitted": func(st cfgqueue.Stats) int64 { return int64(st.Submitted) },
+		"android_vpn_configs_coalesced": func(st cfgqueue.Stats) int64 { return int64(st.Coalesced) },
+		"android_vpn_configs_applied":   func(st cfgqueue.Stats) int64 { return int64(st.Applied) },
+		"android_vpn_configs_failed":    func(st cfgqueue.Stats) int64 { return int64(st.Failed) },
+		"android_vpn_configs_timed_out": func(st cfgqueue.Stats) int64 { return int64(st.TimedOut) },
+	} {
+		clientmetric.NewCounterFunc(name, configStat(f))
+	}
+	clientmetric.NewGaugeFunc("android_vpn_config_apply_ms", configStat(func(st cfgqueue.Stats) int64 {
+		return st.LastDuration.Milliseconds()
+	}))
+}
+
+// serveConfigs serves the counters of router and DNS configs applied to the
+// VPN, and the last error.
+func (a *App) serveConfigs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := runningConfigs.Load()
+	if q == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, q.Stats())
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/tailscale-android/libtailscale/tunretry"
+	"tailscale.com/health"
+)
+
+// The codes of EstablishResult.ErrorCode, classifying why
+// VpnService.Builder.establish failed.
+const (
+	EstablishOK int32 = iota
+	// EstablishErrorPermissionRevoked is when establish returns null
+	// because the VPN permission was revoked or never granted.
+	EstablishErrorPermissionRevoked
+	// EstablishErrorOtherVPN is when another VPN app, usually one set as
+	// the always-on VPN, holds the VPN.
+	EstablishErrorOtherVPN
+	// EstablishErrorMultipleUsers is the Android bug that fails establish
+	// with INTERACT_ACROSS_USERS on some devices with multiple users.
+	// See https://github.com/tailscale/tailscale/issues/2180.
+	EstablishErrorMultipleUsers
+	// EstablishErrorInvalidRoute is when the builder rejects an address or
+	// route.
+	EstablishErrorInvalidRoute
+	// EstablishErrorOther is any other failure.
+	EstablishErrorOther
+)
+
+// establishError is a failure to establish the VPN, classified by code.
+type establishError struct {
+	code int32
+	err  error
+}
+
+func (e *establishError) Error() string { return e.err.Error() }
+func (e *establishError) Unwrap() error { return e.err }
+
+// newEstablishError returns an establishError for code, marked as retryable
+// for the codes that retrying may fix.
+func newEstablishError(code int32, err error) error {
+	e := &establishError{code: code, err: err}
+	if code == EstablishErrorOther {
+		// It happens when racing with the VPN being prepared or
+		// revoked, and retrying fixes it. A revoked permission, on the
+		// other hand, only comes back when the user grants it again,
+		// so it's surfaced rather than retried.
+		return tunretry.Retryable(e)
+	}
+	return e
+}
+
+// establishResultErr returns the failure of a VPNServiceBuilder.Establish call
+// that returned res and err, or nil if it succeeded.
+func establishResultErr(res EstablishResult, err error) error {
+	if err != nil {
+		return newEstablishError(EstablishErrorOther, err)
+	}
+	if code := res.ErrorCode(); code != EstablishOK {
+		return newEstablishError(code, errors.New(res.ErrorMessage()))
+	}
+	return nil
+}
+
+// establishErrorCode returns the code of err, or EstablishErrorOther if it
+// isn't an establishError.
+func establishErrorCode(err error) int32 {
+	var e *establishError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return EstablishErrorOther
+}
+
+// argInterfaces is the health.Args key of the names of the other VPN
+// interfaces seen on the device.
+const argInterfaces health.Arg = "interfaces"
+
+var (
+	vpnPermissionRevokedWarnable = health.Register(&health.Warnable{
+		Code:     "android-vpn-permission-revoked",
+		Title:    "VPN permission revoked",
+		Severity: health.SeverityHigh,
+		Text: func(args health.Args) string {
+			return "Tailscale no longer has permission to set up a VPN. Turn Tailscale off and on again, and allow the connection request."
+		},
+		ImpactsConnectivity: true,
+	})
+	vpnOtherVPNWarnable = health.Register(&health.Warnable{
+		Code:     "android-vpn-other-vpn",
+		Title:    "Another VPN is active",
+		Severity: health.SeverityHigh,
+		Text: func(args health.Args) string {
+			if ifaces := args[argInterfaces]; ifaces != "" {
+				return fmt.Sprintf("Another VPN is connected on this device (%s), for example in a work profile. Traffic may go through it instead of Tailscale.", ifaces)
+			}
+			return "Another VPN app holds the VPN, possibly because it's set as the always-on VPN. Disconnect it, or make Tailscale the always-on VPN in the Android VPN settings."
+		},
+		ImpactsConnectivity: true,
+	})
+	vpnMultipleUsersWarnable = health.Register(&health.Warnable{
+		Code:     "android-vpn-multiple-users",
+		Title:    "VPN unavailable with multiple users",
+		Severity: health.SeverityHigh,
+		Text: func(args health.Args) string {
+			return "An Android bug on devices with multiple users or work profiles prevents Tailscale from setting up the VPN. Try removing other users or profiles, or check for a system update."
+		},
+		ImpactsConnectivity: true,
+	})
+	vpnInvalidRouteWarnable = health.Register(&health.Warnable{
+		Code:     "android-vpn-invalid-route",
+		Title:    "VPN route rejected",
+		Severity: health.SeverityMedium,
+		Text: func(args health.Args) string {
+			return fmt.Sprintf("Android rejected an address or route of the VPN: %s. Check the subnet routes advertised in your tailnet, or contact your network administrator.", args[health.ArgError])
+		},
+		ImpactsConnectivity: true,
+	})
+)
+
+// establishWarnables are the health warnables of VPN establishment failures,
+// cleared when the VPN is established.
+var establishWarnables = []*health.Warnable{
+	vpnEstablishFailingWarnable,
+	vpnPermissionRevokedWarnable,
+	vpnOtherVPNWarnable,
+	vpnMultipleUsersWarnable,
+	vpnInvalidRouteWarnable,
+}
+
+// establishWarnable returns the warnable for err.
+func establishWarnable(err error) *health.Warnable {
+	switch establishErrorCode(err) {
+	case EstablishErrorPermissionRevoked:
+		return vpnPermissionRevokedWarnable
+	case EstablishErrorOtherVPN:
+		return vpnOtherVPNWarnable
+	case EstablishErrorMultipleUsers:
+		return vpnMultipleUsersWarnable
+	case EstablishErrorInvalidRoute:
+		return vpnInvalidRouteWarnable
+	}
+	return vpnEstablishFailingWarnable
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/tunretry"
+	"tailscale.com/health"
+)
+
+// argAttempts is the health.Args key of the number of failed attempts.
+const argAttempts health.Arg = "attempts"
+
+var vpnEstablishFailingWarnable = health.Register(&health.Warnable{
+	Code:     "android-vpn-establish-failing",
+	Title:    "Unable to set up the VPN",
+	Severity: health.SeverityMedium,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("Tailscale failed to set up the VPN interface after %s attempts: %s. If this persists, turn Tailscale off and on again.", args[argAttempts], args[health.ArgError])
+	},
+})
+
+// tunRetrier retries bringing up the tun device after retryable failures,
+// with backoff, instead of turning Tailscale off. It's only used from the
+// runBackend goroutine.
+type tunRetrier struct {
+	b       *backend
+	backoff tunretry.Backoff
+	// C receives a value when the next attempt is due. It's nil when no
+	// retry is pending.
+	C <-chan time.Time
+}
+
+// handle handles the result of an attempt to bring up the tun device. It
+// returns false if err is fatal, or retryable but failed too many times in a
+// row, in which case the caller gives up on the VPN.
+func (r *tunRetrier) handle(err error) bool {
+	if err == nil {
+		if n := r.backoff.Failures(); n > 0 {
+			r.b.logger.Logf("updateTUN: succeeded after %d failures", n)
+		}
+		r.stop()
+		return true
+	}
+	if !tunretry.IsRetryable(err) {
+		r.stop()
+		r.warn(err, 1)
+		return false
+	}
+	d := r.backoff.Fail(err)
+	if r.backoff.Exhausted() {
+		attempts := r.backoff.Failures()
+		r.b.logger.Logf("updateTUN: giving up after %d failures: %v", attempts, err)
+		r.stop()
+		r.warn(err, attempts)
+		return false
+	}
+	r.b.logger.Logf("updateTUN: failure %d, retrying in %v: %v", r.backoff.Failures(), d.Round(time.Millisecond), err)
+	r.C = time.After(d)
+	if r.backoff.Persistent() {
+		r.warn(err, r.backoff.Failures())
+	}
+	return true
+}
+
+// warn raises the health warning for err, after the given number of failed
+// attempts.
+func (r *tunRetrier) warn(err error, attempts int) {
+	r.b.sys.HealthTracker.Get().SetUnhealthy(establishWarnable(err), health.Args{
+		health.ArgError: err.Error(),
+		argAttempts:     strconv.Itoa(attempts),
+	})
+}
+
+// cancel cancels any pending retry, leaving the health warnings of past
+// failures up, so that a VPN given up on still tells the user why.
+func (r *tunRetrier) cancel() {
+	r.C = nil
+	r.backoff.Reset()
+}
+
+// stop cancels any pending retry and clears the health warnings.
+func (r *tunRetrier) stop() {
+	r.cancel()
+	ht := r.b.sys.HealthTracker.Get()
+	for _, w := range establishWarnables {
+		ht.SetHealthy(w)
+	}
+}
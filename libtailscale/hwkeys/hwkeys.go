@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package hwkeys decides when Android KeyStore hardware attestation keys are
+// unusable, which keys replaced them, and when replacements are registered
+// with control.
+package hwkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is returned by Probe when the key is definitely unusable, and
+// must be replaced.
+var ErrInvalid = errors.New("hardware attestation key is invalid")
+
+// invalidMessages are the messages of the KeyStore exceptions, passed
+// through JNI, that mean the key is gone or can no longer be used.
+var invalidMessages = []string{
+	"no key found matching the provided ID", // com.tailscale.ipn.util.NoSuchKeyException
+	"Key permanently invalidated",           // KeyPermanentlyInvalidatedException
+}
+
+// IsInvalid reports whether err means the key is definitely missing or
+// unusable, as opposed to the KeyStore failing or timing out, after which
+// the key may still work.
+func IsInvalid(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrInvalid) {
+		return true
+	}
+	msg := err.Error()
+	for _, m := range invalidMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe checks that a key, whose public key was cached as pub, still has
+// that public key, as returned by public, and that sign produces signatures
+// of SHA-256 digests that verify against it. Errors that mean the key is
+// unusable wrap ErrInvalid; see IsInvalid.
+func Probe(pub *ecdsa.PublicKey, public func() (*ecdsa.PublicKey, error), sign func(digest []byte) ([]byte, error)) error {
+	cur, err := public()
+	if err != nil {
+		return err
+	}
+	if pub == nil || !cur.Equal(pub) {
+		return fmt.Errorf("%w: KeyStore public key does not match the cached one", ErrInvalid)
+	}
+
+	var nonce [32]byte
+	rand.Read(nonce[:])
+	digest := sha256.Sum256(nonce[:])
+	sig, err := sign(digest[:])
+	if err != nil {
+		return fmt.Errorf("signing probe digest: %w", err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return fmt.Errorf("%w: probe signature does not verify against the cached public key", ErrInvalid)
+	}
+	return nil
+}
+
+// Replacements maps the IDs of re-created keys to the IDs of the keys that
+// replaced them.
+//
+// The profiles hold the ID of their key, and are only written again when
+// their prefs or persist change. Until then, they still refer to the old
+// key, which must resolve to its replacement rather than be replaced again
+// on every start, leaking a KeyStore key each time.
+type Replacements map[string]string
+
+// ParseReplacements parses Replacements in the JSON form returned by
+// Replacements.String. The empty string is no replacements.
+func ParseReplacements(s string) (Replacements, error) {
+	r := make(Replacements)
+	if s == "" {
+		return r, nil
+	}
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return make(Replacements), err
+	}
+	return r, nil
+}
+
+func (r Replacements) String() string {
+	b, _ := json.Marshal(map[string]string(r))
+	return string(b)
+}
+
+// Resolve returns the ID of the key that replaced the key id, or id if it
+// wasn't replaced.
+func (r Replacements) Resolve(id string) string {
+	if newID, ok := r[id]; ok {
+		return newID
+	}
+	return id
+}
+
+// Record records that the key oldID was replaced with id, updating the keys
+// that oldID itself replaced to resolve to id too.
+func (r Replacements) Record(oldID, id string) {
+	for k, v := range r {
+		if v == oldID {
+			r[k] = id
+		}
+	}
+	r[oldID] = id
+}
+
+// Registrar decides when re-created keys are registered with control.
+//
+// Keys are only sent to control when the control client registers, which
+// requires restarting it and dropping the netmap until it gets a new one.
+// So that an active tunnel is never interrupted, Registrar only registers
+// while the backend is logged in but not running, one registration at a
+// time, and once for all the keys re-created meanwhile. Until then, keys are
+// registered when the profile is next loaded.
+//
+// The zero Registrar is not idle, and has nothing to register.
+type Registrar struct {
+	idle    bool // logged in, and not running
+	pending bool // a re-created key awaits registration
+	running bool // a registration is in progress
+}
+
+// Request records that a key was re-created, and reports whether to
+// register now.
+func (r *Registrar) Request() bool {
+	r.pending = true
+	return r.next()
+}
+
+// SetIdle records whether the backend is logged in but not running, and
+// reports whether to register now.
+func (r *Registrar) SetIdle(idle bool) bool {
+	r.idle = idle
+	return r.next()
+}
+
+// LoggedOut records that the backend needs to log in, which registers the
+// current keys, so that nothing is pending anymore.
+func (r *Registrar) LoggedOut() {
+	r.idle = false
+	r.pending = false
+}
+
+// Done records that a registration finished, and reports whether to
+// register again now, for keys re-created while it ran.
+func (r *Registrar) Done() bool {
+	r.running = false
+	return r.next()
+}
+
+// Pending reports whether a re-created key awaits registration.
+func (r *Registrar) Pending() bool {
+	return r.pending
+}
+
+func (r *Registrar) next() bool {
+	if !r.pending || !r.idle || r.running {
+		return false
+	}
+	r.pending = false
+	r.running = true
+	return true
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hwkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestProbe(t *testing.T) {
+	k, other := newKey(t), newKey(t)
+	public := func(k *ecdsa.PrivateKey) func() (*ecdsa.PublicKey, error) {
+		return func() (*ecdsa.PublicKey, error) { return &k.PublicKey, nil }
+	}
+	sign := func(k *ecdsa.PrivateKey) func([]byte) ([]byte, error) {
+		return func(digest []byte) ([]byte, error) { return ecdsa.SignASN1(rand.Reader, k, digest) }
+	}
+	errTimeout := errors.New("KeyStore call timed out")
+	errGone := fmt.Errorf("loading public key: %w", errors.New("no key found matching the provided ID"))
+
+	tests := []struct {
+		name        string
+		pub         *ecdsa.PublicKey
+		public      func() (*ecdsa.PublicKey, error)
+		sign        func([]byte) ([]byte, error)
+		wantErr     bool
+		wantInvalid bool
+	}{
+		{"ok", &k.PublicKey, public(k), sign(k), false, false},
+		{"public-changed", &k.PublicKey, public(other), sign(other), true, true},
+		{"bad-signature", &k.PublicKey, public(k), sign(other), true, true},
+		{"missing", &k.PublicKey, func() (*ecdsa.PublicKey, error) { return nil, errGone }, sign(k), true, true},
+		{"public-timeout", &k.PublicKey, func() (*ecdsa.PublicKey, error) { return nil, errTimeout }, sign(k), true, false},
+		{"sign-timeout", &k.PublicKey, public(k), func([]byte) ([]byte, error) { return nil, errTimeout }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Probe(tt.pub, tt.public, tt.sign)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Probe = %v, want error %v", err, tt.wantErr)
+			}
+			if got := IsInvalid(err); got != tt.wantInvalid {
+				t.Errorf("IsInvalid(%v) = %v, want %v", err, got, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestReplacements(t *testing.T) {
+	r, err := ParseReplacements("")
+	if err != nil || len(r) != 0 {
+		t.Fatalf("ParseReplacements(\"\") = %v, %v", r, err)
+	}
+	r.Record("a", "b")
+	r.Record("b", "c")
+	for id, want := range map[string]string{"a": "c", "b": "c", "c": "c", "x": "x"} {
+		if got := r.Resolve(id); got != want {
+			t.Errorf("Resolve(%q) = %q, want %q", id, got, want)
+		}
+	}
+
+	r2, err := ParseReplacements(r.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r2.Resolve("a"); got != "c" {
+		t.Errorf("after round trip, Resolve(a) = %q, want c", got)
+	}
+	if _, err := ParseReplacements("{"); err == nil {
+		t.Error("ParseReplacements succeeded on invalid JSON")
+	}
+}
+
+func TestRegistrar(t *testing.T) {
+	var r Registrar
+	// Not idle: the request waits.
+	if r.Request() {
+		t.Fatal("registered while not idle")
+	}
+	if !r.Pending() {
+		t.Fatal("request not pending")
+	}
+	if r.SetIdle(false) {
+		t.Fatal("registered while running")
+	}
+	if !r.SetIdle(true) {
+		t.Fatal("didn't register once idle")
+	}
+	// Requests while registering wait for it to finish.
+	if r.Request() {
+		t.Fatal("registered twice at once")
+	}
+	if !r.Done() {
+		t.Fatal("didn't register again after the first registration")
+	}
+	if r.Done() {
+		t.Fatal("registered again with nothing pending")
+	}
+
+	// Logging in registers the current key.
+	r.SetIdle(false)
+	r.Request()
+	r.LoggedOut()
+	if r.Pending() || r.SetIdle(true) {
+		t.Fatal("registered after logging out")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/opt"
 )
 
 type ParseStats struct {
@@ -21,6 +22,118 @@ type ParseStats struct {
 	AddrsTotal    int
 	AddrsParsed   int
 	AddrsSkipped  int
+
+	// The following are zero for payloads from app versions that don't
+	// report the network of the interfaces.
+	IfacesWithNetwork  int // interfaces with a Transport
+	VPNIfaces          int
+	MeteredIfaces      int
+	DefaultRouteIfaces int
+	GatewaysTotal      int
+	GatewaysSkipped    int
+	DNSServersTotal    int
+	DNSServersSkipped  int
+}
+
+// Transport is the type of the Android network of an interface, from
+// NetworkCapabilities.hasTransport. Other values may be added by newer
+// versions of the app.
+type Transport string
+
+const (
+	TransportWiFi      Transport = "wifi"
+	TransportCellular  Transport = "cellular"
+	TransportEthernet  Transport = "ethernet"
+	TransportBluetooth Transport = "bluetooth"
+	TransportUSB       Transport = "usb"
+	TransportVPN       Transport = "vpn"
+	TransportOther     Transport = "other"
+)
+
+// Interface is a network interface and what Android knows about the network
+// it belongs to. The network fields are zero if the interface isn't part of
+// a network, or the app doesn't report them.
+type Interface struct {
+	netmon.Interface
+
+	// Transport is the type of the network, or empty if unknown. A VPN's
+	// transport is TransportVPN, regardless of the networks under it.
+	Transport Transport
+	Metered   opt.Bool
+	// VPN is whether the network is a VPN, Tailscale's included.
+	VPN bool
+	// DefaultRoute is whether the interface has a default route.
+	DefaultRoute bool
+	// Gateways are the gateways of the default routes.
+	Gateways   []netip.Addr
+	DNSServers []netip.Addr
+}
+
+// describe returns a short description of the network of i, such as
+// "wifi metered default-route", or the empty string if unknown. FromNetmon
+// parses it back.
+func (i Interface) describe() string {
+	if i.Transport == "" {
+		return ""
+	}
+	desc := []string{string(i.Transport)}
+	if m, ok := i.Metered.Get(); ok && m {
+		desc = append(desc, "metered")
+	} else if ok {
+		desc = append(desc, "unmetered")
+	}
+	if i.VPN && i.Transport != TransportVPN {
+		desc = append(desc, "vpn")
+	}
+	if i.DefaultRoute {
+		desc = append(desc, "default-route")
+	}
+	return strings.Join(desc, " ")
+}
+
+// FromNetmon returns the interface ni, with the network recovered from the
+// Desc that ParseInterfacesJSONAsNetmon gave it, so that consumers of the
+// netmon interface state see what the app reported. Gateways and DNS servers
+// aren't part of Desc, and are left nil.
+func FromNetmon(ni netmon.Interface) Interface {
+	it := Interface{Interface: ni}
+	desc := strings.Fields(ni.Desc)
+	if len(desc) == 0 {
+		return it
+	}
+	it.Transport = Transport(desc[0])
+	it.VPN = it.Transport == TransportVPN
+	for _, f := range desc[1:] {
+		switch f {
+		case "metered":
+			it.Metered.Set(true)
+		case "unmetered":
+			it.Metered.Set(false)
+		case "vpn":
+			it.VPN = true
+		case "default-route":
+			it.DefaultRoute = true
+		}
+	}
+	return it
+}
+
+// IPs returns the addresses of i, without their prefix length.
+func (i Interface) IPs() []netip.Addr {
+	var ips []netip.Addr
+	for _, a := range i.AltAddrs {
+		var ip net.IP
+		switch a := a.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		if na, ok := netip.AddrFromSlice(ip); ok {
+			ips = append(ips, na.Unmap())
+		}
+	}
+	return ips
 }
 
 type addrJSON struct {
@@ -37,13 +150,37 @@ type ifaceJSON struct {
 	PointToPt bool       `json:"pointToPoint"`
 	Multicast bool       `json:"multicast"`
 	Addrs     []addrJSON `json:"addrs"`
+
+	// The network of the interface, if any. Older app versions don't
+	// report them.
+	Transport    string   `json:"transport,omitempty"`
+	Metered      *bool    `json:"metered,omitempty"`
+	VPN          bool     `json:"vpn,omitempty"`
+	DefaultRoute bool     `json:"defaultRoute,omitempty"`
+	Gateways     []string `json:"gateways,omitempty"`
+	DNSServers   []string `json:"dnsServers,omitempty"`
 }
 
 var ErrNotJSON = errors.New("not a JSON interfaces payload")
 
 // ParseInterfacesJSONAsNetmon parses a JSON payload produced by getInterfacesAsJson()
-// and returns netmon.Interfaces plus parsing stats.
+// and returns netmon.Interfaces plus parsing stats. The network of each
+// interface is summarized in its Desc.
 func ParseInterfacesJSONAsNetmon(b []byte) ([]netmon.Interface, ParseStats, error) {
+	ifaces, st, err := ParseInterfacesJSON(b)
+	if err != nil {
+		return nil, st, err
+	}
+	out := make([]netmon.Interface, 0, len(ifaces))
+	for _, it := range ifaces {
+		out = append(out, it.Interface)
+	}
+	return out, st, nil
+}
+
+// ParseInterfacesJSON is like ParseInterfacesJSONAsNetmon, but also returns
+// the network of each interface.
+func ParseInterfacesJSON(b []byte) ([]Interface, ParseStats, error) {
 	var st ParseStats
 	trim := strings.TrimSpace(string(b))
 	if trim == "" {
@@ -58,7 +195,7 @@ func ParseInterfacesJSONAsNetmon(b []byte) ([]netmon.Interface, ParseStats, erro
 		return nil, st, err
 	}
 
-	out := make([]netmon.Interface, 0, len(in))
+	out := make([]Interface, 0, len(in))
 	for _, it := range in {
 		st.IfacesTotal++
 
@@ -103,13 +240,58 @@ func ParseInterfacesJSONAsNetmon(b []byte) ([]netmon.Interface, ParseStats, erro
 			st.AddrsParsed++
 		}
 
-		out = append(out, nif)
+		iface := Interface{
+			Interface:    nif,
+			Transport:    Transport(it.Transport),
+			VPN:          it.VPN,
+			DefaultRoute: it.DefaultRoute,
+		}
+		if it.Metered != nil {
+			iface.Metered = opt.NewBool(*it.Metered)
+		}
+		var skipped int
+		iface.Gateways, skipped = parseIPs(it.Gateways)
+		st.GatewaysTotal += len(it.Gateways)
+		st.GatewaysSkipped += skipped
+		iface.DNSServers, skipped = parseIPs(it.DNSServers)
+		st.DNSServersTotal += len(it.DNSServers)
+		st.DNSServersSkipped += skipped
+		iface.Desc = iface.describe()
+
+		if iface.Transport != "" {
+			st.IfacesWithNetwork++
+		}
+		if iface.VPN {
+			st.VPNIfaces++
+		}
+		if m, ok := iface.Metered.Get(); ok && m {
+			st.MeteredIfaces++
+		}
+		if iface.DefaultRoute {
+			st.DefaultRouteIfaces++
+		}
+
+		out = append(out, iface)
 		st.IfacesParsed++
 	}
 
 	return out, st, nil
 }
 
+// parseIPs parses the IP addresses ss, and returns the number of them that
+// couldn't be parsed.
+func parseIPs(ss []string) (ips []netip.Addr, skipped int) {
+	for _, s := range ss {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			skipped++
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, skipped
+}
+
 func (a addrJSON) NetAddr() (net.Addr, error) {
 	na, err := netip.ParseAddr(a.IP)
 	if err != nil {
@@ -5,6 +5,8 @@ package ifaceparse
 
 import (
 	"net"
+	"net/netip"
+	"slices"
 	"sort"
 	"testing"
 
@@ -188,6 +190,113 @@ func TestParseInterfacesJSONAsNetmon(t *testing.T) {
 	}
 }
 
+func TestParseInterfacesJSONNetwork(t *testing.T) {
+	ifaces, st, err := ParseInterfacesJSON([]byte(`[
+		{
+			"name":"wlan0","index":30,"mtu":1500,"up":true,"broadcast":true,"loopback":false,"pointToPoint":false,"multicast":true,
+			"addrs":[{"ip":"10.1.10.131","prefixLen":24}],
+			"transport":"wifi","metered":false,"vpn":false,"defaultRoute":true,
+			"gateways":["10.1.10.1","fe80::1%wlan0","bogus"],
+			"dnsServers":["10.1.10.1","2001:4860:4860::8888"]
+		},
+		{
+			"name":"tun1","index":40,"mtu":1400,"up":true,"broadcast":false,"loopback":false,"pointToPoint":true,"multicast":false,
+			"addrs":[{"ip":"10.8.0.2","prefixLen":32}],
+			"transport":"vpn","metered":null,"vpn":true,"defaultRoute":true,"gateways":[],"dnsServers":[]
+		},
+		{
+			"name":"rmnet0","index":12,"mtu":1500,"up":true,"broadcast":false,"loopback":false,"pointToPoint":true,"multicast":false,
+			"addrs":[],"transport":"cellular","metered":true
+		},
+		{"name":"lo","index":1,"mtu":65536,"up":true,"broadcast":false,"loopback":true,"pointToPoint":false,"multicast":false,"addrs":[]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifaces) != 4 {
+		t.Fatalf("got %d interfaces, want 4", len(ifaces))
+	}
+	wlan, tun, rmnet, lo := ifaces[0], ifaces[1], ifaces[2], ifaces[3]
+
+	if wlan.Transport != TransportWiFi || !wlan.DefaultRoute || wlan.VPN {
+		t.Errorf("wlan0 = %+v", wlan)
+	}
+	if m, ok := wlan.Metered.Get(); !ok || m {
+		t.Errorf("wlan0 Metered = %q, want false", wlan.Metered)
+	}
+	wantGateways := []netip.Addr{netip.MustParseAddr("10.1.10.1"), netip.MustParseAddr("fe80::1%wlan0")}
+	if !slices.Equal(wlan.Gateways, wantGateways) {
+		t.Errorf("wlan0 Gateways = %v, want %v", wlan.Gateways, wantGateways)
+	}
+	if len(wlan.DNSServers) != 2 {
+		t.Errorf("wlan0 DNSServers = %v", wlan.DNSServers)
+	}
+	if _, ok := tun.Metered.Get(); ok || !tun.VPN || tun.Transport != TransportVPN {
+		t.Errorf("tun1 = %+v", tun)
+	}
+	if lo.Transport != "" || lo.Desc != "" {
+		t.Errorf("lo = %+v, want no network", lo)
+	}
+	if got := FromNetmon(lo.Interface); got.Transport != "" || got.VPN || got.DefaultRoute {
+		t.Errorf("FromNetmon(lo) = %+v, want no network", got)
+	}
+
+	for _, tc := range []struct {
+		iface Interface
+		want  string
+	}{
+		{wlan, "wifi unmetered default-route"},
+		{tun, "vpn default-route"},
+		{rmnet, "cellular metered"},
+	} {
+		if tc.iface.Desc != tc.want {
+			t.Errorf("%s Desc = %q, want %q", tc.iface.Name, tc.iface.Desc, tc.want)
+		}
+		// The network survives the trip through netmon, but for the
+		// gateways and DNS servers.
+		got := FromNetmon(tc.iface.Interface)
+		if got.Transport != tc.iface.Transport || got.Metered != tc.iface.Metered || got.VPN != tc.iface.VPN || got.DefaultRoute != tc.iface.DefaultRoute {
+			t.Errorf("FromNetmon(%s) = %+v, want %+v", tc.iface.Name, got, tc.iface)
+		}
+	}
+	if got := tun.IPs(); !slices.Equal(got, []netip.Addr{netip.MustParseAddr("10.8.0.2")}) {
+		t.Errorf("tun1 IPs = %v", got)
+	}
+
+	want := ParseStats{
+		IfacesTotal: 4, IfacesParsed: 4, AddrsTotal: 2, AddrsParsed: 2,
+		IfacesWithNetwork: 3, VPNIfaces: 1, MeteredIfaces: 1, DefaultRouteIfaces: 2,
+		GatewaysTotal: 3, GatewaysSkipped: 1, DNSServersTotal: 2,
+	}
+	if st != want {
+		t.Errorf("stats = %+v, want %+v", st, want)
+	}
+
+	// The netmon interfaces carry the description of their network.
+	nifs, _, err := ParseInterfacesJSONAsNetmon([]byte(`[{"name":"rmnet0","transport":"cellular","metered":true,"addrs":[]}]`))
+	if err != nil || len(nifs) != 1 || nifs[0].Desc != "cellular metered" {
+		t.Errorf("ParseInterfacesJSONAsNetmon = %+v, %v", nifs, err)
+	}
+}
+
+func TestParseInterfacesJSONOldApp(t *testing.T) {
+	// Older app versions don't report the network of interfaces.
+	ifaces, st, err := ParseInterfacesJSON([]byte(`[{"name":"wlan0","index":30,"mtu":1500,"up":true,"broadcast":true,"loopback":false,"pointToPoint":false,"multicast":true,"addrs":[{"ip":"10.1.10.131","prefixLen":24}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifaces) != 1 {
+		t.Fatalf("got %d interfaces, want 1", len(ifaces))
+	}
+	it := ifaces[0]
+	if _, ok := it.Metered.Get(); ok || it.Transport != "" || it.VPN || it.DefaultRoute || it.Gateways != nil || it.DNSServers != nil || it.Desc != "" {
+		t.Errorf("interface = %+v, want no network", it)
+	}
+	if st.IfacesWithNetwork != 0 || st.GatewaysTotal != 0 || st.DNSServersTotal != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
 // collectAltAddrStrings formats AltAddrs into comparable strings.
 // Supports both *net.IPNet and *net.IPAddr.
 func collectAltAddrStrings(t *testing.T, ifc netmon.Interface) map[string]bool {
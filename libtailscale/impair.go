@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_android_impair
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/tailscale/tailscale-android/libtailscale/impair"
+	"github.com/tailscale/tailscale-android/libtailscale/multitun"
+)
+
+// The network impairment simulator is only available in QA builds, made
+// with the ts_android_impair build tag.
+func init() {
+	androidAPIHandlers["impair"] = (*App).serveImpairment
+}
+
+type impairmentStatus struct {
+	Config *impair.Config `json:",omitempty"`
+	Stats  multitun.ImpairmentStats
+}
+
+// serveImpairment serves the network impairment simulator:
+//
+//   - GET returns the impairment configuration and counters.
+//   - POST sets the impairment configuration, an impair.Config in JSON.
+//   - DELETE stops impairing traffic.
+func (a *App) serveImpairment(w http.ResponseWriter, r *http.Request) {
+	d := tunDevice.Load()
+	if d == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var st impairmentStatus
+		if im := d.Impairment(); im != nil {
+			cfg := im.Config()
+			st.Config = &cfg
+		}
+		st.Stats = d.ImpairmentStats()
+		writeJSON(w, st)
+	case http.MethodPost:
+		var cfg impair.Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		im, err := impair.New(cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.SetImpairment(im)
+		log.Printf("network impairment: %d rules", len(cfg.Rules))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		d.SetImpairment(nil)
+		log.Printf("network impairment: stopped")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package impair simulates bad networks by delaying, dropping, reordering
+// and rate limiting packets, for testing how the app behaves on them.
+//
+// It's only linked into builds with the ts_android_impair build tag, which
+// release builds don't set.
+package impair
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxBacklog is how far behind its bandwidth cap a rule may fall before
+// further packets are dropped, like a router's queue overflowing.
+const maxBacklog = 2 * time.Second
+
+// Direction is the direction of a packet through the tunnel.
+type Direction string
+
+const (
+	// Both matches packets in either direction, in a Rule.
+	Both Direction = ""
+	// Outbound packets come from the local network stack and are bound
+	// for the tailnet.
+	Outbound Direction = "out"
+	// Inbound packets come from the tailnet.
+	Inbound Direction = "in"
+)
+
+// Duration is a time.Duration that's encoded in JSON as a string such as
+// "150ms".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule describes the impairment of the packets it matches.
+type Rule struct {
+	// Direction is the direction of the packets the rule applies to.
+	Direction Direction `json:",omitempty"`
+	// Prefix restricts the rule to packets exchanged with addresses in it:
+	// the destination of outbound packets and the source of inbound ones.
+	// The zero Prefix matches all packets.
+	Prefix netip.Prefix `json:",omitzero"`
+
+	// Latency is added to every packet, give or take a random amount of up
+	// to Jitter. Large jitter reorders packets.
+	Latency Duration `json:",omitzero"`
+	Jitter  Duration `json:",omitzero"`
+	// Loss is the probability that a packet is dropped, from 0 to 1.
+	Loss float64 `json:",omitzero"`
+	// Reorder is the probability that a packet skips the latency and
+	// overtakes the packets sent before it, from 0 to 1.
+	Reorder float64 `json:",omitzero"`
+	// Bandwidth caps the rate of the matched packets, in bits per second.
+	// Zero means unlimited.
+	Bandwidth int64 `json:",omitzero"`
+}
+
+// Config is the impairment configuration of the tunnel.
+type Config struct {
+	// Rules are the impairment rules. A packet is impaired by the matching
+	// rule with the longest prefix, or the first of them if several have
+	// the same length. Packets that match no rule are left alone.
+	Rules []Rule
+	// Seed seeds the random decisions, so that runs can be reproduced.
+	// Zero picks a random seed.
+	Seed uint64 `json:",omitzero"`
+}
+
+// Validate reports whether c is a valid configuration.
+func (c Config) Validate() error {
+	var errs []error
+	for i, r := range c.Rules {
+		bad := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("rule %d: "+format, append([]any{i}, args...)...))
+		}
+		switch r.Direction {
+		case Both, Outbound, Inbound:
+		default:
+			bad("unknown direction %q", r.Direction)
+		}
+		if r.Prefix.IsValid() && r.Prefix != r.Prefix.Masked() {
+			bad("prefix %v has host bits set", r.Prefix)
+		}
+		if r.Latency < 0 || r.Jitter < 0 {
+			bad("latency and jitter must not be negative")
+		}
+		if r.Loss < 0 || r.Loss > 1 {
+			bad("loss %v is not between 0 and 1", r.Loss)
+		}
+		if r.Reorder < 0 || r.Reorder > 1 {
+			bad("reorder %v is not between 0 and 1", r.Reorder)
+		}
+		if r.Bandwidth < 0 {
+			bad("bandwidth must not be negative")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RuleStats are the counters of a Rule.
+type RuleStats struct {
+	Rule Rule
+	// Packets is the number of packets that matched the rule.
+	Packets uint64
+	// Lost is the number of packets dropped because of Rule.Loss.
+	Lost uint64
+	// Overflowed is the number of packets dropped because the rule was too
+	// far behind its bandwidth cap.
+	Overflowed uint64
+	// Reordered is the number of packets sent ahead of earlier ones
+	// because of Rule.Reorder.
+	Reordered uint64
+}
+
+type rule struct {
+	RuleStats
+	busyUntil time.Time // when the bandwidth cap allows the next packet
+}
+
+// Impairer decides the fate of packets according to a Config.
+// It's safe for concurrent use.
+type Impairer struct {
+	cfg Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	rules []*rule // in Config order
+	match []*rule // most specific prefix first
+}
+
+// New returns an Impairer for cfg.
+func New(cfg Config) (*Impairer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.Rules = slices.Clone(cfg.Rules)
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	im := &Impairer{
+		cfg: cfg,
+		rng: rand.New(rand.NewPCG(seed, seed)),
+	}
+	for _, r := range cfg.Rules {
+		im.rules = append(im.rules, &rule{RuleStats: RuleStats{Rule: r}})
+	}
+	im.match = slices.Clone(im.rules)
+	slices.SortStableFunc(im.match, func(a, b *rule) int {
+		return cmp.Compare(prefixBits(b.Rule.Prefix), prefixBits(a.Rule.Prefix))
+	})
+	return im, nil
+}
+
+func prefixBits(p netip.Prefix) int {
+	if !p.IsValid() {
+		return -1
+	}
+	return p.Bits()
+}
+
+// Config returns the configuration of im.
+func (im *Impairer) Config() Config {
+	c := im.cfg
+	c.Rules = slices.Clone(c.Rules)
+	return c
+}
+
+// Stats returns the counters of the rules of im, in Config order.
+func (im *Impairer) Stats() []RuleStats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	st := make([]RuleStats, len(im.rules))
+	for i, r := range im.rules {
+		st[i] = r.RuleStats
+	}
+	return st
+}
+
+// Decide decides the fate of pkt, an IP packet travelling in direction dir
+// (Inbound or Outbound) at time now. It returns when the packet should be
+// delivered, or false if it should be dropped.
+func (im *Impairer) Decide(dir Direction, pkt []byte, now time.Time) (time.Time, bool) {
+	r := im.lookup(dir, pkt)
+	if r == nil {
+		return now, true
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	r.Packets++
+	if r.Rule.Loss > 0 && im.rng.Float64() < r.Rule.Loss {
+		r.Lost++
+		return time.Time{}, false
+	}
+	at := now
+	if r.Rule.Bandwidth > 0 {
+		if r.busyUntil.After(at) {
+			if r.busyUntil.Sub(at) > maxBacklog {
+				r.Overflowed++
+				return time.Time{}, false
+			}
+			at = r.busyUntil
+		}
+		at = at.Add(time.Duration(int64(len(pkt)) * 8 * int64(time.Second) / r.Rule.Bandwidth))
+		r.busyUntil = at
+	}
+	if r.Rule.Reorder > 0 && im.rng.Float64() < r.Rule.Reorder {
+		r.Reordered++
+		return at, true
+	}
+	delay := time.Duration(r.Rule.Latency)
+	if j := int64(r.Rule.Jitter); j > 0 {
+		delay += time.Duration(im.rng.Int64N(2*j+1) - j)
+	}
+	return at.Add(max(delay, 0)), true
+}
+
+// lookup returns the rule matching pkt travelling in direction dir, or nil.
+func (im *Impairer) lookup(dir Direction, pkt []byte) *rule {
+	remote, ok := remoteAddr(dir, pkt)
+	for _, r := range im.match {
+		if r.Rule.Direction != Both && r.Rule.Direction != dir {
+			continue
+		}
+		if r.Rule.Prefix.IsValid() && (!ok || !r.Rule.Prefix.Contains(remote)) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+// remoteAddr returns the tailnet side address of pkt: its destination if
+// it's outbound, and its source if it's inbound.
+func remoteAddr(dir Direction, pkt []byte) (netip.Addr, bool) {
+	if len(pkt) == 0 {
+		return netip.Addr{}, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return netip.Addr{}, false
+		}
+		if dir == Outbound {
+			return netip.AddrFrom4([4]byte(pkt[16:20])), true
+		}
+		return netip.AddrFrom4([4]byte(pkt[12:16])), true
+	case 6:
+		if len(pkt) < 40 {
+			return netip.Addr{}, false
+		}
+		if dir == Outbound {
+			return netip.AddrFrom16([16]byte(pkt[24:40])), true
+		}
+		return netip.AddrFrom16([16]byte(pkt[8:24])), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package impair
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// packet returns a minimal IPv4 or IPv6 packet of size bytes.
+func packet(src, dst string, size int) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	if s.Is4() {
+		b := make([]byte, max(size, 20))
+		b[0] = 0x45
+		copy(b[12:], s.AsSlice())
+		copy(b[16:], d.AsSlice())
+		return b
+	}
+	b := make([]byte, max(size, 40))
+	b[0] = 0x60
+	copy(b[8:], s.AsSlice())
+	copy(b[24:], d.AsSlice())
+	return b
+}
+
+func mustNew(t *testing.T, cfg Config) *Impairer {
+	t.Helper()
+	im, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func TestConfigJSON(t *testing.T) {
+	const in = `{"Rules":[{"Direction":"out","Prefix":"100.64.0.0/10","Latency":"150ms","Jitter":"20ms","Loss":0.01,"Bandwidth":1000000}],"Seed":1}`
+	var c Config
+	if err := json.Unmarshal([]byte(in), &c); err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Rules: []Rule{{
+			Direction: Outbound,
+			Prefix:    netip.MustParsePrefix("100.64.0.0/10"),
+			Latency:   Duration(150 * time.Millisecond),
+			Jitter:    Duration(20 * time.Millisecond),
+			Loss:      0.01,
+			Bandwidth: 1e6,
+		}},
+		Seed: 1,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("got %+v, want %+v", c, want)
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("round trip:\n got %s\nwant %s", out, in)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, r := range []Rule{
+		{Direction: "sideways"},
+		{Prefix: netip.MustParsePrefix("10.1.2.3/8")},
+		{Latency: -1},
+		{Loss: 1.5},
+		{Reorder: -0.1},
+		{Bandwidth: -1},
+	} {
+		if err := (Config{Rules: []Rule{r}}).Validate(); err == nil {
+			t.Errorf("%+v: got no error", r)
+		}
+	}
+	if err := (Config{Rules: []Rule{{Loss: 1, Reorder: 1}}}).Validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	im := mustNew(t, Config{Rules: []Rule{
+		{Latency: Duration(1 * time.Millisecond)},
+		{Prefix: netip.MustParsePrefix("100.64.0.0/10"), Latency: Duration(2 * time.Millisecond)},
+		{Prefix: netip.MustParsePrefix("100.100.0.0/16"), Latency: Duration(3 * time.Millisecond)},
+		{Direction: Inbound, Prefix: netip.MustParsePrefix("fd7a:115c:a1e0::/48"), Latency: Duration(4 * time.Millisecond)},
+	}})
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		dir      Direction
+		src, dst string
+		want     time.Duration
+	}{
+		{Outbound, "100.100.1.1", "8.8.8.8", 1 * time.Millisecond},
+		{Outbound, "8.8.8.8", "100.65.1.1", 2 * time.Millisecond},
+		{Outbound, "8.8.8.8", "100.100.1.1", 3 * time.Millisecond},
+		// Inbound packets match on their source.
+		{Inbound, "100.100.1.1", "100.65.1.1", 3 * time.Millisecond},
+		{Inbound, "fd7a:115c:a1e0::1", "fd7a:115c:a1e0::2", 4 * time.Millisecond},
+		// Prefix-less rules match all directions and families.
+		{Outbound, "fd7a:115c:a1e0::1", "fd7a:115c:a1e0::2", 1 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		at, ok := im.Decide(tt.dir, packet(tt.src, tt.dst, 60), now)
+		if !ok || at.Sub(now) != tt.want {
+			t.Errorf("%s %s->%s: got delay %v, %v; want %v", tt.dir, tt.src, tt.dst, at.Sub(now), ok, tt.want)
+		}
+	}
+
+	// Packets that match no rule pass through.
+	im = mustNew(t, Config{Rules: []Rule{{Direction: Inbound, Loss: 1}}})
+	if at, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 60), now); !ok || !at.Equal(now) {
+		t.Errorf("unmatched packet: got %v, %v", at, ok)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	im := mustNew(t, Config{Rules: []Rule{{Loss: 0.25}}, Seed: 1})
+	const n = 10000
+	var lost int
+	for range n {
+		if _, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 60), time.Now()); !ok {
+			lost++
+		}
+	}
+	if lost < n*20/100 || lost > n*30/100 {
+		t.Errorf("lost %d of %d packets, want about 25%%", lost, n)
+	}
+	st := im.Stats()[0]
+	if st.Packets != n || st.Lost != uint64(lost) {
+		t.Errorf("stats = %+v, want %d packets, %d lost", st, n, lost)
+	}
+}
+
+func TestJitterReorder(t *testing.T) {
+	im := mustNew(t, Config{
+		Rules: []Rule{{
+			Latency: Duration(100 * time.Millisecond),
+			Jitter:  Duration(10 * time.Millisecond),
+			Reorder: 0.1,
+		}},
+		Seed: 1,
+	})
+	now := time.Unix(1000, 0)
+	var reordered int
+	for range 1000 {
+		at, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 60), now)
+		if !ok {
+			t.Fatal("packet dropped")
+		}
+		switch d := at.Sub(now); {
+		case d == 0:
+			reordered++
+		case d < 90*time.Millisecond || d > 110*time.Millisecond:
+			t.Fatalf("delay %v out of range", d)
+		}
+	}
+	if reordered < 50 || reordered > 150 {
+		t.Errorf("reordered %d of 1000 packets, want about 100", reordered)
+	}
+	if got := im.Stats()[0].Reordered; got != uint64(reordered) {
+		t.Errorf("Reordered = %d, want %d", got, reordered)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	// 1000 byte packets at 80kbit/s take 100ms each.
+	im := mustNew(t, Config{Rules: []Rule{{Bandwidth: 80000}}})
+	now := time.Unix(1000, 0)
+	for i := 1; i <= 21; i++ {
+		at, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 1000), now)
+		if !ok {
+			t.Fatalf("packet %d dropped", i)
+		}
+		if want := time.Duration(i) * 100 * time.Millisecond; at.Sub(now) != want {
+			t.Fatalf("packet %d: delay %v, want %v", i, at.Sub(now), want)
+		}
+	}
+	// The rule is now more than 2s behind, and drops what doesn't fit.
+	if _, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 1000), now); ok {
+		t.Fatal("packet beyond backlog not dropped")
+	}
+	if got := im.Stats()[0].Overflowed; got != 1 {
+		t.Errorf("Overflowed = %d, want 1", got)
+	}
+	// Once idle, packets go through at the capped rate again.
+	later := now.Add(5 * time.Second)
+	if at, ok := im.Decide(Outbound, packet("1.1.1.1", "2.2.2.2", 1000), later); !ok || at.Sub(later) != 100*time.Millisecond {
+		t.Errorf("after idle: got delay %v, %v", at.Sub(later), ok)
+	}
+}
+
+func TestLine(t *testing.T) {
+	l := NewLine(3)
+	now := time.Unix(1000, 0)
+	ms := func(n int) time.Time { return now.Add(time.Duration(n) * time.Millisecond) }
+	l.Push(ms(20), []byte("c"))
+	l.Push(ms(10), []byte("a"))
+	l.Push(ms(10), []byte("b"))
+	if l.Push(ms(0), []byte("x")) {
+		t.Error("Push on full line succeeded")
+	}
+	if l.Dropped() != 1 {
+		t.Errorf("Dropped = %d, want 1", l.Dropped())
+	}
+	select {
+	case <-l.Pushed():
+	default:
+		t.Error("Pushed not signalled")
+	}
+
+	pkts, next := l.Pop(nil, ms(5), 10)
+	if len(pkts) != 0 || !next.Equal(ms(10)) {
+		t.Errorf("Pop early: got %q, next %v", pkts, next)
+	}
+	pkts, next = l.Pop(nil, ms(20), 2)
+	if got := string(pkts[0]) + string(pkts[1]); got != "ab" || !next.Equal(ms(20)) {
+		t.Errorf("Pop: got %q, next %v", got, next)
+	}
+	pkts, next = l.Pop(pkts[:0], ms(20), 2)
+	if len(pkts) != 1 || string(pkts[0]) != "c" || !next.IsZero() {
+		t.Errorf("Pop last: got %q, next %v", pkts, next)
+	}
+	if l.Len() != 0 {
+		t.Errorf("Len = %d, want 0", l.Len())
+	}
+}
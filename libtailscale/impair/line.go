@@ -0,0 +1,115 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package impair
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Line is a delay line: a queue of packets, each released at its own time.
+// Packets due at the same time are released in the order they were pushed.
+// It's safe for concurrent use.
+type Line struct {
+	limit  int
+	pushed chan struct{}
+
+	mu      sync.Mutex
+	q       packetHeap
+	seq     uint64
+	dropped uint64
+}
+
+// NewLine returns a Line holding at most limit packets.
+func NewLine(limit int) *Line {
+	return &Line{
+		limit:  limit,
+		pushed: make(chan struct{}, 1),
+	}
+}
+
+// Push queues pkt for release at t. It reports false, and drops pkt, if the
+// Line is full.
+func (l *Line) Push(t time.Time, pkt []byte) bool {
+	l.mu.Lock()
+	if len(l.q) >= l.limit {
+		l.dropped++
+		l.mu.Unlock()
+		return false
+	}
+	heap.Push(&l.q, queuedPacket{at: t, seq: l.seq, pkt: pkt})
+	l.seq++
+	l.mu.Unlock()
+
+	select {
+	case l.pushed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pushed returns a channel that receives a value after packets are pushed.
+// It's meant for a single consumer waiting for new packets.
+func (l *Line) Pushed() <-chan struct{} {
+	return l.pushed
+}
+
+// Pop appends up to n packets that are due at now to dst, and returns it.
+// next is the release time of the earliest packet left, or the zero time if
+// the Line is empty.
+func (l *Line) Pop(dst [][]byte, now time.Time, n int) (pkts [][]byte, next time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ; n > 0 && len(l.q) > 0 && !l.q[0].at.After(now); n-- {
+		dst = append(dst, heap.Pop(&l.q).(queuedPacket).pkt)
+	}
+	if len(l.q) > 0 {
+		next = l.q[0].at
+	}
+	return dst, next
+}
+
+// Len returns the number of packets in the Line.
+func (l *Line) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.q)
+}
+
+// Dropped returns the number of packets dropped because the Line was full.
+func (l *Line) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+type queuedPacket struct {
+	at  time.Time
+	seq uint64
+	pkt []byte
+}
+
+type packetHeap []queuedPacket
+
+func (h packetHeap) Len() int { return len(h) }
+
+func (h packetHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h packetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *packetHeap) Push(x any) { *h = append(*h, x.(queuedPacket)) }
+
+func (h *packetHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	old[len(old)-1] = queuedPacket{}
+	*h = old[:len(old)-1]
+	return p
+}
@@ -54,6 +54,9 @@ type AppContext interface {
 	// IsClientLoggingEnabled reports whether the user has enabled remote client logging.
 	IsClientLoggingEnabled() (bool, error)
 
+	// IsDebugBuild reports whether this is a debug build of the app.
+	IsDebugBuild() bool
+
 	// GetInterfacesAsJson gets a JSON representation of all network
 	// interfaces.
 	GetInterfacesAsJson() (string, error)
@@ -75,17 +78,31 @@ type AppContext interface {
 	// Methods used to implement key.HardwareAttestationKey using the Android
 	// KeyStore.
 	HardwareAttestationKeySupported() bool
-	HardwareAttestationKeyCreate() (id string, err error)
+	// HardwareAttestationKeyCreate creates a key whose attestation
+	// certificate carries challenge.
+	HardwareAttestationKeyCreate(challenge []byte) (id string, err error)
 	HardwareAttestationKeyRelease(id string) error
 	HardwareAttestationKeyPublic(id string) (pub []byte, err error)
 	HardwareAttestationKeySign(id string, data []byte) (sig []byte, err error)
 	HardwareAttestationKeyLoad(id string) error
 
+	// HardwareAttestationKeyCertificateChain returns the KeyStore attestation
+	// certificate chain of the key as concatenated DER certificates, leaf
+	// first. HardwareAttestationKeySecurityLevel returns where the key lives:
+	// "STRONGBOX", "TRUSTED_ENVIRONMENT", "SOFTWARE" or "UNKNOWN".
+	HardwareAttestationKeyCertificateChain(id string) (chain []byte, err error)
+	HardwareAttestationKeySecurityLevel(id string) (level string, err error)
+
 	BindSocketToNetwork(fd int32) bool
 
 	// GetUserCACertsPEM returns PEM-encoded user-installed CA certificates
 	// from the Android KeyStore, or empty bytes if none are installed.
 	GetUserCACertsPEM() ([]byte, error)
+
+	// GetSplitTunnelAppsJSON returns the user's selection of apps for split
+	// tunneling, and the apps that bypass the VPN by default, as a JSON
+	// object with the fields of userSplitTunnelApps.
+	GetSplitTunnelAppsJSON() (string, error)
 }
 
 // IPNService corresponds to our IPNService in Java.
@@ -108,6 +125,12 @@ type IPNService interface {
 	DisconnectVPN()
 
 	UpdateVpnStatus(bool)
+
+	// IsAlwaysOnVPN and IsLockdownVPN report whether this is the always-on
+	// VPN, and whether it's in lockdown mode, blocking connections outside
+	// the VPN. They're false before Android 10.
+	IsAlwaysOnVPN() bool
+	IsLockdownVPN() bool
 }
 
 // VPNServiceBuilder corresponds to Android's VpnService.Builder.
@@ -118,7 +141,31 @@ type VPNServiceBuilder interface {
 	AddRoute(string, int32) error
 	ExcludeRoute(string, int32) error
 	AddAddress(string, int32) error
-	Establish() (ParcelFileDescriptor, error)
+	// AddAllowedApplication and AddDisallowedApplication take a package
+	// name. They fail if the package isn't installed.
+	AddAllowedApplication(string) error
+	AddDisallowedApplication(string) error
+	// SetHTTPProxy publishes an HTTP proxy, given by host, port and
+	// comma-separated excluded hosts, and SetHTTPProxyPAC one configured by
+	// the PAC file at a URL. They do nothing before Android 10.
+	SetHTTPProxy(string, int32, string) error
+	SetHTTPProxyPAC(string) error
+	AllowBypass() error
+	// AllowFamily takes AF_INET or AF_INET6.
+	AllowFamily(int32) error
+	// Establish establishes the VPN. Failures are reported by the result's
+	// error code, or, if they can't be classified, as an error.
+	Establish() (EstablishResult, error)
+}
+
+// EstablishResult is the result of VPNServiceBuilder.Establish.
+type EstablishResult interface {
+	// FileDescriptor returns the tun file descriptor, or nil on failure.
+	FileDescriptor() ParcelFileDescriptor
+	// ErrorCode returns EstablishOK, or one of the EstablishError codes.
+	ErrorCode() int32
+	// ErrorMessage describes the failure, if any.
+	ErrorMessage() string
 }
 
 // ParcelFileDescriptor corresponds to Android's ParcelFileDescriptor.
@@ -141,6 +188,11 @@ type Application interface {
 	// so it can re-read it via the [syspolicyHandler].
 	NotifyPolicyChanged()
 
+	// NotifySplitTunnelChanged notifies the backend that the user changed
+	// their selection of apps for split tunneling, so it can re-read it
+	// and reconfigure the VPN.
+	NotifySplitTunnelChanged()
+
 	// SetClientLoggingEnabled sets whether diagnostic logs are uploaded to
 	// Tailscale's logging backend. Changes take effect immediately.
 	SetClientLoggingEnabled(enabled bool)
@@ -0,0 +1,268 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package keyattest parses Android key attestation certificate chains.
+//
+// See https://source.android.com/docs/security/features/keystore/attestation
+// for the format of the attestation extension.
+package keyattest
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// OID is the object identifier of the Android key attestation extension.
+var OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 17}
+
+// ErrNoExtension is returned when a certificate has no attestation extension.
+var ErrNoExtension = errors.New("certificate has no Android key attestation extension")
+
+// SecurityLevel is where an attested key, or the attestation itself, lives.
+type SecurityLevel int
+
+const (
+	Software           SecurityLevel = 0
+	TrustedEnvironment SecurityLevel = 1
+	StrongBox          SecurityLevel = 2
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case Software:
+		return "Software"
+	case TrustedEnvironment:
+		return "TrustedEnvironment"
+	case StrongBox:
+		return "StrongBox"
+	default:
+		return fmt.Sprintf("SecurityLevel(%d)", int(l))
+	}
+}
+
+func (l SecurityLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// VerifiedBootState is the state of verified boot on the attesting device.
+type VerifiedBootState int
+
+const (
+	Verified   VerifiedBootState = 0
+	SelfSigned VerifiedBootState = 1
+	Unverified VerifiedBootState = 2
+	Failed     VerifiedBootState = 3
+)
+
+func (s VerifiedBootState) String() string {
+	switch s {
+	case Verified:
+		return "Verified"
+	case SelfSigned:
+		return "SelfSigned"
+	case Unverified:
+		return "Unverified"
+	case Failed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("VerifiedBootState(%d)", int(s))
+	}
+}
+
+func (s VerifiedBootState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// RootOfTrust describes the verified boot state of the attesting device.
+type RootOfTrust struct {
+	VerifiedBootKey   []byte
+	DeviceLocked      bool
+	VerifiedBootState VerifiedBootState
+	VerifiedBootHash  []byte `json:",omitempty"` // attestation version 3 and later
+}
+
+// AuthorizationList holds the subset of key authorizations we care about.
+// Zero values mean the authorization was absent.
+type AuthorizationList struct {
+	Purposes                 []int        `json:",omitempty"`
+	Algorithm                int          `json:",omitempty"`
+	KeySize                  int          `json:",omitempty"`
+	Origin                   int          `json:",omitempty"`
+	RootOfTrust              *RootOfTrust `json:",omitempty"`
+	OSVersion                int          `json:",omitempty"`
+	OSPatchLevel             int          `json:",omitempty"`
+	AttestationApplicationID []byte       `json:",omitempty"`
+	VendorPatchLevel         int          `json:",omitempty"`
+	BootPatchLevel           int          `json:",omitempty"`
+}
+
+// Authorization tags, from the KeyMint AuthorizationList schema.
+const (
+	tagPurpose                  = 1
+	tagAlgorithm                = 2
+	tagKeySize                  = 3
+	tagOrigin                   = 702
+	tagRootOfTrust              = 704
+	tagOSVersion                = 705
+	tagOSPatchLevel             = 706
+	tagAttestationApplicationID = 709
+	tagVendorPatchLevel         = 718
+	tagBootPatchLevel           = 719
+)
+
+// KeyDescription is the content of the attestation extension.
+type KeyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel SecurityLevel
+	KeyMintVersion           int
+	KeyMintSecurityLevel     SecurityLevel
+	AttestationChallenge     []byte
+	UniqueID                 []byte `json:",omitempty"`
+	SoftwareEnforced         AuthorizationList
+	HardwareEnforced         AuthorizationList
+}
+
+// keyDescription is the ASN.1 layout of [KeyDescription].
+type keyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel asn1.Enumerated
+	KeyMintVersion           int
+	KeyMintSecurityLevel     asn1.Enumerated
+	AttestationChallenge     []byte
+	UniqueID                 []byte
+	SoftwareEnforced         asn1.RawValue
+	HardwareEnforced         asn1.RawValue
+}
+
+type rootOfTrust struct {
+	VerifiedBootKey   []byte
+	DeviceLocked      bool
+	VerifiedBootState asn1.Enumerated
+	VerifiedBootHash  []byte `asn1:"optional"`
+}
+
+// Parse parses the DER-encoded value of an attestation extension.
+func Parse(der []byte) (*KeyDescription, error) {
+	var kd keyDescription
+	rest, err := asn1.Unmarshal(der, &kd)
+	if err != nil {
+		return nil, fmt.Errorf("parsing KeyDescription: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after KeyDescription")
+	}
+	ret := &KeyDescription{
+		AttestationVersion:       kd.AttestationVersion,
+		AttestationSecurityLevel: SecurityLevel(kd.AttestationSecurityLevel),
+		KeyMintVersion:           kd.KeyMintVersion,
+		KeyMintSecurityLevel:     SecurityLevel(kd.KeyMintSecurityLevel),
+		AttestationChallenge:     kd.AttestationChallenge,
+		UniqueID:                 kd.UniqueID,
+	}
+	if err := parseAuthorizationList(kd.SoftwareEnforced, &ret.SoftwareEnforced); err != nil {
+		return nil, fmt.Errorf("softwareEnforced: %w", err)
+	}
+	if err := parseAuthorizationList(kd.HardwareEnforced, &ret.HardwareEnforced); err != nil {
+		return nil, fmt.Errorf("hardwareEnforced: %w", err)
+	}
+	return ret, nil
+}
+
+// parseAuthorizationList parses a SEQUENCE of explicitly tagged, optional
+// authorizations into al. Authorizations we don't know about are skipped.
+func parseAuthorizationList(raw asn1.RawValue, al *AuthorizationList) error {
+	if raw.Class != asn1.ClassUniversal || raw.Tag != asn1.TagSequence {
+		return fmt.Errorf("unexpected tag %d/%d", raw.Class, raw.Tag)
+	}
+	rest := raw.Bytes
+	for len(rest) > 0 {
+		var elem asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &elem)
+		if err != nil {
+			return err
+		}
+		if elem.Class != asn1.ClassContextSpecific {
+			continue
+		}
+		switch elem.Tag {
+		case tagPurpose:
+			err = unmarshalExplicit(elem, &al.Purposes, "set")
+		case tagAlgorithm:
+			err = unmarshalExplicit(elem, &al.Algorithm, "")
+		case tagKeySize:
+			err = unmarshalExplicit(elem, &al.KeySize, "")
+		case tagOrigin:
+			err = unmarshalExplicit(elem, &al.Origin, "")
+		case tagRootOfTrust:
+			var rot rootOfTrust
+			if err = unmarshalExplicit(elem, &rot, ""); err == nil {
+				al.RootOfTrust = &RootOfTrust{
+					VerifiedBootKey:   rot.VerifiedBootKey,
+					DeviceLocked:      rot.DeviceLocked,
+					VerifiedBootState: VerifiedBootState(rot.VerifiedBootState),
+					VerifiedBootHash:  rot.VerifiedBootHash,
+				}
+			}
+		case tagOSVersion:
+			err = unmarshalExplicit(elem, &al.OSVersion, "")
+		case tagOSPatchLevel:
+			err = unmarshalExplicit(elem, &al.OSPatchLevel, "")
+		case tagAttestationApplicationID:
+			err = unmarshalExplicit(elem, &al.AttestationApplicationID, "")
+		case tagVendorPatchLevel:
+			err = unmarshalExplicit(elem, &al.VendorPatchLevel, "")
+		case tagBootPatchLevel:
+			err = unmarshalExplicit(elem, &al.BootPatchLevel, "")
+		}
+		if err != nil {
+			return fmt.Errorf("tag %d: %w", elem.Tag, err)
+		}
+	}
+	return nil
+}
+
+func unmarshalExplicit(elem asn1.RawValue, v any, params string) error {
+	rest, err := asn1.UnmarshalWithParams(elem.Bytes, v, params)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// FromCertificate parses the attestation extension of cert.
+// It returns ErrNoExtension if cert doesn't have one.
+func FromCertificate(cert *x509.Certificate) (*KeyDescription, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OID) {
+			return Parse(ext.Value)
+		}
+	}
+	return nil, ErrNoExtension
+}
+
+// ParseChain parses a certificate chain made of concatenated DER-encoded
+// certificates, leaf first, as returned by the Android KeyStore. It returns
+// the certificates and the key description from the leaf certificate.
+//
+// ParseChain does not verify the chain; verification has to happen on the
+// server side against Google's attestation roots.
+func ParseChain(der []byte) ([]*x509.Certificate, *KeyDescription, error) {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("empty certificate chain")
+	}
+	kd, err := FromCertificate(certs[0])
+	if err != nil {
+		return certs, nil, err
+	}
+	return certs, kd, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package keyattest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testAuthList struct {
+	Purpose     []int       `asn1:"explicit,tag:1,set,optional"`
+	Algorithm   int         `asn1:"explicit,tag:2,optional"`
+	KeySize     int         `asn1:"explicit,tag:3,optional"`
+	NoAuthReq   asn1.Flag   `asn1:"explicit,tag:503,optional"` // not parsed, must be skipped
+	Origin      int         `asn1:"explicit,tag:702,optional"`
+	RootOfTrust rootOfTrust `asn1:"explicit,tag:704,optional"`
+	OSVersion   int         `asn1:"explicit,tag:705,optional"`
+	AppID       []byte      `asn1:"explicit,tag:709,optional"`
+}
+
+type testKeyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel asn1.Enumerated
+	KeyMintVersion           int
+	KeyMintSecurityLevel     asn1.Enumerated
+	AttestationChallenge     []byte
+	UniqueID                 []byte
+	SoftwareEnforced         testAuthList
+	HardwareEnforced         testAuthList
+}
+
+func testExtension(t *testing.T) []byte {
+	t.Helper()
+	der, err := asn1.Marshal(testKeyDescription{
+		AttestationVersion:       200,
+		AttestationSecurityLevel: asn1.Enumerated(StrongBox),
+		KeyMintVersion:           200,
+		KeyMintSecurityLevel:     asn1.Enumerated(StrongBox),
+		AttestationChallenge:     []byte("challenge"),
+		UniqueID:                 []byte{},
+		SoftwareEnforced: testAuthList{
+			AppID: []byte("com.tailscale.ipn"),
+		},
+		HardwareEnforced: testAuthList{
+			Purpose:   []int{2, 3},
+			Algorithm: 3,
+			KeySize:   256,
+			NoAuthReq: true,
+			RootOfTrust: rootOfTrust{
+				VerifiedBootKey:   []byte{1, 2, 3},
+				DeviceLocked:      true,
+				VerifiedBootState: asn1.Enumerated(Verified),
+				VerifiedBootHash:  []byte{4, 5, 6},
+			},
+			OSVersion: 140000,
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return der
+}
+
+func TestParse(t *testing.T) {
+	kd, err := Parse(testExtension(t))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := &KeyDescription{
+		AttestationVersion:       200,
+		AttestationSecurityLevel: StrongBox,
+		KeyMintVersion:           200,
+		KeyMintSecurityLevel:     StrongBox,
+		AttestationChallenge:     []byte("challenge"),
+		UniqueID:                 []byte{},
+		SoftwareEnforced: AuthorizationList{
+			AttestationApplicationID: []byte("com.tailscale.ipn"),
+		},
+		HardwareEnforced: AuthorizationList{
+			Purposes:  []int{2, 3},
+			Algorithm: 3,
+			KeySize:   256,
+			RootOfTrust: &RootOfTrust{
+				VerifiedBootKey:   []byte{1, 2, 3},
+				DeviceLocked:      true,
+				VerifiedBootState: Verified,
+				VerifiedBootHash:  []byte{4, 5, 6},
+			},
+			OSVersion: 140000,
+		},
+	}
+	if !reflect.DeepEqual(kd, want) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", kd, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	ext := testExtension(t)
+	for _, tt := range []struct {
+		name string
+		der  []byte
+	}{
+		{"empty", nil},
+		{"truncated", ext[:len(ext)/2]},
+		{"trailing", append(bytes.Clone(ext), 0x05, 0x00)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.der); err == nil {
+				t.Errorf("Parse succeeded, want error")
+			}
+		})
+	}
+}
+
+func testCert(t *testing.T, exts []pkix.Extension) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "Android Keystore Key"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: exts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParseChain(t *testing.T) {
+	leaf := testCert(t, []pkix.Extension{{Id: OID, Value: testExtension(t)}})
+	intermediate := testCert(t, nil)
+
+	certs, kd, err := ParseChain(append(leaf, intermediate...))
+	if err != nil {
+		t.Fatalf("ParseChain: %v", err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("got %d certs, want 2", len(certs))
+	}
+	if kd.KeyMintSecurityLevel != StrongBox {
+		t.Errorf("KeyMintSecurityLevel = %v, want %v", kd.KeyMintSecurityLevel, StrongBox)
+	}
+
+	if _, _, err := ParseChain(intermediate); !errors.Is(err, ErrNoExtension) {
+		t.Errorf("ParseChain without extension: err = %v, want %v", err, ErrNoExtension)
+	}
+}
@@ -11,23 +11,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"sync"
 
+	"github.com/tailscale/tailscale-android/libtailscale/hwkeys"
+	"github.com/tailscale/tailscale-android/libtailscale/keyattest"
 	"tailscale.com/types/key"
 )
 
-func emptyHardwareAttestationKey(appCtx AppContext) key.HardwareAttestationKey {
-	return &hardwareAttestationKey{appCtx: appCtx}
+func emptyHardwareAttestationKey(appCtx AppContext, keys *hardwareKeys) key.HardwareAttestationKey {
+	return &hardwareAttestationKey{appCtx: appCtx, keys: keys, st: new(hardwareKeyState)}
 }
 
-func createHardwareAttestationKey(appCtx AppContext) (key.HardwareAttestationKey, error) {
-	id, err := appCtx.HardwareAttestationKeyCreate()
+func createHardwareAttestationKey(appCtx AppContext, keys *hardwareKeys) (key.HardwareAttestationKey, error) {
+	id, pub, err := newKeyStoreKey(appCtx, keys.challenge())
 	if err != nil {
 		return nil, err
 	}
-	k := &hardwareAttestationKey{appCtx: appCtx, id: id}
-	if err := k.fetchPublic(); err != nil {
-		return nil, err
-	}
+	k := &hardwareAttestationKey{appCtx: appCtx, keys: keys, st: &hardwareKeyState{id: id, public: pub}}
+	keys.track(k.st)
 	return k, nil
 }
 
@@ -35,68 +37,217 @@ var hardwareAttestationKeyNotInitialized = errors.New("HardwareAttestationKey ha
 
 type hardwareAttestationKey struct {
 	appCtx AppContext
-	id     string
+	// keys tracks the key for health checks. It may be nil.
+	keys *hardwareKeys
+	// st is never nil, and is shared with all clones of this key.
+	st *hardwareKeyState
+}
+
+// hardwareKeyState is the KeyStore identity of a hardware attestation key.
+// It's shared between a key and its clones so that, when the key is
+// re-created after failing a health check, all of them pick up the new one.
+type hardwareKeyState struct {
+	mu sync.Mutex
+	id string
 	// public key is always initialized in createHardwareAttestationKey and
 	// UnmarshalJSON. It's only nil in emptyHardwareAttestationKey.
 	public *ecdsa.PublicKey
 }
 
-func (k *hardwareAttestationKey) fetchPublic() error {
-	if k.id == "" || k.appCtx == nil {
-		return hardwareAttestationKeyNotInitialized
+func (st *hardwareKeyState) get() (id string, pub *ecdsa.PublicKey) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.id, st.public
+}
+
+func (st *hardwareKeyState) set(id string, pub *ecdsa.PublicKey) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.id, st.public = id, pub
+}
+
+// newKeyStoreKey creates a new key in the Android KeyStore, attested with
+// challenge, and returns its ID and public key. The key is released if it
+// can't be used, including when its creation times out and completes later.
+func newKeyStoreKey(appCtx AppContext, challenge []byte) (id string, pub *ecdsa.PublicKey, err error) {
+	release := func(id string) {
+		if err := callKeyStoreErr(keyStoreRelease, func() error { return appCtx.HardwareAttestationKeyRelease(id) }); err != nil {
+			log.Printf("releasing unused KeyStore key %q: %v", id, err)
+		}
+	}
+	id, err = callKeyStoreLate(keyStoreCreate, func() (string, error) {
+		return appCtx.HardwareAttestationKeyCreate(challenge)
+	}, release)
+	if err != nil {
+		return "", nil, err
+	}
+	pub, err = keyStorePublic(appCtx, id)
+	if err != nil {
+		release(id)
+		return "", nil, err
+	}
+	return id, pub, nil
+}
+
+// keyStorePublic loads the public key for id from the Android KeyStore.
+func keyStorePublic(appCtx AppContext, id string) (*ecdsa.PublicKey, error) {
+	if id == "" || appCtx == nil {
+		return nil, hardwareAttestationKeyNotInitialized
 	}
 
-	pubRaw, err := k.appCtx.HardwareAttestationKeyPublic(k.id)
+	pubRaw, err := callKeyStore(keyStorePubKey, func() ([]byte, error) {
+		return appCtx.HardwareAttestationKeyPublic(id)
+	})
 	if err != nil {
-		return fmt.Errorf("loading public key for id %q from KeyStore: %w", k.id, err)
+		return nil, fmt.Errorf("loading public key for id %q from KeyStore: %w", id, err)
 	}
 	pubAny, err := x509.ParsePKIXPublicKey(pubRaw)
 	if err != nil {
-		return fmt.Errorf("parsing public key: %w", err)
+		return nil, fmt.Errorf("parsing public key: %w", err)
 	}
 	pub, ok := pubAny.(*ecdsa.PublicKey)
 	if !ok {
-		return fmt.Errorf("parsed key is %T, expected *ecdsa.PublicKey", pubAny)
+		return nil, fmt.Errorf("parsed key is %T, expected *ecdsa.PublicKey", pubAny)
 	}
-	k.public = pub
-	return nil
+	return pub, nil
 }
 
-func (k *hardwareAttestationKey) Public() crypto.PublicKey { return k.public }
+func (k *hardwareAttestationKey) Public() crypto.PublicKey {
+	_, pub := k.st.get()
+	if pub == nil {
+		// Avoid returning a non-nil interface holding a nil pointer.
+		return nil
+	}
+	return pub
+}
 
 func (k *hardwareAttestationKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	if k.id == "" || k.appCtx == nil {
+	id, _ := k.st.get()
+	if id == "" || k.appCtx == nil {
 		return nil, hardwareAttestationKeyNotInitialized
 	}
-	return k.appCtx.HardwareAttestationKeySign(k.id, digest)
+	return callKeyStore(keyStoreSign, func() ([]byte, error) {
+		return k.appCtx.HardwareAttestationKeySign(id, digest)
+	})
 }
 
-func (k *hardwareAttestationKey) MarshalJSON() ([]byte, error) { return json.Marshal(k.id) }
+func (k *hardwareAttestationKey) MarshalJSON() ([]byte, error) {
+	id, _ := k.st.get()
+	return json.Marshal(id)
+}
 
 func (k *hardwareAttestationKey) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, &k.id); err != nil {
+	var id string
+	if err := json.Unmarshal(data, &id); err != nil {
 		return err
 	}
-	if err := k.appCtx.HardwareAttestationKeyLoad(k.id); err != nil {
-		return fmt.Errorf("loading key with ID %q from KeyStore: %w", k.id, err)
+	if k.keys != nil {
+		// The key may have been re-created since the profile was
+		// written.
+		id = k.keys.resolve(id)
 	}
-	return k.fetchPublic()
+	pub, err := loadKeyStoreKey(k.appCtx, id)
+	if err != nil {
+		if k.keys == nil || !hwkeys.IsInvalid(err) {
+			// The KeyStore may be slow or failing, but the key may
+			// still be there.
+			return err
+		}
+		// The key is gone or unusable, which happens after a restore onto a
+		// new device, after the screen lock is removed, or after a KeyStore
+		// wipe. Replace it rather than failing to load the profile.
+		id, pub, err = k.keys.replaceMissing(id, err)
+		if err != nil {
+			return err
+		}
+	}
+	k.st = &hardwareKeyState{id: id, public: pub}
+	k.keys.track(k.st)
+	return nil
+}
+
+// loadKeyStoreKey loads the key with the given id from the Android KeyStore
+// and returns its public key.
+func loadKeyStoreKey(appCtx AppContext, id string) (*ecdsa.PublicKey, error) {
+	if err := callKeyStoreErr(keyStoreLoad, func() error { return appCtx.HardwareAttestationKeyLoad(id) }); err != nil {
+		return nil, fmt.Errorf("loading key with ID %q from KeyStore: %w", id, err)
+	}
+	return keyStorePublic(appCtx, id)
 }
 
 func (k *hardwareAttestationKey) Close() error {
-	if k.id == "" || k.appCtx == nil {
+	id, _ := k.st.get()
+	if id == "" || k.appCtx == nil {
 		return hardwareAttestationKeyNotInitialized
 	}
-	return k.appCtx.HardwareAttestationKeyRelease(k.id)
+	k.keys.untrack(k.st)
+	return callKeyStoreErr(keyStoreRelease, func() error { return k.appCtx.HardwareAttestationKeyRelease(id) })
 }
 
 func (k *hardwareAttestationKey) Clone() key.HardwareAttestationKey {
 	if k == nil {
 		return nil
 	}
-	return &hardwareAttestationKey{appCtx: k.appCtx, id: k.id, public: k.public}
+	return &hardwareAttestationKey{appCtx: k.appCtx, keys: k.keys, st: k.st}
 }
 
 func (k *hardwareAttestationKey) IsZero() bool {
-	return k == nil || k.id == "" || k.public == nil
+	if k == nil {
+		return true
+	}
+	id, pub := k.st.get()
+	return id == "" || pub == nil
+}
+
+// keyAttestation is the Android key attestation of a hardware attestation
+// key, for inclusion in hostinfo or posture reports.
+type keyAttestation struct {
+	KeyID string
+	// SecurityLevel is where the KeyStore says the key lives.
+	SecurityLevel string
+	// Chain is the attestation certificate chain, leaf first.
+	Chain [][]byte
+	// Description is parsed from the attestation extension of the leaf
+	// certificate. It's nil if the extension is missing or malformed.
+	Description *keyattest.KeyDescription `json:",omitempty"`
+	// Error describes why Description could not be parsed.
+	Error string `json:",omitempty"`
+	// NodeKeyBound reports whether the attestation challenge is the
+	// current node key, which binds the key to this node. Keys created
+	// before the node had a key are attested with a random nonce instead.
+	NodeKeyBound bool
+}
+
+// Attestation fetches the KeyStore attestation of k.
+func (k *hardwareAttestationKey) Attestation() (*keyAttestation, error) {
+	id, _ := k.st.get()
+	return keyStoreAttestation(k.appCtx, id)
+}
+
+func keyStoreAttestation(appCtx AppContext, id string) (*keyAttestation, error) {
+	if id == "" || appCtx == nil {
+		return nil, hardwareAttestationKeyNotInitialized
+	}
+	level, err := callKeyStore(keyStoreLevel, func() (string, error) {
+		return appCtx.HardwareAttestationKeySecurityLevel(id)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting security level of key %q: %w", id, err)
+	}
+	chainDER, err := callKeyStore(keyStoreChain, func() ([]byte, error) {
+		return appCtx.HardwareAttestationKeyCertificateChain(id)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting attestation chain of key %q: %w", id, err)
+	}
+	ka := &keyAttestation{KeyID: id, SecurityLevel: level}
+	certs, kd, err := keyattest.ParseChain(chainDER)
+	for _, c := range certs {
+		ka.Chain = append(ka.Chain, c.Raw)
+	}
+	if err != nil {
+		ka.Error = err.Error()
+	}
+	ka.Description = kd
+	return ka, nil
 }
@@ -0,0 +1,197 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/syncs"
+	"tailscale.com/util/clientmetric"
+)
+
+// errKeyStoreTimeout is returned when a KeyStore call does not complete in
+// time, or when a previous call of the same kind is still stuck.
+var errKeyStoreTimeout = errors.New("KeyStore call timed out")
+
+// keyStoreLatencyBuckets are the upper bounds of the KeyStore call latency
+// histogram buckets. As in a Prometheus histogram, the buckets are
+// cumulative: each counts the calls that took at most its bound, and an
+// additional "inf" bucket counts all calls.
+var keyStoreLatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// keyStoreOp is a kind of KeyStore JNI call, along with its metrics.
+type keyStoreOp struct {
+	name    string
+	timeout time.Duration
+
+	calls    *clientmetric.Metric
+	errors   *clientmetric.Metric
+	timeouts *clientmetric.Metric
+	latency  []*clientmetric.Metric // cumulative, one per keyStoreLatencyBuckets, plus inf
+
+	mu sync.Mutex
+	// stuck is set while a call that timed out is still running. The JNI
+	// call can't be cancelled, so rather than piling up goroutines behind
+	// it, calls fail fast until it returns.
+	stuck bool
+}
+
+func (op *keyStoreOp) isStuck() bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.stuck
+}
+
+func newKeyStoreOp(name string, timeout time.Duration) *keyStoreOp {
+	op := &keyStoreOp{
+		name:     name,
+		timeout:  timeout,
+		calls:    clientmetric.NewCounter("android_keystore_" + name + "_calls"),
+		errors:   clientmetric.NewCounter("android_keystore_" + name + "_errors"),
+		timeouts: clientmetric.NewCounter("android_keystore_" + name + "_timeouts"),
+	}
+	for _, b := range keyStoreLatencyBuckets {
+		op.latency = append(op.latency, clientmetric.NewCounter(
+			"android_keystore_"+name+"_latency_le_"+strconv.FormatInt(b.Milliseconds(), 10)+"ms"))
+	}
+	op.latency = append(op.latency, clientmetric.NewCounter("android_keystore_"+name+"_latency_le_inf"))
+	return op
+}
+
+func (op *keyStoreOp) observe(d time.Duration) {
+	for i, b := range keyStoreLatencyBuckets {
+		if d <= b {
+			op.latency[i].Add(1)
+		}
+	}
+	op.latency[len(op.latency)-1].Add(1)
+}
+
+var (
+	keyStoreCreate  = newKeyStoreOp("create", 15*time.Second) // StrongBox key generation is slow
+	keyStoreLoad    = newKeyStoreOp("load", 5*time.Second)
+	keyStorePubKey  = newKeyStoreOp("public", 5*time.Second)
+	keyStoreSign    = newKeyStoreOp("sign", 5*time.Second)
+	keyStoreRelease = newKeyStoreOp("release", 5*time.Second)
+	keyStoreLevel   = newKeyStoreOp("security_level", 5*time.Second)
+	keyStoreChain   = newKeyStoreOp("certificate_chain", 5*time.Second)
+)
+
+// keyStoreHealth is the health tracker used to warn about slow KeyStore
+// calls. It's nil until the backend is created.
+var keyStoreHealth syncs.AtomicValue[*health.Tracker]
+
+var keyStoreTimeoutWarnable = health.Register(&health.Warnable{
+	Code:     "android-keystore-timeout",
+	Title:    "Hardware attestation unavailable",
+	Severity: health.SeverityLow,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("The Android KeyStore did not respond in time, so hardware attestation keys can't sign until it recovers: %s", args[health.ArgError])
+	},
+})
+
+// callKeyStore calls fn, which makes a KeyStore JNI call of kind op, and
+// waits at most op.timeout for it to complete. On timeout, it returns
+// errKeyStoreTimeout and leaves fn running in the background.
+func callKeyStore[T any](op *keyStoreOp, fn func() (T, error)) (T, error) {
+	return callKeyStoreLate(op, fn, nil)
+}
+
+// callKeyStoreLate is like callKeyStore, but if the call times out and then
+// succeeds, late, if non-nil, is called with its result. It's used to clean
+// up what the abandoned call created.
+func callKeyStoreLate[T any](op *keyStoreOp, fn func() (T, error), late func(T)) (T, error) {
+	var zero T
+	op.calls.Add(1)
+	if op.isStuck() {
+		op.timeouts.Add(1)
+		return zero, fmt.Errorf("%s: %w (previous call still running)", op.name, errKeyStoreTimeout)
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	var finished, timedOut bool // protected by op.mu
+	start := time.Now()
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in callKeyStore(%s) %s: %s", op.name, p, debug.Stack())
+				panic(p)
+			}
+		}()
+		v, err := fn()
+		d := time.Since(start)
+		op.observe(d)
+		if err != nil {
+			op.errors.Add(1)
+		}
+		op.mu.Lock()
+		finished = true
+		abandoned := timedOut
+		if timedOut {
+			op.stuck = false
+			log.Printf("KeyStore %s call returned after %v", op.name, d.Round(time.Millisecond))
+		}
+		op.mu.Unlock()
+		done <- result{v, err}
+		if abandoned && err == nil && late != nil {
+			late(v)
+		}
+	}()
+
+	t := time.NewTimer(op.timeout)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		if r.err == nil {
+			if ht := keyStoreHealth.Load(); ht != nil {
+				ht.SetHealthy(keyStoreTimeoutWarnable)
+			}
+		}
+		return r.v, r.err
+	case <-t.C:
+	}
+
+	op.mu.Lock()
+	if finished {
+		// The call completed just as the timer fired.
+		op.mu.Unlock()
+		r := <-done
+		return r.v, r.err
+	}
+	timedOut = true
+	op.stuck = true
+	op.mu.Unlock()
+
+	op.timeouts.Add(1)
+	err := fmt.Errorf("%s: %w after %v", op.name, errKeyStoreTimeout, op.timeout)
+	log.Printf("callKeyStore: %v", err)
+	if ht := keyStoreHealth.Load(); ht != nil {
+		ht.SetUnhealthy(keyStoreTimeoutWarnable, health.Args{health.ArgError: err.Error()})
+	}
+	return zero, err
+}
+
+// callKeyStoreErr is like callKeyStore, for calls that only return an error.
+func callKeyStoreErr(op *keyStoreOp, fn func() error) error {
+	_, err := callKeyStore(op, func() (struct{}, error) { return struct{}{}, fn() })
+	return err
+}
@@ -0,0 +1,380 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/hwkeys"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/syncs"
+	"tailscale.com/types/key"
+)
+
+// hardwareKeyCheckInterval is how often hardware attestation keys are
+// validated after the initial check on start.
+const hardwareKeyCheckInterval = 6 * time.Hour
+
+var hardwareAttestationDegradedWarnable = health.Register(&health.Warnable{
+	Code:     "android-hardware-attestation-degraded",
+	Title:    "Hardware attestation degraded",
+	Severity: health.SeverityLow,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("This device's hardware attestation key failed validation: %s. If the key is gone, a new one is registered with the coordination server the next time Tailscale disconnects or restarts.", args[health.ArgError])
+	},
+})
+
+// hardwareKeys tracks the live hardware attestation keys, validates them
+// periodically, and re-creates keys that no longer work.
+type hardwareKeys struct {
+	appCtx AppContext
+	store  *stateStore
+
+	mu     sync.Mutex
+	states map[*hardwareKeyState]bool
+	health *health.Tracker // nil until the backend is created
+	// lastErr is the most recent validation failure, or nil if the most
+	// recent check passed.
+	lastErr error
+	// reregister, if non-nil, is called after a key was re-created so the
+	// new key gets registered with control. It must not block.
+	reregister func()
+	// pendingReregister is set when a key was re-created before start,
+	// typically while the profiles were loaded, so that start re-registers.
+	pendingReregister bool
+	// nodeKeyFn, if non-nil, returns the current node key. It's called by
+	// refreshNodeKey, never while keys are loaded with the profile, when
+	// LocalBackend may hold the lock that it takes.
+	nodeKeyFn func() key.NodePublic
+	// nodeKey is the node key as of the last refreshNodeKey, with which new
+	// keys are attested. It's zero until then.
+	nodeKey key.NodePublic
+}
+
+// runningHardwareKeys is the started hardwareKeys, for the c2n handler. It's
+// nil until the backend is created, or if hardware attestation is disabled.
+var runningHardwareKeys syncs.AtomicValue[*hardwareKeys]
+
+func init() {
+	ipnlocal.RegisterC2N("GET /android/attestation", handleC2NAttestation)
+}
+
+// handleC2NAttestation serves the KeyStore attestations of the hardware
+// attestation keys in use to control, for posture checks.
+func handleC2NAttestation(_ *ipnlocal.LocalBackend, w http.ResponseWriter, r *http.Request) {
+	hk := runningHardwareKeys.Load()
+	if hk == nil {
+		http.Error(w, "hardware attestation is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, hk.attestations())
+}
+
+// challenge returns the attestation challenge for a new key: the node key,
+// so that control can check that the key was created for this node, or a
+// random nonce if the node key isn't known yet.
+func (hk *hardwareKeys) challenge() []byte {
+	if hk != nil {
+		hk.mu.Lock()
+		nodeKey := hk.nodeKey
+		hk.mu.Unlock()
+		if !nodeKey.IsZero() {
+			raw := nodeKey.Raw32()
+			return raw[:]
+		}
+	}
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	return nonce
+}
+
+// refreshNodeKey updates the node key that new keys are attested with. It
+// must not be called while LocalBackend holds its lock.
+func (hk *hardwareKeys) refreshNodeKey() {
+	if hk == nil {
+		return
+	}
+	hk.mu.Lock()
+	fn := hk.nodeKeyFn
+	hk.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	k := fn()
+	hk.mu.Lock()
+	hk.nodeKey = k
+	hk.mu.Unlock()
+}
+
+func newHardwareKeys(appCtx AppContext, store *stateStore) *hardwareKeys {
+	return &hardwareKeys{
+		appCtx: appCtx,
+		store:  store,
+		states: make(map[*hardwareKeyState]bool),
+	}
+}
+
+// replacedKeysKey is the state store key of the KeyStore keys re-created by
+// hardwareKeys, as hwkeys.Replacements in JSON.
+const replacedKeysKey = "hardware-attestation-key-replacements"
+
+// replacedKeys returns the keys re-created.
+func (hk *hardwareKeys) replacedKeys() hwkeys.Replacements {
+	v, err := hk.store.ReadString(replacedKeysKey, "")
+	if err != nil {
+		log.Printf("hardwareKeys: reading replaced keys: %v", err)
+		return make(hwkeys.Replacements)
+	}
+	r, err := hwkeys.ParseReplacements(v)
+	if err != nil {
+		log.Printf("hardwareKeys: parsing replaced keys: %v", err)
+	}
+	return r
+}
+
+// resolve returns the ID of the key that replaced the key id, or id if it
+// wasn't replaced.
+func (hk *hardwareKeys) resolve(id string) string {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	return hk.replacedKeys().Resolve(id)
+}
+
+// recordReplacement persists that the key oldID was replaced with id.
+func (hk *hardwareKeys) recordReplacement(oldID, id string) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	r := hk.replacedKeys()
+	r.Record(oldID, id)
+	if err := hk.store.WriteString(replacedKeysKey, r.String()); err != nil {
+		log.Printf("hardwareKeys: recording replacement of key %q: %v", oldID, err)
+	}
+}
+
+// requestReregister re-registers with control now if start has run, or
+// once it does.
+func (hk *hardwareKeys) requestReregister() {
+	hk.mu.Lock()
+	reregister := hk.reregister
+	if reregister == nil {
+		hk.pendingReregister = true
+	}
+	hk.mu.Unlock()
+	if reregister != nil {
+		reregister()
+	}
+}
+
+func (hk *hardwareKeys) track(st *hardwareKeyState) {
+	if hk == nil {
+		return
+	}
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	hk.states[st] = true
+}
+
+func (hk *hardwareKeys) untrack(st *hardwareKeyState) {
+	if hk == nil {
+		return
+	}
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	delete(hk.states, st)
+}
+
+// start sets the health tracker used to report degraded attestation, the
+// function returning the node key that new keys are attested with, and the
+// function used to re-register re-created keys, then validates the tracked
+// keys now and every hardwareKeyCheckInterval until ctx is done.
+func (hk *hardwareKeys) start(ctx context.Context, ht *health.Tracker, nodeKey func() key.NodePublic, reregister func()) {
+	keyStoreHealth.Store(ht)
+	runningHardwareKeys.Store(hk)
+	hk.mu.Lock()
+	hk.health = ht
+	hk.nodeKeyFn = nodeKey
+	hk.reregister = reregister
+	pending := hk.pendingReregister
+	hk.pendingReregister = false
+	hk.updateHealthLocked()
+	hk.mu.Unlock()
+	if pending {
+		reregister()
+	}
+
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in hardwareKeys.start %s: %s", p, debug.Stack())
+				panic(p)
+			}
+		}()
+		t := time.NewTicker(hardwareKeyCheckInterval)
+		defer t.Stop()
+		for {
+			hk.refreshNodeKey()
+			hk.checkAll()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// checkAll validates all tracked keys, re-creating those that are definitely
+// unusable.
+func (hk *hardwareKeys) checkAll() {
+	hk.mu.Lock()
+	states := make([]*hardwareKeyState, 0, len(hk.states))
+	for st := range hk.states {
+		states = append(states, st)
+	}
+	hk.mu.Unlock()
+
+	var errs []error
+	for _, st := range states {
+		id, pub := st.get()
+		if id == "" {
+			continue
+		}
+		err := probeKeyStoreKey(hk.appCtx, id, pub)
+		if err == nil {
+			continue
+		}
+		log.Printf("hardwareKeys: key %q failed validation: %v", id, err)
+		if !hwkeys.IsInvalid(err) {
+			// A slow or failing KeyStore doesn't mean the key is
+			// gone; keep it.
+			errs = append(errs, err)
+			continue
+		}
+		if rerr := hk.replace(st, id); rerr != nil {
+			err = fmt.Errorf("%w; re-creating it failed: %v", err, rerr)
+		}
+		errs = append(errs, err)
+	}
+
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+	hk.lastErr = errors.Join(errs...)
+	hk.updateHealthLocked()
+}
+
+// replace swaps the KeyStore key behind st, which was oldID, for a new one,
+// and asks for the new one to be registered with control.
+func (hk *hardwareKeys) replace(st *hardwareKeyState, oldID string) error {
+	id, pub, err := newKeyStoreKey(hk.appCtx, hk.challenge())
+	if err != nil {
+		return err
+	}
+	st.set(id, pub)
+	hk.recordReplacement(oldID, id)
+	hk.release(oldID)
+	log.Printf("hardwareKeys: replaced key %q with %q", oldID, id)
+	hk.requestReregister()
+	return nil
+}
+
+// release releases the KeyStore key id, which was replaced, logging
+// failures.
+func (hk *hardwareKeys) release(id string) {
+	if err := callKeyStoreErr(keyStoreRelease, func() error { return hk.appCtx.HardwareAttestationKeyRelease(id) }); err != nil {
+		log.Printf("hardwareKeys: releasing old key %q: %v", id, err)
+	}
+}
+
+// replaceMissing creates a new key to stand in for oldID, which could not be
+// loaded from the KeyStore because of loadErr. It's used when keys are
+// unmarshaled, before they're tracked.
+func (hk *hardwareKeys) replaceMissing(oldID string, loadErr error) (id string, pub *ecdsa.PublicKey, err error) {
+	log.Printf("hardwareKeys: key %q is unusable (%v); creating a new key", oldID, loadErr)
+	id, pub, err = newKeyStoreKey(hk.appCtx, hk.challenge())
+
+	hk.mu.Lock()
+	if err != nil {
+		hk.lastErr = fmt.Errorf("%w; re-creating it failed: %v", loadErr, err)
+	} else {
+		hk.lastErr = loadErr
+	}
+	hk.updateHealthLocked()
+	hk.mu.Unlock()
+	if err != nil {
+		return "", nil, loadErr
+	}
+
+	hk.recordReplacement(oldID, id)
+	// The old key is unusable, but its alias may still exist.
+	hk.release(oldID)
+	hk.requestReregister()
+	return id, pub, nil
+}
+
+func (hk *hardwareKeys) updateHealthLocked() {
+	if hk.health == nil {
+		return
+	}
+	if hk.lastErr != nil {
+		hk.health.SetUnhealthy(hardwareAttestationDegradedWarnable, health.Args{health.ArgError: hk.lastErr.Error()})
+	} else {
+		hk.health.SetHealthy(hardwareAttestationDegradedWarnable)
+	}
+}
+
+// attestations returns the KeyStore attestation of each tracked key.
+func (hk *hardwareKeys) attestations() []*keyAttestation {
+	hk.mu.Lock()
+	var ids []string
+	for st := range hk.states {
+		if id, _ := st.get(); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	nodeKey := hk.nodeKey
+	hk.mu.Unlock()
+	slices.Sort(ids)
+	var nodeKeyRaw []byte
+	if !nodeKey.IsZero() {
+		raw := nodeKey.Raw32()
+		nodeKeyRaw = raw[:]
+	}
+
+	ret := make([]*keyAttestation, 0, len(ids))
+	for _, id := range ids {
+		ka, err := keyStoreAttestation(hk.appCtx, id)
+		if err != nil {
+			ka = &keyAttestation{KeyID: id, Error: err.Error()}
+		}
+		if ka.Description != nil && nodeKeyRaw != nil {
+			ka.NodeKeyBound = bytes.Equal(ka.Description.AttestationChallenge, nodeKeyRaw)
+		}
+		ret = append(ret, ka)
+	}
+	return ret
+}
+
+// probeKeyStoreKey checks that the KeyStore key id still exists, still has
+// the public key pub, and can produce signatures that verify against it.
+func probeKeyStoreKey(appCtx AppContext, id string, pub *ecdsa.PublicKey) error {
+	return hwkeys.Probe(pub,
+		func() (*ecdsa.PublicKey, error) { return keyStorePublic(appCtx, id) },
+		func(digest []byte) ([]byte, error) {
+			return callKeyStore(keyStoreSign, func() ([]byte, error) {
+				return appCtx.HardwareAttestationKeySign(id, digest)
+			})
+		})
+}
@@ -0,0 +1,272 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/killswitch"
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	"github.com/tailscale/tailscale-android/libtailscale/tunmtu"
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// killSwitchPolicy is the Android-specific policy setting that turns the kill
+// switch on or off. It takes precedence over the user's setting.
+const killSwitchPolicy = pkey.Key(mdmpolicy.KillSwitch)
+
+// killSwitchSourceUser is the source of a kill switch setting made by the
+// user.
+const killSwitchSourceUser policySource = "user"
+
+// killSwitchSetting is the kill switch setting, and where it comes from.
+type killSwitchSetting struct {
+	Enabled bool
+	Source  policySource // policySourceMDM or policySourceOverlay for the policy, "user", or empty
+}
+
+// killSwitch holds the kill switch setting and the blackhole tun device that
+// stands in for the tunnel while the kill switch is engaged.
+type killSwitch struct {
+	a *App
+	*livesetting.Value[killSwitchSetting]
+
+	mu        sync.Mutex
+	blackhole *killswitch.Blackhole
+	engaged   int64 // number of times a blackhole was established
+}
+
+func newKillSwitch(a *App) *killSwitch {
+	k := &killSwitch{a: a}
+	k.Value = newPolicySetting(a, "kill switch", k.resolve, livesetting.Equal)
+	return k
+}
+
+// resolve returns the kill switch setting, from the policy or else the user.
+func (k *killSwitch) resolve() killSwitchSetting {
+	v, src, err := k.a.policyStore.readBoolean(killSwitchPolicy)
+	switch {
+	case err == nil:
+		return killSwitchSetting{Enabled: v, Source: src}
+	case !errors.Is(err, syspolicy.ErrNoSuchKey):
+		log.Printf("kill switch: policy %q: %v", killSwitchPolicy, err)
+		return killSwitchSetting{}
+	}
+	b, err := k.a.store.read(killSwitchPrefKey)
+	if err != nil {
+		log.Printf("kill switch: reading the user's setting: %v", err)
+		return killSwitchSetting{}
+	}
+	if len(b) == 0 {
+		return killSwitchSetting{}
+	}
+	return killSwitchSetting{Enabled: string(b) == "true", Source: killSwitchSourceUser}
+}
+
+// setUser sets the user's setting.
+func (k *killSwitch) setUser(enabled bool) error {
+	if err := k.a.store.write(killSwitchPrefKey, []byte(strconv.FormatBool(enabled))); err != nil {
+		return err
+	}
+	k.Load()
+	return nil
+}
+
+// killSwitchState returns the state deciding whether the kill switch is
+// armed and engaged.
+func (b *backend) killSwitchState() killswitch.State {
+	return killswitch.State{
+		Enabled:        b.ks.Get().Enabled,
+		WantRunning:    b.wantRunning,
+		Connected:      b.lastCfg != nil,
+		ServiceRunning: b.session.service() != nil,
+	}
+}
+
+// enforceKillSwitch establishes a blackhole tun device if the kill switch is
+// engaged, and closes it once it's no longer needed.
+func (b *backend) enforceKillSwitch() {
+	switch b.killSwitchState().Action() {
+	case killswitch.Engage:
+		b.tryEngageBlackhole()
+	case killswitch.Release:
+		b.ksAttempts.Reset()
+		b.ksRetry = nil
+		b.releaseBlackhole()
+	}
+}
+
+// tryEngageBlackhole calls engageBlackhole unless a previous attempt failed
+// and the next one isn't due yet. After a failure, ksRetry receives once the
+// next attempt is due.
+func (b *backend) tryEngageBlackhole() {
+	now := time.Now()
+	if !b.ksAttempts.Due(now) {
+		return
+	}
+	err := b.engageBlackhole()
+	if d := b.ksAttempts.Done(err, now); err != nil {
+		b.logger.Logf("kill switch: attempt %d failed, retrying in %v: %v", b.ksAttempts.Failures(), d.Round(time.Millisecond), err)
+		b.ksRetry = time.After(d)
+	} else {
+		b.ksRetry = nil
+	}
+}
+
+// engageBlackhole replaces any tun device with one that routes all traffic of
+// the apps using the VPN and discards it, unless one is already up.
+func (b *backend) engageBlackhole() error {
+	k := b.ks
+	k.mu.Lock()
+	up := k.blackhole != nil
+	k.mu.Unlock()
+	if up {
+		return nil
+	}
+
+	if b.devices.Down() {
+		b.logger.Logf("kill switch: tunnel brought down")
+	}
+	b.CloseTUNs()
+	b.lastDNSCfg = nil
+
+	builder := b.session.service().NewBuilder()
+	if err := builder.SetMTU(tunmtu.Min); err != nil {
+		return err
+	}
+	applyApps(builder, b.apps.Get(), b.logger.Logf)
+	for _, addr := range killswitch.Addrs {
+		if err := builder.AddAddress(addr.Addr().String(), int32(addr.Bits())); err != nil {
+			return err
+		}
+	}
+	for _, route := range killswitch.Routes {
+		if err := builder.AddRoute(route.Addr().String(), int32(route.Bits())); err != nil {
+			return err
+		}
+	}
+	res, err := establish(builder)
+	if errors.Is(err, errEstablishTimeout) {
+		return fmt.Errorf("establishing blackhole: %w", err)
+	}
+	if err := establishResultErr(res, err); err != nil {
+		return fmt.Errorf("establishing blackhole: %w", err)
+	}
+	parcelFD := res.FileDescriptor()
+	if parcelFD == nil {
+		return errVPNNotPrepared
+	}
+	fd, err := parcelFD.Detach()
+	if err != nil {
+		return fmt.Errorf("detachFd: %w", err)
+	}
+	dev, _, err := tun.CreateUnmonitoredTUNFromFD(int(fd))
+	if err != nil {
+		syscall.Close(int(fd))
+		return err
+	}
+
+	k.mu.Lock()
+	k.blackhole = killswitch.NewBlackhole(dev)
+	k.engaged++
+	k.mu.Unlock()
+	b.logger.Logf("kill switch: engaged, blackholing traffic until the tunnel is up")
+	return nil
+}
+
+// releaseBlackhole closes the blackhole tun device, if any. It's called
+// after the real tun device was established, which takes over from the
+// blackhole without a gap, or when the kill switch is disengaged.
+func (b *backend) releaseBlackhole() {
+	k := b.ks
+	k.mu.Lock()
+	bh := k.blackhole
+	k.blackhole = nil
+	k.mu.Unlock()
+	if bh == nil {
+		return
+	}
+	if err := bh.Close(); err != nil {
+		b.logger.Logf("kill switch: closing blackhole: %v", err)
+	}
+	b.logger.Logf("kill switch: released after dropping %d packets", bh.Dropped())
+}
+
+type killSwitchStatus struct {
+	Enabled bool
+	Source  policySource `json:",omitempty"`
+	// AlwaysOn and Lockdown are the always-on VPN state of the VPN
+	// service, which doesn't arm the kill switch by itself.
+	AlwaysOn bool `json:",omitzero"`
+	Lockdown bool `json:",omitzero"`
+	Engaged  bool
+	Dropped  int64 `json:",omitzero"`
+	// EngagedCount is the number of times a blackhole was established.
+	EngagedCount int64 `json:",omitzero"`
+}
+
+// serveKillSwitch serves the kill switch setting:
+//
+//   - GET returns the setting and whether a blackhole is up.
+//   - POST ?enabled=BOOL sets the user's setting. It's rejected if the
+//     KillSwitch policy is set.
+//   - DELETE clears the user's setting.
+func (a *App) serveKillSwitch(w http.ResponseWriter, r *http.Request) {
+	k := a.killSwitch
+	switch r.Method {
+	case http.MethodGet:
+		set := k.Get()
+		k.mu.Lock()
+		st := killSwitchStatus{
+			Enabled:      set.Enabled,
+			Source:       set.Source,
+			Engaged:      k.blackhole != nil,
+			EngagedCount: k.engaged,
+		}
+		if k.blackhole != nil {
+			st.Dropped = int64(k.blackhole.Dropped())
+		}
+		k.mu.Unlock()
+		if s := a.session.service(); s != nil {
+			st.AlwaysOn = s.IsAlwaysOnVPN()
+			st.Lockdown = s.IsLockdownVPN()
+		}
+		writeJSON(w, st)
+	case http.MethodPost, http.MethodDelete:
+		if src := k.Get().Source; src != "" && src != killSwitchSourceUser {
+			http.Error(w, "the kill switch is set by policy", http.StatusForbidden)
+			return
+		}
+		var err error
+		if r.Method == http.MethodPost {
+			enabled, perr := strconv.ParseBool(r.FormValue("enabled"))
+			if perr != nil {
+				http.Error(w, "invalid enabled", http.StatusBadRequest)
+				return
+			}
+			err = k.setUser(enabled)
+		} else {
+			if err = a.store.write(killSwitchPrefKey, nil); err == nil {
+				k.Load()
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package killswitch keeps traffic from leaking onto the underlying network
+// while Tailscale wants to run but has no tunnel, by standing in a
+// "blackhole" tun device that routes everything and forwards nothing.
+package killswitch
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/tunretry"
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+var (
+	// Addrs are the addresses of the blackhole tun device. Android requires
+	// at least one. They're never used as a source, since nothing is
+	// forwarded.
+	Addrs = []netip.Prefix{
+		netip.MustParsePrefix("100.100.100.101/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::101/128"),
+	}
+	// Routes are the catch-all routes of the blackhole tun device.
+	Routes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+)
+
+// State is what decides whether the kill switch is armed and engaged.
+type State struct {
+	// Enabled is whether the kill switch is turned on by policy or by the
+	// user. The always-on VPN setting doesn't arm it: Android keeps the
+	// VPN service running then, but only blocks traffic outside the VPN in
+	// lockdown mode, and users relying on that shouldn't find their
+	// traffic blackholed without opting in.
+	Enabled bool
+	// WantRunning is the WantRunning pref.
+	WantRunning bool
+	// Connected is whether a tun device with a real config is up.
+	Connected bool
+	// ServiceRunning is whether the VPN service is running, without which
+	// no tun device can be established.
+	ServiceRunning bool
+}
+
+// Armed reports whether the kill switch replaces a missing tunnel with a
+// blackhole, rather than letting traffic go to the underlying network. When
+// it's armed, failures to bring up the tunnel must not turn WantRunning off,
+// since that would disarm it.
+func (s State) Armed() bool {
+	return s.Enabled
+}
+
+// Engaged reports whether a blackhole should be up.
+func (s State) Engaged() bool {
+	return s.Armed() && s.WantRunning && !s.Connected
+}
+
+// An Action is what to do with the blackhole, as returned by State.Action.
+type Action int
+
+const (
+	// Keep leaves the blackhole as it is. The tunnel is up, and takes
+	// over from any blackhole once it's established.
+	Keep Action = iota
+	// Engage brings up a blackhole, unless one is already up.
+	Engage
+	// Release closes the blackhole, if any, and forgets past failures to
+	// bring one up.
+	Release
+)
+
+func (a Action) String() string {
+	switch a {
+	case Keep:
+		return "keep"
+	case Engage:
+		return "engage"
+	case Release:
+		return "release"
+	}
+	return "unknown"
+}
+
+// Action returns what to do with the blackhole in state s.
+func (s State) Action() Action {
+	switch {
+	case !s.ServiceRunning:
+		return Release
+	case s.Engaged():
+		return Engage
+	case !s.Connected:
+		return Release
+	}
+	return Keep
+}
+
+// Attempts paces the attempts to engage the blackhole, which fail the same
+// way as establishing the tunnel does, with the backoff of tunretry.
+type Attempts struct {
+	backoff tunretry.Backoff
+	next    time.Time // when the next attempt is due after a failure
+}
+
+// Due reports whether an attempt may be made at now.
+func (a *Attempts) Due(now time.Time) bool {
+	return a.backoff.Failures() == 0 || !now.Before(a.next)
+}
+
+// Done records the result of an attempt made at now. After a failure, it
+// returns the delay until the next attempt is due.
+func (a *Attempts) Done(err error, now time.Time) time.Duration {
+	if err == nil {
+		a.Reset()
+		return 0
+	}
+	d := a.backoff.Fail(err)
+	a.next = now.Add(d)
+	return d
+}
+
+// Reset forgets the failed attempts, so that the next one is due
+// immediately.
+func (a *Attempts) Reset() {
+	a.backoff.Reset()
+	a.next = time.Time{}
+}
+
+// Failures returns the number of consecutive failed attempts.
+func (a *Attempts) Failures() int {
+	return a.backoff.Failures()
+}
+
+// readErrorBackoff is how long a Blackhole waits after a failed read.
+const readErrorBackoff = 10 * time.Millisecond
+
+// Blackhole reads and discards the packets of a tun device.
+type Blackhole struct {
+	dev     tun.Device
+	dropped atomic.Uint64
+
+	closing   atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+// NewBlackhole starts discarding the packets of dev. The Blackhole owns dev
+// from then on.
+func NewBlackhole(dev tun.Device) *Blackhole {
+	b := &Blackhole{
+		dev:  dev,
+		done: make(chan struct{}),
+	}
+	go b.drain()
+	return b
+}
+
+func (b *Blackhole) drain() {
+	defer close(b.done)
+	n := b.dev.BatchSize()
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, 65535)
+	}
+	sizes := make([]int, n)
+	for {
+		count, err := b.dev.Read(bufs, sizes, 0)
+		b.dropped.Add(uint64(count))
+		if err == nil {
+			continue
+		}
+		if b.closing.Load() || errors.Is(err, os.ErrClosed) {
+			return
+		}
+		// Other errors, like a packet too big for the buffers, only
+		// lose some packets. Back off in case they persist.
+		time.Sleep(readErrorBackoff)
+	}
+}
+
+// Dropped returns the number of packets discarded.
+func (b *Blackhole) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Close closes the tun device and waits for draining to stop.
+func (b *Blackhole) Close() error {
+	b.closeOnce.Do(func() {
+		b.closing.Store(true)
+		b.closeErr = b.dev.Close()
+		<-b.done
+	})
+	return b.closeErr
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package killswitch
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+func TestState(t *testing.T) {
+	tests := []struct {
+		name           string
+		s              State
+		armed, engaged bool
+	}{
+		{name: "off", s: State{WantRunning: true}},
+		{name: "enabled", s: State{Enabled: true, WantRunning: true}, armed: true, engaged: true},
+		{name: "connected", s: State{Enabled: true, WantRunning: true, Connected: true}, armed: true},
+		{name: "stopped", s: State{Enabled: true}, armed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.Armed(); got != tt.armed {
+				t.Errorf("Armed = %v, want %v", got, tt.armed)
+			}
+			if got := tt.s.Engaged(); got != tt.engaged {
+				t.Errorf("Engaged = %v, want %v", got, tt.engaged)
+			}
+		})
+	}
+}
+
+func TestAction(t *testing.T) {
+	tests := []struct {
+		name string
+		s    State
+		want Action
+	}{
+		{name: "engaged", s: State{Enabled: true, WantRunning: true, ServiceRunning: true}, want: Engage},
+		{name: "connected", s: State{Enabled: true, WantRunning: true, Connected: true, ServiceRunning: true}, want: Keep},
+		{name: "no_service", s: State{Enabled: true, WantRunning: true}, want: Release},
+		{name: "stopped", s: State{Enabled: true, ServiceRunning: true}, want: Release},
+		{name: "disabled", s: State{WantRunning: true, ServiceRunning: true}, want: Release},
+		{name: "disabled_connected", s: State{WantRunning: true, Connected: true, ServiceRunning: true}, want: Keep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.Action(); got != tt.want {
+				t.Errorf("Action = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	var a Attempts
+	now := time.Unix(1000, 0)
+	if !a.Due(now) {
+		t.Fatal("first attempt not due")
+	}
+	errFail := errors.New("establish failed")
+	d := a.Done(errFail, now)
+	if d <= 0 {
+		t.Fatalf("delay after failure = %v, want > 0", d)
+	}
+	if a.Due(now) || a.Due(now.Add(d-time.Millisecond)) {
+		t.Error("attempt due before the delay elapsed")
+	}
+	if !a.Due(now.Add(d)) {
+		t.Error("attempt not due after the delay")
+	}
+	// Delays grow with consecutive failures.
+	var last time.Duration
+	for range 10 {
+		last = a.Done(errFail, now)
+	}
+	if last <= d || a.Failures() != 11 {
+		t.Errorf("after 11 failures, delay = %v (first %v), failures = %d", last, d, a.Failures())
+	}
+	if a.Done(nil, now) != 0 || !a.Due(now) || a.Failures() != 0 {
+		t.Error("success didn't reset the attempts")
+	}
+}
+
+// fakeTUN is a tun.Device whose reads return packets sent on in, or errors
+// sent on errs.
+type fakeTUN struct {
+	in   chan []byte
+	errs chan error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeTUN() *fakeTUN {
+	return &fakeTUN{
+		in:     make(chan []byte),
+		errs:   make(chan error),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeTUN) File() *os.File { return nil }
+
+func (f *fakeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case p := <-f.in:
+		sizes[0] = copy(bufs[0][offset:], p)
+		return 1, nil
+	case err := <-f.errs:
+		return 0, err
+	case <-f.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (f *fakeTUN) Write(bufs [][]byte, offset int) (int, error) {
+	return 0, errors.New("unexpected write")
+}
+
+func (f *fakeTUN) MTU() (int, error)        { return 1280, nil }
+func (f *fakeTUN) Name() (string, error)    { return "fake", nil }
+func (f *fakeTUN) Events() <-chan tun.Event { return nil }
+func (f *fakeTUN) BatchSize() int           { return 1 }
+
+func (f *fakeTUN) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func TestBlackhole(t *testing.T) {
+	dev := newFakeTUN()
+	b := NewBlackhole(dev)
+	for range 3 {
+		dev.in <- []byte{0x45, 0, 0, 20}
+	}
+	// A read error doesn't stop draining.
+	dev.errs <- errors.New("packet too big")
+	dev.in <- []byte{0x60}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Dropped() != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Dropped = %d, want 4", b.Dropped())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dev.in <- nil:
+		t.Error("still draining after Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package livesetting holds settings resolved from policy settings and the
+// user's, which are resolved again whenever either changes.
+package livesetting
+
+import (
+	"log"
+	"sync"
+)
+
+// Value is a setting of type T. It's resolved by a func given to New, and
+// again by each call to Load, which is usually registered as a callback for
+// changes of the policy settings.
+type Value[T any] struct {
+	name    string
+	resolve func() T
+	equal   func(a, b T) bool
+	changed chan struct{}
+
+	mu sync.Mutex
+	v  T
+}
+
+// New returns a Value resolved by resolve. Load compares the values it
+// resolves with equal to tell whether the setting changed. The name
+// prefixes the logged changes.
+func New[T any](name string, resolve func() T, equal func(a, b T) bool) *Value[T] {
+	return &Value[T]{
+		name:    name,
+		resolve: resolve,
+		equal:   equal,
+		changed: make(chan struct{}, 1),
+		v:       resolve(),
+	}
+}
+
+// Equal reports whether a and b are equal, for the settings of a comparable
+// type.
+func Equal[T comparable](a, b T) bool {
+	return a == b
+}
+
+// Load resolves the setting again, and reports whether it changed. If it did,
+// Changed receives a value.
+func (v *Value[T]) Load() bool {
+	nv := v.resolve()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.equal(nv, v.v) {
+		return false
+	}
+	log.Printf("%s: %+v", v.name, nv)
+	v.v = nv
+	v.Notify()
+	return true
+}
+
+// Get returns the setting.
+func (v *Value[T]) Get() T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Changed returns a channel that receives a value after the setting changed,
+// or Notify was called. Changes made before it's read are merged into one.
+func (v *Value[T]) Changed() <-chan struct{} {
+	return v.changed
+}
+
+// Notify makes Changed receive a value, for changes of what depends on the
+// setting.
+func (v *Value[T]) Notify() {
+	select {
+	case v.changed <- struct{}{}:
+	default:
+	}
+}
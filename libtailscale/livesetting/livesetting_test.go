@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package livesetting
+
+import (
+	"slices"
+	"testing"
+)
+
+// changed reports whether v.Changed has a value, consuming it.
+func changed[T any](v *Value[T]) bool {
+	select {
+	case <-v.Changed():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestValue(t *testing.T) {
+	next := 1
+	v := New("test", func() int { return next }, Equal[int])
+	if got := v.Get(); got != 1 {
+		t.Errorf("Get = %d, want 1", got)
+	}
+	if changed(v) {
+		t.Error("Changed after New")
+	}
+
+	if v.Load() || changed(v) {
+		t.Error("Load reported a change of an unchanged setting")
+	}
+
+	next = 2
+	if !v.Load() {
+		t.Error("Load reported no change")
+	}
+	next = 3
+	v.Load()
+	if got := v.Get(); got != 3 {
+		t.Errorf("Get = %d, want 3", got)
+	}
+	// Both changes are merged into one.
+	if !changed(v) || changed(v) {
+		t.Error("want one value from Changed")
+	}
+
+	v.Notify()
+	if !changed(v) {
+		t.Error("Notify didn't make Changed receive")
+	}
+}
+
+func TestValueEqual(t *testing.T) {
+	next := []string{"a"}
+	v := New("test", func() []string { return slices.Clone(next) }, slices.Equal[[]string])
+	if v.Load() {
+		t.Error("Load reported a change of an equal slice")
+	}
+	next = append(next, "b")
+	if !v.Load() || !slices.Equal(v.Get(), next) {
+		t.Errorf("Load didn't pick up %q, got %q", next, v.Get())
+	}
+}
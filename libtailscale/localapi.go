@@ -111,6 +111,10 @@ func (app *App) NotifyPolicyChanged() {
 	app.policyStore.notifyChanged()
 }
 
+func (app *App) NotifySplitTunnelChanged() {
+	app.splitTunnel.Load()
+}
+
 func (app *App) SetClientLoggingEnabled(enabled bool) {
 	if lg := app.logger.Load(); lg != nil {
 		lg.SetEnabled(enabled)
@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package mdmpolicy reads the Android policy settings, set by an MDM through
+// the RestrictionsManager or by a local overlay file, and validates and
+// reports them.
+package mdmpolicy
+
+import "errors"
+
+// ErrNotConfigured is returned when a policy setting has no value.
+var ErrNotConfigured = errors.New("policy setting not configured")
+
+// Origin identifies where a policy value was read from.
+type Origin string
+
+const (
+	OriginMDM     Origin = "mdm"     // Android RestrictionsManager
+	OriginOverlay Origin = "overlay" // see Overlay
+)
+
+// Source is a source of policy values, such as the Android
+// RestrictionsManager. Its methods return ErrNotConfigured for settings it
+// has no value for.
+type Source interface {
+	ReadString(key string) (string, error)
+	ReadBoolean(key string) (bool, error)
+	ReadStringArray(key string) ([]string, error)
+}
+
+// Layered reads policy values from Overlay, falling back to Base for the
+// settings that the overlay doesn't mention. A nil Overlay mentions none.
+type Layered struct {
+	Overlay *Overlay
+	Base    Source
+}
+
+// ReadString returns the string value of key and where it was read from.
+func (l Layered) ReadString(key string) (string, Origin, error) {
+	if v, ok, err := l.Overlay.ReadString(key); ok {
+		return v, OriginOverlay, err
+	}
+	v, err := l.Base.ReadString(key)
+	return v, OriginMDM, err
+}
+
+// ReadBoolean returns the boolean value of key and where it was read from.
+func (l Layered) ReadBoolean(key string) (bool, Origin, error) {
+	if v, ok, err := l.Overlay.ReadBoolean(key); ok {
+		return v, OriginOverlay, err
+	}
+	v, err := l.Base.ReadBoolean(key)
+	return v, OriginMDM, err
+}
+
+// ReadStringArray returns the string list value of key and where it was
+// read from.
+func (l Layered) ReadStringArray(key string) ([]string, Origin, error) {
+	if v, ok, err := l.Overlay.ReadStringArray(key); ok {
+		return v, OriginOverlay, err
+	}
+	v, err := l.Base.ReadStringArray(key)
+	return v, OriginMDM, err
+}
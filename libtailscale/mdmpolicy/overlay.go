@@ -0,0 +1,199 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mdmpolicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Overlay holds the policy values most recently loaded from a JSON file,
+// which are layered over the ones set via the Android RestrictionsManager. It
+// lets us reproduce MDM configurations locally without enrolling the device
+// in an EMM.
+//
+// The file contains a single JSON object mapping policy keys to values:
+//
+//	{
+//	  "ExitNodeID": "auto:any",
+//	  "ForceEnabled": true,
+//	  "ExcludedPackageNames": null
+//	}
+//
+// Precedence, per key:
+//   - a key absent from the file falls through to the RestrictionsManager value;
+//   - a key with a non-null value overrides the RestrictionsManager value;
+//   - a key with a null value is reported as not configured, even if the
+//     RestrictionsManager has a value for it.
+//
+// A nil *Overlay is valid and has no values.
+type Overlay struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time                  // of the last loaded file; zero if missing
+	size    int64                      // of the last loaded file
+	values  map[string]json.RawMessage // nil if the file is missing or invalid
+}
+
+// NewOverlay returns an Overlay for the file at path. It has no values until
+// Reload is called.
+func NewOverlay(path string) *Overlay {
+	return &Overlay{path: path}
+}
+
+// Reload re-reads the overlay file if it has changed since the last call,
+// and reports whether the effective overlay values may have changed.
+func (o *Overlay) Reload() (changed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fi, err := os.Stat(o.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("policyOverlay: stat %s: %v", o.path, err)
+		}
+		changed = o.values != nil || !o.modTime.IsZero()
+		o.values, o.modTime, o.size = nil, time.Time{}, 0
+		return changed
+	}
+	if fi.ModTime().Equal(o.modTime) && fi.Size() == o.size {
+		return false
+	}
+	o.modTime, o.size = fi.ModTime(), fi.Size()
+
+	data, err := os.ReadFile(o.path)
+	if err != nil {
+		log.Printf("policyOverlay: read %s: %v", o.path, err)
+		o.values = nil
+		return true
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		log.Printf("policyOverlay: parse %s: %v; ignoring overlay", o.path, err)
+		o.values = nil
+		return true
+	}
+	log.Printf("policyOverlay: loaded %d policy values from %s", len(values), o.path)
+	o.values = values
+	return true
+}
+
+// Watch polls the overlay file every interval until ctx is done, calling
+// onChange whenever its contents change.
+func (o *Overlay) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in policyOverlay.watch %s: %s", p, debug.Stack())
+			panic(p)
+		}
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if o.Reload() {
+			onChange()
+		}
+	}
+}
+
+// lookup returns the raw overlay value for key. It reports false if the
+// overlay doesn't mention key, in which case the caller should fall back to
+// the RestrictionsManager value. A JSON null is returned as a nil value.
+func (o *Overlay) lookup(key string) (raw json.RawMessage, ok bool) {
+	if o == nil {
+		return nil, false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	raw, ok = o.values[key]
+	if ok && bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		raw = nil
+	}
+	return raw, ok
+}
+
+// ReadString returns the overlay value of key as a string. It reports false
+// if the overlay doesn't mention key, and returns ErrNotConfigured if it's
+// null.
+func (o *Overlay) ReadString(key string) (_ string, ok bool, _ error) {
+	raw, ok := o.lookup(key)
+	if !ok {
+		return "", false, nil
+	}
+	if raw == nil {
+		return "", true, ErrNotConfigured
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true, nil
+	}
+	// Allow numbers and booleans to be written without quotes,
+	// mirroring how RestrictionsManager values are stringified.
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", true, err
+	}
+	switch v := v.(type) {
+	case bool, float64:
+		return string(bytes.TrimSpace(raw)), true, nil
+	default:
+		return "", true, fmt.Errorf("policy overlay: %s: expected a string, got %T", key, v)
+	}
+}
+
+// ReadBoolean is like ReadString, for boolean values. Strings accepted by
+// strconv.ParseBool are allowed too.
+func (o *Overlay) ReadBoolean(key string) (_ bool, ok bool, _ error) {
+	raw, ok := o.lookup(key)
+	if !ok {
+		return false, false, nil
+	}
+	if raw == nil {
+		return false, true, ErrNotConfigured
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, true, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, true, fmt.Errorf("policy overlay: %s: expected a boolean", key)
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, true, fmt.Errorf("policy overlay: %s: %w", key, err)
+	}
+	return b, true, nil
+}
+
+// ReadStringArray is like ReadString, for string list values.
+func (o *Overlay) ReadStringArray(key string) (_ []string, ok bool, _ error) {
+	raw, ok := o.lookup(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if raw == nil {
+		return nil, true, ErrNotConfigured
+	}
+	var arr []string
+	if err := json.Unmarshal(raw, &arr); err != nil {
+		return nil, true, fmt.Errorf("policy overlay: %s: expected an array of strings: %w", key, err)
+	}
+	return arr, true, nil
+}
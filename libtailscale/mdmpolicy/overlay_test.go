@@ -0,0 +1,221 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mdmpolicy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSource is a Source with fixed values. Keys it doesn't have aren't
+// configured.
+type fakeSource map[string]any
+
+func (f fakeSource) read(key string) (any, error) {
+	v, ok := f[key]
+	if !ok {
+		return nil, ErrNotConfigured
+	}
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (f fakeSource) ReadString(key string) (string, error) {
+	v, err := f.read(key)
+	s, _ := v.(string)
+	return s, err
+}
+
+func (f fakeSource) ReadBoolean(key string) (bool, error) {
+	v, err := f.read(key)
+	b, _ := v.(bool)
+	return b, err
+}
+
+func (f fakeSource) ReadStringArray(key string) ([]string, error) {
+	v, err := f.read(key)
+	l, _ := v.([]string)
+	return l, err
+}
+
+func writeOverlay(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayeredPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	writeOverlay(t, path, `{
+		"ExitNodeID": "auto:any",
+		"ForceEnabled": "true",
+		"ExcludedPackageNames": null,
+		"Hidden": null,
+		"Number": 1280
+	}`)
+	o := NewOverlay(path)
+	if !o.Reload() {
+		t.Fatal("Reload = false on first load")
+	}
+	l := Layered{Overlay: o, Base: fakeSource{
+		"ExitNodeID":           "mdm-node",
+		"LoginURL":             "https://login.example.com",
+		"ForceEnabled":         false,
+		"ExcludedPackageNames": "com.example",
+	}}
+
+	tests := []struct {
+		key     string
+		read    func(string) (any, Origin, error)
+		want    any
+		origin  Origin
+		wantErr error
+	}{
+		// The overlay overrides the MDM value.
+		{"ExitNodeID", readString(l), "auto:any", OriginOverlay, nil},
+		{"ForceEnabled", readBoolean(l), true, OriginOverlay, nil},
+		// Keys the overlay doesn't mention fall through.
+		{"LoginURL", readString(l), "https://login.example.com", OriginMDM, nil},
+		{"Unset", readString(l), "", OriginMDM, ErrNotConfigured},
+		// A null hides the MDM value.
+		{"ExcludedPackageNames", readString(l), "", OriginOverlay, ErrNotConfigured},
+		{"Hidden", readStringArray(l), []string(nil), OriginOverlay, ErrNotConfigured},
+		// Numbers are read as strings, as RestrictionsManager returns them.
+		{"Number", readString(l), "1280", OriginOverlay, nil},
+	}
+	for _, tt := range tests {
+		v, origin, err := tt.read(tt.key)
+		if !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+			t.Errorf("%s: err = %v, want %v", tt.key, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(v, tt.want) || origin != tt.origin {
+			t.Errorf("%s = %#v from %q, want %#v from %q", tt.key, v, origin, tt.want, tt.origin)
+		}
+	}
+}
+
+func readString(l Layered) func(string) (any, Origin, error) {
+	return func(k string) (any, Origin, error) { return l.ReadString(k) }
+}
+
+func readBoolean(l Layered) func(string) (any, Origin, error) {
+	return func(k string) (any, Origin, error) { return l.ReadBoolean(k) }
+}
+
+func readStringArray(l Layered) func(string) (any, Origin, error) {
+	return func(k string) (any, Origin, error) { return l.ReadStringArray(k) }
+}
+
+func TestOverlayTypeErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	writeOverlay(t, path, `{"List": "not a list", "Bool": "maybe", "String": {"a": 1}}`)
+	o := NewOverlay(path)
+	o.Reload()
+	if _, ok, err := o.ReadStringArray("List"); !ok || err == nil {
+		t.Errorf("ReadStringArray(List) = %v, %v; want an error", ok, err)
+	}
+	if _, ok, err := o.ReadBoolean("Bool"); !ok || err == nil {
+		t.Errorf("ReadBoolean(Bool) = %v, %v; want an error", ok, err)
+	}
+	if _, ok, err := o.ReadString("String"); !ok || err == nil {
+		t.Errorf("ReadString(String) = %v, %v; want an error", ok, err)
+	}
+}
+
+func TestNilOverlay(t *testing.T) {
+	var o *Overlay
+	if _, ok, _ := o.ReadString("ExitNodeID"); ok {
+		t.Error("nil overlay has a value")
+	}
+	l := Layered{Base: fakeSource{"ExitNodeID": "node"}}
+	if v, origin, err := l.ReadString("ExitNodeID"); v != "node" || origin != OriginMDM || err != nil {
+		t.Errorf("ReadString = %q, %q, %v", v, origin, err)
+	}
+}
+
+func TestOverlayReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	o := NewOverlay(path)
+	if o.Reload() {
+		t.Error("Reload = true without a file")
+	}
+
+	writeOverlay(t, path, `{"ExitNodeID": "a"}`)
+	if !o.Reload() {
+		t.Error("Reload = false after the file was created")
+	}
+	if o.Reload() {
+		t.Error("Reload = true without a change")
+	}
+
+	writeOverlay(t, path, `{"ExitNodeID": "abc"}`)
+	if !o.Reload() {
+		t.Error("Reload = false after the file changed")
+	}
+	if v, _, _ := o.ReadString("ExitNodeID"); v != "abc" {
+		t.Errorf("ExitNodeID = %q after reload, want abc", v)
+	}
+
+	writeOverlay(t, path, `{not json`)
+	if !o.Reload() {
+		t.Error("Reload = false after the file became invalid")
+	}
+	if _, ok, _ := o.ReadString("ExitNodeID"); ok {
+		t.Error("invalid overlay still has values")
+	}
+
+	writeOverlay(t, path, `{"ExitNodeID": "b"}`)
+	o.Reload()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !o.Reload() {
+		t.Error("Reload = false after the file was removed")
+	}
+	if _, ok, _ := o.ReadString("ExitNodeID"); ok {
+		t.Error("removed overlay still has values")
+	}
+}
+
+func TestOverlayWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	o := NewOverlay(path)
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Watch(ctx, time.Millisecond, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	writeOverlay(t, path, `{"ExitNodeID": "a"}`)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onChange not called after the file was created")
+	}
+	if v, _, _ := o.ReadString("ExitNodeID"); v != "a" {
+		t.Errorf("ExitNodeID = %q, want a", v)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't return after ctx was canceled")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mdmpolicy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedKeys are policy settings whose values must not be included in the
+// effective-policy report.
+var redactedKeys = []string{
+	AuthKey,
+}
+
+// Status is the result of the most recent read of a policy setting.
+type Status struct {
+	Source Origin `json:",omitempty"`
+	// Configured is whether the source had a value for the key, valid or
+	// not.
+	Configured bool
+	Value      any      `json:",omitempty"`
+	Errors     []string `json:",omitempty"` // parse and validation errors
+	ReadAt     time.Time
+}
+
+// Store reads policy settings from an overlay and a Source, validates them,
+// and records the result of the most recent read of each, for the
+// effective-policy report. Its methods return ErrNotConfigured for settings
+// without a value.
+type Store struct {
+	// Overlay, if non-nil, holds values that take precedence over Base.
+	// It must be set before the Store is used.
+	Overlay *Overlay
+	Base    Source
+	// TypeOf returns the type of the setting key, if it's not one of
+	// Android.
+	TypeOf func(key string) (Type, bool)
+	// Logf logs invalid values when they change. It's log.Printf if nil.
+	Logf func(format string, args ...any)
+
+	now func() time.Time // for tests; time.Now if nil
+
+	mu     sync.Mutex
+	status map[string]Status
+}
+
+func (s *Store) layered() Layered {
+	return Layered{Overlay: s.Overlay, Base: s.Base}
+}
+
+// typeOf returns the type of the setting key, or UnknownType.
+func (s *Store) typeOf(key string) Type {
+	if t, ok := androidType(key); ok {
+		return t
+	}
+	if s.TypeOf != nil {
+		if t, ok := s.TypeOf(key); ok {
+			return t
+		}
+	}
+	return UnknownType
+}
+
+// ReadString returns the value of the string setting key and where it was
+// read from.
+func (s *Store) ReadString(key string) (string, Origin, error) {
+	v, origin, err := s.layered().ReadString(key)
+	return v, origin, s.record(key, origin, v, err)
+}
+
+// ReadBoolean returns the value of the boolean setting key and where it was
+// read from.
+func (s *Store) ReadBoolean(key string) (bool, Origin, error) {
+	v, origin, err := s.layered().ReadBoolean(key)
+	return v, origin, s.record(key, origin, v, err)
+}
+
+// ReadStringArray returns the value of the string list setting key and
+// where it was read from.
+func (s *Store) ReadStringArray(key string) ([]string, Origin, error) {
+	v, origin, err := s.layered().ReadStringArray(key)
+	return v, origin, s.record(key, origin, v, err)
+}
+
+// ReadUInt64 returns the value of the integer setting key and where it was
+// read from. The RestrictionsManager stringifies integers, so they're read
+// as strings and parsed.
+func (s *Store) ReadUInt64(key string) (uint64, Origin, error) {
+	str, origin, err := s.layered().ReadString(key)
+	var v uint64
+	if err == nil {
+		if v, err = strconv.ParseUint(strings.TrimSpace(str), 10, 64); err != nil {
+			err = &invalidError{fmt.Errorf("policy %q: %q is not an unsigned integer", key, str), str}
+		}
+	}
+	return v, origin, s.record(key, origin, v, err)
+}
+
+// invalidError is a value that was read but couldn't be parsed.
+type invalidError struct {
+	err error
+	raw any // the value as read
+}
+
+func (e *invalidError) Error() string { return e.err.Error() }
+func (e *invalidError) Unwrap() error { return e.err }
+
+// record validates v, read from origin for key with the error err, records
+// the result, and returns err or the validation error.
+func (s *Store) record(key string, origin Origin, v any, err error) error {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	st := Status{Source: origin, ReadAt: now()}
+	var invalid *invalidError
+	switch {
+	case err == nil:
+		st.Configured = true
+		st.Value = v
+		if verr := Validate(key, s.typeOf(key), v); verr != nil {
+			err = verr
+			st.Errors = []string{verr.Error()}
+		}
+	case errors.Is(err, ErrNotConfigured):
+		if origin != OriginOverlay {
+			// Not configured anywhere; an overlay null is worth reporting.
+			st.Source = ""
+		}
+	case errors.As(err, &invalid):
+		st.Configured = true
+		st.Value = invalid.raw
+		st.Errors = []string{err.Error()}
+	default:
+		// The source had a value, but it couldn't be read or parsed.
+		st.Configured = true
+		st.Errors = []string{err.Error()}
+	}
+	if slices.Contains(redactedKeys, key) && st.Value != nil {
+		st.Value = "<redacted>"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == nil {
+		s.status = make(map[string]Status)
+	}
+	if len(st.Errors) > 0 && !slices.Equal(s.status[key].Errors, st.Errors) {
+		logf := s.Logf
+		if logf == nil {
+			logf = log.Printf
+		}
+		logf("syspolicy: invalid value for policy %q from %s: %v", key, origin, err)
+	}
+	s.status[key] = st
+	return err
+}
+
+// Status returns the result of the most recent read of key.
+func (s *Store) Status(key string) Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status[key]
+}
+
+// ReportEntry is a single setting in the effective-policy report.
+type ReportEntry struct {
+	Key  string
+	Type Type
+	Status
+}
+
+// Report re-reads the settings of defs, and every setting of Android, and
+// returns the resulting value, source and errors of each, along with those of
+// any other setting read so far. The settings of defs come first, in order,
+// then the others sorted by key.
+func (s *Store) Report(defs []Definition) []ReportEntry {
+	all := slices.Clone(defs)
+	for _, d := range Android {
+		if !slices.ContainsFunc(all, func(e Definition) bool { return e.Key == d.Key }) {
+			all = append(all, d)
+		}
+	}
+	for _, d := range all {
+		switch d.Type {
+		case Boolean:
+			s.ReadBoolean(d.Key)
+		case Integer:
+			s.ReadUInt64(d.Key)
+		case StringList:
+			s.ReadStringArray(d.Key)
+		default:
+			s.ReadString(d.Key)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := make([]ReportEntry, 0, len(s.status))
+	for _, d := range all {
+		report = append(report, ReportEntry{Key: d.Key, Type: d.Type, Status: s.status[d.Key]})
+	}
+	var others []string
+	for key := range s.status {
+		if !slices.ContainsFunc(all, func(d Definition) bool { return d.Key == key }) {
+			others = append(others, key)
+		}
+	}
+	slices.Sort(others)
+	for _, key := range others {
+		report = append(report, ReportEntry{Key: key, Type: s.typeOf(key), Status: s.status[key]})
+	}
+	return report
+}
+
+// CheckExitNode adds an error to the ExitNodeID entry of report if it names a
+// node for which isPeer reports false. The caller passes a nil isPeer when
+// there's no netmap to check against.
+func CheckExitNode(report []ReportEntry, isPeer func(id string) bool) {
+	i := slices.IndexFunc(report, func(e ReportEntry) bool { return e.Key == ExitNodeID })
+	if i < 0 || isPeer == nil {
+		return
+	}
+	id, _ := report[i].Value.(string)
+	if id == "" || strings.HasPrefix(id, "auto:") || len(report[i].Errors) > 0 {
+		return
+	}
+	if !isPeer(id) {
+		report[i].Errors = append(report[i].Errors, fmt.Sprintf("no peer with stable ID %q in the current netmap", id))
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mdmpolicy
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		key   string
+		typ   Type
+		v     any
+		valid bool
+	}{
+		{"ForceEnabled", Boolean, true, true},
+		{"ForceEnabled", Boolean, "true", false},
+		{"KeyExpirationNotice", Integer, uint64(24), true},
+		{"KeyExpirationNotice", Integer, "24", false},
+		{"AllowedSuggestedExitNodes", StringList, []string{"a"}, true},
+		{"AllowedSuggestedExitNodes", StringList, "a", false},
+		{"ExitNodeAllowLANAccess", PreferenceOption, "User-Decides", true},
+		{"ExitNodeAllowLANAccess", PreferenceOption, "sometimes", false},
+		{"AdminConsole", Visibility, "hide", true},
+		{"AdminConsole", Visibility, "hidden", false},
+		{"KeyExpirationNotice", Duration, "24h", true},
+		{"KeyExpirationNotice", Duration, "a day", false},
+
+		{LoginURL, String, "https://login.example.com", true},
+		{LoginURL, String, "login.example.com", false},
+		{ExitNodeID, String, "auto:any", true},
+		{ExitNodeID, String, "nKxPEJ3CNTRL", true},
+		{ExitNodeID, String, "not a node", false},
+		{ExitNodeIP, String, "100.64.0.1", true},
+		{ExitNodeIP, String, "100.64.0", false},
+		// Unknown settings only get their format rules checked.
+		{ExitNodeIP, UnknownType, "100.64.0", false},
+		{"Unknown", UnknownType, 42, true},
+
+		{TunnelMTU, String, "probe:1400", true},
+		{TunnelMTU, String, "20000", false},
+		{HTTPProxy, String, "proxy.example.com:3128", true},
+		{HTTPProxy, String, "proxy.example.com", false},
+		{HTTPProxyPACURL, String, "https://example.com/proxy.pac", true},
+		{HTTPProxyPACURL, String, "proxy.pac", false},
+		{AllowedAddressFamilies, String, "ipv4", true},
+		{AllowedAddressFamilies, String, "ipx", false},
+		{RouteAggregation, String, "overinclude", true},
+		{RouteAggregation, String, "sometimes", false},
+		{KillSwitch, Boolean, "yes", false},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.key, tt.typ, tt.v)
+		if got := err == nil; got != tt.valid {
+			t.Errorf("Validate(%q, %v, %#v) = %v, want valid %v", tt.key, tt.typ, tt.v, err, tt.valid)
+		}
+	}
+}
+
+func newTestStore(base fakeSource, overlay *Overlay) (*Store, *[]string) {
+	var logged []string
+	s := &Store{
+		Overlay: overlay,
+		Base:    base,
+		TypeOf: func(key string) (Type, bool) {
+			switch key {
+			case LoginURL, ExitNodeID, AuthKey:
+				return String, true
+			case "KeyExpirationNotice":
+				return Integer, true
+			}
+			return UnknownType, false
+		},
+		Logf: func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) },
+		now:  func() time.Time { return time.Unix(1000, 0) },
+	}
+	return s, &logged
+}
+
+func TestStoreStatus(t *testing.T) {
+	s, logged := newTestStore(fakeSource{
+		LoginURL:             "login.example.com",
+		ExitNodeID:           "node",
+		AuthKey:              "tskey-secret",
+		TunnelMTU:            "20000",
+		"Broken":             errors.New("JNI failure"),
+		IncludedPackageNames: "com.example",
+	}, nil)
+
+	// A configured but invalid value is still configured.
+	if _, _, err := s.ReadString(LoginURL); err == nil {
+		t.Error("ReadString(LoginURL) succeeded with an invalid URL")
+	}
+	if st := s.Status(LoginURL); !st.Configured || st.Value != "login.example.com" || len(st.Errors) != 1 || st.Source != OriginMDM {
+		t.Errorf("LoginURL status = %+v", st)
+	}
+	if len(*logged) != 1 {
+		t.Errorf("logged %q, want one line", *logged)
+	}
+	// Reading the same invalid value again doesn't log again.
+	s.ReadString(LoginURL)
+	if len(*logged) != 1 {
+		t.Errorf("logged %q after a second read, want one line", *logged)
+	}
+
+	if _, _, err := s.ReadString(TunnelMTU); err == nil {
+		t.Error("ReadString(TunnelMTU) succeeded with an invalid MTU")
+	}
+	if v, origin, err := s.ReadString(ExitNodeID); v != "node" || origin != OriginMDM || err != nil {
+		t.Errorf("ReadString(ExitNodeID) = %q, %q, %v", v, origin, err)
+	}
+	if _, _, err := s.ReadString("Unset"); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("ReadString(Unset) = %v, want ErrNotConfigured", err)
+	}
+	if st := s.Status("Unset"); st.Configured || st.Source != "" {
+		t.Errorf("Unset status = %+v", st)
+	}
+	if _, _, err := s.ReadString("Broken"); err == nil {
+		t.Error("ReadString(Broken) succeeded")
+	}
+	if st := s.Status("Broken"); !st.Configured || len(st.Errors) != 1 {
+		t.Errorf("Broken status = %+v", st)
+	}
+	s.ReadString(AuthKey)
+	if st := s.Status(AuthKey); st.Value != "<redacted>" {
+		t.Errorf("AuthKey value = %v, want redacted", st.Value)
+	}
+}
+
+func TestStoreReadUInt64(t *testing.T) {
+	s, _ := newTestStore(fakeSource{
+		"KeyExpirationNotice": "24",
+		"Bad":                 "-1",
+	}, nil)
+	if v, _, err := s.ReadUInt64("KeyExpirationNotice"); v != 24 || err != nil {
+		t.Errorf("ReadUInt64 = %v, %v; want 24", v, err)
+	}
+	if st := s.Status("KeyExpirationNotice"); st.Value != uint64(24) || len(st.Errors) > 0 {
+		t.Errorf("status = %+v", st)
+	}
+	if _, _, err := s.ReadUInt64("Bad"); err == nil {
+		t.Error("ReadUInt64(Bad) succeeded")
+	}
+	if st := s.Status("Bad"); !st.Configured || st.Value != "-1" || len(st.Errors) != 1 {
+		t.Errorf("Bad status = %+v", st)
+	}
+}
+
+func TestStoreOverlayNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	writeOverlay(t, path, `{"ExitNodeID": null}`)
+	o := NewOverlay(path)
+	o.Reload()
+	s, _ := newTestStore(fakeSource{ExitNodeID: "node"}, o)
+	if _, _, err := s.ReadString(ExitNodeID); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("ReadString = %v, want ErrNotConfigured", err)
+	}
+	if st := s.Status(ExitNodeID); st.Configured || st.Source != OriginOverlay {
+		t.Errorf("status = %+v, want unconfigured by the overlay", st)
+	}
+}
+
+func TestReport(t *testing.T) {
+	s, _ := newTestStore(fakeSource{
+		LoginURL:              "https://login.example.com",
+		"KeyExpirationNotice": "24",
+		KillSwitch:            "not read as a boolean",
+		IncludedPackageNames:  "com.example",
+	}, nil)
+	s.ReadString("ReadEarlier")
+
+	report := s.Report([]Definition{
+		{LoginURL, String},
+		{"KeyExpirationNotice", Integer},
+	})
+	var keys []string
+	for _, e := range report {
+		keys = append(keys, e.Key)
+	}
+	want := []string{LoginURL, "KeyExpirationNotice"}
+	for _, d := range Android {
+		want = append(want, d.Key)
+	}
+	want = append(want, "ReadEarlier")
+	if !slices.Equal(keys, want) {
+		t.Fatalf("report keys = %q, want %q", keys, want)
+	}
+
+	byKey := func(key string) ReportEntry {
+		return report[slices.IndexFunc(report, func(e ReportEntry) bool { return e.Key == key })]
+	}
+	if e := byKey("KeyExpirationNotice"); e.Type != Integer || e.Value != uint64(24) || len(e.Errors) > 0 {
+		t.Errorf("integer setting = %+v", e)
+	}
+	if e := byKey(IncludedPackageNames); !e.Configured || e.Value != "com.example" || e.Type != String {
+		t.Errorf("Android setting = %+v", e)
+	}
+	if e := byKey(TunnelMTU); e.Configured || e.Type != String {
+		t.Errorf("unconfigured Android setting = %+v", e)
+	}
+}
+
+func TestCheckExitNode(t *testing.T) {
+	report := func(id string) []ReportEntry {
+		return []ReportEntry{{Key: ExitNodeID, Status: Status{Configured: true, Value: id}}}
+	}
+	isPeer := func(id string) bool { return id == "peer" }
+	for _, tt := range []struct {
+		id      string
+		isPeer  func(string) bool
+		wantErr bool
+	}{
+		{"peer", isPeer, false},
+		{"stranger", isPeer, true},
+		{"stranger", nil, false},
+		{"auto:any", isPeer, false},
+	} {
+		r := report(tt.id)
+		CheckExitNode(r, tt.isPeer)
+		if got := len(r[0].Errors) > 0; got != tt.wantErr {
+			t.Errorf("CheckExitNode(%q) errors = %q, want error %v", tt.id, r[0].Errors, tt.wantErr)
+		}
+	}
+}
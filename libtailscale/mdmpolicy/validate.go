@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mdmpolicy
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+	"github.com/tailscale/tailscale-android/libtailscale/tunmtu"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnopts"
+)
+
+// Type is the type of the value of a policy setting.
+type Type int
+
+const (
+	// UnknownType is the type of settings that aren't defined. Only their
+	// key-specific format rules are checked.
+	UnknownType Type = iota
+	Boolean
+	Integer
+	String
+	StringList
+	// PreferenceOption is a string, one of "always", "never" and
+	// "user-decides".
+	PreferenceOption
+	// Visibility is a string, "show" or "hide".
+	Visibility
+	// Duration is a string accepted by time.ParseDuration.
+	Duration
+)
+
+var typeNames = []string{
+	UnknownType:      "unknown",
+	Boolean:          "boolean",
+	Integer:          "integer",
+	String:           "string",
+	StringList:       "string list",
+	PreferenceOption: "preference option",
+	Visibility:       "visibility",
+	Duration:         "duration",
+}
+
+func (t Type) String() string {
+	if t < 0 || int(t) >= len(typeNames) {
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+	return typeNames[t]
+}
+
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Definition is a policy setting and the type of its value.
+type Definition struct {
+	Key  string
+	Type Type
+}
+
+// The upstream policy settings that have format rules beyond their type.
+const (
+	LoginURL   = "LoginURL"
+	ExitNodeID = "ExitNodeID"
+	ExitNodeIP = "ExitNodeIP"
+	AuthKey    = "AuthKey"
+)
+
+// The Android-only policy settings.
+const (
+	// TunnelMTU selects the MTU of the tun device, in the format accepted
+	// by tunmtu.Parse.
+	TunnelMTU = "TunnelMTU"
+	// HTTPProxy is the HTTP proxy of the VPN, as host:port.
+	HTTPProxy = "HTTPProxy"
+	// HTTPProxyExclusions is a comma-separated list of hosts that bypass
+	// HTTPProxy.
+	HTTPProxyExclusions = "HTTPProxyExclusions"
+	// HTTPProxyPACURL is the URL of the proxy auto-config file of the VPN.
+	HTTPProxyPACURL = "HTTPProxyPACURL"
+	// AllowVPNBypass lets apps bypass the VPN.
+	AllowVPNBypass = "AllowVPNBypass"
+	// AllowedAddressFamilies are the address families that bypass the VPN
+	// when it has no routes for them, in the format of
+	// vpnopts.ParseFamilies.
+	AllowedAddressFamilies = "AllowedAddressFamilies"
+	// RouteAggregation selects how routes are aggregated when there are
+	// too many, in the format of rangescalc.ParseAggregation.
+	RouteAggregation = "RouteAggregation"
+	// KillSwitch turns the kill switch on or off.
+	KillSwitch = "KillSwitch"
+	// IncludedPackageNames and ExcludedPackageNames select the apps using
+	// the VPN, as comma-separated lists of package names.
+	IncludedPackageNames = "IncludedPackageNames"
+	ExcludedPackageNames = "ExcludedPackageNames"
+)
+
+// Android are the definitions of the Android-only policy settings, which
+// the upstream syspolicy package doesn't know.
+var Android = []Definition{
+	{TunnelMTU, String},
+	{HTTPProxy, String},
+	{HTTPProxyExclusions, String},
+	{HTTPProxyPACURL, String},
+	{AllowVPNBypass, Boolean},
+	{AllowedAddressFamilies, String},
+	{RouteAggregation, String},
+	{KillSwitch, Boolean},
+	{IncludedPackageNames, String},
+	{ExcludedPackageNames, String},
+}
+
+// androidType returns the type of the Android-only setting key.
+func androidType(key string) (Type, bool) {
+	i := slices.IndexFunc(Android, func(d Definition) bool { return d.Key == key })
+	if i < 0 {
+		return UnknownType, false
+	}
+	return Android[i].Type, true
+}
+
+// Validate checks v, as read for the setting key of type t, against t and
+// any key-specific format rules.
+func Validate(key string, t Type, v any) error {
+	switch t {
+	case Boolean:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("policy %q is a boolean, got %T", key, v)
+		}
+	case Integer:
+		if _, ok := v.(uint64); !ok {
+			return fmt.Errorf("policy %q is an integer, got %T", key, v)
+		}
+	case StringList:
+		if _, ok := v.([]string); !ok {
+			return fmt.Errorf("policy %q is a string list, got %T", key, v)
+		}
+	case String, PreferenceOption, Visibility, Duration:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("policy %q is a string, got %T", key, v)
+		}
+		switch t {
+		case PreferenceOption:
+			if !slices.Contains([]string{"always", "never", "user-decides"}, strings.ToLower(s)) {
+				return fmt.Errorf("policy %q: %q is not one of always, never, user-decides", key, s)
+			}
+		case Visibility:
+			if !slices.Contains([]string{"show", "hide"}, strings.ToLower(s)) {
+				return fmt.Errorf("policy %q: %q is not one of show, hide", key, s)
+			}
+		case Duration:
+			if _, err := time.ParseDuration(s); err != nil {
+				return fmt.Errorf("policy %q: %w", key, err)
+			}
+		}
+	}
+	return validateFormat(key, v)
+}
+
+// validateFormat applies additional checks to settings whose values have a
+// more specific format than their type implies.
+func validateFormat(key string, v any) error {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch key {
+	case LoginURL:
+		var u *url.URL
+		if u, err = url.Parse(s); err == nil && (u.Scheme != "https" && u.Scheme != "http" || u.Host == "") {
+			return fmt.Errorf("policy %q: %q is not an absolute http(s) URL", key, s)
+		}
+	case ExitNodeID:
+		if s == "" || strings.HasPrefix(s, "auto:") {
+			return nil
+		}
+		if strings.IndexFunc(s, func(r rune) bool {
+			return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+		}) >= 0 {
+			return fmt.Errorf("policy %q: %q is not a valid stable node ID or auto: expression", key, s)
+		}
+	case ExitNodeIP:
+		if s != "" {
+			_, err = netip.ParseAddr(s)
+		}
+	case TunnelMTU:
+		_, err = tunmtu.Parse(s)
+	case HTTPProxy:
+		if s != "" {
+			_, _, err = vpnopts.SplitProxy(s)
+		}
+	case HTTPProxyPACURL:
+		if s != "" {
+			err = vpnopts.ValidatePACURL(s)
+		}
+	case AllowedAddressFamilies:
+		_, err = vpnopts.ParseFamilies(s)
+	case RouteAggregation:
+		_, err = rangescalc.ParseAggregation(s)
+	}
+	if err != nil {
+		return fmt.Errorf("policy %q: %w", key, err)
+	}
+	return nil
+}
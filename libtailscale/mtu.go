@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	"github.com/tailscale/tailscale-android/libtailscale/tunmtu"
+	"tailscale.com/control/controlknobs"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// tunnelMTUPolicy is the Android-specific policy setting that selects the MTU
+// of the tun device, in the format accepted by [tunmtu.Parse].
+const tunnelMTUPolicy = pkey.Key(mdmpolicy.TunnelMTU)
+
+const (
+	// mtuProbeTimeout bounds a whole path MTU probe, and mtuPingTimeout
+	// each ping during it.
+	mtuProbeTimeout = 30 * time.Second
+	mtuPingTimeout  = 2 * time.Second
+	// mtuProbePeers is the number of peers whose path MTU is probed.
+	// The tun MTU is the smallest of theirs.
+	mtuProbePeers = 3
+	// discoPingOverhead is the number of bytes a disco ping of a given
+	// size takes on the wire beyond that size, assuming IPv6: the IP and
+	// UDP headers, the disco header and box, and the ping message.
+	discoPingOverhead = 40 + 8 + 78 + 46
+)
+
+// tunMTU selects the MTU of the tun device. It's taken from the TunnelMTU
+// policy, and is either fixed or found by probing the path MTU to peers. It
+// falls back to tunmtu.Min when nothing is configured or probing fails.
+//
+// Probing relies on magicsock setting the don't-fragment bit, without which
+// probes would get through regardless of their size. Magicsock only does so
+// when control enables path MTU discovery for the node, so probing fails
+// otherwise.
+type tunMTU struct {
+	a *App
+	*livesetting.Value[mtuSetting]
+
+	mu sync.Mutex
+	// probedFor is the setting of the last probe. Its results only apply
+	// while the setting stays the same.
+	probedFor tunmtu.Setting
+	probed    int // the last probed MTU, or zero
+	probedAt  time.Time
+	probeErr  error
+	probing   bool
+}
+
+// mtuSetting is the MTU setting, and where it comes from.
+type mtuSetting struct {
+	Setting tunmtu.Setting
+	Source  policySource // policySourceMDM or policySourceOverlay, or empty
+}
+
+func newTunMTU(a *App) *tunMTU {
+	m := &tunMTU{a: a}
+	m.Value = newPolicySetting(a, "tun MTU", m.resolve, livesetting.Equal)
+	return m
+}
+
+// resolve returns the MTU setting from the policy, or the zero setting if
+// it's unset or invalid.
+func (m *tunMTU) resolve() mtuSetting {
+	v, src, err := m.a.policyStore.readString(tunnelMTUPolicy)
+	if errors.Is(err, syspolicy.ErrNoSuchKey) {
+		return mtuSetting{}
+	}
+	if err == nil {
+		var set tunmtu.Setting
+		if set, err = tunmtu.Parse(v); err == nil {
+			return mtuSetting{Setting: set, Source: src}
+		}
+	}
+	log.Printf("tun MTU: policy %q: %v; using default", tunnelMTUPolicy, err)
+	return mtuSetting{}
+}
+
+// current returns the MTU to use for the tun device.
+func (m *tunMTU) current() int {
+	set := m.Get().Setting
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.currentLocked(set)
+}
+
+// currentLocked returns the MTU to use for the tun device with setting set.
+func (m *tunMTU) currentLocked(set tunmtu.Setting) int {
+	switch {
+	case set.Probe && m.probed != 0 && m.probedFor == set:
+		return m.probed
+	case !set.Probe && set.MTU != 0:
+		return set.MTU
+	}
+	return tunmtu.Min
+}
+
+// startProbe starts probing the path MTU to peers in the background, if
+// the setting asks for it and no probe is running. knobs are the control
+// knobs of the backend, which say whether path MTU discovery is enabled.
+func (m *tunMTU) startProbe(lb *ipnlocal.LocalBackend, knobs *controlknobs.Knobs) {
+	set := m.Get().Setting
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !set.Probe || m.probing {
+		return
+	}
+	m.probing = true
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in tunMTU.probe %s: %s", p, debug.Stack())
+				panic(p)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), mtuProbeTimeout)
+		defer cancel()
+		mtu, err := tunmtu.Min, errPMTUDDisabled
+		if knobs != nil && knobs.PeerMTUEnable.Load() {
+			mtu, err = tunmtu.Probe(ctx, set.ProbeMax(), peerPinger(lb))
+		}
+		if err != nil {
+			log.Printf("tun MTU: probe failed, using %d: %v", mtu, err)
+		} else {
+			log.Printf("tun MTU: probed %d", mtu)
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.probing = false
+		old := m.currentLocked(set)
+		m.probedFor, m.probed, m.probedAt, m.probeErr = set, mtu, time.Now(), err
+		if m.Get().Setting == set && m.currentLocked(set) != old {
+			m.Notify()
+		}
+	}()
+}
+
+// errPMTUDDisabled is the probe error when control hasn't enabled path MTU
+// discovery.
+var errPMTUDDisabled = errors.New("path MTU discovery is not enabled for this node")
+
+// peerPinger returns a tunmtu.PingFunc that sends disco pings, padded to the
+// size of the WireGuard packets carrying a full sized tun packet, to up to
+// mtuProbePeers online peers with direct connections.
+func peerPinger(lb *ipnlocal.LocalBackend) tunmtu.PingFunc {
+	return func(ctx context.Context, mtu int) error {
+		var pinged int
+		for _, ps := range lb.Status().Peer {
+			if pinged == mtuProbePeers {
+				break
+			}
+			if !ps.Online || ps.CurAddr == "" || len(ps.TailscaleIPs) == 0 {
+				continue
+			}
+			pinged++
+			size := mtu + tunmtu.WireGuardOverhead - discoPingOverhead
+			pctx, cancel := context.WithTimeout(ctx, mtuPingTimeout)
+			res, err := lb.Ping(pctx, ps.TailscaleIPs[0], tailcfg.PingDisco, size)
+			cancel()
+			if err == nil && res.Err != "" {
+				err = errors.New(res.Err)
+			}
+			if err != nil {
+				return fmt.Errorf("pinging %v with %d bytes: %w", ps.HostName, size, err)
+			}
+		}
+		if pinged == 0 {
+			return errors.New("no online peers with direct connections")
+		}
+		return nil
+	}
+}
+
+type mtuStatus struct {
+	MTU      int
+	Setting  string
+	Source   policySource `json:",omitempty"`
+	Probed   int          `json:",omitzero"`
+	ProbedAt time.Time    `json:",omitzero"`
+	ProbeErr string       `json:",omitempty"`
+	Probing  bool         `json:",omitzero"`
+}
+
+// serveMTU serves the MTU in use, the setting it comes from, and the result
+// of the last probe.
+func (a *App) serveMTU(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	m := a.tunMTU
+	set := m.Get()
+	m.mu.Lock()
+	st := mtuStatus{
+		MTU:     m.currentLocked(set.Setting),
+		Setting: set.Setting.String(),
+		Source:  set.Source,
+		Probing: m.probing,
+	}
+	if m.probedFor == set.Setting {
+		st.Probed, st.ProbedAt = m.probed, m.probedAt
+		if m.probeErr != nil {
+			st.ProbeErr = m.probeErr.Error()
+		}
+	}
+	m.mu.Unlock()
+	writeJSON(w, st)
+}
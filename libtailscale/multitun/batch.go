@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// batchSize is the number of packets exchanged with wireguard-go per Read and
+// Write. Android doesn't allow the TUNSETOFFLOAD ioctl that enables GSO/GRO
+// on the tun device, so instead of reading a single packet per wakeup, we
+// drain up to batchSize packets from the file descriptor before returning.
+//
+// wireguard-go allocates BatchSize buffers of its maximum message size per
+// routine, so this is kept lower than conn.IdealBatchSize to limit memory use.
+const batchSize = 16
+
+// batchIO performs batched reads and writes directly on the file descriptor
+// of a tun.Device that doesn't support batching itself.
+type batchIO struct {
+	f  *os.File
+	rc syscall.RawConn
+}
+
+// newBatchIO returns a batchIO for dev, or nil if dev supports batching
+// itself or doesn't expose its file descriptor.
+func newBatchIO(dev tun.Device) *batchIO {
+	if dev.BatchSize() > 1 {
+		return nil
+	}
+	f := dev.File()
+	if f == nil {
+		return nil
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return &batchIO{f: f, rc: rc}
+}
+
+// read reads as many packets as are available, up to len(bufs), waiting
+// until at least one is.
+func (b *batchIO) read(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	var rerr error
+	err = b.rc.Read(func(fd uintptr) bool {
+		for n < len(bufs) {
+			m, err := syscall.Read(int(fd), bufs[n][offset:])
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN:
+				// Wait for the fd to become readable if we have nothing yet.
+				return n > 0
+			case err == syscall.EBADFD:
+				rerr = os.ErrClosed
+				return true
+			case err != nil:
+				rerr = err
+				return true
+			case m == 0:
+				rerr = io.EOF
+				return true
+			}
+			sizes[n] = m
+			n++
+		}
+		return true
+	})
+	if n > 0 {
+		// Report the error on the next call, once the packets
+		// we already have have been processed.
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, rerr
+}
+
+// readUntil is like read, but gives up with os.ErrDeadlineExceeded if no
+// packet arrives before deadline.
+func (b *batchIO) readUntil(bufs [][]byte, sizes []int, offset int, deadline time.Time) (int, error) {
+	if err := b.f.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return b.read(bufs, sizes, offset)
+}
+
+// discard reads and throws away all packets that are available without
+// waiting, using buf as scratch space, and returns how many there were.
+func (b *batchIO) discard(buf []byte) (n int) {
+	// Clear any deadline set by readUntil, which would fail the read early.
+	b.f.SetReadDeadline(time.Time{})
+	b.rc.Read(func(fd uintptr) bool {
+		for {
+			_, err := syscall.Read(int(fd), buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return true
+			}
+			n++
+		}
+	})
+	return n
+}
+
+// write writes each of bufs as a separate packet. Like the tun.Device
+// implementation for Linux, it keeps going after a failed write and returns
+// all errors joined.
+func (b *batchIO) write(bufs [][]byte, offset int) (int, error) {
+	var (
+		i, n int
+		errs []error
+	)
+	err := b.rc.Write(func(fd uintptr) bool {
+		for i < len(bufs) {
+			_, err := syscall.Write(int(fd), bufs[i][offset:])
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN:
+				return false
+			case err == syscall.EBADFD:
+				errs = append(errs, os.ErrClosed)
+				return true
+			case err != nil:
+				errs = append(errs, err)
+			default:
+				n++
+			}
+			i++
+		}
+		return true
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return n, errors.Join(errs...)
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// fileTUN is a tun.Device backed by one end of a datagram socket pair,
+// which, like a tun fd, preserves packet boundaries.
+type fileTUN struct {
+	f      *os.File
+	events chan tun.Event
+}
+
+// newFileTUN returns a fileTUN and the file for the other end of its
+// socket pair.
+func newFileTUN(t testing.TB) (*fileTUN, *os.File) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	t.Cleanup(func() { peer.Close() })
+	return &fileTUN{
+		f:      os.NewFile(uintptr(fds[0]), "tun"),
+		events: make(chan tun.Event),
+	}, peer
+}
+
+func (f *fileTUN) File() *os.File { return f.f }
+
+func (f *fileTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := f.f.Read(bufs[0][offset:])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func (f *fileTUN) Write(bufs [][]byte, offset int) (int, error) {
+	for i, b := range bufs {
+		if _, err := f.f.Write(b[offset:]); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (f *fileTUN) MTU() (int, error)        { return 1280, nil }
+func (f *fileTUN) Name() (string, error)    { return "tun0", nil }
+func (f *fileTUN) Events() <-chan tun.Event { return f.events }
+func (f *fileTUN) BatchSize() int           { return 1 }
+func (f *fileTUN) Close() error             { return f.f.Close() }
+
+func makeBufs(n, size int) ([][]byte, []int) {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	return bufs, make([]int, n)
+}
+
+func TestBatchRead(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	dev, peer := newFileTUN(t)
+	d.Add(dev)
+
+	const packets = 5
+	for i := range packets {
+		if _, err := peer.Write([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bufs, sizes := makeBufs(d.BatchSize(), 1500)
+	n, err := d.Read(bufs, sizes, 10)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n != packets {
+		t.Fatalf("Read returned %d packets, want %d", n, packets)
+	}
+	for i := range n {
+		if got, want := string(bufs[i][10:10+sizes[i]]), fmt.Sprintf("packet %d", i); got != want {
+			t.Errorf("packet %d = %q, want %q", i, got, want)
+		}
+	}
+
+	// More packets than fit in a batch are left for the next Read.
+	for i := range d.BatchSize() + 1 {
+		peer.Write([]byte{byte(i)})
+	}
+	if n, _ := d.Read(bufs, sizes, 0); n != d.BatchSize() {
+		t.Errorf("first Read returned %d packets, want %d", n, d.BatchSize())
+	}
+	if n, _ := d.Read(bufs, sizes, 0); n != 1 {
+		t.Errorf("second Read returned %d packets, want 1", n)
+	}
+}
+
+func TestBatchWrite(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+	dev, peer := newFileTUN(t)
+	d.Add(dev)
+
+	bufs := [][]byte{[]byte("xxone"), []byte("xxtwo"), []byte("xxthree")}
+	n, err := d.Write(bufs, 2)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != len(bufs) {
+		t.Errorf("Write = %d, want %d", n, len(bufs))
+	}
+	buf := make([]byte, 100)
+	for _, want := range []string{"one", "two", "three"} {
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBatchReadClose(t *testing.T) {
+	d := New(1280)
+	dev, _ := newFileTUN(t)
+	d.Add(dev)
+
+	rc := startRead(d)
+	assertBlocked(t, rc)
+	d.Close()
+	if r := waitResult(t, rc); !errors.Is(r.err, os.ErrClosed) {
+		t.Errorf("pending Read after Close: %v, want %v", r.err, os.ErrClosed)
+	}
+}
+
+func TestBatchHandover(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	dev1, peer1 := newFileTUN(t)
+	d.Add(dev1)
+	dev2, peer2 := newFileTUN(t)
+	d.Add(dev2)
+
+	peer1.Write([]byte("old"))
+	peer2.Write([]byte("new"))
+	bufs, sizes := makeBufs(d.BatchSize(), 1500)
+	var got []string
+	for len(got) < 2 {
+		n, err := d.Read(bufs, sizes, 0)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		for i := range n {
+			got = append(got, string(bufs[i][:sizes[i]]))
+		}
+	}
+	// The old device is drained before reading from the new one.
+	if got[0] != "old" || got[1] != "new" {
+		t.Errorf("read %q, want [old new]", got)
+	}
+	if st := d.HandoverStats(); st != (HandoverStats{Handovers: 1, Drained: 1}) {
+		t.Errorf("HandoverStats = %+v, want 1 handover and 1 drained packet", st)
+	}
+}
+
+func TestBatchHandoverDropped(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.SetHandoverGrace(10 * time.Millisecond)
+	dev1, peer1 := newFileTUN(t)
+	d.Add(dev1)
+	dev2, peer2 := newFileTUN(t)
+	d.Add(dev2)
+
+	for range 5 {
+		peer1.Write([]byte("old"))
+	}
+	bufs, sizes := makeBufs(1, 1500)
+	if n, err := d.Read(bufs, sizes, 0); n != 1 || err != nil {
+		t.Fatalf("Read = %d, %v; want 1, nil", n, err)
+	}
+	// Let the grace period end with packets still queued.
+	time.Sleep(20 * time.Millisecond)
+	peer2.Write([]byte("new"))
+	if n, err := d.Read(bufs, sizes, 0); n != 1 || err != nil || string(bufs[0][:sizes[0]]) != "new" {
+		t.Fatalf("Read = %d, %q, %v; want 1, new, nil", n, bufs[0][:sizes[0]], err)
+	}
+	if st := d.HandoverStats(); st != (HandoverStats{Handovers: 1, Drained: 1, Dropped: 4}) {
+		t.Errorf("HandoverStats = %+v, want 1 handover, 1 drained and 4 dropped packets", st)
+	}
+}
+
+func BenchmarkBatchRead(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+			d := New(1280)
+			defer d.Close()
+			dev, peer := newFileTUN(b)
+			d.Add(dev)
+			bufs, sizes := makeBufs(d.BatchSize(), 1500)
+			if !batch {
+				bufs, sizes = bufs[:1], sizes[:1]
+			}
+			pkt := make([]byte, 1280)
+			b.SetBytes(1280)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for read := 0; read < b.N; {
+				for range min(len(bufs), b.N-read) {
+					peer.Write(pkt)
+				}
+				n, err := d.Read(bufs, sizes, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+)
+
+// maxCoalescedSize is the maximum size of an IP packet produced by
+// coalesceTCP. It's bounded by the 16-bit IPv4 total length and IPv6 payload
+// length fields.
+const maxCoalescedSize = 65535
+
+const (
+	ipProtoTCP = 6
+
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// tcpFlow identifies the TCP flow of a packet.
+type tcpFlow struct {
+	src, dst         netip.Addr
+	srcPort, dstPort uint16
+}
+
+// tcpSegment is a parsed TCP packet that is a candidate for coalescing.
+type tcpSegment struct {
+	flow  tcpFlow
+	ipLen int // IP header length
+	hdrs  int // IP and TCP header length
+	seq   uint32
+	ack   uint32
+	win   uint16
+	flags uint8
+}
+
+// parseTCPSegment parses pkt if it's a TCP packet that may take part in
+// coalescing: no IP options or extension headers, no fragmentation, and only
+// the ACK and PSH flags set. If pkt is a TCP packet that may not, seg.flow is
+// still populated.
+func parseTCPSegment(pkt []byte) (seg tcpSegment, ok bool) {
+	if len(pkt) < 1 {
+		return seg, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[0]&0x0f != 5 || pkt[9] != ipProtoTCP {
+			return seg, false
+		}
+		if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return seg, false
+		}
+		// MF set or a non-zero fragment offset.
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return seg, false
+		}
+		seg.ipLen = 20
+		seg.flow.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		seg.flow.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+	case 6:
+		if len(pkt) < 40 || pkt[6] != ipProtoTCP {
+			return seg, false
+		}
+		if int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+			return seg, false
+		}
+		seg.ipLen = 40
+		seg.flow.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		seg.flow.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+	default:
+		return seg, false
+	}
+	tcp := pkt[seg.ipLen:]
+	if len(tcp) < 20 {
+		return seg, false
+	}
+	tcpLen := int(tcp[12]>>4) * 4
+	if tcpLen < 20 || len(tcp) < tcpLen {
+		return seg, false
+	}
+	seg.hdrs = seg.ipLen + tcpLen
+	seg.flow.srcPort = binary.BigEndian.Uint16(tcp[0:])
+	seg.flow.dstPort = binary.BigEndian.Uint16(tcp[2:])
+	seg.seq = binary.BigEndian.Uint32(tcp[4:])
+	seg.ack = binary.BigEndian.Uint32(tcp[8:])
+	seg.flags = tcp[13]
+	seg.win = binary.BigEndian.Uint16(tcp[14:])
+	if seg.flags&^(tcpFlagACK|tcpFlagPSH) != 0 || seg.flags&tcpFlagACK == 0 {
+		return seg, false
+	}
+	return seg, true
+}
+
+// canAppend reports whether the payload of next, which follows head in
+// the same flow, can be appended to head.
+func canAppend(head []byte, hseg tcpSegment, next []byte, nseg tcpSegment) bool {
+	if hseg.flags&tcpFlagPSH != 0 {
+		// PSH marks the end of a burst. Don't hold back anything behind it.
+		return false
+	}
+	if hseg.hdrs != nseg.hdrs || hseg.ack != nseg.ack || hseg.win != nseg.win {
+		return false
+	}
+	if hseg.seq+uint32(len(head)-hseg.hdrs) != nseg.seq || len(next) == nseg.hdrs {
+		return false
+	}
+	// The IP headers must match apart from lengths, IDs and checksums.
+	if head[0]>>4 == 4 {
+		// TOS, flags and TTL.
+		if head[1] != next[1] || head[6]&0xe0 != next[6]&0xe0 || head[8] != next[8] {
+			return false
+		}
+	} else {
+		// Traffic class, flow label and hop limit.
+		if !bytes.Equal(head[:4], next[:4]) || head[7] != next[7] {
+			return false
+		}
+	}
+	// TCP options, such as timestamps, must be identical.
+	return bytes.Equal(head[hseg.ipLen+20:hseg.hdrs], next[nseg.ipLen+20:nseg.hdrs])
+}
+
+// coalesceTCP merges consecutive in-order TCP segments of the same flow in
+// bufs into a single packet and returns the resulting packets, and for each
+// of bufs, the index of the packet it ended up in. Merged
+// segments are appended to the first one's buffer if it has enough spare
+// capacity, so as with wireguard-go's own GRO, bufs must not share backing
+// arrays.
+//
+// The kernel accepts packets larger than the tun MTU and delivers them to
+// local sockets as it would packets coalesced by GRO, so this trades a bit
+// of copying for far fewer syscalls and much less work in the TCP stack.
+// Segments are only merged if their checksums are valid, so that a corrupt
+// segment can't be hidden behind a recomputed checksum.
+func coalesceTCP(bufs [][]byte, offset int) (out [][]byte, at []int) {
+	type head struct {
+		idx    int // index into out
+		seg    tcpSegment
+		merged bool // whether segments were appended
+	}
+	at = make([]int, len(bufs))
+	if len(bufs) < 2 {
+		return bufs, at
+	}
+	var (
+		heads map[tcpFlow]*head
+		dirty []*head // heads that were appended to
+	)
+	out = make([][]byte, 0, len(bufs))
+	for i, buf := range bufs {
+		at[i] = len(out)
+		pkt := buf[offset:]
+		seg, ok := parseTCPSegment(pkt)
+		if !ok {
+			// Nothing in the same flow may be merged across this packet.
+			delete(heads, seg.flow)
+			out = append(out, buf)
+			continue
+		}
+		if h := heads[seg.flow]; h != nil {
+			hbuf := out[h.idx]
+			hpkt := hbuf[offset:]
+			size := len(hpkt) + len(pkt) - seg.hdrs
+			if size <= maxCoalescedSize && offset+size <= cap(hbuf) &&
+				canAppend(hpkt, h.seg, pkt, seg) && validTCPChecksum(pkt, seg) {
+				hbuf = append(hbuf, pkt[seg.hdrs:]...)
+				out[h.idx] = hbuf
+				at[i] = h.idx
+				h.seg.flags |= seg.flags & tcpFlagPSH
+				if !h.merged {
+					h.merged = true
+					dirty = append(dirty, h)
+				}
+				continue
+			}
+		}
+		if !validTCPChecksum(pkt, seg) {
+			out = append(out, buf)
+			delete(heads, seg.flow)
+			continue
+		}
+		if heads == nil {
+			heads = make(map[tcpFlow]*head)
+		}
+		heads[seg.flow] = &head{idx: len(out), seg: seg}
+		out = append(out, buf)
+	}
+	for _, h := range dirty {
+		fixupTCP(out[h.idx][offset:], h.seg)
+	}
+	return out, at
+}
+
+// consumed returns how many of the bufs given to coalesceTCP are in the
+// first n packets it returned, given where it put each of them. That's the
+// number of bufs written when n of the packets were.
+func consumed(at []int, n int) int {
+	var c int
+	for _, idx := range at {
+		if idx < n {
+			c++
+		}
+	}
+	return c
+}
+
+// fixupTCP updates the lengths, flags and checksums of a coalesced packet.
+func fixupTCP(pkt []byte, seg tcpSegment) {
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(pkt[:20], 0))
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+	}
+	tcp := pkt[seg.ipLen:]
+	tcp[13] = seg.flags
+	tcp[16], tcp[17] = 0, 0
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(tcp, pseudoHeaderSum(pkt, seg)))
+}
+
+// validTCPChecksum reports whether the TCP checksum of pkt is valid.
+func validTCPChecksum(pkt []byte, seg tcpSegment) bool {
+	return checksum(pkt[seg.ipLen:], pseudoHeaderSum(pkt, seg)) == 0xffff
+}
+
+// pseudoHeaderSum returns the sum of the TCP pseudo-header of pkt.
+func pseudoHeaderSum(pkt []byte, seg tcpSegment) uint64 {
+	var addrs []byte
+	if seg.ipLen == 20 {
+		addrs = pkt[12:20]
+	} else {
+		addrs = pkt[8:40]
+	}
+	return sum(addrs, uint64(ipProtoTCP)+uint64(len(pkt)-seg.ipLen))
+}
+
+// sum adds b to initial as a sequence of big-endian 16-bit words, without
+// folding the carries.
+func sum(b []byte, initial uint64) uint64 {
+	s := initial
+	for len(b) >= 8 {
+		s += uint64(binary.BigEndian.Uint16(b[0:])) +
+			uint64(binary.BigEndian.Uint16(b[2:])) +
+			uint64(binary.BigEndian.Uint16(b[4:])) +
+			uint64(binary.BigEndian.Uint16(b[6:]))
+		b = b[8:]
+	}
+	for len(b) >= 2 {
+		s += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint64(b[0]) << 8
+	}
+	return s
+}
+
+// checksum returns the folded ones' complement sum of b and initial.
+func checksum(b []byte, initial uint64) uint16 {
+	s := sum(b, initial)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
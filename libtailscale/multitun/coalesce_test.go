@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+var (
+	testSrc4 = netip.MustParseAddr("100.64.0.1")
+	testDst4 = netip.MustParseAddr("100.64.0.2")
+	testSrc6 = netip.MustParseAddr("fd7a:115c:a1e0::1")
+	testDst6 = netip.MustParseAddr("fd7a:115c:a1e0::2")
+)
+
+type testSegment struct {
+	src, dst netip.Addr
+	srcPort  uint16
+	seq      uint32
+	flags    uint8
+	payload  string
+}
+
+// makeTCP returns a TCP packet with valid checksums at offset in a buffer
+// with room for coalescing.
+func makeTCP(s testSegment, offset int) []byte {
+	if s.srcPort == 0 {
+		s.srcPort = 1234
+	}
+	if s.flags == 0 {
+		s.flags = tcpFlagACK
+	}
+	ipLen := 20
+	if s.src.Is6() {
+		ipLen = 40
+	}
+	// 12 bytes of TCP options, as with timestamps.
+	const tcpLen = 32
+	pkt := make([]byte, ipLen+tcpLen+len(s.payload), maxCoalescedSize)
+	if s.src.Is4() {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[6] = 0x40 // DF
+		pkt[8] = 64
+		pkt[9] = ipProtoTCP
+		copy(pkt[12:], s.src.AsSlice())
+		copy(pkt[16:], s.dst.AsSlice())
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(pkt[:20], 0))
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		pkt[6] = ipProtoTCP
+		pkt[7] = 64
+		copy(pkt[8:], s.src.AsSlice())
+		copy(pkt[24:], s.dst.AsSlice())
+	}
+	tcp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], s.srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], s.seq)
+	binary.BigEndian.PutUint32(tcp[8:], 1000)
+	tcp[12] = tcpLen / 4 << 4
+	tcp[13] = s.flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+	copy(tcp[tcpLen:], s.payload)
+	seg, _ := parseTCPSegment(pkt)
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(tcp, pseudoHeaderSum(pkt, seg)))
+
+	buf := make([]byte, offset, offset+cap(pkt))
+	return append(buf, pkt...)
+}
+
+// payloadOf returns the TCP payload of pkt, after checking its lengths and,
+// if checkSum is set, its checksums.
+func payloadOf(t *testing.T, pkt []byte, checkSum bool) string {
+	t.Helper()
+	seg, ok := parseTCPSegment(pkt)
+	if !ok {
+		// FIN packets aren't parsed as segments.
+		seg.hdrs = len(pkt)
+	}
+	if checkSum && ok && !validTCPChecksum(pkt, seg) {
+		t.Errorf("packet has an invalid TCP checksum")
+	}
+	if checkSum && seg.ipLen == 20 && checksum(pkt[:20], 0) != 0xffff {
+		t.Errorf("packet has an invalid IPv4 header checksum")
+	}
+	return string(pkt[seg.hdrs:])
+}
+
+func TestCoalesceTCP(t *testing.T) {
+	const offset = 16
+	for _, fam := range []struct {
+		name     string
+		src, dst netip.Addr
+	}{
+		{"ipv4", testSrc4, testDst4},
+		{"ipv6", testSrc6, testDst6},
+	} {
+		seg := func(srcPort uint16, seq uint32, flags uint8, payload string) []byte {
+			return makeTCP(testSegment{fam.src, fam.dst, srcPort, seq, flags, payload}, offset)
+		}
+		corrupt := func(b []byte) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		}
+		t.Run(fam.name, func(t *testing.T) {
+			for _, tt := range []struct {
+				name        string
+				in          [][]byte
+				want        []string // payloads
+				badChecksum bool     // whether a packet is corrupt
+			}{
+				{
+					name: "in_order",
+					in:   [][]byte{seg(1, 100, 0, "aaaa"), seg(1, 104, 0, "bbbb"), seg(1, 108, tcpFlagACK|tcpFlagPSH, "cc")},
+					want: []string{"aaaabbbbcc"},
+				},
+				{
+					name: "push_ends_burst",
+					in:   [][]byte{seg(1, 100, tcpFlagACK|tcpFlagPSH, "aaaa"), seg(1, 104, 0, "bbbb")},
+					want: []string{"aaaa", "bbbb"},
+				},
+				{
+					name: "gap",
+					in:   [][]byte{seg(1, 100, 0, "aaaa"), seg(1, 200, 0, "bbbb"), seg(1, 204, 0, "cccc")},
+					want: []string{"aaaa", "bbbbcccc"},
+				},
+				{
+					name: "interleaved_flows",
+					in:   [][]byte{seg(1, 100, 0, "aa"), seg(2, 500, 0, "xx"), seg(1, 102, 0, "bb"), seg(2, 502, 0, "yy")},
+					want: []string{"aabb", "xxyy"},
+				},
+				{
+					name: "pure_ack",
+					in:   [][]byte{seg(1, 100, 0, "aa"), seg(1, 102, 0, "")},
+					want: []string{"aa", ""},
+				},
+				{
+					name: "fin_breaks_flow",
+					in:   [][]byte{seg(1, 100, 0, "aa"), seg(1, 102, tcpFlagACK|0x01, ""), seg(1, 102, 0, "bb")},
+					want: []string{"aa", "", "bb"},
+				},
+				{
+					name:        "bad_checksum",
+					in:          [][]byte{seg(1, 100, 0, "aaaa"), corrupt(seg(1, 104, 0, "bbbb")), seg(1, 108, 0, "cccc")},
+					want:        []string{"aaaa", "bbb\x9d", "cccc"},
+					badChecksum: true,
+				},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					out, _ := coalesceTCP(tt.in, offset)
+					if len(out) != len(tt.want) {
+						t.Fatalf("got %d packets, want %d", len(out), len(tt.want))
+					}
+					for i, want := range tt.want {
+						if got := payloadOf(t, out[i][offset:], !tt.badChecksum); got != want {
+							t.Errorf("packet %d payload = %q, want %q", i, got, want)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCoalesceTCPConsumed(t *testing.T) {
+	seg := func(srcPort uint16, seq uint32, payload string) []byte {
+		return makeTCP(testSegment{testSrc4, testDst4, srcPort, seq, 0, payload}, 0)
+	}
+	in := [][]byte{seg(1, 100, "aa"), seg(2, 500, "xx"), seg(1, 102, "bb"), seg(3, 900, "zz")}
+	out, at := coalesceTCP(in, 0)
+	if len(out) != 3 || !slices.Equal(at, []int{0, 1, 0, 2}) {
+		t.Fatalf("got %d packets at %v, want 3 at [0 1 0 2]", len(out), at)
+	}
+	// Writing a coalesced packet consumes every input merged into it.
+	for n, want := range []int{0, 2, 3, 4} {
+		if got := consumed(at, n); got != want {
+			t.Errorf("consumed(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+func TestCoalesceTCPCapacity(t *testing.T) {
+	a := makeTCP(testSegment{testSrc4, testDst4, 1, 100, 0, "aaaa"}, 0)
+	b := makeTCP(testSegment{testSrc4, testDst4, 1, 104, 0, "bbbb"}, 0)
+	a = a[:len(a):len(a)]
+	out, _ := coalesceTCP([][]byte{a, b}, 0)
+	if len(out) != 2 {
+		t.Errorf("got %d packets, want 2 when the first buffer is full", len(out))
+	}
+}
+
+func TestCoalesceTCPNonTCP(t *testing.T) {
+	udp := makeTCP(testSegment{testSrc4, testDst4, 1, 100, 0, "aaaa"}, 0)
+	udp[9] = 17
+	in := [][]byte{udp, bytes.Clone(udp), {}}
+	out, _ := coalesceTCP(in, 0)
+	if len(out) != len(in) {
+		t.Errorf("got %d packets, want %d", len(out), len(in))
+	}
+}
+
+func BenchmarkCoalesceTCP(b *testing.B) {
+	const offset = 16
+	payload := string(make([]byte, 1200))
+	bufs := make([][]byte, batchSize)
+	b.SetBytes(int64(len(bufs) * len(payload)))
+	b.ReportAllocs()
+	for range b.N {
+		b.StopTimer()
+		// Coalescing modifies the first packet, so start afresh each time.
+		for i := range bufs {
+			bufs[i] = makeTCP(testSegment{testSrc4, testDst4, 1, uint32(i * len(payload)), 0, payload}, offset)
+		}
+		b.StartTimer()
+		if out, _ := coalesceTCP(bufs, offset); len(out) != 1 {
+			b.Fatalf("got %d packets, want 1", len(out))
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_android_impair
+
+package multitun
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/impair"
+)
+
+const (
+	// impairQueueLen is the number of packets that may be delayed in
+	// each direction. Further packets are dropped.
+	impairQueueLen = 4096
+	// maxPacketSize is the size of the buffers packets are read into
+	// by the impairment stage.
+	maxPacketSize = 65535
+)
+
+// impairStage delays and drops packets between the underlying devices and
+// the users of a Device, as decided by an impair.Impairer.
+//
+// Packets read from the underlying devices are pumped into a delay line
+// that Read takes them from, and packets given to Write go into another
+// one that is pumped into the underlying devices.
+type impairStage struct {
+	d  *Device
+	im atomic.Pointer[impair.Impairer]
+
+	out *impair.Line // packets read from the underlying devices
+	in  *impair.Line // packets to be written to the underlying devices
+
+	// readDone is closed when pumpReads returns, after setting readErr.
+	readDone chan struct{}
+	readErr  error
+
+	// transientMu protects transient, the last error that didn't stop
+	// pumpReads and wasn't returned by read yet. transientC receives a
+	// value when it's set.
+	transientMu sync.Mutex
+	transient   error
+	transientC  chan struct{}
+}
+
+// ImpairmentStats are the counters of the impairment stage of a Device.
+type ImpairmentStats struct {
+	Rules []impair.RuleStats `json:",omitempty"`
+	// QueuedOut and QueuedIn are the numbers of packets currently
+	// delayed, by direction.
+	QueuedOut, QueuedIn int
+	// Overflowed is the number of packets dropped because too many packets
+	// were delayed at once.
+	Overflowed uint64
+}
+
+// SetImpairment makes d delay, drop and reorder the packets it reads and
+// writes, as decided by im. A nil im stops impairing new packets, while
+// those already delayed are still delivered on time.
+//
+// Once impairment has been set, packets read from d go through a queue
+// until d is closed, even if they're no longer impaired.
+func (d *Device) SetImpairment(im *impair.Impairer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s := d.impair.Load(); s != nil {
+		s.im.Store(im)
+		return
+	}
+	if im == nil || d.closed {
+		return
+	}
+	s := &impairStage{
+		d:        d,
+		out:      impair.NewLine(impairQueueLen),
+		in:       impair.NewLine(impairQueueLen),
+		readDone: make(chan struct{}),
+
+		transientC: make(chan struct{}, 1),
+	}
+	s.im.Store(im)
+	d.impair.Store(s)
+	go s.pumpReads()
+	go s.pumpWrites()
+}
+
+// Impairment returns the Impairer set by [Device.SetImpairment], if any.
+func (d *Device) Impairment() *impair.Impairer {
+	if s := d.impair.Load(); s != nil {
+		return s.im.Load()
+	}
+	return nil
+}
+
+// ImpairmentStats returns the counters of the impairment of d.
+func (d *Device) ImpairmentStats() ImpairmentStats {
+	var st ImpairmentStats
+	s := d.impair.Load()
+	if s == nil {
+		return st
+	}
+	if im := s.im.Load(); im != nil {
+		st.Rules = im.Stats()
+	}
+	st.QueuedOut = s.out.Len()
+	st.QueuedIn = s.in.Len()
+	st.Overflowed = s.out.Dropped() + s.in.Dropped()
+	return st
+}
+
+// pumpReads reads packets from the underlying devices into s.out until d is
+// closed. Other read errors, like tun.ErrTooManySegments, are passed to read
+// once, and pumping continues.
+func (s *impairStage) pumpReads() {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in multitun.pumpReads %s: %s", p, debug.Stack())
+			panic(p)
+		}
+	}()
+	defer close(s.readDone)
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, maxPacketSize)
+	}
+	sizes := make([]int, batchSize)
+	for {
+		n, err := s.d.readDevice(bufs, sizes, 0)
+		now := time.Now()
+		im := s.im.Load()
+		for i := range n {
+			pkt := bufs[i][:sizes[i]]
+			at, ok := now, true
+			if im != nil {
+				at, ok = im.Decide(impair.Outbound, pkt, now)
+			}
+			if ok {
+				s.out.Push(at, bytes.Clone(pkt))
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrClosed) || s.d.isClosed() {
+			s.readErr = err
+			return
+		}
+		s.transientMu.Lock()
+		s.transient = err
+		s.transientMu.Unlock()
+		select {
+		case s.transientC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeTransient returns and clears the last transient read error, if any.
+func (s *impairStage) takeTransient() error {
+	s.transientMu.Lock()
+	defer s.transientMu.Unlock()
+	err := s.transient
+	s.transient = nil
+	return err
+}
+
+// read returns the packets read from the underlying devices once they're
+// due, transient read errors, and the error that stopped pumpReads after
+// that.
+func (s *impairStage) read(data [][]byte, sizes []int, offset int) (int, error) {
+	for {
+		pkts, next := s.out.Pop(make([][]byte, 0, len(data)), time.Now(), len(data))
+		if len(pkts) > 0 {
+			for i, pkt := range pkts {
+				sizes[i] = copy(data[i][offset:], pkt)
+			}
+			return len(pkts), nil
+		}
+		if err := s.takeTransient(); err != nil {
+			return 0, err
+		}
+		select {
+		case <-s.readDone:
+			return 0, s.readErr
+		default:
+		}
+		waitLine(s.out, next, s.readDone, s.transientC)
+	}
+}
+
+// write queues packets to be written to the underlying devices when
+// they're due. It reports false if they should be written directly, because
+// nothing is impaired or d is closed.
+func (s *impairStage) write(data [][]byte, offset int) (int, bool) {
+	im := s.im.Load()
+	if im == nil && s.in.Len() == 0 || s.d.isClosed() {
+		return 0, false
+	}
+	now := time.Now()
+	for _, b := range data {
+		pkt := b[offset:]
+		at, ok := now, true
+		if im != nil {
+			at, ok = im.Decide(impair.Inbound, pkt, now)
+		}
+		if ok {
+			s.in.Push(at, bytes.Clone(pkt))
+		}
+	}
+	return len(data), true
+}
+
+// pumpWrites writes packets from s.in to the underlying devices once
+// they're due, until d is closed.
+func (s *impairStage) pumpWrites() {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in multitun.pumpWrites %s: %s", p, debug.Stack())
+			panic(p)
+		}
+	}()
+	var pkts [][]byte
+	for {
+		var next time.Time
+		pkts, next = s.in.Pop(pkts[:0], time.Now(), batchSize)
+		if len(pkts) > 0 {
+			_, err := s.d.writeDevice(pkts, 0)
+			if errors.Is(err, os.ErrClosed) && s.d.isClosed() {
+				return
+			}
+			continue
+		}
+		waitLine(s.in, next, s.d.closeCh, nil)
+		if s.d.isClosed() {
+			return
+		}
+	}
+}
+
+// waitLine waits until a packet is pushed to l, next is reached, stop is
+// closed, or wake receives. A zero next waits for a push.
+func waitLine(l *impair.Line, next time.Time, stop, wake <-chan struct{}) {
+	var timeout <-chan time.Time
+	if !next.IsZero() {
+		t := time.NewTimer(time.Until(next))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-l.Pushed():
+	case <-timeout:
+	case <-stop:
+	case <-wake:
+	}
+}
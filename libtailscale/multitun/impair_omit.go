@@ -0,0 +1,18 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_android_impair
+
+package multitun
+
+// impairStage is the network impairment stage, which is only built with the
+// ts_android_impair build tag. Without it, Device.impair is never set.
+type impairStage struct{}
+
+func (s *impairStage) read(data [][]byte, sizes []int, offset int) (int, error) {
+	panic("unreachable")
+}
+
+func (s *impairStage) write(data [][]byte, offset int) (int, bool) {
+	return 0, false
+}
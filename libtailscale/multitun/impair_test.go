@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_android_impair
+
+package multitun
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/impair"
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+func newImpairer(t *testing.T, rules ...impair.Rule) *impair.Impairer {
+	t.Helper()
+	im, err := impair.New(impair.Config{Rules: rules, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func TestImpairLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+	f := newFakeTUN("tun0")
+	d.Add(f)
+	d.SetImpairment(newImpairer(t, impair.Rule{Latency: impair.Duration(latency)}))
+
+	start := time.Now()
+	rc := startRead(d)
+	f.in <- []byte("outbound")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "outbound" {
+		t.Fatalf("Read = %q, %v", r.data, r.err)
+	}
+	if el := time.Since(start); el < latency {
+		t.Errorf("read after %v, want at least %v", el, latency)
+	}
+
+	start = time.Now()
+	if err := waitResult(t, write(d, []byte("inbound"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(waitResult(t, f.out)); got != "inbound" {
+		t.Fatalf("wrote %q", got)
+	}
+	if el := time.Since(start); el < latency {
+		t.Errorf("written after %v, want at least %v", el, latency)
+	}
+
+	// Without impairment, packets go straight through the queue.
+	d.SetImpairment(nil)
+	start = time.Now()
+	rc = startRead(d)
+	f.in <- []byte("direct")
+	if r := waitResult(t, rc); string(r.data) != "direct" {
+		t.Fatalf("Read = %q, %v", r.data, r.err)
+	}
+	waitResult(t, write(d, []byte("direct")))
+	waitResult(t, f.out)
+	if el := time.Since(start); el >= latency {
+		t.Errorf("unimpaired packets took %v", el)
+	}
+}
+
+func TestImpairLoss(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+	f := newFakeTUN("tun0")
+	d.Add(f)
+	d.SetImpairment(newImpairer(t, impair.Rule{Direction: impair.Inbound, Loss: 1}))
+
+	for range 3 {
+		if err := waitResult(t, write(d, []byte("lost"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertBlocked(t, f.out)
+
+	// Outbound packets aren't affected.
+	rc := startRead(d)
+	f.in <- []byte("kept")
+	if r := waitResult(t, rc); string(r.data) != "kept" {
+		t.Fatalf("Read = %q, %v", r.data, r.err)
+	}
+	st := d.ImpairmentStats()
+	if len(st.Rules) != 1 || st.Rules[0].Lost != 3 {
+		t.Errorf("stats = %+v, want 3 lost", st)
+	}
+}
+
+func TestImpairTransientReadError(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+	f := newFakeTUN("tun0")
+	f.errs = make(chan error)
+	d.Add(f)
+	d.SetImpairment(newImpairer(t))
+
+	rc := startRead(d)
+	f.errs <- tun.ErrTooManySegments
+	if r := waitResult(t, rc); !errors.Is(r.err, tun.ErrTooManySegments) {
+		t.Fatalf("Read = %v, want tun.ErrTooManySegments", r.err)
+	}
+	// The error is returned once, and reading goes on.
+	rc = startRead(d)
+	assertBlocked(t, rc)
+	f.in <- []byte("after")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "after" {
+		t.Fatalf("Read = %q, %v", r.data, r.err)
+	}
+}
+
+func TestImpairClose(t *testing.T) {
+	d := New(1280)
+	d.Up()
+	d.Add(newFakeTUN("tun0"))
+	d.SetImpairment(newImpairer(t, impair.Rule{Latency: impair.Duration(time.Hour)}))
+	rc := startRead(d)
+	assertBlocked(t, rc)
+	d.Close()
+	if r := waitResult(t, rc); !errors.Is(r.err, os.ErrClosed) {
+		t.Errorf("Read after Close: %v, want os.ErrClosed", r.err)
+	}
+	if _, err := d.Write([][]byte{[]byte("x")}, 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close: %v, want os.ErrClosed", err)
+	}
+}
@@ -1,23 +1,24 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-package libtailscale
+package multitun
 
 import (
 	"log"
 	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tailscale/wireguard-go/tun"
-	"tailscale.com/syncs"
 )
 
-// multiTUN implements a tun.Device that supports multiple
-// underlying devices. This is necessary because Android VPN devices
-// have static configurations and wgengine.NewUserspaceEngine
-// assumes a single static tun.Device.
-type multiTUN struct {
+// legacyTUN is the original channel-based implementation of [Device],
+// which hands each Read and Write over to a per-device goroutine.
+// It's kept for comparison in benchmarks.
+type legacyTUN struct {
+	defaultMTU int
+
 	// devices is for adding new devices.
 	devices chan tun.Device
 	// event is the combined event channel from all active devices.
@@ -34,21 +35,21 @@ type multiTUN struct {
 	shutdownDone chan struct{}
 
 	downMu sync.Mutex
-	// downCh is closed when the multiTUN is brought down,
+	// downCh is closed when the legacyTUN is brought down,
 	// such as when Tailscale transitions to the Stopped state.
 	// This indicates that all outgoing packets should be dropped,
-	// and [multiTUN.Write] should return immediately without blocking
-	// until [multiTUN.Up] is called. See [multiTUN.Down]
+	// and [legacyTUN.Write] should return immediately without blocking
+	// until [legacyTUN.Up] is called. See [legacyTUN.Down]
 	// and tailscale/tailscale#18679 for more details.
 	//
 	// It can be read without holding downMu, but the mutex
 	// must be held when writing.
-	downCh syncs.AtomicValue[chan struct{}]
-	down   bool // whether the downCh is closed
+	downCh atomic.Value // of chan struct{}
+	down   bool         // whether the downCh is closed
 }
 
-// tunDevice wraps and drives a single run.Device.
-type tunDevice struct {
+// legacyDevice wraps and drives a single run.Device.
+type legacyDevice struct {
 	dev tun.Device
 	// close closes the device.
 	close     chan struct{}
@@ -79,8 +80,9 @@ type nameReply struct {
 	err  error
 }
 
-func newTUNDevices() *multiTUN {
-	d := &multiTUN{
+func newLegacyTUN(defaultMTU int) *legacyTUN {
+	d := &legacyTUN{
+		defaultMTU:   defaultMTU,
 		devices:      make(chan tun.Device),
 		events:       make(chan tun.Event),
 		close:        make(chan struct{}),
@@ -100,15 +102,15 @@ func newTUNDevices() *multiTUN {
 	return d
 }
 
-func (d *multiTUN) run() {
+func (d *legacyTUN) run() {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.run %s: %s", p, debug.Stack())
+			log.Printf("panic in legacyTUN.run %s: %s", p, debug.Stack())
 			panic(p)
 		}
 	}()
 
-	var devices []*tunDevice
+	var devices []*legacyDevice
 	// readDone is the readDone channel of the device being read from.
 	var readDone chan struct{}
 	// runDone is the closeDone channel of the device being written to.
@@ -156,7 +158,7 @@ func (d *multiTUN) run() {
 				prev := devices[len(devices)-1]
 				close(prev.close)
 			}
-			wrap := &tunDevice{
+			wrap := &legacyDevice{
 				dev:       dev,
 				close:     make(chan struct{}),
 				closeDone: make(chan error),
@@ -171,7 +173,7 @@ func (d *multiTUN) run() {
 			}
 			devices = append(devices, wrap)
 		case m := <-d.mtus:
-			r := mtuReply{mtu: defaultMTU}
+			r := mtuReply{mtu: d.defaultMTU}
 			if len(devices) > 0 {
 				dev := devices[len(devices)-1]
 				r.mtu, r.err = dev.dev.MTU()
@@ -188,10 +190,10 @@ func (d *multiTUN) run() {
 	}
 }
 
-func (d *multiTUN) readFrom(dev *tunDevice) {
+func (d *legacyTUN) readFrom(dev *legacyDevice) {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.readFrom %s: %s", p, debug.Stack())
+			log.Printf("panic in legacyTUN.readFrom %s: %s", p, debug.Stack())
 			panic(p)
 		}
 	}()
@@ -222,10 +224,10 @@ func (d *multiTUN) readFrom(dev *tunDevice) {
 	}
 }
 
-func (d *multiTUN) runDevice(dev *tunDevice) {
+func (d *legacyTUN) runDevice(dev *legacyDevice) {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.runDevice %s: %s", p, debug.Stack())
+			log.Printf("panic in legacyTUN.runDevice %s: %s", p, debug.Stack())
 			panic(p)
 		}
 	}()
@@ -243,7 +245,7 @@ func (d *multiTUN) runDevice(dev *tunDevice) {
 	go func() {
 		defer func() {
 			if p := recover(); p != nil {
-				log.Printf("panic in multiTUN.readFrom.events %s: %s", p, debug.Stack())
+				log.Printf("panic in legacyTUN.readFrom.events %s: %s", p, debug.Stack())
 				panic(p)
 			}
 		}()
@@ -271,17 +273,17 @@ func (d *multiTUN) runDevice(dev *tunDevice) {
 	}
 }
 
-func (d *multiTUN) add(dev tun.Device) {
+func (d *legacyTUN) Add(dev tun.Device) {
 	d.devices <- dev
 }
 
-// Up brings the multiTUN up, allowing it to write packets
+// Up brings the legacyTUN up, allowing it to write packets
 // to the underlying tunnel device. If there is no underlying
 // device yet, write operations are pended until a new device
-// is added with [multiTUN.add].
+// is added with [legacyTUN.add].
 //
 // It reports whether this call brought the device up.
-func (d *multiTUN) Up() bool {
+func (d *legacyTUN) Up() bool {
 	d.downMu.Lock()
 	defer d.downMu.Unlock()
 	if !d.down {
@@ -292,10 +294,10 @@ func (d *multiTUN) Up() bool {
 	return true
 }
 
-// Down brings the multiTUN down, causing all outgoing packets
+// Down brings the legacyTUN down, causing all outgoing packets
 // to be dropped without waiting for the underlying tunnel device,
-// and makes all [multiTUN.Write] calls return immediately
-// until [multiTUN.Up] is called.
+// and makes all [legacyTUN.Write] calls return immediately
+// until [legacyTUN.Up] is called.
 //
 // It mainly exists to distinguish between cases where the underlying
 // device is temporarily unavailable due to VPN reconfiguration,
@@ -305,89 +307,89 @@ func (d *multiTUN) Up() bool {
 // See tailscale/tailscale#18679.
 //
 // It reports whether this call brought the device down.
-func (d *multiTUN) Down() bool {
+func (d *legacyTUN) Down() bool {
 	d.downMu.Lock()
 	defer d.downMu.Unlock()
 	if d.down {
 		return false
 	}
-	close(d.downCh.Load())
+	close(d.downCh.Load().(chan struct{}))
 	d.down = true
 	return true
 }
 
-func (d *multiTUN) File() *os.File {
+func (d *legacyTUN) File() *os.File {
 	// The underlying file descriptor is not constant on Android.
 	// Let's hope no-one uses it.
 	panic("not available on Android")
 }
 
-func (d *multiTUN) Read(data [][]byte, sizes []int, offset int) (int, error) {
+func (d *legacyTUN) Read(data [][]byte, sizes []int, offset int) (int, error) {
 	r := make(chan ioReply)
 	select {
 	// We don't care about d.downCh here, as it's fine
 	// to continue waiting until the tunnel is up again
-	// or the multiTUN device is permanently closed.
+	// or the legacyTUN device is permanently closed.
 	// This does not block WireGuard reconfiguration.
 	case d.reads <- ioRequest{data, sizes, offset, r}:
 		rep := <-r
 		return rep.count, rep.err
 	case <-d.close:
-		// Return immediately if the multiTUN device is closed.
+		// Return immediately if the legacyTUN device is closed.
 		return 0, os.ErrClosed
 	}
 }
 
-func (d *multiTUN) Write(data [][]byte, offset int) (int, error) {
+func (d *legacyTUN) Write(data [][]byte, offset int) (int, error) {
 	r := make(chan ioReply)
 	select {
 	case d.writes <- ioRequest{data, nil, offset, r}:
 		rep := <-r
 		return rep.count, rep.err
-	case <-d.downCh.Load():
+	case <-d.downCh.Load().(chan struct{}):
 		// Drop the packet silently if the tunnel is down.
 		// Otherwise, a race may occur during wireguard reconfig
 		// and result in a deadlock, since a wireguard-go/device.Peer
 		// cannot be removed until its RoutineSequentialReceiver
 		// returns, and it will not return if it is blocked in
-		// (*multiTUN).Write while sending to d.writes without
+		// (*legacyTUN).Write while sending to d.writes without
 		// a receiver on the other side of the pipe.
 		return 0, nil
 	case <-d.close:
-		// Return immediately if the multiTUN device is closed.
+		// Return immediately if the legacyTUN device is closed.
 		return 0, os.ErrClosed
 	}
 }
 
-func (d *multiTUN) MTU() (int, error) {
+func (d *legacyTUN) MTU() (int, error) {
 	r := make(chan mtuReply)
 	d.mtus <- r
 	rep := <-r
 	return rep.mtu, rep.err
 }
 
-func (d *multiTUN) Name() (string, error) {
+func (d *legacyTUN) Name() (string, error) {
 	r := make(chan nameReply)
 	d.names <- r
 	rep := <-r
 	return rep.name, rep.err
 }
 
-func (d *multiTUN) Events() <-chan tun.Event {
+func (d *legacyTUN) Events() <-chan tun.Event {
 	return d.events
 }
 
-func (d *multiTUN) Shutdown() {
+func (d *legacyTUN) Shutdown() {
 	d.shutdowns <- struct{}{}
 	<-d.shutdownDone
 }
 
-func (d *multiTUN) Close() error {
+func (d *legacyTUN) Close() error {
 	close(d.close)
 	return <-d.closeErr
 }
 
-func (d *multiTUN) BatchSize() int {
+func (d *legacyTUN) BatchSize() int {
 	// TODO(raggi): currently Android disallows the necessary ioctls to enable
 	// batching. File a bug.
 	return 1
@@ -0,0 +1,645 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package multitun implements a tun.Device on top of a succession of
+// underlying tun devices, as created by Android's VpnService.
+package multitun
+
+import (
+	"errors"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// Device implements a tun.Device that supports multiple
+// underlying devices. This is necessary because Android VPN devices
+// have static configurations and wgengine.NewUserspaceEngine
+// assumes a single static tun.Device.
+//
+// Reads and writes go directly to the current underlying device, which is
+// swapped atomically when a new device is added. Reads are served by the
+// oldest device that hasn't been retired yet, and writes by the newest one.
+type Device struct {
+	defaultMTU int
+
+	// events is the combined event channel from all active devices.
+	events chan tun.Event
+
+	// readDev is the device Read reads from, and writeDev is the device
+	// Write writes to. They're nil when there are no devices, and are only
+	// stored while holding mu.
+	readDev  atomic.Pointer[device]
+	writeDev atomic.Pointer[device]
+
+	// coalesce is whether TCP segments are coalesced on Write.
+	coalesce atomic.Bool
+	// capture is called with each packet read and written, if non-nil.
+	capture atomic.Pointer[CaptureFunc]
+	// handoverGrace is how long a replaced device is still read from,
+	// as a time.Duration.
+	handoverGrace atomic.Int64
+	// impair, if non-nil, delays and drops packets to simulate a bad
+	// network. It's only ever set in builds with the ts_android_impair
+	// build tag; see impair.go.
+	impair atomic.Pointer[impairStage]
+
+	stats counters
+
+	mu      sync.Mutex
+	devices []*device     // oldest first
+	changed chan struct{} // closed and replaced whenever devices changes
+	closed  bool          // whether Close was called
+
+	// closeCh is closed when the Device is closed.
+	closeCh chan struct{}
+
+	downMu sync.Mutex
+	// downCh is closed when the Device is brought down,
+	// such as when Tailscale transitions to the Stopped state.
+	// This indicates that all outgoing packets should be dropped,
+	// and [Device.Write] should return immediately without blocking
+	// until [Device.Up] is called. See [Device.Down]
+	// and tailscale/tailscale#18679 for more details.
+	//
+	// It can be read without holding downMu, but the mutex
+	// must be held when writing.
+	downCh atomic.Pointer[chan struct{}]
+	down   bool // whether the downCh is closed
+	// downSince is when the Device was last brought down, and downTotal
+	// is how long it was down before that.
+	downSince time.Time
+	downTotal time.Duration
+}
+
+// device wraps a single underlying tun.Device.
+type device struct {
+	dev tun.Device
+	// batch is nil if dev is read from and written to directly.
+	batch *batchIO
+
+	name       string
+	added      time.Time
+	readErrors atomic.Uint64
+
+	// reading is held for reading during each read, so that
+	// waitReads can wait for them to return.
+	reading sync.RWMutex
+
+	// drainDeadline is when a replaced device stops being read from,
+	// in Unix nanoseconds. It's zero until the device is replaced.
+	drainDeadline atomic.Int64
+
+	// closing is closed when the device is asked to close, because it was
+	// replaced by a newer device or the Device was shut down.
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newDevice(dev tun.Device) *device {
+	name, _ := dev.Name()
+	return &device{
+		dev:     dev,
+		batch:   newBatchIO(dev),
+		name:    name,
+		added:   time.Now(),
+		closing: make(chan struct{}),
+	}
+}
+
+func (t *device) read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	t.reading.RLock()
+	defer t.reading.RUnlock()
+	if t.batch != nil {
+		return t.batch.read(bufs, sizes, offset)
+	}
+	return t.dev.Read(bufs, sizes, offset)
+}
+
+func (t *device) write(bufs [][]byte, offset int) (int, error) {
+	if t.batch != nil {
+		return t.batch.write(bufs, offset)
+	}
+	return t.dev.Write(bufs, offset)
+}
+
+// close closes the underlying device, unblocking any pending Read.
+// It's safe to call multiple times.
+func (t *device) close() error {
+	t.closeOnce.Do(func() {
+		close(t.closing)
+		t.closeErr = t.dev.Close()
+	})
+	return t.closeErr
+}
+
+// waitReads waits for the reads of t in progress to return.
+func (t *device) waitReads() {
+	t.reading.Lock()
+	t.reading.Unlock()
+}
+
+// isClosing reports whether close has been called.
+func (t *device) isClosing() bool {
+	select {
+	case <-t.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// New returns a new Device with no underlying devices. MTU reports
+// defaultMTU until a device is added.
+func New(defaultMTU int) *Device {
+	d := &Device{
+		defaultMTU: defaultMTU,
+		events:     make(chan tun.Event),
+		changed:    make(chan struct{}),
+		closeCh:    make(chan struct{}),
+		down:       true, // The device is initially down.
+		downSince:  time.Now(),
+	}
+	d.coalesce.Store(true)
+	d.handoverGrace.Store(int64(DefaultHandoverGrace))
+	downCh := make(chan struct{})
+	d.downCh.Store(&downCh)
+	close(downCh)
+	return d
+}
+
+const (
+	// DefaultHandoverGrace is how long a replaced device is read from by
+	// default, so that packets queued on it aren't lost.
+	DefaultHandoverGrace = time.Second
+
+	// drainIdle is how long a replaced device may go without producing a
+	// packet before it's considered drained.
+	drainIdle = 50 * time.Millisecond
+)
+
+// SetHandoverGrace sets how long a device replaced by [Device.Add] is still
+// read from while writes go to the new device. The old device is closed once
+// it has been idle for a short while or the grace period ends, whichever is
+// first. A zero grace period closes it immediately.
+func (d *Device) SetHandoverGrace(grace time.Duration) {
+	d.handoverGrace.Store(int64(grace))
+}
+
+// Direction is the direction of a packet through the Device.
+type Direction int
+
+const (
+	// FromLocal packets are read from the Device. They come from the local
+	// network stack and are bound for the tailnet.
+	FromLocal Direction = iota
+	// ToLocal packets are written to the Device, from the tailnet.
+	ToLocal
+)
+
+// CaptureFunc is called with each packet read from or written to a Device.
+// It's called synchronously on the I/O path, and pkt is only valid for the
+// duration of the call.
+type CaptureFunc func(dir Direction, pkt []byte)
+
+// SetCapture sets the function called with each packet read from or written
+// to d. A nil f stops the capture.
+func (d *Device) SetCapture(f CaptureFunc) {
+	if f == nil {
+		d.capture.Store(nil)
+		return
+	}
+	d.capture.Store(&f)
+}
+
+// captureRead passes the packets just read to the capture function, if any.
+func (d *Device) captureRead(bufs [][]byte, sizes []int, offset int) {
+	if f := d.capture.Load(); f != nil {
+		for i, size := range sizes {
+			(*f)(FromLocal, bufs[i][offset:offset+size])
+		}
+	}
+}
+
+// SetTCPCoalescing sets whether consecutive TCP segments of the same flow
+// are merged into larger packets before being written. It's enabled by
+// default.
+func (d *Device) SetTCPCoalescing(enabled bool) {
+	d.coalesce.Store(enabled)
+}
+
+// publishLocked updates readDev and writeDev from devices and wakes up
+// any Read or Write waiting for a device. d.mu must be held.
+func (d *Device) publishLocked() {
+	if len(d.devices) == 0 {
+		d.readDev.Store(nil)
+		d.writeDev.Store(nil)
+	} else {
+		d.readDev.Store(d.devices[0])
+		d.writeDev.Store(d.devices[len(d.devices)-1])
+	}
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// changedCh returns a channel that is closed the next time the set of
+// underlying devices changes.
+func (d *Device) changedCh() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+// Add adds dev as the newest underlying device. Writes move to it
+// immediately, and the previous device is drained and closed
+// as described in [Device.SetHandoverGrace]. If dev has a different MTU
+// than the Device had, a tun.EventMTUUpdate is sent.
+func (d *Device) Add(dev tun.Device) {
+	w := newDevice(dev)
+	mtu, err := dev.MTU()
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		dev.Close()
+		return
+	}
+	prevMTU, _ := d.MTU()
+	mtuChanged := err == nil && mtu != prevMTU
+	d.stats.added.Add(1)
+	if len(d.devices) > 0 {
+		d.stats.handovers.Add(1)
+		d.handOverLocked(d.devices[len(d.devices)-1])
+	}
+	d.devices = append(d.devices, w)
+	d.publishLocked()
+	d.mu.Unlock()
+
+	go d.pumpEvents(w, mtuChanged)
+}
+
+// handOverLocked starts draining prev, which is being replaced.
+// d.mu must be held.
+func (d *Device) handOverLocked(prev *device) {
+	// The documentation for https://developer.android.com/reference/android/net/VpnService.Builder#establish()
+	// states that "Therefore, after draining the old file
+	// descriptor...", but pending Reads are never unblocked
+	// when a new descriptor is created. Read from it until it's idle
+	// or the grace period ends, and then close it.
+	grace := time.Duration(d.handoverGrace.Load())
+	if grace <= 0 {
+		prev.close()
+		return
+	}
+	prev.drainDeadline.Store(time.Now().Add(grace).UnixNano())
+	backstop := grace
+	if prev.batch != nil {
+		// Read closes the device itself, after counting any packets left.
+		// This only matters if nothing is reading.
+		backstop += drainIdle
+	}
+	time.AfterFunc(backstop, func() { prev.close() })
+}
+
+// readDraining reads from dev, which has been replaced, until it's idle or
+// its grace period ends. It reports done if dev should be retired instead.
+func (d *Device) readDraining(dev *device, deadline time.Time, bufs [][]byte, sizes []int, offset int) (n int, done bool) {
+	dev.reading.RLock()
+	defer dev.reading.RUnlock()
+	until := time.Now().Add(drainIdle)
+	forced := !until.Before(deadline)
+	if forced {
+		until = deadline
+	}
+	n, err := dev.batch.readUntil(bufs, sizes, offset, until)
+	if n > 0 {
+		d.stats.drained.Add(uint64(n))
+		return n, false
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && forced {
+		// The grace period ended while the device was still busy.
+		if dropped := dev.batch.discard(bufs[0]); dropped > 0 {
+			d.stats.dropped.Add(uint64(dropped))
+			log.Printf("multitun: dropped %d packets from replaced device", dropped)
+		}
+	}
+	dev.close()
+	return 0, true
+}
+
+// retire removes dev from the devices being read from, once it has been
+// closed and its pending Read has returned.
+func (d *Device) retire(dev *device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i := indexOf(d.devices, dev); i >= 0 {
+		d.devices = append(d.devices[:i:i], d.devices[i+1:]...)
+		d.publishLocked()
+	}
+}
+
+func indexOf(devices []*device, dev *device) int {
+	for i, d := range devices {
+		if d == dev {
+			return i
+		}
+	}
+	return -1
+}
+
+// pumpEvents forwards the events of dev until it's closed, after sending
+// a tun.EventMTUUpdate if mtuChanged.
+func (d *Device) pumpEvents(dev *device, mtuChanged bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in multitun.pumpEvents %s: %s", p, debug.Stack())
+			panic(p)
+		}
+	}()
+	if mtuChanged {
+		select {
+		case d.events <- tun.EventMTUUpdate:
+		case <-dev.closing:
+			return
+		}
+	}
+	for {
+		select {
+		case e, ok := <-dev.dev.Events():
+			if !ok {
+				return
+			}
+			select {
+			case d.events <- e:
+			case <-dev.closing:
+				return
+			}
+		case <-dev.closing:
+			return
+		}
+	}
+}
+
+// Up brings the Device up, allowing it to write packets
+// to the underlying tunnel device. If there is no underlying
+// device yet, write operations are pended until a new device
+// is added with [Device.Add].
+//
+// It reports whether this call brought the device up.
+func (d *Device) Up() bool {
+	d.downMu.Lock()
+	defer d.downMu.Unlock()
+	if !d.down {
+		return false
+	}
+	downCh := make(chan struct{})
+	d.downCh.Store(&downCh)
+	d.down = false
+	d.downTotal += time.Since(d.downSince)
+	return true
+}
+
+// Down brings the Device down, causing all outgoing packets
+// to be dropped without waiting for the underlying tunnel device,
+// and makes all [Device.Write] calls return immediately
+// until [Device.Up] is called.
+//
+// It mainly exists to distinguish between cases where the underlying
+// device is temporarily unavailable due to VPN reconfiguration,
+// in which case write requests should be pended, and cases where
+// Tailscale is stopped, where any pending and new requests
+// should complete immediately to prevent deadlocks.
+// See tailscale/tailscale#18679.
+//
+// It reports whether this call brought the device down.
+func (d *Device) Down() bool {
+	d.downMu.Lock()
+	defer d.downMu.Unlock()
+	if d.down {
+		return false
+	}
+	close(*d.downCh.Load())
+	d.down = true
+	d.downSince = time.Now()
+	return true
+}
+
+func (d *Device) File() *os.File {
+	// The underlying file descriptor is not constant on Android.
+	// Let's hope no-one uses it.
+	panic("not available on Android")
+}
+
+func (d *Device) Read(data [][]byte, sizes []int, offset int) (int, error) {
+	if s := d.impair.Load(); s != nil {
+		return s.read(data, sizes, offset)
+	}
+	return d.readDevice(data, sizes, offset)
+}
+
+// readDevice reads packets from the underlying devices.
+func (d *Device) readDevice(data [][]byte, sizes []int, offset int) (int, error) {
+	for {
+		dev := d.readDev.Load()
+		if dev == nil {
+			changed := d.changedCh()
+			if dev = d.readDev.Load(); dev == nil {
+				// We don't care about d.downCh here, as it's fine
+				// to continue waiting until the tunnel is up again
+				// or the Device is permanently closed.
+				// This does not block WireGuard reconfiguration.
+				select {
+				case <-changed:
+					continue
+				case <-d.closeCh:
+					// Return immediately if the Device is closed.
+					return 0, os.ErrClosed
+				}
+			}
+		}
+		if ns := dev.drainDeadline.Load(); ns != 0 && dev.batch != nil && !dev.isClosing() {
+			n, done := d.readDraining(dev, time.Unix(0, ns), data, sizes, offset)
+			if !done {
+				d.stats.countRead(sizes[:n])
+				d.captureRead(data, sizes[:n], offset)
+				return n, nil
+			}
+		}
+		n, err := dev.read(data, sizes, offset)
+		if err != nil && dev.isClosing() {
+			// The device was replaced or shut down while we were
+			// reading from it. Move on to the next one.
+			d.retire(dev)
+			if d.isClosed() {
+				return 0, os.ErrClosed
+			}
+			continue
+		}
+		if err != nil {
+			dev.readErrors.Add(1)
+			d.stats.readErrors.Add(1)
+		}
+		if n > 0 && dev.drainDeadline.Load() != 0 {
+			d.stats.drained.Add(uint64(n))
+		}
+		d.stats.countRead(sizes[:n])
+		d.captureRead(data, sizes[:n], offset)
+		return n, err
+	}
+}
+
+func (d *Device) Write(data [][]byte, offset int) (int, error) {
+	if s := d.impair.Load(); s != nil {
+		if n, ok := s.write(data, offset); ok {
+			return n, nil
+		}
+	}
+	return d.writeDevice(data, offset)
+}
+
+// writeDevice writes packets to the underlying devices.
+func (d *Device) writeDevice(data [][]byte, offset int) (int, error) {
+	captured := false
+	bufs := data
+	var at []int // where coalescing put each of data, if it ran
+	for {
+		downCh := *d.downCh.Load()
+		select {
+		case <-downCh:
+			// Drop the packet silently if the tunnel is down.
+			// Otherwise, a race may occur during wireguard reconfig
+			// and result in a deadlock, since a wireguard-go/device.Peer
+			// cannot be removed until its RoutineSequentialReceiver
+			// returns, and it will not return if it is blocked in
+			// (*Device).Write waiting for a device to be added.
+			d.stats.droppedDown.Add(uint64(len(data)))
+			return 0, nil
+		default:
+		}
+
+		if !captured {
+			// Capture packets before coalescing modifies them, and only
+			// once if the write is retried.
+			captured = true
+			if f := d.capture.Load(); f != nil {
+				for _, b := range data {
+					(*f)(ToLocal, b[offset:])
+				}
+			}
+			if d.coalesce.Load() {
+				bufs, at = coalesceTCP(data, offset)
+			}
+		}
+
+		dev := d.writeDev.Load()
+		if dev == nil {
+			changed := d.changedCh()
+			if dev = d.writeDev.Load(); dev == nil {
+				select {
+				case <-changed:
+				case <-downCh:
+				case <-d.closeCh:
+					// Return immediately if the Device is closed.
+					return 0, os.ErrClosed
+				}
+				continue
+			}
+		}
+		n, err := dev.write(bufs, offset)
+		if err != nil && dev.isClosing() {
+			// The device was replaced while we were writing to it.
+			// Retry on the new one, if any.
+			if d.isClosed() {
+				return 0, os.ErrClosed
+			}
+			continue
+		}
+		// Report the packets we were given, not how many they were
+		// coalesced into.
+		if err == nil {
+			n = len(data)
+		} else if at != nil {
+			n = consumed(at, n)
+		}
+		d.stats.countWrite(data[:n], offset)
+		return n, err
+	}
+}
+
+func (d *Device) isClosed() bool {
+	select {
+	case <-d.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *Device) MTU() (int, error) {
+	if dev := d.writeDev.Load(); dev != nil {
+		return dev.dev.MTU()
+	}
+	return d.defaultMTU, nil
+}
+
+func (d *Device) Name() (string, error) {
+	if dev := d.writeDev.Load(); dev != nil {
+		return dev.dev.Name()
+	}
+	return "", nil
+}
+
+func (d *Device) Events() <-chan tun.Event {
+	return d.events
+}
+
+// Shutdown closes all underlying devices, and waits for the reads from them
+// in progress to return. The Device itself stays usable, and resumes
+// operation once a new device is added.
+func (d *Device) Shutdown() {
+	d.mu.Lock()
+	d.stats.shutdowns.Add(1)
+	devices := d.devices
+	for _, dev := range devices {
+		dev.close()
+	}
+	d.devices = nil
+	d.publishLocked()
+	d.mu.Unlock()
+
+	// Reads retire their device once it's closed, which needs d.mu.
+	for _, dev := range devices {
+		dev.waitReads()
+	}
+}
+
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return os.ErrClosed
+	}
+	d.closed = true
+	close(d.closeCh)
+	var errs []error
+	for _, dev := range d.devices {
+		if err := dev.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	d.devices = nil
+	d.publishLocked()
+	return errors.Join(errs...)
+}
+
+// BatchSize returns the number of packets wireguard-go should exchange with
+// the Device per Read and Write. It's constant regardless of the underlying
+// devices, which don't all support batching.
+func (d *Device) BatchSize() int {
+	return batchSize
+}
@@ -0,0 +1,648 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// fakeTUN is a tun.Device backed by channels. Reads receive packets from in,
+// and writes send them to out. If in is nil, reads return packet immediately,
+// and if out is nil, writes are discarded.
+type fakeTUN struct {
+	name   string
+	mtu    int
+	in     chan []byte
+	out    chan []byte
+	packet []byte
+	events chan tun.Event
+	// errs, if non-nil, receives errors for Read to return.
+	errs chan error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeTUN(name string) *fakeTUN {
+	return &fakeTUN{
+		name:   name,
+		mtu:    1500,
+		in:     make(chan []byte),
+		out:    make(chan []byte, 16),
+		events: make(chan tun.Event, 5),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeTUN) File() *os.File { return nil }
+
+func (f *fakeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	if f.in == nil {
+		select {
+		case <-f.closed:
+			return 0, os.ErrClosed
+		default:
+		}
+		sizes[0] = copy(bufs[0][offset:], f.packet)
+		return 1, nil
+	}
+	select {
+	case p := <-f.in:
+		sizes[0] = copy(bufs[0][offset:], p)
+		return 1, nil
+	case err := <-f.errs:
+		return 0, err
+	case <-f.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (f *fakeTUN) Write(bufs [][]byte, offset int) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+	if f.out == nil {
+		return len(bufs), nil
+	}
+	for _, b := range bufs {
+		f.out <- bytes.Clone(b[offset:])
+	}
+	return len(bufs), nil
+}
+
+func (f *fakeTUN) MTU() (int, error)        { return f.mtu, nil }
+func (f *fakeTUN) Name() (string, error)    { return f.name, nil }
+func (f *fakeTUN) Events() <-chan tun.Event { return f.events }
+func (f *fakeTUN) BatchSize() int           { return 1 }
+
+func (f *fakeTUN) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeTUN) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+type readResult struct {
+	n    int
+	data []byte
+	err  error
+}
+
+// startRead starts a single-packet Read from d in the background.
+func startRead(d *Device) <-chan readResult {
+	ch := make(chan readResult, 1)
+	go func() {
+		bufs := [][]byte{make([]byte, 1500)}
+		sizes := []int{0}
+		n, err := d.Read(bufs, sizes, 0)
+		ch <- readResult{n, bufs[0][:sizes[0]], err}
+	}()
+	return ch
+}
+
+func waitResult[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+func assertBlocked[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpectedly completed: %+v", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func write(d *Device, p []byte) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		_, err := d.Write([][]byte{p}, 0)
+		ch <- err
+	}()
+	return ch
+}
+
+func TestReadWrite(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+
+	if mtu, _ := d.MTU(); mtu != 1280 {
+		t.Errorf("MTU before Add = %d, want 1280", mtu)
+	}
+
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+	if mtu, _ := d.MTU(); mtu != 1500 {
+		t.Errorf("MTU = %d, want 1500", mtu)
+	}
+	if name, _ := d.Name(); name != "tun0" {
+		t.Errorf("Name = %q, want tun0", name)
+	}
+
+	rc := startRead(d)
+	dev.in <- []byte("hello")
+	if r := waitResult(t, rc); r.err != nil || r.n != 1 || string(r.data) != "hello" {
+		t.Errorf("Read = %d, %q, %v; want 1, hello, nil", r.n, r.data, r.err)
+	}
+
+	if err := waitResult(t, write(d, []byte("world"))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := string(<-dev.out); got != "world" {
+		t.Errorf("wrote %q, want world", got)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.SetHandoverGrace(0)
+	d.Up()
+
+	dev1 := newFakeTUN("tun0")
+	d.Add(dev1)
+	rc := startRead(d)
+	assertBlocked(t, rc)
+
+	dev2 := newFakeTUN("tun1")
+	d.Add(dev2)
+	if !dev1.isClosed() {
+		t.Error("previous device not closed after Add")
+	}
+	// The pending Read moves on to the new device.
+	assertBlocked(t, rc)
+	dev2.in <- []byte("new")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "new" {
+		t.Errorf("Read = %q, %v; want new, nil", r.data, r.err)
+	}
+	if err := waitResult(t, write(d, []byte("out"))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := string(<-dev2.out); got != "out" {
+		t.Errorf("wrote %q to new device, want out", got)
+	}
+	if name, _ := d.Name(); name != "tun1" {
+		t.Errorf("Name = %q, want tun1", name)
+	}
+	if st := d.HandoverStats(); st.Handovers != 1 {
+		t.Errorf("Handovers = %d, want 1", st.Handovers)
+	}
+}
+
+func TestHandoverGrace(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.SetHandoverGrace(100 * time.Millisecond)
+	d.Up()
+
+	dev1 := newFakeTUN("tun0")
+	d.Add(dev1)
+	rc := startRead(d)
+	assertBlocked(t, rc)
+
+	dev2 := newFakeTUN("tun1")
+	d.Add(dev2)
+	if dev1.isClosed() {
+		t.Error("previous device closed before its grace period ended")
+	}
+	// Writes move to the new device right away...
+	if err := waitResult(t, write(d, []byte("out"))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := string(<-dev2.out); got != "out" {
+		t.Errorf("wrote %q to new device, want out", got)
+	}
+	// ...while packets still queued on the old one are read.
+	dev1.in <- []byte("old")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "old" {
+		t.Errorf("Read = %q, %v; want old, nil", r.data, r.err)
+	}
+
+	rc = startRead(d)
+	dev2.in <- []byte("new")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "new" {
+		t.Errorf("Read = %q, %v; want new, nil", r.data, r.err)
+	}
+	if !dev1.isClosed() {
+		t.Error("previous device not closed after its grace period")
+	}
+	if st := d.HandoverStats(); st != (HandoverStats{Handovers: 1, Drained: 1}) {
+		t.Errorf("HandoverStats = %+v, want 1 handover and 1 drained packet", st)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+
+	dev1 := newFakeTUN("tun0")
+	d.Add(dev1)
+	d.Shutdown()
+	if !dev1.isClosed() {
+		t.Error("device not closed after Shutdown")
+	}
+
+	// With no device, writes wait for the next one.
+	wc := write(d, []byte("pending"))
+	assertBlocked(t, wc)
+	dev2 := newFakeTUN("tun1")
+	d.Add(dev2)
+	if err := waitResult(t, wc); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := string(<-dev2.out); got != "pending" {
+		t.Errorf("wrote %q, want pending", got)
+	}
+}
+
+// slowCloseTUN is a fakeTUN whose Read, once unblocked by Close, only
+// returns after release is closed.
+type slowCloseTUN struct {
+	*fakeTUN
+	release chan struct{}
+}
+
+func (f *slowCloseTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := f.fakeTUN.Read(bufs, sizes, offset)
+	<-f.release
+	return n, err
+}
+
+func TestShutdownWaitsForReads(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+
+	dev := &slowCloseTUN{newFakeTUN("tun0"), make(chan struct{})}
+	d.Add(dev)
+	rc := startRead(d)
+	assertBlocked(t, rc)
+
+	done := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	assertBlocked(t, done)
+	close(dev.release)
+	waitResult(t, done)
+
+	// The read moves on to wait for the next device.
+	assertBlocked(t, rc)
+	dev2 := newFakeTUN("tun1")
+	d.Add(dev2)
+	dev2.in <- []byte("next")
+	if r := waitResult(t, rc); r.err != nil || string(r.data) != "next" {
+		t.Errorf("Read = %q, %v; want next", r.data, r.err)
+	}
+}
+
+func TestDownDropsWrites(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+
+	// The device starts down, so writes are dropped.
+	if err := waitResult(t, write(d, []byte("x"))); err != nil {
+		t.Fatalf("Write while down: %v", err)
+	}
+
+	if !d.Up() {
+		t.Error("Up reported no change")
+	}
+	if d.Up() {
+		t.Error("second Up reported a change")
+	}
+	wc := write(d, []byte("x"))
+	assertBlocked(t, wc)
+
+	// Bringing the device down unblocks pending writes.
+	if !d.Down() {
+		t.Error("Down reported no change")
+	}
+	if err := waitResult(t, wc); err != nil {
+		t.Fatalf("pending Write after Down: %v", err)
+	}
+
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+	if err := waitResult(t, write(d, []byte("x"))); err != nil {
+		t.Fatalf("Write while down: %v", err)
+	}
+	select {
+	case p := <-dev.out:
+		t.Errorf("wrote %q while down", p)
+	default:
+	}
+}
+
+func TestClose(t *testing.T) {
+	d := New(1280)
+	d.Up()
+
+	rc := startRead(d)
+	wc := write(d, []byte("x"))
+	assertBlocked(t, rc)
+	assertBlocked(t, wc)
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if r := waitResult(t, rc); !errors.Is(r.err, os.ErrClosed) {
+		t.Errorf("pending Read after Close: %v, want %v", r.err, os.ErrClosed)
+	}
+	if err := waitResult(t, wc); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("pending Write after Close: %v, want %v", err, os.ErrClosed)
+	}
+
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+	if !dev.isClosed() {
+		t.Error("device added after Close was not closed")
+	}
+	if r := waitResult(t, startRead(d)); !errors.Is(r.err, os.ErrClosed) {
+		t.Errorf("Read after Close: %v, want %v", r.err, os.ErrClosed)
+	}
+}
+
+func TestCloseWithDevice(t *testing.T) {
+	d := New(1280)
+	d.Up()
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+
+	rc := startRead(d)
+	assertBlocked(t, rc)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !dev.isClosed() {
+		t.Error("device not closed after Close")
+	}
+	if r := waitResult(t, rc); !errors.Is(r.err, os.ErrClosed) {
+		t.Errorf("pending Read after Close: %v, want %v", r.err, os.ErrClosed)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	d := New(1500) // the MTU of fakeTUN, so no MTU update is sent
+	defer d.Close()
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+	dev.events <- tun.EventUp
+	if e := waitResult(t, d.Events()); e != tun.EventUp {
+		t.Errorf("event = %v, want %v", e, tun.EventUp)
+	}
+}
+
+func TestMTUUpdate(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.SetHandoverGrace(0)
+	if mtu, _ := d.MTU(); mtu != 1280 {
+		t.Errorf("MTU = %d, want default 1280", mtu)
+	}
+	dev := newFakeTUN("tun0")
+	dev.mtu = 1420
+	d.Add(dev)
+	if e := waitResult(t, d.Events()); e != tun.EventMTUUpdate {
+		t.Errorf("event = %v, want %v", e, tun.EventMTUUpdate)
+	}
+	if mtu, _ := d.MTU(); mtu != 1420 {
+		t.Errorf("MTU = %d, want 1420", mtu)
+	}
+
+	// No event is sent if the MTU stays the same.
+	dev = newFakeTUN("tun1")
+	dev.mtu = 1420
+	d.Add(dev)
+	assertBlocked(t, d.Events())
+}
+
+// benchTUN is the interface shared by [Device] and legacyTUN.
+type benchTUN interface {
+	tun.Device
+	Add(tun.Device)
+	Up() bool
+}
+
+func benchImpls() []struct {
+	name string
+	new  func() benchTUN
+} {
+	return []struct {
+		name string
+		new  func() benchTUN
+	}{
+		{"legacy", func() benchTUN { return newLegacyTUN(1280) }},
+		{"direct", func() benchTUN { return New(1280) }},
+	}
+}
+
+func newBenchFakeTUN() *fakeTUN {
+	f := newFakeTUN("tun0")
+	f.in = nil
+	f.out = nil
+	f.packet = make([]byte, 1280)
+	return f
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, impl := range benchImpls() {
+		b.Run(impl.name, func(b *testing.B) {
+			d := impl.new()
+			defer d.Close()
+			d.Up()
+			d.Add(newBenchFakeTUN())
+			bufs := [][]byte{make([]byte, 1500)}
+			sizes := []int{0}
+			b.SetBytes(1280)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := d.Read(bufs, sizes, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, impl := range benchImpls() {
+		b.Run(impl.name, func(b *testing.B) {
+			d := impl.new()
+			defer d.Close()
+			d.Up()
+			d.Add(newBenchFakeTUN())
+			bufs := [][]byte{make([]byte, 1280)}
+			b.SetBytes(1280)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := d.Write(bufs, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadWrite reads and writes concurrently, as wireguard-go does.
+func BenchmarkReadWrite(b *testing.B) {
+	for _, impl := range benchImpls() {
+		b.Run(impl.name, func(b *testing.B) {
+			d := impl.new()
+			defer d.Close()
+			d.Up()
+			d.Add(newBenchFakeTUN())
+			b.SetBytes(2 * 1280)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bufs := [][]byte{make([]byte, 1500)}
+				sizes := []int{0}
+				for range b.N {
+					d.Read(bufs, sizes, 0)
+				}
+			}()
+			bufs := [][]byte{make([]byte, 1280)}
+			for range b.N {
+				d.Write(bufs, 0)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.SetHandoverGrace(0)
+
+	// Written while down.
+	waitResult(t, write(d, []byte("dropped")))
+	time.Sleep(10 * time.Millisecond)
+	d.Up()
+
+	dev1 := newFakeTUN("tun0")
+	d.Add(dev1)
+	dev2 := newFakeTUN("tun1")
+	d.Add(dev2)
+
+	rc := startRead(d)
+	dev2.in <- []byte("hello")
+	waitResult(t, rc)
+	waitResult(t, write(d, []byte("hi")))
+	<-dev2.out
+	d.Shutdown()
+
+	st := d.Stats()
+	want := Stats{
+		ReadPackets:       1,
+		ReadBytes:         5,
+		WritePackets:      1,
+		WriteBytes:        2,
+		WritesDroppedDown: 1,
+		DevicesAdded:      2,
+		Shutdowns:         1,
+		Handover:          HandoverStats{Handovers: 1},
+	}
+	if st.Down || st.DownTime < 10*time.Millisecond {
+		t.Errorf("Down, DownTime = %v, %v; want false, at least 10ms", st.Down, st.DownTime)
+	}
+	st.DownTime = 0
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("Stats:\n got %+v\nwant %+v", st, want)
+	}
+	for k, want := range map[Counter]uint64{
+		CounterReadPackets:       st.ReadPackets,
+		CounterWriteBytes:        st.WriteBytes,
+		CounterWritesDroppedDown: st.WritesDroppedDown,
+		CounterShutdowns:         st.Shutdowns,
+		CounterHandovers:         st.Handover.Handovers,
+		Counter(-1):              0,
+	} {
+		if got := d.Counter(k); got != want {
+			t.Errorf("Counter(%d) = %d, want %d", k, got, want)
+		}
+	}
+
+	dev3 := newFakeTUN("tun2")
+	d.Add(dev3)
+	if devs := d.Stats().Devices; len(devs) != 1 || devs[0].Name != "tun2" || devs[0].Draining {
+		t.Errorf("Devices = %+v, want tun2 only", devs)
+	}
+	if n, errs := d.CurrentDevice(); n != 1 || errs != 0 {
+		t.Errorf("CurrentDevice = %d, %d; want 1, 0", n, errs)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	d := New(1280)
+	defer d.Close()
+	d.Up()
+	dev := newFakeTUN("tun0")
+	d.Add(dev)
+
+	type captured struct {
+		dir Direction
+		pkt string
+	}
+	var (
+		mu  sync.Mutex
+		got []captured
+	)
+	d.SetCapture(func(dir Direction, pkt []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, captured{dir, string(pkt)})
+	})
+
+	rc := startRead(d)
+	dev.in <- []byte("out")
+	waitResult(t, rc)
+	waitResult(t, write(d, []byte("in")))
+	<-dev.out
+
+	d.SetCapture(nil)
+	waitResult(t, write(d, []byte("uncaptured")))
+	<-dev.out
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []captured{{FromLocal, "out"}, {ToLocal, "in"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("captured %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package multitun
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters are the traffic and lifecycle counters of a Device.
+type counters struct {
+	readPackets  atomic.Uint64
+	readBytes    atomic.Uint64
+	writePackets atomic.Uint64
+	writeBytes   atomic.Uint64
+	droppedDown  atomic.Uint64 // packets written while down
+	readErrors   atomic.Uint64
+
+	added     atomic.Uint64 // devices added
+	handovers atomic.Uint64 // devices replaced by a newer one
+	shutdowns atomic.Uint64
+	drained   atomic.Uint64 // packets read from replaced devices
+	dropped   atomic.Uint64 // packets discarded from replaced devices
+}
+
+func (c *counters) countRead(sizes []int) {
+	if len(sizes) == 0 {
+		return
+	}
+	var n int
+	for _, size := range sizes {
+		n += size
+	}
+	c.readPackets.Add(uint64(len(sizes)))
+	c.readBytes.Add(uint64(n))
+}
+
+func (c *counters) countWrite(bufs [][]byte, offset int) {
+	var n int
+	for _, b := range bufs {
+		n += len(b) - offset
+	}
+	c.writePackets.Add(uint64(len(bufs)))
+	c.writeBytes.Add(uint64(n))
+}
+
+// A Counter is one of the counters of a Device, which [Device.Counter] reads
+// on its own, without taking a snapshot of all of them.
+type Counter int
+
+const (
+	CounterReadPackets Counter = iota
+	CounterReadBytes
+	CounterWritePackets
+	CounterWriteBytes
+	CounterReadErrors
+	CounterWritesDroppedDown
+	CounterDevicesAdded
+	CounterShutdowns
+	CounterHandovers
+	CounterHandoverDrained
+	CounterHandoverDropped
+)
+
+// get returns the atomic of counter k, or nil if k is unknown.
+func (c *counters) get(k Counter) *atomic.Uint64 {
+	switch k {
+	case CounterReadPackets:
+		return &c.readPackets
+	case CounterReadBytes:
+		return &c.readBytes
+	case CounterWritePackets:
+		return &c.writePackets
+	case CounterWriteBytes:
+		return &c.writeBytes
+	case CounterReadErrors:
+		return &c.readErrors
+	case CounterWritesDroppedDown:
+		return &c.droppedDown
+	case CounterDevicesAdded:
+		return &c.added
+	case CounterShutdowns:
+		return &c.shutdowns
+	case CounterHandovers:
+		return &c.handovers
+	case CounterHandoverDrained:
+		return &c.drained
+	case CounterHandoverDropped:
+		return &c.dropped
+	}
+	return nil
+}
+
+// Counter returns the value of counter k of d, or 0 if k is unknown.
+func (d *Device) Counter(k Counter) uint64 {
+	if c := d.stats.get(k); c != nil {
+		return c.Load()
+	}
+	return 0
+}
+
+// Stats is a snapshot of the traffic and lifecycle counters of a Device.
+// Reads are packets from the local network stack bound for the tailnet,
+// and writes are packets from the tailnet delivered to it.
+type Stats struct {
+	ReadPackets  uint64
+	ReadBytes    uint64
+	WritePackets uint64
+	WriteBytes   uint64
+	// ReadErrors is the number of failed reads across all devices, not
+	// counting those caused by a device being replaced or shut down.
+	ReadErrors uint64
+	// WritesDroppedDown is the number of packets dropped because they were
+	// written while the Device was down.
+	WritesDroppedDown uint64
+
+	// DevicesAdded is the number of underlying devices added.
+	DevicesAdded uint64
+	// Shutdowns is the number of calls to [Device.Shutdown].
+	Shutdowns uint64
+	Handover  HandoverStats
+
+	// Down is whether the Device is currently down, and DownTime is the
+	// total time it has spent down, including the current period.
+	Down     bool
+	DownTime time.Duration
+
+	// Devices are the underlying devices currently in use, oldest first.
+	Devices []DeviceStats
+}
+
+// HandoverStats are counters for handovers between underlying devices.
+type HandoverStats struct {
+	// Handovers is the number of devices replaced by a newer one.
+	Handovers uint64
+	// Drained is the number of packets read from replaced devices.
+	Drained uint64
+	// Dropped is the number of packets still queued on replaced devices
+	// when their grace period ended. Packets lost by devices that don't
+	// expose their file descriptor aren't counted.
+	Dropped uint64
+}
+
+// DeviceStats describes an underlying device.
+type DeviceStats struct {
+	Name  string
+	Added time.Time
+	// Draining is whether the device has been replaced and is only read
+	// from until its grace period ends.
+	Draining   bool
+	ReadErrors uint64
+}
+
+// HandoverStats returns the handover counters of d.
+func (d *Device) HandoverStats() HandoverStats {
+	return HandoverStats{
+		Handovers: d.stats.handovers.Load(),
+		Drained:   d.stats.drained.Load(),
+		Dropped:   d.stats.dropped.Load(),
+	}
+}
+
+// Stats returns a snapshot of the counters of d.
+func (d *Device) Stats() Stats {
+	st := Stats{
+		ReadPackets:       d.stats.readPackets.Load(),
+		ReadBytes:         d.stats.readBytes.Load(),
+		WritePackets:      d.stats.writePackets.Load(),
+		WriteBytes:        d.stats.writeBytes.Load(),
+		ReadErrors:        d.stats.readErrors.Load(),
+		WritesDroppedDown: d.stats.droppedDown.Load(),
+		DevicesAdded:      d.stats.added.Load(),
+		Shutdowns:         d.stats.shutdowns.Load(),
+		Handover:          d.HandoverStats(),
+	}
+	st.Down, st.DownTime = d.DownTime()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dev := range d.devices {
+		st.Devices = append(st.Devices, DeviceStats{
+			Name:       dev.name,
+			Added:      dev.added,
+			Draining:   dev.drainDeadline.Load() != 0,
+			ReadErrors: dev.readErrors.Load(),
+		})
+	}
+	return st
+}
+
+// DownTime reports whether d is down, and the total time it has been down.
+func (d *Device) DownTime() (down bool, total time.Duration) {
+	d.downMu.Lock()
+	defer d.downMu.Unlock()
+	total = d.downTotal
+	if d.down {
+		total += time.Since(d.downSince)
+	}
+	return d.down, total
+}
+
+// CurrentDevice reports the number of underlying devices in use, and the
+// read errors of the newest one, which is the one packets are written to.
+func (d *Device) CurrentDevice() (devices int, readErrors uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.devices) == 0 {
+		return 0, 0
+	}
+	return len(d.devices), d.devices[len(d.devices)-1].readErrors.Load()
+}
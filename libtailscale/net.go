@@ -10,13 +10,17 @@ import (
 	"net/netip"
 	"runtime/debug"
 	"strings"
-	"syscall"
 
 	"github.com/tailscale/tailscale-android/libtailscale/ifaceparse"
 	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+	"github.com/tailscale/tailscale-android/libtailscale/splittunnel"
+	"github.com/tailscale/tailscale-android/libtailscale/tunretry"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnopts"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnsession"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/router"
 )
@@ -26,21 +30,6 @@ import (
 // VPN status was revoked.
 var errVPNNotPrepared = errors.New("VPN service not prepared or was revoked")
 
-// errMultipleUsers is used when we get a "INTERACT_ACROSS_USERS" error, which
-// happens due to a bug in Android. See:
-//
-//	https://github.com/tailscale/tailscale/issues/2180
-var errMultipleUsers = errors.New("VPN cannot be created on this device due to an Android bug with multiple users")
-
-// VpnService contains the IPNService class from Android, the file descriptor, and whether the descriptor has been detached.
-type VpnService struct {
-	service    IPNService
-	fd         int32
-	fdDetached bool
-}
-
-var vpnService = &VpnService{}
-
 // Report interfaces in the device in net.Interface format.
 func (a *App) getInterfaces() ([]netmon.Interface, error) {
 	jsonStr, err := a.appCtx.GetInterfacesAsJson()
@@ -52,18 +41,26 @@ func (a *App) getInterfaces() ([]netmon.Interface, error) {
 		return nil, nil
 	}
 
-	ifaces, st, err := ifaceparse.ParseInterfacesJSONAsNetmon([]byte(jsonStr))
+	ifaces, st, err := ifaceparse.ParseInterfacesJSON([]byte(jsonStr))
 	if err != nil {
 		return nil, err
 	}
 
-	if st.IfacesSkipped > 0 || st.AddrsSkipped > 0 {
-		log.Printf("getInterfaces(JSON): parsed %d/%d ifaces, %d/%d addrs (skipped %d ifaces, %d addrs)",
-			st.IfacesParsed, st.IfacesTotal, st.AddrsParsed, st.AddrsTotal, st.IfacesSkipped, st.AddrsSkipped)
+	if st.IfacesSkipped > 0 || st.AddrsSkipped > 0 || st.GatewaysSkipped > 0 || st.DNSServersSkipped > 0 {
+		log.Printf("getInterfaces(JSON): parsed %d/%d ifaces, %d/%d addrs (skipped %d ifaces, %d addrs, %d/%d gateways, %d/%d DNS servers)",
+			st.IfacesParsed, st.IfacesTotal, st.AddrsParsed, st.AddrsTotal, st.IfacesSkipped, st.AddrsSkipped,
+			st.GatewaysSkipped, st.GatewaysTotal, st.DNSServersSkipped, st.DNSServersTotal)
 
 	}
+	a.interfacesChanged(ifaces)
 
-	return ifaces, nil
+	// The network of each interface is kept in its Desc, which
+	// ifaceparse.FromNetmon decodes for consumers of the netmon state.
+	out := make([]netmon.Interface, 0, len(ifaces))
+	for _, it := range ifaces {
+		out = append(out, it.Interface)
+	}
+	return out, nil
 }
 
 // googleDNSServers are used on ChromeOS, where an empty VpnBuilder DNS setting results
@@ -76,38 +73,54 @@ var googleDNSServers = []netip.Addr{
 	netip.MustParseAddr("2001:4860:4860::8844"),
 }
 
-func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error) {
-	b.logger.Logf("updateTUN: changed")
-	defer b.logger.Logf("updateTUN: finished")
+// tunConfig is everything updateTUN applies to a VPNServiceBuilder.
+type tunConfig struct {
+	rcfg *router.Config
+	dcfg *dns.OSConfig
+	mtu  int
+	apps splittunnel.Filter
+	opts vpnopts.Options
+	sdk  int // Android SDK level, or 0 if unknown
+	agg  rangescalc.Aggregation
+}
 
-	if disableTUN := len(rcfg.LocalAddrs) == 0; disableTUN {
-		b.logger.Logf("updateTUN: closing old TUNs")
-		b.CloseTUNs()
-		b.logger.Logf("updateTUN: closed old TUNs")
+// useExclude reports whether to use ExcludeRoute (API 33+) for local routes,
+// rather than compute included prefixes and pass them to AddRoute (older
+// APIs).
+func (c tunConfig) useExclude() bool {
+	return c.sdk >= 33
+}
 
-		// Since the previous tunnel(s) are closed, the [multiTUN] device is
-		// not operational until a new underlying tunnel is created and added,
-		// which may never happen in case of an error or an empty [router.Config].
-		//
-		// Therefore, to prevent deadlocks where a [multiTUN.Write] would
-		// block waiting for a new tunnel to be added, we bring the multiTUN
-		// device down on exit unless a new [tun.Device] is created and added
-		// successfully. See tailscale/tailscale#18679.
-		//
-		// TODO(nickkhyl): revisit and simplify the [multiTUN] implementation?
-		if b.devices.Down() {
-			b.logger.Logf("updateTUN: tunnel brought down: %v", err)
-		}
-		return nil
+// tunConfig returns the tunConfig of rcfg and dcfg with the current settings.
+func (b *backend) tunConfig(rcfg *router.Config, dcfg *dns.OSConfig) tunConfig {
+	c := tunConfig{
+		rcfg: rcfg,
+		dcfg: dcfg,
+		mtu:  b.mtu.current(),
+		apps: b.apps.Get(),
+		opts: b.opts.Get().Options,
+		agg:  b.routeAgg.Get(),
 	}
+	if sdk, err := b.appCtx.GetSDKInt(); err == nil {
+		c.sdk = sdk
+	}
+	return c
+}
 
-	builder := vpnService.service.NewBuilder()
-	b.logger.Logf("updateTUN: got new builder")
-
-	if err := builder.SetMTU(defaultMTU); err != nil {
-		return err
+// configureBuilder applies c to builder, short of establishing the VPN. It
+// returns the result of the route calculation, unless local routes are
+// excluded with ExcludeRoute.
+func (b *backend) configureBuilder(builder VPNServiceBuilder, c tunConfig, logf logger.Logf) (calc *rangescalc.Result, err error) {
+	rcfg, dcfg := c.rcfg, c.dcfg
+	if err := builder.SetMTU(int32(c.mtu)); err != nil {
+		return nil, err
+	}
+	logf("updateTUN: set MTU %d", c.mtu)
+	applyApps(builder, c.apps, logf)
+	if err := applyOptions(builder, c.opts); err != nil {
+		return nil, err
 	}
-	b.logger.Logf("updateTUN: set MTU")
+	logf("updateTUN: set options %+v", c.opts)
 	if dcfg != nil {
 		nameservers := dcfg.Nameservers
 		if b.avoidEmptyDNS && len(nameservers) == 0 {
@@ -115,31 +128,24 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error)
 		}
 		for _, dns := range nameservers {
 			if err := builder.AddDNSServer(dns.String()); err != nil {
-				return err
+				return nil, err
 			}
 		}
 		for _, dom := range dcfg.SearchDomains {
 			if err := builder.AddSearchDomain(dom.WithoutTrailingDot()); err != nil {
-				return err
+				return nil, err
 			}
 		}
-		b.logger.Logf("updateTUN: set nameservers")
-	}
-
-	// Decide whether to use ExcludeRoute (API 33+) or compute included prefixes
-	// and pass them to AddRoute (older APIs).
-	useExclude := false
-	if sdk, err := b.appCtx.GetSDKInt(); err == nil && sdk >= 33 {
-		useExclude = true
+		logf("updateTUN: set nameservers")
 	}
 
-	if useExclude {
+	if c.useExclude() {
 		// For API 33+, use ExcludeRoute for LocalRoutes and AddRoute for Routes.
 		for _, route := range rcfg.Routes {
 			// Normalize route address; Builder.addRoute does not accept non-zero masked bits.
 			route = route.Masked()
 			if err := builder.AddRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-				return err
+				return nil, newEstablishError(EstablishErrorInvalidRoute, err)
 			}
 		}
 
@@ -150,33 +156,35 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error)
 			}
 			route = route.Masked()
 			if err := builder.ExcludeRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-				return err
+				return nil, newEstablishError(EstablishErrorInvalidRoute, err)
 			}
 		}
 
-		b.logger.Logf("updateTUN: added %d routes (exclude-mode), localRoutes=%d", len(rcfg.Routes), len(rcfg.LocalRoutes))
+		logf("updateTUN: added %d routes (exclude-mode), localRoutes=%d", len(rcfg.Routes), len(rcfg.LocalRoutes))
 	} else {
 		// Older APIs: compute allowed-minus-disallowed prefixes and AddRoute them.
-		prefixesV4, prefixesV6, err := rangescalc.Calculate(rcfg.Routes, rcfg.LocalRoutes)
+		res, err := rangescalc.CalculateWithin(rcfg.Routes, rcfg.LocalRoutes, rangescalc.MaxRoutes, c.agg)
 		if err != nil {
-			b.logger.Logf("updateTUN: route calculation error: %v", err)
-			return err
+			logf("updateTUN: route calculation error: %v", err)
+			return nil, err
 		}
+		calc = &res
+		prefixesV4, prefixesV6 := res.IPv4, res.IPv6
 
 		for _, route := range prefixesV4 {
 			route = route.Masked()
 			if err := builder.AddRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-				return err
+				return nil, newEstablishError(EstablishErrorInvalidRoute, err)
 			}
 		}
 		for _, route := range prefixesV6 {
 			route = route.Masked()
 			if err := builder.AddRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-				return err
+				return nil, newEstablishError(EstablishErrorInvalidRoute, err)
 			}
 		}
 
-		b.logger.Logf(
+		logf(
 			"updateTUN: added routes: v4=%d v6=%d total=%d (input routes=%d, localRoutes=%d)",
 			len(prefixesV4),
 			len(prefixesV6),
@@ -184,58 +192,104 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error)
 			len(rcfg.Routes),
 			len(rcfg.LocalRoutes),
 		)
-		b.logger.Logf("updateTUN: input routes: %v", rcfg.Routes)
-		b.logger.Logf("updateTUN: input local routes: %v", rcfg.LocalRoutes)
-		b.logger.Logf("updateTUN: effective routes v4: %v", prefixesV4)
-		b.logger.Logf("updateTUN: effective routes v6: %v", prefixesV6)
+		logf("updateTUN: input routes: %v", rcfg.Routes)
+		logf("updateTUN: input local routes: %v", rcfg.LocalRoutes)
+		logf("updateTUN: effective routes v4: %v", prefixesV4)
+		logf("updateTUN: effective routes v6: %v", prefixesV6)
 	}
 
 	for _, addr := range rcfg.LocalAddrs {
 		if err := builder.AddAddress(addr.Addr().String(), int32(addr.Bits())); err != nil {
-			return err
+			return nil, newEstablishError(EstablishErrorInvalidRoute, err)
 		}
 	}
-	b.logger.Logf("updateTUN: added %d local addrs", len(rcfg.LocalAddrs))
+	logf("updateTUN: added %d local addrs", len(rcfg.LocalAddrs))
+	return calc, nil
+}
 
-	parcelFD, err := builder.Establish()
+func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error) {
+	b.logger.Logf("updateTUN: changed")
+	defer b.logger.Logf("updateTUN: finished")
+
+	if disableTUN := len(rcfg.LocalAddrs) == 0; disableTUN {
+		b.logger.Logf("updateTUN: closing old TUNs")
+		b.CloseTUNs()
+		b.logger.Logf("updateTUN: closed old TUNs")
+
+		// Since the previous tunnel(s) are closed, the [multitun.Device] is
+		// not operational until a new underlying tunnel is created and added,
+		// which may never happen in case of an error or an empty [router.Config].
+		//
+		// Therefore, to prevent deadlocks where a [multitun.Device.Write] would
+		// block waiting for a new tunnel to be added, we bring the multitun
+		// device down on exit unless a new [tun.Device] is created and added
+		// successfully. See tailscale/tailscale#18679.
+		if b.devices.Down() {
+			b.logger.Logf("updateTUN: tunnel brought down: %v", err)
+		}
+		b.session.to(vpnsession.Requested, "no local addresses", nil)
+		return nil
+	}
+
+	svc := b.session.service()
+	b.session.establishing()
+	defer func() { b.session.established(err) }()
+	c := b.tunConfig(rcfg, dcfg)
+	builder := newRecordingBuilder(svc.NewBuilder(), c)
+	b.logger.Logf("updateTUN: got new builder")
+	defer func() { b.plans.Add(builder.Plan, err) }()
+
+	calc, err := b.configureBuilder(builder, c, b.logger.Logf)
+	builder.Plan.SetAggregation(calc)
 	if err != nil {
-		if strings.Contains(err.Error(), "INTERACT_ACROSS_USERS") {
+		return err
+	}
+
+	res, err := establish(builder)
+	if errors.Is(err, errEstablishTimeout) {
+		b.logger.Logf("updateTUN: %v", err)
+		return err
+	}
+	if err := establishResultErr(res, err); err != nil {
+		if establishErrorCode(err) == EstablishErrorMultipleUsers {
 			// Update VPN status if VPN interface cannot be created
-			b.logger.Logf("updateTUN: could not establish VPN because %v", err)
-			vpnService.service.UpdateVpnStatus(false)
-			return errMultipleUsers
+			svc.UpdateVpnStatus(false)
 		}
-		return fmt.Errorf("VpnService.Builder.establish: %v", err)
+		b.logger.Logf("updateTUN: could not establish VPN because %v", err)
+		return fmt.Errorf("VpnService.Builder.establish: %w", err)
 	}
-	log.Printf("Setting vpn activity status to true")
-	vpnService.service.UpdateVpnStatus(true)
-	b.logger.Logf("updateTUN: established VPN")
-
+	parcelFD := res.FileDescriptor()
 	if parcelFD == nil {
 		b.logger.Logf("updateTUN: could not establish VPN because builder.Establish returned a nil ParcelFileDescriptor")
-		return errVPNNotPrepared
+		return newEstablishError(EstablishErrorPermissionRevoked, errVPNNotPrepared)
 	}
+	log.Printf("Setting vpn activity status to true")
+	svc.UpdateVpnStatus(true)
+	b.logger.Logf("updateTUN: established VPN")
 
 	// detachFd.
 	tunFD, err := parcelFD.Detach()
-	vpnService.fdDetached = true
-	vpnService.fd = tunFD
-
 	if err != nil {
-		return fmt.Errorf("detachFd: %v", err)
+		return tunretry.Retryable(fmt.Errorf("detachFd: %v", err))
 	}
+	b.session.setFD(tunFD)
 	b.logger.Logf("updateTUN: detached FD")
 
 	// Create TUN device.
 	tunDev, _, err := tun.CreateUnmonitoredTUNFromFD(int(tunFD))
 	if err != nil {
-		closeFileDescriptor()
-		return err
+		if cerr := b.session.closeFD(); cerr != nil {
+			b.logger.Logf("updateTUN: %v", cerr)
+		}
+		return tunretry.Retryable(err)
 	}
+	// The tun device owns the fd now.
+	b.session.setFD(-1)
 	b.logger.Logf("updateTUN: created TUN device")
 
-	b.devices.add(tunDev)
+	b.devices.Add(tunDev)
 	b.logger.Logf("updateTUN: added TUN device")
+	b.releaseBlackhole()
 
 	if b.devices.Up() {
 		b.logger.Logf("tunnel brought up")
@@ -243,22 +297,19 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error)
 
 	b.lastCfg = rcfg
 	b.lastDNSCfg = dcfg
-	return nil
-}
-
-func closeFileDescriptor() error {
-	if vpnService.fd != -1 && vpnService.fdDetached {
-		err := syscall.Close(int(vpnService.fd))
-		vpnService.fd = -1
-		vpnService.fdDetached = false
-		return fmt.Errorf("error closing file descriptor: %w", err)
-	}
+	b.lastMTU = c.mtu
+	b.lastApps = c.apps
+	b.lastOpts = c.opts
+	b.applied.Store(&c)
+	b.reportAggregation(calc)
 	return nil
 }
 
 // CloseVPN closes any active TUN devices.
 func (b *backend) CloseTUNs() {
 	b.lastCfg = nil
+	b.applied.Store(nil)
+	b.reportAggregation(nil)
 	b.devices.Shutdown()
 }
 
@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/tailscale-android/libtailscale/ifaceparse"
+	"tailscale.com/health"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/opt"
+)
+
+// interfacesChanged records the interfaces reported by the app, and raises
+// vpnOtherVPNWarnable while another VPN is connected. It only clears the
+// warning it raised itself, leaving one from a failed establish to the
+// establish retries.
+func (a *App) interfacesChanged(ifaces []ifaceparse.Interface) {
+	a.ifaces.Store(&ifaces)
+	b := a.vpnBackend.Load()
+	if b == nil {
+		return
+	}
+	ht := b.sys.HealthTracker.Get()
+	if others := otherVPNs(ifaces); len(others) > 0 {
+		a.otherVPNWarned.Store(true)
+		ht.SetUnhealthy(vpnOtherVPNWarnable, health.Args{argInterfaces: strings.Join(others, ", ")})
+	} else if a.otherVPNWarned.Swap(false) {
+		ht.SetHealthy(vpnOtherVPNWarnable)
+	}
+}
+
+// otherVPNs returns the names of the VPN interfaces that are up and aren't
+// Tailscale's, that is, have no Tailscale address.
+func otherVPNs(ifaces []ifaceparse.Interface) []string {
+	var names []string
+	for _, it := range ifaces {
+		if !it.VPN || !it.IsUp() || slices.ContainsFunc(it.IPs(), tsaddr.IsTailscaleIP) {
+			continue
+		}
+		names = append(names, it.Name)
+	}
+	return names
+}
+
+// interfaceInfo is an interface, as served by serveInterfaces.
+type interfaceInfo struct {
+	Name         string
+	Index        int
+	MTU          int
+	Up           bool
+	Addrs        []string             `json:",omitempty"`
+	Transport    ifaceparse.Transport `json:",omitempty"`
+	Metered      opt.Bool             `json:",omitempty"`
+	VPN          bool                 `json:",omitempty"`
+	DefaultRoute bool                 `json:",omitempty"`
+	Gateways     []netip.Addr         `json:",omitempty"`
+	DNSServers   []netip.Addr         `json:",omitempty"`
+}
+
+// serveInterfaces serves the interfaces last reported by the app, with the
+// network each belongs to.
+func (a *App) serveInterfaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var ifaces []ifaceparse.Interface
+	if p := a.ifaces.Load(); p != nil {
+		ifaces = *p
+	}
+	infos := make([]interfaceInfo, 0, len(ifaces))
+	for _, it := range ifaces {
+		info := interfaceInfo{
+			Name:         it.Name,
+			Index:        it.Index,
+			MTU:          it.MTU,
+			Up:           it.IsUp(),
+			Transport:    it.Transport,
+			Metered:      it.Metered,
+			VPN:          it.VPN,
+			DefaultRoute: it.DefaultRoute,
+			Gateways:     it.Gateways,
+			DNSServers:   it.DNSServers,
+		}
+		for _, addr := range it.AltAddrs {
+			info.Addrs = append(info.Addrs, addr.String())
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, infos)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package pcapng writes packet captures in the pcapng format.
+//
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterfaceDesc   = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	linkTypeRaw          = 101 // raw IPv4 or IPv6 packets
+	optEndOfOpt          = 0
+	optIfName            = 2
+	optIfTSResol         = 9
+	optEPBFlags          = 2
+	defaultSnapLen       = 65535
+	nanosecondResolution = 9
+)
+
+// Direction is the direction of a captured packet, relative to the
+// capturing host.
+type Direction uint8
+
+const (
+	Unknown  Direction = 0
+	Inbound  Direction = 1
+	Outbound Direction = 2
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// Writer writes a pcapng stream with a single section and interface.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes the section header and the description of an interface
+// named ifName, carrying raw IP packets, to w, and returns a Writer for the
+// packets captured on it.
+func NewWriter(w io.Writer, ifName string) (*Writer, error) {
+	pw := &Writer{w: w}
+	if _, err := w.Write(pw.header(ifName)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) header(ifName string) []byte {
+	b := pw.buf[:0]
+
+	// Section Header Block.
+	b = appendU32(b, blockSectionHeader)
+	b = appendU32(b, 28)
+	b = appendU32(b, byteOrderMagic)
+	b = appendU16(b, 1) // major version
+	b = appendU16(b, 0) // minor version
+	b = appendU32(b, 0xffffffff)
+	b = appendU32(b, 0xffffffff) // section length unknown
+	b = appendU32(b, 28)
+
+	// Interface Description Block.
+	start := len(b)
+	b = appendU32(b, blockInterfaceDesc)
+	b = appendU32(b, 0) // length, filled in below
+	b = appendU16(b, linkTypeRaw)
+	b = appendU16(b, 0) // reserved
+	b = appendU32(b, defaultSnapLen)
+	if ifName != "" {
+		b = appendOption(b, optIfName, []byte(ifName))
+	}
+	b = appendOption(b, optIfTSResol, []byte{nanosecondResolution})
+	b = appendU32(b, optEndOfOpt) // opt_endofopt, zero length
+	b = finishBlock(b, start)
+
+	pw.buf = b[:0]
+	return b
+}
+
+// WritePacket writes pkt, captured at t in direction dir.
+func (pw *Writer) WritePacket(t time.Time, dir Direction, pkt []byte) error {
+	_, err := pw.w.Write(pw.appendPacket(t, dir, pkt))
+	return err
+}
+
+func (pw *Writer) appendPacket(t time.Time, dir Direction, pkt []byte) []byte {
+	b := pw.buf[:0]
+	ts := uint64(t.UnixNano())
+	b = appendU32(b, blockEnhancedPacket)
+	b = appendU32(b, 0) // length, filled in by finishBlock
+	b = appendU32(b, 0) // interface ID
+	b = appendU32(b, uint32(ts>>32))
+	b = appendU32(b, uint32(ts))
+	b = appendU32(b, uint32(len(pkt))) // captured length
+	b = appendU32(b, uint32(len(pkt))) // original length
+	b = append(b, pkt...)
+	b = append(b, make([]byte, pad4(len(pkt))-len(pkt))...)
+	if dir != Unknown {
+		b = appendOption(b, optEPBFlags, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+	}
+	b = appendU32(b, optEndOfOpt)
+	b = finishBlock(b, 0)
+	pw.buf = b[:0]
+	return b
+}
+
+// finishBlock fills in the length of the block starting at b[start:] and
+// appends its trailing length.
+func finishBlock(b []byte, start int) []byte {
+	n := len(b) - start + 4
+	binary.LittleEndian.PutUint32(b[start+4:], uint32(n))
+	return appendU32(b, uint32(n))
+}
+
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	b = appendU16(b, code)
+	b = appendU16(b, uint16(len(val)))
+	b = append(b, val...)
+	return append(b, make([]byte, pad4(len(val))-len(val))...)
+}
+
+func appendU16(b []byte, v uint16) []byte { return binary.LittleEndian.AppendUint16(b, v) }
+func appendU32(b []byte, v uint32) []byte { return binary.LittleEndian.AppendUint32(b, v) }
+
+func pad4(n int) int { return (n + 3) &^ 3 }
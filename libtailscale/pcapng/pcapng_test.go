@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// parseBlocks splits a pcapng stream into blocks, checking their framing.
+func parseBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	var blocks []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(b))
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n%4 != 0 || n < 12 || n > len(b) {
+			t.Fatalf("block of type %#x has invalid length %d", typ, n)
+		}
+		if trailer := int(binary.LittleEndian.Uint32(b[n-4:])); trailer != n {
+			t.Fatalf("block of type %#x has trailing length %d, want %d", typ, trailer, n)
+		}
+		blocks = append(blocks, block{typ, b[8 : n-4]})
+		b = b[n:]
+	}
+	return blocks
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "tun0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	if err := w.WritePacket(ts, Outbound, []byte{0x45, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(ts, Inbound, []byte{0x60, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := parseBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks, want 4", len(blocks))
+	}
+	if blocks[0].typ != blockSectionHeader || binary.LittleEndian.Uint32(blocks[0].body) != byteOrderMagic {
+		t.Errorf("first block is not a little-endian section header")
+	}
+	idb := blocks[1]
+	if idb.typ != blockInterfaceDesc || binary.LittleEndian.Uint16(idb.body) != linkTypeRaw {
+		t.Errorf("second block is not a raw IP interface description")
+	}
+	if !bytes.Contains(idb.body, []byte("tun0")) {
+		t.Errorf("interface description lacks the interface name")
+	}
+
+	for i, want := range []struct {
+		dir Direction
+		pkt []byte
+	}{
+		{Outbound, []byte{0x45, 1, 2, 3, 4}},
+		{Inbound, []byte{0x60, 1, 2, 3}},
+	} {
+		epb := blocks[2+i]
+		if epb.typ != blockEnhancedPacket {
+			t.Fatalf("block %d has type %#x, want an enhanced packet block", 2+i, epb.typ)
+		}
+		ns := uint64(binary.LittleEndian.Uint32(epb.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb.body[8:]))
+		if ns != uint64(ts.UnixNano()) {
+			t.Errorf("packet %d timestamp = %d, want %d", i, ns, ts.UnixNano())
+		}
+		n := int(binary.LittleEndian.Uint32(epb.body[12:]))
+		if got := epb.body[20 : 20+n]; !bytes.Equal(got, want.pkt) {
+			t.Errorf("packet %d = %x, want %x", i, got, want.pkt)
+		}
+		opts := epb.body[20+pad4(n):]
+		if code := binary.LittleEndian.Uint16(opts); code != optEPBFlags {
+			t.Fatalf("packet %d first option = %d, want epb_flags", i, code)
+		}
+		if dir := Direction(binary.LittleEndian.Uint32(opts[4:]) & 3); dir != want.dir {
+			t.Errorf("packet %d direction = %v, want %v", i, dir, want.dir)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	dir := t.TempDir()
+	// A stale file from a previous capture.
+	os.WriteFile(filepath.Join(dir, "capture-00042.pcapng"), []byte("old"), 0o600)
+
+	r, err := NewRing(dir, "capture", "tun0", 1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := make([]byte, 100)
+	for i := range 100 {
+		pkt[0] = byte(i)
+		if err := r.WritePacket(time.Now(), Outbound, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := RingFiles(dir, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("got files %q, want 3", names)
+	}
+	var last []block
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each file is a complete capture, slightly over the limit at most.
+		if len(b) > 1024+200 {
+			t.Errorf("%s is %d bytes, want about 1024 at most", name, len(b))
+		}
+		last = parseBlocks(t, b)
+		if last[0].typ != blockSectionHeader || last[1].typ != blockInterfaceDesc {
+			t.Errorf("%s doesn't start with section and interface headers", name)
+		}
+	}
+	// The newest file ends with the last packet.
+	if epb := last[len(last)-1]; epb.body[20] != 99 {
+		t.Errorf("last packet is %d, want 99", epb.body[20])
+	}
+}
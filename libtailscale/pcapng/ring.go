@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pcapng
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Ring writes a capture to a ring of files in a directory. Once the current
+// file reaches the maximum size, a new one is started, and the oldest files
+// are removed to keep at most the maximum number of files.
+type Ring struct {
+	dir      string
+	prefix   string
+	ifName   string
+	maxSize  int64
+	maxFiles int
+
+	seq  int // sequence number of the current file
+	f    *os.File
+	bw   *bufio.Writer
+	pw   *Writer
+	size int64 // bytes written to the current file
+}
+
+// FileExt is the extension of files written by Ring.
+const FileExt = ".pcapng"
+
+// NewRing returns a Ring that writes files named prefix-NNNNN.pcapng in dir,
+// each at most maxSize bytes, keeping at most maxFiles of them. Files from a
+// previous capture with the same prefix are removed.
+func NewRing(dir, prefix, ifName string, maxSize int64, maxFiles int) (*Ring, error) {
+	if maxSize <= 0 || maxFiles <= 0 {
+		return nil, errors.New("pcapng: ring limits must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	old, err := RingFiles(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range old {
+		os.Remove(filepath.Join(dir, name))
+	}
+	r := &Ring{
+		dir:      dir,
+		prefix:   prefix,
+		ifName:   ifName,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		seq:      -1,
+	}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RingFiles returns the names of the capture files with the given prefix in
+// dir, oldest first.
+func RingFiles(dir, prefix string) ([]string, error) {
+	ents, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range ents {
+		name := e.Name()
+		if strings.HasPrefix(name, prefix+"-") && strings.HasSuffix(name, FileExt) {
+			names = append(names, name)
+		}
+	}
+	// Sequence numbers are zero-padded, so they sort lexically.
+	slices.Sort(names)
+	return names, nil
+}
+
+func (r *Ring) fileName(seq int) string {
+	return fmt.Sprintf("%s-%05d%s", r.prefix, seq, FileExt)
+}
+
+// rotate closes the current file, if any, and starts a new one.
+func (r *Ring) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	r.seq++
+	f, err := os.OpenFile(filepath.Join(r.dir, r.fileName(r.seq)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.bw = bufio.NewWriter(f)
+	cw := &countingWriter{w: r.bw, n: &r.size}
+	r.size = 0
+	if r.pw, err = NewWriter(cw, r.ifName); err != nil {
+		return err
+	}
+	if old := r.seq - r.maxFiles; old >= 0 {
+		os.Remove(filepath.Join(r.dir, r.fileName(old)))
+	}
+	return nil
+}
+
+// WritePacket writes pkt, captured at t in direction dir, to the current
+// file, starting a new one first if it's full.
+func (r *Ring) WritePacket(t time.Time, dir Direction, pkt []byte) error {
+	if r.size >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	return r.pw.WritePacket(t, dir, pkt)
+}
+
+// Flush writes any buffered data to the current file.
+func (r *Ring) Flush() error {
+	return r.bw.Flush()
+}
+
+func (r *Ring) closeFile() error {
+	if r.f == nil {
+		return nil
+	}
+	err := errors.Join(r.bw.Flush(), r.f.Close())
+	r.f = nil
+	return err
+}
+
+// Close flushes and closes the current file. The capture files are kept.
+func (r *Ring) Close() error {
+	return r.closeFile()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tailscale/tailscale-android/libtailscale/vpnplan"
+	"tailscale.com/types/logger"
+)
+
+// errDryRun is returned by a recordingBuilder without a VPNServiceBuilder
+// when asked to establish the VPN.
+var errDryRun = errors.New("dry run: not establishing the VPN")
+
+// recordingBuilder is a VPNServiceBuilder that records the plan applied to
+// it, and passes it on to a VPNServiceBuilder, if any.
+type recordingBuilder struct {
+	*vpnplan.Recorder
+	next VPNServiceBuilder // nil for a dry run
+}
+
+func newRecordingBuilder(next VPNServiceBuilder, c tunConfig) *recordingBuilder {
+	return &recordingBuilder{
+		Recorder: &vpnplan.Recorder{
+			Next: next,
+			Plan: vpnplan.Plan{SDK: c.sdk, ExcludeMode: c.useExclude()},
+		},
+		next: next,
+	}
+}
+
+func (r *recordingBuilder) Establish() (EstablishResult, error) {
+	if r.next == nil {
+		return nil, errDryRun
+	}
+	return r.next.Establish()
+}
+
+type dryRunPlan struct {
+	Plan vpnplan.Plan
+	// Closed reports whether the config has no addresses, in which case
+	// the tun device is closed rather than established with Plan.
+	Closed bool `json:",omitempty"`
+	// Err is the error that would stop the plan from being applied.
+	Err string `json:",omitempty"`
+}
+
+// serveVPNPlan serves the plan updateTUN would apply to the VPN for the
+// current router and DNS configs and settings, without applying it.
+func (a *App) serveVPNPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	b := a.vpnBackend.Load()
+	if b == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	rcfg, dcfg := b.facade.config()
+	if rcfg == nil {
+		http.Error(w, "no router config yet", http.StatusNotFound)
+		return
+	}
+	c := b.tunConfig(rcfg, dcfg)
+	builder := newRecordingBuilder(nil, c)
+	var res dryRunPlan
+	if len(rcfg.LocalAddrs) == 0 {
+		res.Closed = true
+	} else {
+		calc, err := b.configureBuilder(builder, c, logger.Discard)
+		builder.Plan.SetAggregation(calc)
+		if err != nil {
+			res.Err = err.Error()
+		}
+	}
+	res.Plan = builder.Plan
+	writeJSON(w, res)
+}
+
+// serveVPNPlanHistory serves the plans most recently applied to the VPN, most
+// recent first, with the time they were applied and whether establishing the
+// VPN failed.
+func (a *App) serveVPNPlanHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	b := a.vpnBackend.Load()
+	if b == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, b.plans.List())
+}
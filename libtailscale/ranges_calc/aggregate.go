@@ -0,0 +1,296 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// MaxRoutes is the number of prefixes Calculate returns at most.
+const MaxRoutes = maxCalculatedRoutes
+
+// Aggregation is how CalculateWithin fits the calculated prefixes into its
+// budget.
+type Aggregation string
+
+const (
+	// OverInclude merges neighbouring prefixes into their smallest common
+	// prefix, routing the addresses between them through the VPN, even if
+	// they're not in any route.
+	OverInclude Aggregation = "overinclude"
+	// DropExclusions ignores local routes, smallest first, routing the
+	// addresses they excluded through the VPN. If the prefixes still
+	// exceed the budget without any local routes, they're merged as with
+	// OverInclude.
+	DropExclusions Aggregation = "dropexclusions"
+	// Fail returns ErrTooManyRoutes, as Calculate does.
+	Fail Aggregation = "fail"
+)
+
+// ParseAggregation parses an Aggregation. The empty string is OverInclude.
+func ParseAggregation(s string) (Aggregation, error) {
+	switch a := Aggregation(s); a {
+	case "":
+		return OverInclude, nil
+	case OverInclude, DropExclusions, Fail:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown route aggregation %q; want %q, %q or %q", s, OverInclude, DropExclusions, Fail)
+}
+
+// Result is the result of CalculateWithin.
+type Result struct {
+	IPv4, IPv6 []netip.Prefix
+	// Calculated is the number of prefixes before aggregation.
+	Calculated int
+	// Aggregation is how the prefixes were fit into the budget, or empty
+	// if they fit.
+	Aggregation Aggregation `json:",omitempty"`
+	// DroppedExclusions are the local routes ignored by DropExclusions.
+	DroppedExclusions []netip.Prefix `json:",omitempty"`
+	// Affected are the addresses routed through the VPN only because of
+	// aggregation, as minimal prefixes.
+	Affected []netip.Prefix `json:",omitempty"`
+}
+
+// CalculateWithin is like Calculate, but returns at most budget prefixes,
+// which must be at least 2. If more result, they're aggregated with agg.
+func CalculateWithin(routes, localRoutes []netip.Prefix, budget int, agg Aggregation) (Result, error) {
+	if budget < 2 {
+		return Result{}, fmt.Errorf("route budget %d is less than 2", budget)
+	}
+	ranges4, ranges6 := newRangesCalc(routes, localRoutes).ranges()
+	s4, s6 := space{bits: 32}, space{bits: 128}
+	res := Result{IPv4: s4.cidrs(ranges4), IPv6: s6.cidrs(ranges6)}
+	res.Calculated = len(res.IPv4) + len(res.IPv6)
+	if res.Calculated <= budget {
+		return res, nil
+	}
+
+	switch agg {
+	case Fail:
+		return Result{}, fmt.Errorf("%w: %d exceed cap (%d)", ErrTooManyRoutes, res.Calculated, budget)
+	case DropExclusions:
+		var r4, r6 []ipRange
+		r4, r6, res.DroppedExclusions = dropExclusions(routes, localRoutes, ranges4, ranges6, budget)
+		res.IPv4, res.IPv6 = s4.cidrs(r4), s6.cidrs(r6)
+	case OverInclude:
+	default:
+		return Result{}, fmt.Errorf("unknown route aggregation %q", agg)
+	}
+	res.Aggregation = agg
+	res.IPv4, res.IPv6 = overInclude(res.IPv4, res.IPv6, budget)
+	res.Affected = append(
+		s4.cidrs(s4.subtractRanges(s4.prefixRanges(res.IPv4), ranges4)),
+		s6.cidrs(s6.subtractRanges(s6.prefixRanges(res.IPv6), ranges6))...)
+	return res, nil
+}
+
+// dropExclusions drops the non-loopback localRoutes, smallest first, from
+// ranges4 and ranges6, the ranges of routes minus localRoutes, until their
+// prefixes fit in budget or no local routes are left. It returns the new
+// ranges, and the local routes dropped.
+//
+// Rather than subtracting the remaining local routes from the routes again
+// for every local route dropped, it first computes the part of each local
+// route that no local route dropped after it covers. Dropping a local route
+// then adds back exactly that part, intersected with the routes.
+func dropExclusions(routes, localRoutes []netip.Prefix, ranges4, ranges6 []ipRange, budget int) (r4, r6 []ipRange, dropped []netip.Prefix) {
+	spaces := [2]space{{bits: 32}, {bits: 128}}
+	family := func(p netip.Prefix) int {
+		if p.Addr().Is4() {
+			return 0
+		}
+		return 1
+	}
+
+	var excl []netip.Prefix
+	for _, p := range localRoutes {
+		if !p.Addr().IsLoopback() {
+			excl = append(excl, p.Masked())
+		}
+	}
+	// Drop the smallest exclusions first, since they affect the fewest
+	// addresses.
+	slices.SortStableFunc(excl, func(a, b netip.Prefix) int { return cmp.Compare(b.Bits(), a.Bits()) })
+
+	// uncovered[i] is the part of excl[i] not in any of excl[i+1:].
+	uncovered := make([][]ipRange, len(excl))
+	var later [2][]ipRange // the union of excl[i+1:], sorted and merged
+	for i := len(excl) - 1; i >= 0; i-- {
+		f := family(excl[i])
+		s := spaces[f]
+		r := s.prefixToRange(excl[i])
+		lo, hi := overlapping(later[f], r)
+		uncovered[i] = s.subtractRanges([]ipRange{r}, later[f][lo:hi])
+		later[f] = s.insertRange(later[f], r)
+	}
+
+	var allowed [2][]ipRange
+	for _, p := range routes {
+		f := family(p)
+		allowed[f] = append(allowed[f], spaces[f].prefixToRange(p))
+	}
+	ranges := [2][]ipRange{slices.Clone(ranges4), slices.Clone(ranges6)}
+	count := 0
+	for f, s := range spaces {
+		allowed[f] = s.mergeRanges(allowed[f])
+		for _, r := range ranges[f] {
+			count += s.cidrCount(r)
+		}
+	}
+
+	for i := 0; i < len(excl) && count > budget; i++ {
+		dropped = append(dropped, excl[i])
+		f := family(excl[i])
+		s := spaces[f]
+		for _, u := range uncovered[i] {
+			lo, hi := overlapping(allowed[f], u)
+			for _, a := range allowed[f][lo:hi] {
+				add := ipRange{start: max128(a.start, u.start), end: min128(a.end, u.end)}
+				// add is disjoint from the ranges, as it was excluded,
+				// but may be adjacent to them.
+				lo, hi := s.adjacent(ranges[f], add)
+				for _, r := range ranges[f][lo:hi] {
+					count -= s.cidrCount(r)
+				}
+				ranges[f] = s.insertRange(ranges[f], add)
+				count += s.cidrCount(ranges[f][lo])
+			}
+		}
+	}
+	return ranges[0], ranges[1], dropped
+}
+
+// overlapping returns the bounds of the ranges of the sorted, merged set
+// that overlap r.
+func overlapping(set []ipRange, r ipRange) (lo, hi int) {
+	lo = sort.Search(len(set), func(i int) bool { return set[i].end.cmp(r.start) >= 0 })
+	hi = sort.Search(len(set), func(i int) bool { return set[i].start.cmp(r.end) > 0 })
+	return lo, max(lo, hi)
+}
+
+// adjacent returns the bounds of the ranges of the sorted, merged set that
+// overlap r or are adjacent to it.
+func (s space) adjacent(set []ipRange, r ipRange) (lo, hi int) {
+	last := mask(s.bits)
+	lo = sort.Search(len(set), func(i int) bool {
+		return set[i].end == last || set[i].end.addOne().cmp(r.start) >= 0
+	})
+	hi = sort.Search(len(set), func(i int) bool {
+		return r.end != last && set[i].start.cmp(r.end.addOne()) > 0
+	})
+	return lo, max(lo, hi)
+}
+
+// insertRange inserts r into the sorted, merged set, merging it with the
+// ranges it overlaps or is adjacent to.
+func (s space) insertRange(set []ipRange, r ipRange) []ipRange {
+	lo, hi := s.adjacent(set, r)
+	if lo < hi {
+		r.start = min128(r.start, set[lo].start)
+		r.end = max128(r.end, set[hi-1].end)
+	}
+	return slices.Replace(set, lo, hi, r)
+}
+
+// overInclude merges the sorted, disjoint prefixes of v4 and v6 until there
+// are at most budget of them, merging first the neighbouring prefixes with
+// the smallest common prefix, and in address order, IPv4 first, among equal
+// ones. Merging prefixes replaces all the prefixes their common prefix
+// contains with it.
+//
+// Merging the neighbours whose common prefix has h host bits never changes
+// the common prefix of other neighbours with at least h host bits, so the
+// number of prefixes left after merging all neighbours up to h host bits is
+// known upfront. overInclude picks the smallest h that fits the budget, and
+// merges in a single pass all neighbours up to h-1 host bits and, in order,
+// just enough of the common prefixes with h host bits.
+func overInclude(v4, v6 []netip.Prefix, budget int) ([]netip.Prefix, []netip.Prefix) {
+	n := len(v4) + len(v6)
+	if n <= budget {
+		return v4, v6
+	}
+	spaces := [2]space{{bits: 32}, {bits: 128}}
+	lists := [2][]netip.Prefix{v4, v6}
+
+	// levels[f][i] is the number of host bits of the common prefix of
+	// lists[f][i] and lists[f][i+1], and hist counts the levels.
+	var levels [2][]int
+	var hist [129]int
+	for f, ps := range lists {
+		for i := 1; i < len(ps); i++ {
+			l := spaces[f].commonHostBits(ps[i-1], ps[i])
+			levels[f] = append(levels[f], l)
+			hist[l]++
+		}
+	}
+	// Merging all neighbours leaves one prefix per family, so this ends
+	// with h ≤ 128.
+	h, below := 0, 0 // below is the number of levels under h
+	for n-below-hist[h] > budget {
+		below += hist[h]
+		h++
+	}
+	need := n - below - budget // merges needed at level h
+
+	for f, ps := range lists {
+		if len(ps) == 0 {
+			continue
+		}
+		var out []netip.Prefix
+		first, bits := ps[0], hostBits(ps[0])
+		open := false // whether merging the common prefix at level h
+		for i := 1; i < len(ps); i++ {
+			l := levels[f][i-1]
+			join := l < h
+			switch {
+			case l == h:
+				if !open && need > 0 {
+					open = true
+				}
+				if open {
+					join = true
+					need--
+				}
+			case l > h:
+				open = false
+			}
+			if join {
+				bits = max(bits, l)
+				continue
+			}
+			out = append(out, netip.PrefixFrom(first.Addr(), spaces[f].bits-bits).Masked())
+			first, bits = ps[i], hostBits(ps[i])
+		}
+		lists[f] = append(out, netip.PrefixFrom(first.Addr(), spaces[f].bits-bits).Masked())
+	}
+	return lists[0], lists[1]
+}
+
+// commonHostBits returns the number of host bits of the smallest prefix
+// containing the disjoint prefixes p and q.
+func (s space) commonHostBits(p, q netip.Prefix) int {
+	diff := s.prefixToRange(p).start.xor(s.prefixToRange(q).start)
+	return max(hostBits(p), hostBits(q), diff.bitLen())
+}
+
+// hostBits returns the number of host bits of p, so that it spans
+// 2^hostBits(p) addresses.
+func hostBits(p netip.Prefix) int {
+	return p.Addr().BitLen() - p.Bits()
+}
+
+// prefixRanges returns the ranges of the sorted, disjoint prefixes ps, merged.
+func (s space) prefixRanges(ps []netip.Prefix) []ipRange {
+	ranges := make([]ipRange, 0, len(ps))
+	for _, p := range ps {
+		ranges = append(ranges, s.prefixToRange(p))
+	}
+	return s.mergeRanges(ranges)
+}
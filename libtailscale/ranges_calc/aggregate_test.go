@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func containedIn(addr netip.Addr, ps []netip.Prefix) bool {
+	return slices.ContainsFunc(ps, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// hosts returns 10.0.0.1/32, 10.0.0.3/32, ..., n disjoint prefixes.
+func hosts(n int) []netip.Prefix {
+	var ps []netip.Prefix
+	a := netip.MustParseAddr("10.0.0.1")
+	for range n {
+		ps = append(ps, netip.PrefixFrom(a, 32))
+		a = a.Next().Next()
+	}
+	return ps
+}
+
+func TestCalculateWithinFits(t *testing.T) {
+	routes := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	local := []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}
+	res, err := CalculateWithin(routes, local, MaxRoutes, OverInclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, _, _ := Calculate(routes, local)
+	if !slices.Equal(res.IPv4, v4) || res.Aggregation != "" || res.Affected != nil {
+		t.Errorf("Result = %+v, want %v unaggregated", res, v4)
+	}
+}
+
+func TestCalculateWithinOverInclude(t *testing.T) {
+	routes := append(hosts(600), netip.MustParsePrefix("fd7a:115c:a1e0::/48"))
+	res, err := CalculateWithin(routes, nil, MaxRoutes, OverInclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(res.IPv4) + len(res.IPv6); n > MaxRoutes {
+		t.Fatalf("%d prefixes exceed the budget", n)
+	}
+	if res.Calculated != 601 || res.Aggregation != OverInclude {
+		t.Errorf("Calculated = %d, Aggregation = %q", res.Calculated, res.Aggregation)
+	}
+	for _, r := range routes {
+		if !containedIn(r.Addr(), append(res.IPv4, res.IPv6...)) {
+			t.Errorf("route %v dropped", r)
+		}
+	}
+	// Merging neighbouring /32s over-includes the even addresses between
+	// them, and nothing else.
+	var affected int
+	for _, p := range res.Affected {
+		if p.Bits() != 32 || p.Addr().As4()[3]%2 != 0 || containedIn(p.Addr(), routes) {
+			t.Errorf("unexpected affected prefix %v", p)
+		}
+		if !containedIn(p.Addr(), res.IPv4) {
+			t.Errorf("affected prefix %v is not routed", p)
+		}
+		affected++
+	}
+	// 601 prefixes are merged into 500 by merging 101 pairs of /32s into
+	// /30s, each adding two addresses.
+	if affected != 202 {
+		t.Errorf("%d affected prefixes, want 202", affected)
+	}
+}
+
+func TestCalculateWithinDropExclusions(t *testing.T) {
+	routes := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	local := append(hosts(100), netip.MustParsePrefix("192.168.0.0/16"))
+	res, err := CalculateWithin(routes, local, 100, DropExclusions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(res.IPv4); n > 100 {
+		t.Fatalf("%d prefixes exceed the budget", n)
+	}
+	if len(res.DroppedExclusions) == 0 || slices.Contains(res.DroppedExclusions, netip.MustParsePrefix("192.168.0.0/16")) {
+		t.Fatalf("DroppedExclusions = %v, want some of the /32s only", res.DroppedExclusions)
+	}
+	// The affected addresses are exactly the dropped exclusions.
+	slices.SortFunc(res.DroppedExclusions, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+	if !slices.Equal(res.Affected, res.DroppedExclusions) {
+		t.Errorf("Affected = %v, want %v", res.Affected, res.DroppedExclusions)
+	}
+	if containedIn(netip.MustParseAddr("192.168.1.1"), res.IPv4) {
+		t.Error("LAN routed through the VPN")
+	}
+}
+
+func TestCalculateWithinFail(t *testing.T) {
+	_, err := CalculateWithin(hosts(600), nil, MaxRoutes, Fail)
+	if !errors.Is(err, ErrTooManyRoutes) {
+		t.Errorf("err = %v, want ErrTooManyRoutes", err)
+	}
+	if _, _, err := Calculate(hosts(600), nil); !errors.Is(err, ErrTooManyRoutes) {
+		t.Errorf("Calculate err = %v, want ErrTooManyRoutes", err)
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+	for s, want := range map[string]Aggregation{"": OverInclude, "overinclude": OverInclude, "dropexclusions": DropExclusions, "fail": Fail} {
+		if got, err := ParseAggregation(s); err != nil || got != want {
+			t.Errorf("ParseAggregation(%q) = %q, %v", s, got, err)
+		}
+	}
+	if _, err := ParseAggregation("merge"); err == nil {
+		t.Error("ParseAggregation(merge) succeeded")
+	}
+}
+
+func TestCalculateWithinMatchesQuadratic(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	for range 500 {
+		data := make([]byte, 4*rng.IntN(48))
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		routes, localRoutes := prefixesFromBytes(data)
+		for _, agg := range []Aggregation{OverInclude, DropExclusions} {
+			budget := 2 + rng.IntN(20)
+			got, err := CalculateWithin(routes, localRoutes, budget, agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := quadraticCalculateWithin(routes, localRoutes, budget, agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("CalculateWithin(%v, %v, %d, %s) = %+v, want %+v", routes, localRoutes, budget, agg, got, want)
+			}
+		}
+	}
+}
+
+// quadraticCalculateWithin is the original implementation of CalculateWithin,
+// which recalculates the routes for every exclusion dropped and merges one
+// pair of prefixes at a time.
+func quadraticCalculateWithin(routes, localRoutes []netip.Prefix, budget int, agg Aggregation) (Result, error) {
+	if budget < 2 {
+		return Result{}, fmt.Errorf("route budget %d is less than 2", budget)
+	}
+	ranges4, ranges6 := newRangesCalc(routes, localRoutes).ranges()
+	s4, s6 := space{bits: 32}, space{bits: 128}
+	res := Result{IPv4: s4.cidrs(ranges4), IPv6: s6.cidrs(ranges6)}
+	res.Calculated = len(res.IPv4) + len(res.IPv6)
+	if res.Calculated <= budget {
+		return res, nil
+	}
+
+	switch agg {
+	case Fail:
+		return Result{}, fmt.Errorf("%w: %d exceed cap (%d)", ErrTooManyRoutes, res.Calculated, budget)
+	case DropExclusions:
+		var excl []netip.Prefix
+		for _, p := range localRoutes {
+			if !p.Addr().IsLoopback() {
+				excl = append(excl, p.Masked())
+			}
+		}
+		// Drop the smallest exclusions first, since they affect the
+		// fewest addresses.
+		slices.SortStableFunc(excl, func(a, b netip.Prefix) int { return cmp.Compare(b.Bits(), a.Bits()) })
+		for len(res.IPv4)+len(res.IPv6) > budget && len(excl) > 0 {
+			res.DroppedExclusions = append(res.DroppedExclusions, excl[0])
+			excl = excl[1:]
+			r4, r6 := newRangesCalc(routes, excl).ranges()
+			res.IPv4, res.IPv6 = s4.cidrs(r4), s6.cidrs(r6)
+		}
+	case OverInclude:
+	default:
+		return Result{}, fmt.Errorf("unknown route aggregation %q", agg)
+	}
+	res.Aggregation = agg
+	res.IPv4, res.IPv6 = quadraticOverInclude(res.IPv4, res.IPv6, budget)
+	res.Affected = append(
+		s4.cidrs(s4.subtractRanges(s4.prefixRanges(res.IPv4), ranges4)),
+		s6.cidrs(s6.subtractRanges(s6.prefixRanges(res.IPv6), ranges6))...)
+	return res, nil
+}
+
+// overInclude merges the sorted, disjoint prefixes of v4 and v6 until there
+// are at most budget of them. It repeatedly picks the two neighbouring
+// prefixes with the smallest common prefix, and replaces all the prefixes it
+// contains with it.
+func quadraticOverInclude(v4, v6 []netip.Prefix, budget int) ([]netip.Prefix, []netip.Prefix) {
+	lists := [2]*[]netip.Prefix{&v4, &v6}
+	for len(v4)+len(v6) > budget {
+		var (
+			best     netip.Prefix
+			bestList *[]netip.Prefix
+			bestAt   int
+		)
+		for _, l := range lists {
+			ps := *l
+			for i := 0; i+1 < len(ps); i++ {
+				s := quadraticSupernet(ps[i], ps[i+1])
+				if bestList == nil || hostBits(s) < hostBits(best) {
+					best, bestList, bestAt = s, l, i
+				}
+			}
+		}
+		if bestList == nil {
+			break // one prefix per family
+		}
+		ps := *bestList
+		lo, hi := bestAt, bestAt+1
+		for lo > 0 && best.Contains(ps[lo-1].Addr()) {
+			lo--
+		}
+		for hi+1 < len(ps) && best.Contains(ps[hi+1].Addr()) {
+			hi++
+		}
+		*bestList = slices.Replace(ps, lo, hi+1, best)
+	}
+	return v4, v6
+}
+
+// quadraticSupernet returns the smallest prefix containing p and q, which must be of
+// the same family.
+func quadraticSupernet(p, q netip.Prefix) netip.Prefix {
+	for bits := min(p.Bits(), q.Bits()); ; bits-- {
+		s, _ := p.Addr().Prefix(bits)
+		if s.Contains(q.Addr()) {
+			return s
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"math/big"
+	"net/netip"
+	"sort"
+)
+
+// This is the original math/big implementation of Calculate, without the
+// cap, that the fixed-width one is checked against.
+
+// bigRange is an IP range [Start, End] (inclusive).
+type bigRange struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+// bigSpace describes the address space (32 for IPv4, 128 for IPv6).
+type bigSpace struct {
+	bits uint
+}
+
+// ---------- netip.Addr <-> big.Int ----------
+func (s bigSpace) addrToInt(a netip.Addr) *big.Int {
+	if s.bits == 32 {
+		b := a.As4()
+		return new(big.Int).SetBytes(b[:])
+	}
+	b := a.As16()
+	return new(big.Int).SetBytes(b[:])
+}
+
+func (s bigSpace) intToAddr(i *big.Int) netip.Addr {
+	b := i.FillBytes(make([]byte, s.bits/8))
+	if s.bits == 32 {
+		var a [4]byte
+		copy(a[:], b)
+		return netip.AddrFrom4(a)
+	}
+	var a [16]byte
+	copy(a[:], b)
+	return netip.AddrFrom16(a)
+}
+
+// ---------- merge overlapping ranges ----------
+func (s bigSpace) mergeRanges(ranges []bigRange) []bigRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start.Compare(ranges[j].Start) < 0
+	})
+	merged := []bigRange{ranges[0]}
+	one := big.NewInt(1)
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		lastEnd := s.addrToInt(last.End)
+		curStart := s.addrToInt(r.Start)
+		if curStart.Cmp(new(big.Int).Add(lastEnd, one)) <= 0 {
+			if r.End.Compare(last.End) > 0 {
+				last.End = r.End
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// ---------- range -> minimal number of CIDRs ----------
+// Every IP range defined by a start and end address can be represented
+// by one or more CIDR prefixes. This function calculates the minimal set of CIDR
+// prefixes that cover the given range.
+func (s bigSpace) rangeToCIDRs(r bigRange) []netip.Prefix {
+	var result []netip.Prefix
+	cur := s.addrToInt(r.Start)
+	last := s.addrToInt(r.End)
+	one := big.NewInt(1)
+
+	for cur.Cmp(last) <= 0 {
+		// Find the largest power-of-2 block starting at cur
+		var maxSize uint
+		for size := uint(0); size <= s.bits; size++ {
+			block := new(big.Int).Lsh(one, size)
+			if new(big.Int).And(cur, new(big.Int).Sub(block, one)).Cmp(big.NewInt(0)) != 0 {
+				break
+			}
+			maxSize = size
+		}
+
+		// Shrink maxSize if it would go past last
+		for {
+			block := new(big.Int).Lsh(one, maxSize)
+			lastAddr := new(big.Int).Add(cur, new(big.Int).Sub(block, one))
+			if lastAddr.Cmp(last) <= 0 {
+				break
+			}
+			if maxSize == 0 {
+				break
+			}
+			maxSize--
+		}
+
+		prefixLen := int(s.bits - maxSize)
+		result = append(result, netip.PrefixFrom(s.intToAddr(cur), prefixLen))
+		cur = cur.Add(cur, new(big.Int).Lsh(one, maxSize))
+	}
+
+	return result
+}
+
+// ---------- CIDR -> range ----------
+// prefixToRange converts a netip.Prefix to a bigRange with Start and End addresses.
+// Start is the network address and End is the broadcast address.
+func (s bigSpace) prefixToRange(p netip.Prefix) bigRange {
+	p = p.Masked()
+	start := s.addrToInt(p.Addr())
+	hostBits := int(s.bits) - p.Bits()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	size.Sub(size, big.NewInt(1))
+	end := new(big.Int).Add(start, size)
+	return bigRange{Start: p.Addr(), End: s.intToAddr(end)}
+}
+
+// ---------- helper: subtract disallowed from allowed ----------
+func (s bigSpace) subtractRanges(allowed []bigRange, disallowed []bigRange) []bigRange {
+	if len(allowed) == 0 {
+		return nil
+	}
+	if len(disallowed) == 0 {
+		return allowed
+	}
+
+	var result []bigRange
+	for _, a := range allowed {
+		cur := []bigRange{a}
+		for _, d := range disallowed {
+			cur2 := []bigRange{}
+			for _, r := range cur {
+				cur2 = append(cur2, s.subtractOneRange(r, d)...)
+			}
+			cur = cur2
+			if len(cur) == 0 {
+				break
+			}
+		}
+		result = append(result, cur...)
+	}
+	return s.mergeRanges(result)
+}
+
+// subtractOneRange subtracts a single disallowed range from a single allowed range
+func (s bigSpace) subtractOneRange(allowed bigRange, disallowed bigRange) []bigRange {
+	aStart := s.addrToInt(allowed.Start)
+	aEnd := s.addrToInt(allowed.End)
+	dStart := s.addrToInt(disallowed.Start)
+	dEnd := s.addrToInt(disallowed.End)
+	one := big.NewInt(1)
+
+	// No overlap
+	if aEnd.Cmp(dStart) < 0 || aStart.Cmp(dEnd) > 0 {
+		return []bigRange{allowed}
+	}
+
+	var result []bigRange
+
+	// left side
+	if aStart.Cmp(dStart) < 0 {
+		result = append(result, bigRange{
+			Start: allowed.Start,
+			End:   s.intToAddr(new(big.Int).Sub(dStart, one)),
+		})
+	}
+
+	// right side
+	if aEnd.Cmp(dEnd) > 0 {
+		result = append(result, bigRange{
+			Start: s.intToAddr(new(big.Int).Add(dEnd, one)),
+			End:   allowed.End,
+		})
+	}
+
+	return result
+}
+
+// bigCalculate returns routes minus localRoutes as computed by the math/big
+// implementation.
+func bigCalculate(routes, localRoutes []netip.Prefix) (ipv4, ipv6 []netip.Prefix) {
+	var allowed4, disallowed4, allowed6, disallowed6 []bigRange
+	s4, s6 := bigSpace{bits: 32}, bigSpace{bits: 128}
+	for _, p := range routes {
+		if p.Addr().Is4() {
+			allowed4 = append(allowed4, s4.prefixToRange(p))
+		} else {
+			allowed6 = append(allowed6, s6.prefixToRange(p))
+		}
+	}
+	for _, p := range localRoutes {
+		if p.Addr().IsLoopback() {
+			continue
+		}
+		if p.Addr().Is4() {
+			disallowed4 = append(disallowed4, s4.prefixToRange(p))
+		} else {
+			disallowed6 = append(disallowed6, s6.prefixToRange(p))
+		}
+	}
+	for _, r := range s4.subtractRanges(s4.mergeRanges(allowed4), s4.mergeRanges(disallowed4)) {
+		ipv4 = append(ipv4, s4.rangeToCIDRs(r)...)
+	}
+	for _, r := range s6.subtractRanges(s6.mergeRanges(allowed6), s6.mergeRanges(disallowed6)) {
+		ipv6 = append(ipv6, s6.rangeToCIDRs(r)...)
+	}
+	return ipv4, ipv6
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Explanation tells whether traffic to an address goes through the VPN, and
+// which route decided it.
+type Explanation struct {
+	Addr netip.Addr
+	// ExcludeMode is whether local routes are excluded from the VPN with
+	// VpnService.Builder.excludeRoute (Android 13 and later), rather than
+	// subtracted from the routes by Calculate.
+	ExcludeMode bool
+	Tunneled    bool
+	// Route is the most specific entry of the routes containing Addr, if
+	// any.
+	Route netip.Prefix `json:",omitzero"`
+	// LocalRoute is the entry of the local routes that excludes Addr from
+	// the VPN, if any.
+	LocalRoute netip.Prefix `json:",omitzero"`
+	// Effective is the prefix given to the builder that covers Addr: the
+	// route added, or, in exclude mode, the route excluded.
+	Effective netip.Prefix `json:",omitzero"`
+	Reason    string
+}
+
+// Explain explains whether traffic to addr goes through the VPN given routes
+// and localRoutes, as applied by updateTUN in exclude mode, or with
+// CalculateWithin with MaxRoutes and agg.
+//
+// In exclude mode, Android picks the most specific added or excluded route
+// containing addr; exclusions win ties. Calculate instead subtracts all local
+// routes from the routes, so a local route excludes addr even if a route
+// containing it is more specific. In both modes, loopback local routes are
+// ignored.
+func Explain(addr netip.Addr, routes, localRoutes []netip.Prefix, excludeMode bool, agg Aggregation) (Explanation, error) {
+	addr = addr.Unmap()
+	e := Explanation{Addr: addr, ExcludeMode: excludeMode}
+	e.Route = mostSpecific(addr, routes, false)
+	if e.Route.IsValid() {
+		e.LocalRoute = mostSpecific(addr, localRoutes, true)
+	}
+
+	if excludeMode {
+		switch {
+		case !e.Route.IsValid():
+			e.Reason = "no route contains the address"
+		case !e.LocalRoute.IsValid():
+			e.Tunneled = true
+			e.Effective = e.Route
+			e.Reason = fmt.Sprintf("route %v contains the address", e.Route)
+		case e.LocalRoute.Bits() >= e.Route.Bits():
+			e.Effective = e.LocalRoute
+			e.Reason = fmt.Sprintf("local route %v excludes the address from route %v", e.LocalRoute, e.Route)
+		default:
+			e.Tunneled = true
+			e.Effective = e.Route
+			e.Reason = fmt.Sprintf("route %v is more specific than local route %v", e.Route, e.LocalRoute)
+		}
+		return e, nil
+	}
+
+	res, err := CalculateWithin(routes, localRoutes, MaxRoutes, agg)
+	if err != nil {
+		return e, err
+	}
+	calculated := res.IPv6
+	if addr.Is4() {
+		calculated = res.IPv4
+	}
+	e.Effective = mostSpecific(addr, calculated, false)
+	e.Tunneled = e.Effective.IsValid()
+	switch {
+	case mostSpecific(addr, res.Affected, false).IsValid():
+		e.Reason = fmt.Sprintf("routes were aggregated (%s) into %v to fit the limit of %d routes", res.Aggregation, e.Effective, MaxRoutes)
+	case !e.Route.IsValid():
+		e.Reason = "no route contains the address"
+	case !e.LocalRoute.IsValid():
+		e.Reason = fmt.Sprintf("route %v contains the address", e.Route)
+	default:
+		e.Reason = fmt.Sprintf("local route %v is subtracted from route %v", e.LocalRoute, e.Route)
+	}
+	return e, nil
+}
+
+// mostSpecific returns the longest of prefixes containing addr, or the zero
+// Prefix if none does. Loopback prefixes are skipped if skipLoopback is set.
+func mostSpecific(addr netip.Addr, prefixes []netip.Prefix, skipLoopback bool) netip.Prefix {
+	var best netip.Prefix
+	for _, p := range prefixes {
+		if skipLoopback && p.Addr().IsLoopback() {
+			continue
+		}
+		p = p.Masked()
+		if p.Contains(addr) && (!best.IsValid() || p.Bits() > best.Bits()) {
+			best = p
+		}
+	}
+	return best
+}
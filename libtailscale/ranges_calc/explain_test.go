@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	pfx := netip.MustParsePrefix
+	// An exit node with LAN access: all traffic is tunneled except to the
+	// LAN, and a subnet route inside the LAN.
+	routes := []netip.Prefix{pfx("0.0.0.0/0"), pfx("::/0"), pfx("192.168.1.128/25")}
+	localRoutes := []netip.Prefix{pfx("192.168.1.0/24"), pfx("127.0.0.0/8"), pfx("fe80::/10")}
+
+	tests := []struct {
+		addr       string
+		exclude    bool
+		tunneled   bool
+		route      netip.Prefix
+		localRoute netip.Prefix
+		effective  netip.Prefix
+	}{
+		{"8.8.8.8", true, true, pfx("0.0.0.0/0"), netip.Prefix{}, pfx("0.0.0.0/0")},
+		{"8.8.8.8", false, true, pfx("0.0.0.0/0"), netip.Prefix{}, pfx("0.0.0.0/1")},
+		{"192.168.1.10", true, false, pfx("0.0.0.0/0"), pfx("192.168.1.0/24"), pfx("192.168.1.0/24")},
+		{"192.168.1.10", false, false, pfx("0.0.0.0/0"), pfx("192.168.1.0/24"), netip.Prefix{}},
+		// The subnet route is more specific than the LAN, which only
+		// matters in exclude mode.
+		{"192.168.1.200", true, true, pfx("192.168.1.128/25"), pfx("192.168.1.0/24"), pfx("192.168.1.128/25")},
+		{"192.168.1.200", false, false, pfx("192.168.1.128/25"), pfx("192.168.1.0/24"), netip.Prefix{}},
+		// Loopback local routes are ignored.
+		{"127.0.0.1", false, true, pfx("0.0.0.0/0"), netip.Prefix{}, pfx("0.0.0.0/1")},
+		{"fe80::1", true, false, pfx("::/0"), pfx("fe80::/10"), pfx("fe80::/10")},
+		{"::ffff:8.8.8.8", true, true, pfx("0.0.0.0/0"), netip.Prefix{}, pfx("0.0.0.0/0")},
+	}
+	for _, tt := range tests {
+		e, err := Explain(netip.MustParseAddr(tt.addr), routes, localRoutes, tt.exclude, OverInclude)
+		if err != nil {
+			t.Fatalf("%s (exclude=%v): %v", tt.addr, tt.exclude, err)
+		}
+		if e.Tunneled != tt.tunneled || e.Route != tt.route || e.LocalRoute != tt.localRoute || e.Effective != tt.effective {
+			t.Errorf("%s (exclude=%v): got tunneled=%v route=%v local=%v effective=%v (%s); want %v %v %v %v",
+				tt.addr, tt.exclude, e.Tunneled, e.Route, e.LocalRoute, e.Effective, e.Reason,
+				tt.tunneled, tt.route, tt.localRoute, tt.effective)
+		}
+	}
+}
+
+func TestExplainNoRoute(t *testing.T) {
+	routes := []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")}
+	for _, exclude := range []bool{true, false} {
+		e, err := Explain(netip.MustParseAddr("1.1.1.1"), routes, nil, exclude, OverInclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Tunneled || e.Route.IsValid() || e.Effective.IsValid() || e.Reason == "" {
+			t.Errorf("exclude=%v: %+v", exclude, e)
+		}
+	}
+}
+
+func TestExplainAggregated(t *testing.T) {
+	routes := hosts(600)
+	e, err := Explain(netip.MustParseAddr("10.0.0.2"), routes, nil, false, OverInclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Tunneled || e.Route.IsValid() || e.Effective != netip.MustParsePrefix("10.0.0.0/30") {
+		t.Errorf("got %+v, want over-included by 10.0.0.0/30", e)
+	}
+	if _, err := Explain(netip.MustParseAddr("10.0.0.2"), routes, nil, false, Fail); err == nil {
+		t.Error("Explain succeeded with too many routes")
+	}
+}
@@ -4,62 +4,42 @@
 package ranges_calc
 
 import (
+	"errors"
 	"fmt"
-	"math/big"
 	"net/netip"
-	"sort"
+	"slices"
 )
 
-// Internal representation of an IP range [Start, End] (inclusive)
+// ErrTooManyRoutes is returned by Calculate when more than MaxRoutes prefixes
+// result.
+var ErrTooManyRoutes = errors.New("too many calculated routes")
+
+// ipRange is an IP range [start, end] (inclusive), as integers of its
+// address space.
 type ipRange struct {
-	Start netip.Addr
-	End   netip.Addr
+	start, end uint128
 }
 
 // space describes the address space (32 for IPv4, 128 for IPv6)
 type space struct {
-	bits uint
-}
-
-// ---------- netip.Addr <-> big.Int ----------
-func (s space) addrToInt(a netip.Addr) *big.Int {
-	if s.bits == 32 {
-		b := a.As4()
-		return new(big.Int).SetBytes(b[:])
-	}
-	b := a.As16()
-	return new(big.Int).SetBytes(b[:])
-}
-
-func (s space) intToAddr(i *big.Int) netip.Addr {
-	b := i.FillBytes(make([]byte, s.bits/8))
-	if s.bits == 32 {
-		var a [4]byte
-		copy(a[:], b)
-		return netip.AddrFrom4(a)
-	}
-	var a [16]byte
-	copy(a[:], b)
-	return netip.AddrFrom16(a)
+	bits int
 }
 
 // ---------- merge overlapping ranges ----------
+// mergeRanges sorts ranges and merges the ones that overlap or are adjacent.
 func (s space) mergeRanges(ranges []ipRange) []ipRange {
 	if len(ranges) == 0 {
 		return nil
 	}
-	sort.Slice(ranges, func(i, j int) bool {
-		return ranges[i].Start.Compare(ranges[j].Start) < 0
-	})
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.start.cmp(b.start) })
 	merged := []ipRange{ranges[0]}
-	one := big.NewInt(1)
 	for _, r := range ranges[1:] {
 		last := &merged[len(merged)-1]
-		lastEnd := s.addrToInt(last.End)
-		curStart := s.addrToInt(r.Start)
-		if curStart.Cmp(new(big.Int).Add(lastEnd, one)) <= 0 {
-			if r.End.Compare(last.End) > 0 {
-				last.End = r.End
+		// last.end+1 can't overflow unless last already reaches the end of
+		// the address space, in which case it contains r.
+		if last.end == mask(s.bits) || r.start.cmp(last.end.addOne()) <= 0 {
+			if r.end.cmp(last.end) > 0 {
+				last.end = r.end
 			}
 		} else {
 			merged = append(merged, r)
@@ -74,113 +54,83 @@ func (s space) mergeRanges(ranges []ipRange) []ipRange {
 // prefixes that cover the given range.
 func (s space) rangeToCIDRs(r ipRange) []netip.Prefix {
 	var result []netip.Prefix
-	cur := s.addrToInt(r.Start)
-	last := s.addrToInt(r.End)
-	one := big.NewInt(1)
+	for cur := r.start; ; {
+		size := s.cidrSize(cur, r.end)
+		result = append(result, netip.PrefixFrom(s.uint128ToAddr(cur), s.bits-size))
 
-	for cur.Cmp(last) <= 0 {
-		// Find the largest power-of-2 block starting at cur
-		var maxSize uint
-		for size := uint(0); size <= s.bits; size++ {
-			block := new(big.Int).Lsh(one, size)
-			if new(big.Int).And(cur, new(big.Int).Sub(block, one)).Cmp(big.NewInt(0)) != 0 {
-				break
-			}
-			maxSize = size
+		last := cur.or(mask(size))
+		if last == r.end {
+			return result
 		}
+		cur = last.addOne()
+	}
+}
 
-		// Shrink maxSize if it would go past last
-		for {
-			block := new(big.Int).Lsh(one, maxSize)
-			lastAddr := new(big.Int).Add(cur, new(big.Int).Sub(block, one))
-			if lastAddr.Cmp(last) <= 0 {
-				break
-			}
-			if maxSize == 0 {
-				break
-			}
-			maxSize--
+// cidrCount returns len(s.rangeToCIDRs(r)), without allocating.
+func (s space) cidrCount(r ipRange) int {
+	for n, cur := 1, r.start; ; n++ {
+		last := cur.or(mask(s.cidrSize(cur, r.end)))
+		if last == r.end {
+			return n
 		}
-
-		prefixLen := int(s.bits - maxSize)
-		result = append(result, netip.PrefixFrom(s.intToAddr(cur), prefixLen))
-		cur = cur.Add(cur, new(big.Int).Lsh(one, maxSize))
+		cur = last.addOne()
 	}
+}
 
-	return result
+// cidrSize returns the host bits of the largest CIDR prefix starting at cur
+// that ends at or before end.
+func (s space) cidrSize(cur, end uint128) int {
+	// The largest power-of-2 block starting at cur is limited by the
+	// alignment of cur, and by the number of addresses left, n+1.
+	size := min(cur.trailingZeros(), s.bits)
+	if n := end.sub(cur); n != maxUint128 {
+		size = min(size, n.addOne().bitLen()-1)
+	}
+	return size
 }
 
 // ---------- CIDR -> range ----------
-// prefixToRange converts a netip.Prefix to an ipRange with Start and End addresses.
-// Start is the network address and End is the broadcast address.
+// prefixToRange converts a netip.Prefix to an ipRange with start and end addresses.
+// start is the network address and end is the broadcast address.
 func (s space) prefixToRange(p netip.Prefix) ipRange {
-	p = p.Masked()
-	start := s.addrToInt(p.Addr())
-	hostBits := int(s.bits) - p.Bits()
-	size := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
-	size.Sub(size, big.NewInt(1))
-	end := new(big.Int).Add(start, size)
-	return ipRange{Start: p.Addr(), End: s.intToAddr(end)}
+	hostBits := mask(s.bits - p.Bits())
+	start := s.addrToUint128(p.Addr()).andNot(hostBits)
+	return ipRange{start: start, end: start.or(hostBits)}
 }
 
 // ---------- helper: subtract disallowed from allowed ----------
+// subtractRanges returns the parts of the sorted, merged ranges allowed that
+// aren't in the sorted, merged ranges disallowed. It sweeps both in a single
+// pass, in order of address.
 func (s space) subtractRanges(allowed []ipRange, disallowed []ipRange) []ipRange {
-	if len(allowed) == 0 {
-		return nil
-	}
 	if len(disallowed) == 0 {
 		return allowed
 	}
-
 	var result []ipRange
+	j := 0
 	for _, a := range allowed {
-		cur := []ipRange{a}
-		for _, d := range disallowed {
-			cur2 := []ipRange{}
-			for _, r := range cur {
-				cur2 = append(cur2, s.subtractOneRange(r, d)...)
+		// Skip the disallowed ranges entirely before a. As allowed is
+		// sorted, they're before the next ones too.
+		for j < len(disallowed) && disallowed[j].end.cmp(a.start) < 0 {
+			j++
+		}
+		cur := a.start
+		covered := false
+		for k := j; k < len(disallowed) && disallowed[k].start.cmp(a.end) <= 0; k++ {
+			d := disallowed[k]
+			if d.start.cmp(cur) > 0 {
+				result = append(result, ipRange{start: cur, end: d.start.subOne()})
 			}
-			cur = cur2
-			if len(cur) == 0 {
+			if d.end.cmp(a.end) >= 0 {
+				covered = true
 				break
 			}
+			cur = d.end.addOne()
+		}
+		if !covered {
+			result = append(result, ipRange{start: cur, end: a.end})
 		}
-		result = append(result, cur...)
-	}
-	return s.mergeRanges(result)
-}
-
-// subtractOneRange subtracts a single disallowed range from a single allowed range
-func (s space) subtractOneRange(allowed ipRange, disallowed ipRange) []ipRange {
-	aStart := s.addrToInt(allowed.Start)
-	aEnd := s.addrToInt(allowed.End)
-	dStart := s.addrToInt(disallowed.Start)
-	dEnd := s.addrToInt(disallowed.End)
-	one := big.NewInt(1)
-
-	// No overlap
-	if aEnd.Cmp(dStart) < 0 || aStart.Cmp(dEnd) > 0 {
-		return []ipRange{allowed}
-	}
-
-	var result []ipRange
-
-	// left side
-	if aStart.Cmp(dStart) < 0 {
-		result = append(result, ipRange{
-			Start: allowed.Start,
-			End:   s.intToAddr(new(big.Int).Sub(dStart, one)),
-		})
-	}
-
-	// right side
-	if aEnd.Cmp(dEnd) > 0 {
-		result = append(result, ipRange{
-			Start: s.intToAddr(new(big.Int).Add(dEnd, one)),
-			End:   allowed.End,
-		})
 	}
-
 	return result
 }
 
@@ -196,13 +146,9 @@ func newRangesCalc(routes, localRoutes []netip.Prefix) *rangesCalc {
 
 const maxCalculatedRoutes = 500
 
-// calculate computes allowed routes (Routes minus LocalRoutes) and returns
-// separate IPv4 and IPv6 prefix lists. If the resulting route set exceeds
-// a conservative cap, an error is returned so the caller can fail fast.
-func (rc *rangesCalc) calculate() (ipv4 []netip.Prefix, ipv6 []netip.Prefix, err error) {
-	var out4 []netip.Prefix
-	var out6 []netip.Prefix
-
+// ranges computes the allowed ranges (Routes minus LocalRoutes), merged and
+// sorted, separately for IPv4 and IPv6.
+func (rc *rangesCalc) ranges() (ranges4, ranges6 []ipRange) {
 	// Collect IPv4 and IPv6 separately
 	var allowed4 []ipRange
 	var disallowed4 []ipRange
@@ -242,12 +188,7 @@ func (rc *rangesCalc) calculate() (ipv4 []netip.Prefix, ipv6 []netip.Prefix, err
 		s := space{bits: 32}
 		mergedAllowed := s.mergeRanges(allowed4)
 		mergedDisallowed := s.mergeRanges(disallowed4)
-		finalAllowed := s.subtractRanges(mergedAllowed, mergedDisallowed)
-		for _, r := range finalAllowed {
-			for _, pref := range s.rangeToCIDRs(r) {
-				out4 = append(out4, pref)
-			}
-		}
+		ranges4 = s.subtractRanges(mergedAllowed, mergedDisallowed)
 	}
 
 	// Process IPv6
@@ -255,17 +196,31 @@ func (rc *rangesCalc) calculate() (ipv4 []netip.Prefix, ipv6 []netip.Prefix, err
 		s := space{bits: 128}
 		mergedAllowed := s.mergeRanges(allowed6)
 		mergedDisallowed := s.mergeRanges(disallowed6)
-		finalAllowed := s.subtractRanges(mergedAllowed, mergedDisallowed)
-		for _, r := range finalAllowed {
-			for _, pref := range s.rangeToCIDRs(r) {
-				out6 = append(out6, pref)
-			}
-		}
+		ranges6 = s.subtractRanges(mergedAllowed, mergedDisallowed)
+	}
+	return ranges4, ranges6
+}
+
+// cidrs returns the minimal prefixes covering ranges.
+func (s space) cidrs(ranges []ipRange) []netip.Prefix {
+	var out []netip.Prefix
+	for _, r := range ranges {
+		out = append(out, s.rangeToCIDRs(r)...)
 	}
+	return out
+}
+
+// calculate computes allowed routes (Routes minus LocalRoutes) and returns
+// separate IPv4 and IPv6 prefix lists. If the resulting route set exceeds
+// a conservative cap, an error is returned so the caller can fail fast.
+func (rc *rangesCalc) calculate() (ipv4 []netip.Prefix, ipv6 []netip.Prefix, err error) {
+	ranges4, ranges6 := rc.ranges()
+	out4 := space{bits: 32}.cidrs(ranges4)
+	out6 := space{bits: 128}.cidrs(ranges6)
 
 	total := len(out4) + len(out6)
 	if total > maxCalculatedRoutes {
-		return nil, nil, fmt.Errorf("calculated routes (%d) exceed cap (%d)", total, maxCalculatedRoutes)
+		return nil, nil, fmt.Errorf("%w: %d exceed cap (%d)", ErrTooManyRoutes, total, maxCalculatedRoutes)
 	}
 
 	return out4, out6, nil
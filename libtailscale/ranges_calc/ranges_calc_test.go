@@ -5,7 +5,9 @@ package ranges_calc
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"net/netip"
+	"slices"
 	"testing"
 )
 
@@ -73,3 +75,240 @@ func TestCalculate_CapExceeded(t *testing.T) {
 		t.Fatalf("expected error when exceeding cap (%d), got nil", maxCalculatedRoutes)
 	}
 }
+
+// calculate returns routes minus localRoutes, without the cap of Calculate.
+func calculate(routes, localRoutes []netip.Prefix) (ipv4, ipv6 []netip.Prefix) {
+	ranges4, ranges6 := newRangesCalc(routes, localRoutes).ranges()
+	return space{bits: 32}.cidrs(ranges4), space{bits: 128}.cidrs(ranges6)
+}
+
+// prefixesFromBytes decodes routes and local routes from data, 4 bytes per
+// prefix: flags (local route, IPv6), prefix length, and 2 bytes repeated
+// into an address, so that prefixes often overlap.
+func prefixesFromBytes(data []byte) (routes, localRoutes []netip.Prefix) {
+	for ; len(data) >= 4; data = data[4:] {
+		flags, bits, x, y := data[0], int(data[1]), data[2], data[3]
+		var p netip.Prefix
+		if flags&2 == 0 {
+			p = netip.PrefixFrom(netip.AddrFrom4([4]byte{x, y, y, x}), bits%33)
+		} else {
+			p = netip.PrefixFrom(netip.AddrFrom16([16]byte{0: x, 1: y, 14: x, 15: y}), bits%129)
+		}
+		if flags&1 == 0 {
+			routes = append(routes, p)
+		} else {
+			localRoutes = append(localRoutes, p)
+		}
+	}
+	return routes, localRoutes
+}
+
+// checkCalculation checks that the prefixes calculated from routes and
+// localRoutes match the math/big implementation, exactly cover the routes
+// minus the local routes, and are the fewest prefixes that do.
+func checkCalculation(t *testing.T, routes, localRoutes []netip.Prefix) {
+	t.Helper()
+	got4, got6 := calculate(routes, localRoutes)
+	want4, want6 := bigCalculate(routes, localRoutes)
+	if !slices.Equal(got4, want4) || !slices.Equal(got6, want6) {
+		t.Fatalf("Calculate(%v, %v) = %v %v, math/big = %v %v", routes, localRoutes, got4, got6, want4, want6)
+	}
+	for _, s := range []space{{bits: 32}, {bits: 128}} {
+		got := got4
+		if s.bits == 128 {
+			got = got6
+		}
+		checkMinimal(t, s, got)
+		checkCoverage(t, s, routes, localRoutes, got)
+	}
+}
+
+// checkCoverage checks that an address is in got, which must be sorted and
+// disjoint, if and only if it's in routes and not in the non-loopback
+// localRoutes. Whether an address is in any of them only changes at the
+// bounds of their prefixes, so only the bounds and the addresses next to them
+// are checked.
+func checkCoverage(t *testing.T, s space, routes, localRoutes, got []netip.Prefix) {
+	t.Helper()
+	var nonLoopback []netip.Prefix
+	for _, p := range localRoutes {
+		if !p.Addr().IsLoopback() {
+			nonLoopback = append(nonLoopback, p)
+		}
+	}
+	in := func(a netip.Addr, ps []netip.Prefix) bool {
+		return slices.ContainsFunc(ps, func(p netip.Prefix) bool { return p.Contains(a) })
+	}
+	inGot := func(a netip.Addr) bool {
+		i, found := slices.BinarySearchFunc(got, a, func(p netip.Prefix, a netip.Addr) int { return p.Addr().Compare(a) })
+		return found || i > 0 && got[i-1].Contains(a)
+	}
+	for _, ps := range [][]netip.Prefix{routes, nonLoopback, got} {
+		for _, p := range ps {
+			if p.Addr().BitLen() != s.bits {
+				continue
+			}
+			r := s.prefixToRange(p)
+			points := []uint128{r.start, r.end}
+			if !r.start.isZero() {
+				points = append(points, r.start.subOne())
+			}
+			if r.end != mask(s.bits) {
+				points = append(points, r.end.addOne())
+			}
+			for _, u := range points {
+				a := s.uint128ToAddr(u)
+				want := in(a, routes) && !in(a, nonLoopback)
+				if inGot(a) != want {
+					t.Fatalf("routes %v minus %v: %v in %v is %v, want %v", routes, localRoutes, a, got, !want, want)
+				}
+			}
+		}
+	}
+}
+
+// checkMinimal checks that got is sorted and disjoint, and that no prefix
+// could be merged with others into its parent prefix, which makes it the
+// unique minimal set of prefixes covering its addresses.
+func checkMinimal(t *testing.T, s space, got []netip.Prefix) {
+	t.Helper()
+	for i := 1; i < len(got); i++ {
+		if s.prefixToRange(got[i-1]).end.cmp(s.prefixToRange(got[i]).start) >= 0 {
+			t.Fatalf("%v and %v are out of order or overlap", got[i-1], got[i])
+		}
+	}
+	covered := s.prefixRanges(got)
+	for _, p := range got {
+		if p.Bits() == 0 {
+			continue
+		}
+		parent, _ := p.Addr().Prefix(p.Bits() - 1)
+		pr := s.prefixToRange(parent)
+		// The covered range starting at or before the parent is the only
+		// one that can contain it.
+		i, found := slices.BinarySearchFunc(covered, pr.start, func(r ipRange, u uint128) int { return r.start.cmp(u) })
+		if !found {
+			i--
+		}
+		if i >= 0 && covered[i].end.cmp(pr.end) >= 0 {
+			t.Fatalf("%v in %v could be merged into %v", p, got, parent)
+		}
+	}
+}
+
+func TestCalculateProperties(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 2000 {
+		data := make([]byte, 4*rng.IntN(12))
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		routes, localRoutes := prefixesFromBytes(data)
+		checkCalculation(t, routes, localRoutes)
+	}
+}
+
+func TestCalculateEdges(t *testing.T) {
+	pfx := netip.MustParsePrefix
+	for _, tt := range []struct{ routes, localRoutes []netip.Prefix }{
+		{[]netip.Prefix{pfx("0.0.0.0/0"), pfx("::/0")}, nil},
+		{[]netip.Prefix{pfx("0.0.0.0/0"), pfx("::/0")}, []netip.Prefix{pfx("0.0.0.0/32"), pfx("255.255.255.255/32"), pfx("::/128"), pfx("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128")}},
+		{[]netip.Prefix{pfx("255.255.255.254/31"), pfx("ffff:ffff:ffff:ffff::/64")}, []netip.Prefix{pfx("255.255.255.255/32"), pfx("ffff:ffff:ffff:ffff:8000::/65")}},
+		{[]netip.Prefix{pfx("10.0.0.1/8"), pfx("10.0.0.0/8"), pfx("11.0.0.0/8")}, []netip.Prefix{pfx("10.255.255.255/32"), pfx("11.0.0.0/32")}},
+		{[]netip.Prefix{pfx("0.0.0.0/0")}, []netip.Prefix{pfx("0.0.0.0/0")}},
+	} {
+		checkCalculation(t, tt.routes, tt.localRoutes)
+	}
+}
+
+// maxFuzzPrefixes is the number of prefixes FuzzCalculate calculates at most,
+// which keeps the checks fast.
+const maxFuzzPrefixes = 32
+
+func FuzzCalculate(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 1, 24, 192, 168})
+	f.Add([]byte{2, 0, 0, 0, 3, 10, 0xfe, 0x80, 3, 128, 0, 1})
+	f.Add([]byte{0, 8, 10, 0, 0, 16, 11, 0, 1, 32, 10, 10, 1, 12, 127, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 4*maxFuzzPrefixes {
+			t.Skip("too many prefixes")
+		}
+		routes, localRoutes := prefixesFromBytes(data)
+		checkCalculation(t, routes, localRoutes)
+	})
+}
+
+// tailnetRoutes returns the routes and local routes of a large tailnet: an
+// exit node, nsubnets subnet routes, and nlocal local routes.
+func tailnetRoutes(nsubnets, nlocal int) (routes, localRoutes []netip.Prefix) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	routes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+	}
+	for range nsubnets {
+		a := netip.AddrFrom4([4]byte{10, byte(rng.Uint32()), byte(rng.Uint32()), 0})
+		routes = append(routes, netip.PrefixFrom(a, 24))
+		a6 := [16]byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, byte(rng.Uint32()), byte(rng.Uint32())}
+		routes = append(routes, netip.PrefixFrom(netip.AddrFrom16(a6), 64))
+	}
+	localRoutes = []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+	for range nlocal {
+		a := netip.AddrFrom4([4]byte{byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32())})
+		localRoutes = append(localRoutes, netip.PrefixFrom(a, 16+rng.IntN(17)).Masked())
+	}
+	return routes, localRoutes
+}
+
+func BenchmarkCalculate(b *testing.B) {
+	for _, size := range []struct{ subnets, local int }{{10, 10}, {1000, 100}, {10000, 1000}} {
+		routes, localRoutes := tailnetRoutes(size.subnets, size.local)
+		name := fmt.Sprintf("subnets=%d/local=%d", size.subnets, size.local)
+		b.Run(name+"/fixed", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				calculate(routes, localRoutes)
+			}
+		})
+		b.Run(name+"/big", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				bigCalculate(routes, localRoutes)
+			}
+		})
+	}
+}
+
+// subnetRoutes returns nsubnets /25 subnet routes and nlocal local routes
+// overlapping them, more than fit in MaxRoutes.
+func subnetRoutes(nsubnets, nlocal int) (routes, localRoutes []netip.Prefix) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	for range nsubnets {
+		a := netip.AddrFrom4([4]byte{10, byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32())})
+		routes = append(routes, netip.PrefixFrom(a, 25).Masked())
+	}
+	for range nlocal {
+		a := netip.AddrFrom4([4]byte{10, byte(rng.Uint32()), byte(rng.Uint32()), byte(rng.Uint32())})
+		localRoutes = append(localRoutes, netip.PrefixFrom(a, 24+rng.IntN(9)).Masked())
+	}
+	return routes, localRoutes
+}
+
+func BenchmarkCalculateWithin(b *testing.B) {
+	routes, localRoutes := subnetRoutes(10000, 1000)
+	for _, agg := range []Aggregation{OverInclude, DropExclusions} {
+		b.Run(string(agg), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := CalculateWithin(routes, localRoutes, MaxRoutes, agg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
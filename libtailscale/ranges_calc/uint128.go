@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ranges_calc
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// uint128 is a 128-bit unsigned integer. IPv4 addresses are stored in the
+// low 32 bits.
+type uint128 struct {
+	hi, lo uint64
+}
+
+// maxUint128 is 2^128 - 1.
+var maxUint128 = uint128{^uint64(0), ^uint64(0)}
+
+func (u uint128) isZero() bool { return u.hi == 0 && u.lo == 0 }
+
+func (u uint128) cmp(v uint128) int {
+	switch {
+	case u.hi < v.hi:
+		return -1
+	case u.hi > v.hi:
+		return 1
+	case u.lo < v.lo:
+		return -1
+	case u.lo > v.lo:
+		return 1
+	}
+	return 0
+}
+
+// addOne returns u+1, wrapping around at 2^128.
+func (u uint128) addOne() uint128 {
+	lo, carry := bits.Add64(u.lo, 1, 0)
+	return uint128{u.hi + carry, lo}
+}
+
+// subOne returns u-1, wrapping around at 0.
+func (u uint128) subOne() uint128 {
+	lo, borrow := bits.Sub64(u.lo, 1, 0)
+	return uint128{u.hi - borrow, lo}
+}
+
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	return uint128{u.hi - v.hi - borrow, lo}
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+func (u uint128) xor(v uint128) uint128 {
+	return uint128{u.hi ^ v.hi, u.lo ^ v.lo}
+}
+
+func (u uint128) andNot(v uint128) uint128 {
+	return uint128{u.hi &^ v.hi, u.lo &^ v.lo}
+}
+
+func min128(u, v uint128) uint128 {
+	if u.cmp(v) <= 0 {
+		return u
+	}
+	return v
+}
+
+func max128(u, v uint128) uint128 {
+	if u.cmp(v) >= 0 {
+		return u
+	}
+	return v
+}
+
+// bitLen returns the number of bits needed to represent u.
+func (u uint128) bitLen() int {
+	if u.hi != 0 {
+		return 64 + bits.Len64(u.hi)
+	}
+	return bits.Len64(u.lo)
+}
+
+// trailingZeros returns the number of trailing zero bits of u, or 128 if u is
+// zero.
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// mask returns 2^n - 1, the value with the n low bits set, for n ≤ 128.
+func mask(n int) uint128 {
+	switch {
+	case n >= 128:
+		return maxUint128
+	case n >= 64:
+		return uint128{1<<(n-64) - 1, ^uint64(0)}
+	}
+	return uint128{0, 1<<n - 1}
+}
+
+// addrToUint128 returns the address a, which must be of the address space,
+// as an integer.
+func (s space) addrToUint128(a netip.Addr) uint128 {
+	if s.bits == 32 {
+		b := a.As4()
+		return uint128{0, uint64(binary.BigEndian.Uint32(b[:]))}
+	}
+	b := a.As16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+// uint128ToAddr returns the address of the address space whose integer
+// value is u.
+func (s space) uint128ToAddr(u uint128) netip.Addr {
+	if s.bits == 32 {
+		var a [4]byte
+		binary.BigEndian.PutUint32(a[:], uint32(u.lo))
+		return netip.AddrFrom4(a)
+	}
+	var a [16]byte
+	binary.BigEndian.PutUint64(a[:8], u.hi)
+	binary.BigEndian.PutUint64(a[8:], u.lo)
+	return netip.AddrFrom16(a)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+	"tailscale.com/health"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// routeAggregationPolicy is the Android-specific policy setting that selects
+// how routes are aggregated before Android 13, when more than
+// rangescalc.MaxRoutes result from subtracting the local routes, in the
+// format accepted by [rangescalc.ParseAggregation].
+const routeAggregationPolicy = pkey.Key(mdmpolicy.RouteAggregation)
+
+// newRouteAggregation returns the route aggregation setting, which defaults
+// to rangescalc.OverInclude.
+func newRouteAggregation(a *App) *livesetting.Value[rangescalc.Aggregation] {
+	return newPolicySetting(a, "route aggregation", func() rangescalc.Aggregation {
+		v, err := a.policyStore.ReadString(routeAggregationPolicy)
+		switch {
+		case err == nil:
+			agg, _ := rangescalc.ParseAggregation(v) // validated by ReadString
+			return agg
+		case !errors.Is(err, syspolicy.ErrNoSuchKey):
+			log.Printf("route aggregation: policy %q: %v", routeAggregationPolicy, err)
+		}
+		return rangescalc.OverInclude
+	}, livesetting.Equal)
+}
+
+// maxListedAffected is the number of affected prefixes listed in the health
+// warning of aggregated routes.
+const maxListedAffected = 5
+
+var routesAggregatedWarnable = health.Register(&health.Warnable{
+	Code:     "android-routes-aggregated",
+	Title:    "Routes aggregated",
+	Severity: health.SeverityLow,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("This version of Android limits the VPN to %d routes, so some routes were merged. Traffic to %s goes through Tailscale even though it shouldn't.", rangescalc.MaxRoutes, args[health.ArgError])
+	},
+})
+
+// reportAggregation logs the routes aggregated by the last route calculation
+// and raises a health warning listing the addresses affected, or clears it if
+// res is nil or no routes were aggregated.
+func (b *backend) reportAggregation(res *rangescalc.Result) {
+	ht := b.sys.HealthTracker.Get()
+	if res == nil || res.Aggregation == "" {
+		ht.SetHealthy(routesAggregatedWarnable)
+		return
+	}
+	b.logger.Logf("updateTUN: aggregated %d routes into %d (%s), dropped exclusions %v, affected %v",
+		res.Calculated, len(res.IPv4)+len(res.IPv6), res.Aggregation, res.DroppedExclusions, res.Affected)
+	ht.SetUnhealthy(routesAggregatedWarnable, health.Args{
+		health.ArgError: affectedSummary(res.Affected),
+	})
+}
+
+// affectedSummary lists the first maxListedAffected of affected.
+func affectedSummary(affected []netip.Prefix) string {
+	var b strings.Builder
+	for i, p := range affected {
+		if i == maxListedAffected {
+			fmt.Fprintf(&b, " and %d more", len(affected)-i)
+			break
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/http"
+	"net/netip"
+
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+)
+
+// serveRouteExplain serves whether traffic to the address in the ip query
+// parameter goes through the VPN, and which of the routes and local routes of
+// the current tun device decided it.
+func (a *App) serveRouteExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, err := netip.ParseAddr(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	b := a.vpnBackend.Load()
+	if b == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	c := b.applied.Load()
+	if c == nil {
+		http.Error(w, "the VPN is not up", http.StatusNotFound)
+		return
+	}
+	e, err := rangescalc.Explain(ip, c.rcfg.Routes, c.rcfg.LocalRoutes, c.useExclude(), c.agg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, e)
+}
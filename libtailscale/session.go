@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/tailscale/tailscale-android/libtailscale/vpnsession"
+	"tailscale.com/util/clientmetric"
+)
+
+// vpnSession is the VPN session of the app: the IPNService running the VPN,
+// the file descriptor of a tun device being created, and the state of the
+// session. It's safe for concurrent use.
+type vpnSession struct {
+	m *vpnsession.Machine
+
+	mu  sync.Mutex
+	svc IPNService // nil when the VPN service isn't running
+	fd  int32      // detached fd not yet owned by a tun device, or -1
+}
+
+func newVPNSession() *vpnSession {
+	s := &vpnSession{m: vpnsession.New(), fd: -1}
+	s.m.Observe(func(t vpnsession.Transition) {
+		if t.Err != "" {
+			log.Printf("VPN session: %v -> %v (%s): %s", t.From, t.To, t.Reason, t.Err)
+		} else {
+			log.Printf("VPN session: %v -> %v (%s)", t.From, t.To, t.Reason)
+		}
+	})
+	return s
+}
+
+// to moves the session to state, logging invalid transitions.
+func (s *vpnSession) to(state vpnsession.State, reason string, err error) {
+	if err := s.m.To(state, reason, err); err != nil {
+		log.Printf("[unexpected] %v", err)
+	}
+}
+
+// service returns the running VPN service, or nil.
+func (s *vpnSession) service() IPNService {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svc
+}
+
+// isService reports whether svc is the running VPN service.
+func (s *vpnSession) isService(svc IPNService) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svc != nil && s.svc.ID() == svc.ID()
+}
+
+// start records that svc was started as the VPN service.
+func (s *vpnSession) start(svc IPNService) {
+	s.mu.Lock()
+	s.svc = svc
+	s.mu.Unlock()
+	s.to(vpnsession.Requested, "VPN requested", nil)
+}
+
+// stop records that the VPN service stopped, and returns it.
+func (s *vpnSession) stop(reason string, err error) IPNService {
+	s.mu.Lock()
+	svc := s.svc
+	s.svc = nil
+	s.mu.Unlock()
+	s.to(vpnsession.Idle, reason, err)
+	return svc
+}
+
+// establishing records that a tun device is being established, replacing
+// the current one if the session is up.
+func (s *vpnSession) establishing() {
+	if err := s.m.Establishing(); err != nil {
+		log.Printf("[unexpected] %v", err)
+	}
+}
+
+// established records the result of establishing a tun device.
+func (s *vpnSession) established(err error) {
+	revoked := errors.Is(err, errVPNNotPrepared)
+	if err != nil {
+		switch establishErrorCode(err) {
+		case EstablishErrorPermissionRevoked, EstablishErrorOtherVPN:
+			revoked = true
+		}
+	}
+	if err := s.m.Established(err, revoked); err != nil {
+		log.Printf("[unexpected] %v", err)
+	}
+}
+
+// setFD records fd as detached from its ParcelFileDescriptor and not yet
+// owned by a tun device, or -1 once a tun device owns it.
+func (s *vpnSession) setFD(fd int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fd = fd
+}
+
+// closeFD closes the fd recorded by setFD, if any.
+func (s *vpnSession) closeFD() error {
+	s.mu.Lock()
+	fd := s.fd
+	s.fd = -1
+	s.mu.Unlock()
+	if fd == -1 {
+		return nil
+	}
+	if err := syscall.Close(int(fd)); err != nil {
+		return fmt.Errorf("error closing file descriptor: %w", err)
+	}
+	return nil
+}
+
+// sessionMachine is the state machine of the app's VPN session, for metrics.
+// It's nil until the app is created.
+var sessionMachine atomic.Pointer[vpnsession.Machine]
+
+func init() {
+	clientmetric.NewGaugeFunc("android_vpn_session_state", func() int64 {
+		m := sessionMachine.Load()
+		if m == nil {
+			return 0
+		}
+		return int64(m.State())
+	})
+	for _, st := range vpnsession.States() {
+		clientmetric.NewCounterFunc("android_vpn_session_entered_"+st.String(), func() int64 {
+			m := sessionMachine.Load()
+			if m == nil {
+				return 0
+			}
+			return int64(m.Entered(st))
+		})
+	}
+}
+
+// serveSession serves the state of the VPN session and its recent
+// transitions.
+func (a *App) serveSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.session.m.Status())
+}
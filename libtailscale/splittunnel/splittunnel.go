@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package splittunnel decides which apps use the VPN, from the lists set by
+// policy and by the user.
+package splittunnel
+
+import (
+	"slices"
+	"strings"
+)
+
+// Mode is how the packages of a Filter are treated.
+type Mode string
+
+const (
+	// Disallow makes the listed apps bypass the VPN, and all others use it.
+	Disallow Mode = "disallow"
+	// Allow makes only the listed apps use the VPN.
+	Allow Mode = "allow"
+)
+
+// Source is where a Filter comes from.
+type Source string
+
+const (
+	SourceUser   Source = "user"
+	SourcePolicy Source = "policy"
+)
+
+// Filter is the set of apps that use the VPN.
+type Filter struct {
+	Mode Mode
+	// Packages are the package names of the listed apps, sorted and
+	// without duplicates.
+	Packages []string
+	Source   Source
+}
+
+// Equal reports whether f and g select the same apps, regardless of their
+// Source.
+func (f Filter) Equal(g Filter) bool {
+	return f.Mode == g.Mode && slices.Equal(f.Packages, g.Packages)
+}
+
+// Inputs are the app lists a Filter is resolved from.
+type Inputs struct {
+	// PolicyIncluded and PolicyExcluded are the IncludedPackageNames and
+	// ExcludedPackageNames policy settings.
+	PolicyIncluded []string
+	PolicyExcluded []string
+
+	// UserAllow is whether the user's apps are the only ones using the
+	// VPN, rather than the ones bypassing it.
+	UserAllow    bool
+	UserPackages []string
+
+	// BuiltInDisallowed are apps known to break when using the VPN. They
+	// bypass it unless only specific apps use the VPN.
+	BuiltInDisallowed []string
+}
+
+// Resolve returns the Filter selected by in. Apps included by policy take
+// precedence over apps excluded by policy, which take precedence over the
+// user's selection.
+func Resolve(in Inputs) Filter {
+	var f Filter
+	switch {
+	case len(in.PolicyIncluded) > 0:
+		f = Filter{Mode: Allow, Packages: in.PolicyIncluded, Source: SourcePolicy}
+	case len(in.PolicyExcluded) > 0:
+		f = Filter{Mode: Disallow, Packages: in.PolicyExcluded, Source: SourcePolicy}
+	case in.UserAllow:
+		f = Filter{Mode: Allow, Packages: in.UserPackages, Source: SourceUser}
+	default:
+		f = Filter{Mode: Disallow, Packages: in.UserPackages, Source: SourceUser}
+	}
+	if f.Mode == Disallow {
+		f.Packages = append(slices.Clone(f.Packages), in.BuiltInDisallowed...)
+	}
+	f.Packages = normalize(f.Packages)
+	return f
+}
+
+// ParseList parses a comma-separated list of package names, as used by the
+// IncludedPackageNames and ExcludedPackageNames policy settings.
+func ParseList(s string) []string {
+	return normalize(strings.Split(s, ","))
+}
+
+// normalize returns the valid package names in pkgs, trimmed, sorted and
+// without duplicates.
+func normalize(pkgs []string) []string {
+	var out []string
+	for _, p := range pkgs {
+		if p = strings.TrimSpace(p); validPackageName(p) {
+			out = append(out, p)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// validPackageName reports whether s is a plausible Android package name:
+// dot-separated segments of letters, digits and underscores.
+func validPackageName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, seg := range strings.Split(s, ".") {
+		if seg == "" {
+			return false
+		}
+		for _, r := range seg {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
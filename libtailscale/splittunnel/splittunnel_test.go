@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package splittunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	got := ParseList(" com.b.app, com.a.app,,com.b.app , not a package, com..x, org.example_1")
+	want := []string{"com.a.app", "com.b.app", "org.example_1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseList = %q, want %q", got, want)
+	}
+	if got := ParseList(""); got != nil {
+		t.Errorf("ParseList(\"\") = %q, want nil", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	builtIn := []string{"com.sonos.acr"}
+	tests := []struct {
+		name string
+		in   Inputs
+		want Filter
+	}{
+		{
+			name: "default",
+			in:   Inputs{BuiltInDisallowed: builtIn},
+			want: Filter{Mode: Disallow, Packages: builtIn, Source: SourceUser},
+		},
+		{
+			name: "user-disallow",
+			in:   Inputs{UserPackages: []string{"com.z", "com.a"}, BuiltInDisallowed: builtIn},
+			want: Filter{Mode: Disallow, Packages: []string{"com.a", "com.sonos.acr", "com.z"}, Source: SourceUser},
+		},
+		{
+			name: "user-allow",
+			in:   Inputs{UserAllow: true, UserPackages: []string{"com.a"}, BuiltInDisallowed: builtIn},
+			want: Filter{Mode: Allow, Packages: []string{"com.a"}, Source: SourceUser},
+		},
+		{
+			name: "policy-excluded",
+			in: Inputs{
+				PolicyExcluded:    []string{"com.x"},
+				UserAllow:         true,
+				UserPackages:      []string{"com.a"},
+				BuiltInDisallowed: builtIn,
+			},
+			want: Filter{Mode: Disallow, Packages: []string{"com.sonos.acr", "com.x"}, Source: SourcePolicy},
+		},
+		{
+			name: "policy-included",
+			in: Inputs{
+				PolicyIncluded:    []string{"com.y"},
+				PolicyExcluded:    []string{"com.x"},
+				UserPackages:      []string{"com.a"},
+				BuiltInDisallowed: builtIn,
+			},
+			want: Filter{Mode: Allow, Packages: []string{"com.y"}, Source: SourcePolicy},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Resolve(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := Filter{Mode: Disallow, Packages: []string{"com.a"}, Source: SourceUser}
+	b := Filter{Mode: Disallow, Packages: []string{"com.a"}, Source: SourcePolicy}
+	if !a.Equal(b) {
+		t.Error("filters differing only in source are not equal")
+	}
+	b.Mode = Allow
+	if a.Equal(b) {
+		t.Error("filters with different modes are equal")
+	}
+}
@@ -4,10 +4,15 @@
 package libtailscale
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
 
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
 	"tailscale.com/util/set"
 	"tailscale.com/util/syspolicy"
 	"tailscale.com/util/syspolicy/pkey"
@@ -19,49 +24,77 @@ type syspolicyStore struct {
 	a   *App
 	mu  sync.RWMutex
 	cbs set.HandleSet[func()]
+
+	// store reads, validates and records the policy values. Its Overlay,
+	// if non-nil, holds values that take precedence over the
+	// RestrictionsManager ones. See [policyOverlayFile].
+	store *mdmpolicy.Store
+}
+
+func newSyspolicyStore(a *App) *syspolicyStore {
+	return &syspolicyStore{
+		a: a,
+		store: &mdmpolicy.Store{
+			Base:   restrictionsSource{a.appCtx},
+			TypeOf: policyTypeOf,
+		},
+	}
+}
+
+// enableOverlay layers the policy values from the JSON file at path over the
+// RestrictionsManager values, and starts watching the file for changes.
+// It must be called before the store is registered.
+func (h *syspolicyStore) enableOverlay(path string) {
+	h.store.Overlay = mdmpolicy.NewOverlay(path)
+	h.store.Overlay.Reload()
+	go h.store.Overlay.Watch(context.Background(), policyOverlayPollInterval, h.notifyChanged)
+	log.Printf("syspolicy: local policy overlay enabled at %s", path)
 }
 
 func (h *syspolicyStore) ReadString(key pkey.Key) (string, error) {
 	if key == "" {
 		return "", syspolicy.ErrNoSuchKey
 	}
-	retVal, err := h.a.appCtx.GetSyspolicyStringValue(string(key))
-	return retVal, translateHandlerError(err)
+	v, _, err := h.readString(key)
+	return v, err
+}
+
+// readString is like ReadString, but also returns where the value was read
+// from.
+func (h *syspolicyStore) readString(key pkey.Key) (string, policySource, error) {
+	v, src, err := h.store.ReadString(string(key))
+	return v, src, fromPolicyErr(err)
 }
 
 func (h *syspolicyStore) ReadBoolean(key pkey.Key) (bool, error) {
 	if key == "" {
 		return false, syspolicy.ErrNoSuchKey
 	}
-	retVal, err := h.a.appCtx.GetSyspolicyBooleanValue(string(key))
-	return retVal, translateHandlerError(err)
+	v, _, err := h.readBoolean(key)
+	return v, err
+}
+
+// readBoolean is like ReadBoolean, but also returns where the value was read
+// from.
+func (h *syspolicyStore) readBoolean(key pkey.Key) (bool, policySource, error) {
+	v, src, err := h.store.ReadBoolean(string(key))
+	return v, src, fromPolicyErr(err)
 }
 
 func (h *syspolicyStore) ReadUInt64(key pkey.Key) (uint64, error) {
 	if key == "" {
 		return 0, syspolicy.ErrNoSuchKey
 	}
-	// We don't have any UInt64 policy settings as of 2024-08-06.
-	return 0, errors.New("ReadUInt64 is not implemented on Android")
+	v, _, err := h.store.ReadUInt64(string(key))
+	return v, fromPolicyErr(err)
 }
 
 func (h *syspolicyStore) ReadStringArray(key pkey.Key) ([]string, error) {
 	if key == "" {
 		return nil, syspolicy.ErrNoSuchKey
 	}
-	retVal, err := h.a.appCtx.GetSyspolicyStringArrayJSONValue(string(key))
-	if err := translateHandlerError(err); err != nil {
-		return nil, err
-	}
-	if retVal == "" {
-		return nil, syspolicy.ErrNoSuchKey
-	}
-	var arr []string
-	jsonErr := json.Unmarshal([]byte(retVal), &arr)
-	if jsonErr != nil {
-		return nil, jsonErr
-	}
-	return arr, err
+	v, _, err := h.store.ReadStringArray(string(key))
+	return v, fromPolicyErr(err)
 }
 
 func (h *syspolicyStore) RegisterChangeCallback(cb func()) (unregister func(), err error) {
@@ -83,9 +116,59 @@ func (h *syspolicyStore) notifyChanged() {
 	h.mu.RUnlock()
 }
 
-func translateHandlerError(err error) error {
-	if err != nil && !errors.Is(err, syspolicy.ErrNoSuchKey) && err.Error() == syspolicy.ErrNoSuchKey.Error() {
-		return syspolicy.ErrNoSuchKey
+// newPolicySetting returns a livesetting.Value resolved by resolve, which is
+// resolved again whenever the policy settings change.
+func newPolicySetting[T any](a *App, name string, resolve func() T, equal func(x, y T) bool) *livesetting.Value[T] {
+	v := livesetting.New(name, resolve, equal)
+	a.policyStore.RegisterChangeCallback(func() { v.Load() })
+	return v
+}
+
+// restrictionsSource is the mdmpolicy.Source of the values set via the
+// Android RestrictionsManager.
+type restrictionsSource struct {
+	appCtx AppContext
+}
+
+func (s restrictionsSource) ReadString(key string) (string, error) {
+	v, err := s.appCtx.GetSyspolicyStringValue(key)
+	return v, toPolicyErr(err)
+}
+
+func (s restrictionsSource) ReadBoolean(key string) (bool, error) {
+	v, err := s.appCtx.GetSyspolicyBooleanValue(key)
+	return v, toPolicyErr(err)
+}
+
+func (s restrictionsSource) ReadStringArray(key string) ([]string, error) {
+	v, err := s.appCtx.GetSyspolicyStringArrayJSONValue(key)
+	if err := toPolicyErr(err); err != nil {
+		return nil, err
+	}
+	if v == "" {
+		return nil, mdmpolicy.ErrNotConfigured
+	}
+	var arr []string
+	if err := json.Unmarshal([]byte(v), &arr); err != nil {
+		return nil, fmt.Errorf("parsing string array %q: %w", v, err)
+	}
+	return arr, nil
+}
+
+// toPolicyErr translates the syspolicy.ErrNoSuchKey returned through JNI,
+// which is only recognizable by its message, to mdmpolicy.ErrNotConfigured.
+func toPolicyErr(err error) error {
+	if err != nil && err.Error() == syspolicy.ErrNoSuchKey.Error() {
+		return mdmpolicy.ErrNotConfigured
 	}
 	return err // may be nil or non-nil
 }
+
+// fromPolicyErr translates mdmpolicy.ErrNotConfigured to
+// syspolicy.ErrNoSuchKey, which syspolicy expects.
+func fromPolicyErr(err error) error {
+	if errors.Is(err, mdmpolicy.ErrNotConfigured) {
+		return syspolicy.ErrNoSuchKey
+	}
+	return err
+}
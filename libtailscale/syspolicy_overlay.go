@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import "time"
+
+// policyOverlayFile is the name of an optional JSON file in the app's data
+// directory whose policy values are layered over the ones set via the Android
+// RestrictionsManager. See [mdmpolicy.Overlay] for its format.
+//
+// The file is only honored in debug builds, and in QA builds made with the
+// ts_android_policy_overlay build tag. To use it, push the file into the
+// app's files directory, with run-as if the build is debuggable:
+//
+//	adb push overlay.json /data/local/tmp/
+//	adb shell run-as com.tailscale.ipn cp /data/local/tmp/overlay.json files/syspolicy-overlay.json
+//
+// or else as root, to /data/data/com.tailscale.ipn/files/. Changes are
+// picked up within policyOverlayPollInterval.
+const policyOverlayFile = "syspolicy-overlay.json"
+
+// policyOverlayPollInterval is how often the overlay file is checked for changes.
+const policyOverlayPollInterval = 5 * time.Second
+
+// policyOverlayBuild is set in builds made with the ts_android_policy_overlay
+// build tag.
+var policyOverlayBuild bool
+
+// policyOverlayAllowed reports whether the [policyOverlayFile] should be honored.
+func policyOverlayAllowed(appCtx AppContext) bool {
+	return policyOverlayBuild || appCtx.IsDebugBuild()
+}
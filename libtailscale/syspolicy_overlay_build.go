@@ -0,0 +1,12 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ts_android_policy_overlay
+
+package libtailscale
+
+// QA builds made with the ts_android_policy_overlay build tag honor the policy
+// overlay file, like debug builds.
+func init() {
+	policyOverlayBuild = true
+}
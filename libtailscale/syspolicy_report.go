@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/http"
+
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/syspolicy/pkey"
+	"tailscale.com/util/syspolicy/setting"
+)
+
+// policySource identifies where a policy value was read from.
+type policySource = mdmpolicy.Origin
+
+const (
+	policySourceMDM     = mdmpolicy.OriginMDM
+	policySourceOverlay = mdmpolicy.OriginOverlay
+)
+
+// policyTypeOf returns the type of the upstream policy setting key.
+func policyTypeOf(key string) (mdmpolicy.Type, bool) {
+	def, err := setting.DefinitionOf(pkey.Key(key))
+	if err != nil {
+		return mdmpolicy.UnknownType, false
+	}
+	return policyType(def.Type()), true
+}
+
+func policyType(t setting.Type) mdmpolicy.Type {
+	switch t {
+	case setting.BooleanValue:
+		return mdmpolicy.Boolean
+	case setting.IntegerValue:
+		return mdmpolicy.Integer
+	case setting.StringValue:
+		return mdmpolicy.String
+	case setting.StringListValue:
+		return mdmpolicy.StringList
+	case setting.PreferenceOptionValue:
+		return mdmpolicy.PreferenceOption
+	case setting.VisibilityValue:
+		return mdmpolicy.Visibility
+	case setting.DurationValue:
+		return mdmpolicy.Duration
+	default:
+		return mdmpolicy.UnknownType
+	}
+}
+
+// effectivePolicy re-reads every known policy setting, upstream and
+// Android-only, and returns the resulting value, source and errors for each.
+func (h *syspolicyStore) effectivePolicy() ([]mdmpolicy.ReportEntry, error) {
+	defs, err := setting.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	mdefs := make([]mdmpolicy.Definition, 0, len(defs))
+	for _, def := range defs {
+		mdefs = append(mdefs, mdmpolicy.Definition{Key: string(def.Key()), Type: policyType(def.Type())})
+	}
+	return h.store.Report(mdefs), nil
+}
+
+// servePolicyReport serves the effective-policy report, listing every known
+// policy setting along with its value, source and any errors.
+func (a *App) servePolicyReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := a.policyStore.effectivePolicy()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mdmpolicy.CheckExitNode(report, a.isPeer())
+	writeJSON(w, report)
+}
+
+// isPeer returns a func reporting whether a stable node ID is that of a peer
+// in the current netmap, or nil if the backend isn't running. The ExitNodeID
+// policy can't be checked against the netmap when it's read, since the netmap
+// may not be available yet.
+func (a *App) isPeer() func(id string) bool {
+	b := a.vpnBackend.Load()
+	if b == nil {
+		return nil
+	}
+	st := b.backend.Status()
+	if st.BackendState != ipn.Running.String() {
+		return nil
+	}
+	return func(id string) bool {
+		for _, ps := range st.Peer {
+			if ps.ID == tailcfg.StableNodeID(id) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -24,12 +24,12 @@ import (
 	"tailscale.com/util/syspolicy/setting"
 )
 
-const defaultMTU = 1280 // minimalMTU from wgengine/userspace.go
-
 const (
 	logPrefKey               = "privatelogid"
 	loginMethodPrefKey       = "loginmethod"
 	customLoginServerPrefKey = "customloginserver"
+	vpnOptionsPrefKey        = "vpnoptions"
+	killSwitchPrefKey        = "killswitch"
 )
 
 func newApp(dataDir, directFileRoot string, hardwareAttestationPref bool, appCtx AppContext) Application {
@@ -41,15 +41,26 @@ func newApp(dataDir, directFileRoot string, hardwareAttestationPref bool, appCtx
 	a.ready.Add(2)
 
 	a.store = newStateStore(a.appCtx)
-	a.policyStore = &syspolicyStore{a: a}
+	a.policyStore = newSyspolicyStore(a)
+	if policyOverlayAllowed(appCtx) {
+		a.policyStore.enableOverlay(filepath.Join(dataDir, policyOverlayFile))
+	}
+	a.tunMTU = newTunMTU(a)
+	a.splitTunnel = newSplitTunnel(a)
+	a.vpnOptions = newVPNOptions(a)
+	a.killSwitch = newKillSwitch(a)
+	a.routeAggregation = newRouteAggregation(a)
+	a.session = newVPNSession()
+	sessionMachine.Store(a.session.m)
 	netmon.RegisterInterfaceGetter(a.getInterfaces)
 	rsop.RegisterStore("DeviceHandler", setting.DeviceScope, a.policyStore)
 
 	hwAttestEnabled := appCtx.HardwareAttestationKeySupported() && hardwareAttestationPref
 	if hwAttestEnabled {
+		a.hwKeys = newHardwareKeys(appCtx, a.store)
 		key.RegisterHardwareAttestationKeyFns(
-			func() key.HardwareAttestationKey { return emptyHardwareAttestationKey(appCtx) },
-			func() (key.HardwareAttestationKey, error) { return createHardwareAttestationKey(appCtx) },
+			func() key.HardwareAttestationKey { return emptyHardwareAttestationKey(appCtx, a.hwKeys) },
+			func() (key.HardwareAttestationKey, error) { return createHardwareAttestationKey(appCtx, a.hwKeys) },
 		)
 	} else {
 		log.Printf("HardwareAttestationKey is not supported on this device")
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/tailscale/tailscale-android/libtailscale/multitun"
+	"tailscale.com/util/clientmetric"
+)
+
+// tunDevice is the tun device of the running backend, for metrics.
+// It's nil until the backend is created.
+var tunDevice atomic.Pointer[multitun.Device]
+
+// tunMetric returns a func that reports a value read from tunDevice. Each
+// reads only what it reports, rather than a full multitun.Stats snapshot,
+// as a scrape calls all of them.
+func tunMetric(f func(d *multitun.Device) int64) func() int64 {
+	return func() int64 {
+		d := tunDevice.Load()
+		if d == nil {
+			return 0
+		}
+		return f(d)
+	}
+}
+
+// tunCounter returns a func that reports counter k of tunDevice.
+func tunCounter(k multitun.Counter) func() int64 {
+	return tunMetric(func(d *multitun.Device) int64 { return int64(d.Counter(k)) })
+}
+
+func init() {
+	for name, k := range map[string]multitun.Counter{
+		"android_tun_read_packets":        multitun.CounterReadPackets,
+		"android_tun_read_bytes":          multitun.CounterReadBytes,
+		"android_tun_write_packets":       multitun.CounterWritePackets,
+		"android_tun_write_bytes":         multitun.CounterWriteBytes,
+		"android_tun_read_errors":         multitun.CounterReadErrors,
+		"android_tun_writes_dropped_down": multitun.CounterWritesDroppedDown,
+		"android_tun_devices_added":       multitun.CounterDevicesAdded,
+		"android_tun_devices_replaced":    multitun.CounterHandovers,
+		"android_tun_shutdowns":           multitun.CounterShutdowns,
+		"android_tun_handover_drained":    multitun.CounterHandoverDrained,
+		"android_tun_handover_dropped":    multitun.CounterHandoverDropped,
+	} {
+		clientmetric.NewCounterFunc(name, tunCounter(k))
+	}
+	clientmetric.NewCounterFunc("android_tun_down_seconds", tunMetric(func(d *multitun.Device) int64 {
+		_, total := d.DownTime()
+		return int64(total.Seconds())
+	}))
+	for name, f := range map[string]func(*multitun.Device) int64{
+		"android_tun_down": func(d *multitun.Device) int64 {
+			if down, _ := d.DownTime(); down {
+				return 1
+			}
+			return 0
+		},
+		"android_tun_devices": func(d *multitun.Device) int64 {
+			n, _ := d.CurrentDevice()
+			return int64(n)
+		},
+		// Read errors of the newest device, which is the one in use.
+		"android_tun_device_read_errors": func(d *multitun.Device) int64 {
+			_, errs := d.CurrentDevice()
+			return int64(errs)
+		},
+	} {
+		clientmetric.NewGaugeFunc(name, tunMetric(f))
+	}
+}
+
+// serveTUNStats serves the traffic and lifecycle counters of the tun device,
+// including per-device read errors.
+func (a *App) serveTUNStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	d := tunDevice.Load()
+	if d == nil {
+		http.Error(w, "backend not running", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, d.Stats())
+}
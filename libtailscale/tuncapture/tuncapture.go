@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tuncapture runs packet captures of the tun device, at most one at a
+// time, writing them in the pcapng format.
+package tuncapture
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/multitun"
+	"github.com/tailscale/tailscale-android/libtailscale/pcapng"
+)
+
+// QueueLen is the number of packets that may be waiting to be written.
+// Packets are dropped from the capture rather than slowing down the tunnel
+// when the queue is full.
+const QueueLen = 1024
+
+// ErrActive is returned by Capturer.Start when a capture is already running.
+var ErrActive = errors.New("a packet capture is already running")
+
+// Tapper is the device whose packets are captured. It's implemented by
+// multitun.Device.
+type Tapper interface {
+	SetCapture(multitun.CaptureFunc)
+}
+
+// Sink is where a Session writes packets. It's implemented by pcapng.Ring.
+type Sink interface {
+	WritePacket(t time.Time, dir pcapng.Direction, pkt []byte) error
+	Flush() error
+}
+
+// Capturer runs the packet captures of a device. The zero value is ready to
+// use.
+type Capturer struct {
+	mu     sync.Mutex
+	active *Session
+}
+
+// Session is a running packet capture.
+type Session struct {
+	c       *Capturer
+	d       Tapper
+	mode    string
+	started time.Time
+	packets chan packet
+	stop    chan struct{}
+	done    chan struct{} // closed when the session's writer has returned
+
+	stopOnce sync.Once
+	captured atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+type packet struct {
+	t   time.Time
+	dir pcapng.Direction
+	pkt []byte
+}
+
+// Start starts a new capture session on d, unless one is already running.
+// The mode describes the session, such as "file" or "stream". The caller
+// must call Run, or Abort if it can't.
+func (c *Capturer) Start(d Tapper, mode string) (*Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active != nil {
+		return nil, ErrActive
+	}
+	s := &Session{
+		c:       c,
+		d:       d,
+		mode:    mode,
+		started: time.Now(),
+		packets: make(chan packet, QueueLen),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	c.active = s
+	d.SetCapture(s.tap)
+	return s, nil
+}
+
+// StopActive stops the running capture, if any, and waits for it to finish
+// writing. It reports whether a capture was running.
+func (c *Capturer) StopActive() bool {
+	c.mu.Lock()
+	s := c.active
+	c.mu.Unlock()
+	if s == nil {
+		return false
+	}
+	s.Halt()
+	<-s.done
+	return true
+}
+
+// Status is the state of the running capture, if any.
+type Status struct {
+	Active   bool
+	Mode     string    `json:",omitempty"`
+	Started  time.Time `json:",omitzero"`
+	Captured uint64
+	// Dropped is the number of packets left out of the capture because
+	// they arrived faster than they could be written.
+	Dropped uint64
+}
+
+// Status returns the state of the running capture.
+func (c *Capturer) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.active
+	if s == nil {
+		return Status{}
+	}
+	return Status{
+		Active:   true,
+		Mode:     s.mode,
+		Started:  s.started,
+		Captured: s.captured.Load(),
+		Dropped:  s.dropped.Load(),
+	}
+}
+
+// tap is the multitun.CaptureFunc of the session.
+func (s *Session) tap(dir multitun.Direction, pkt []byte) {
+	p := packet{t: time.Now(), dir: pcapng.Inbound, pkt: bytes.Clone(pkt)}
+	if dir == multitun.FromLocal {
+		p.dir = pcapng.Outbound
+	}
+	select {
+	case s.packets <- p:
+		s.captured.Add(1)
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run writes captured packets to sink until the session is stopped, or
+// writing fails.
+func (s *Session) Run(sink Sink) {
+	defer close(s.done)
+	for {
+		select {
+		case p := <-s.packets:
+			err := sink.WritePacket(p.t, p.dir, p.pkt)
+			if err == nil && len(s.packets) == 0 {
+				err = sink.Flush()
+			}
+			if err != nil {
+				log.Printf("packet capture: %v", err)
+				s.Halt()
+				return
+			}
+		case <-s.stop:
+			sink.Flush()
+			return
+		}
+	}
+}
+
+// Halt stops capturing packets, and makes Run return. It's safe to call
+// multiple times.
+func (s *Session) Halt() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.d.SetCapture(nil)
+		s.c.mu.Lock()
+		defer s.c.mu.Unlock()
+		if s.c.active == s {
+			s.c.active = nil
+		}
+	})
+}
+
+// Abort stops a session that Run was never called for.
+func (s *Session) Abort() {
+	s.Halt()
+	close(s.done)
+}
+
+// Done returns a channel that's closed once Run has returned.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tuncapture
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/tailscale-android/libtailscale/multitun"
+	"github.com/tailscale/tailscale-android/libtailscale/pcapng"
+)
+
+// fakeTapper records the CaptureFunc set on it.
+type fakeTapper struct {
+	mu sync.Mutex
+	f  multitun.CaptureFunc
+}
+
+func (d *fakeTapper) SetCapture(f multitun.CaptureFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.f = f
+}
+
+func (d *fakeTapper) capture() multitun.CaptureFunc {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f
+}
+
+// fakeSink records the packets written to it, and fails writes with err.
+type fakeSink struct {
+	mu      sync.Mutex
+	pkts    []string
+	dirs    []pcapng.Direction
+	flushes int
+	err     error
+	written chan struct{}
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{written: make(chan struct{}, QueueLen)}
+}
+
+func (s *fakeSink) WritePacket(t time.Time, dir pcapng.Direction, pkt []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.pkts = append(s.pkts, string(pkt))
+	s.dirs = append(s.dirs, dir)
+	s.written <- struct{}{}
+	return nil
+}
+
+func (s *fakeSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	return nil
+}
+
+func waitClosed(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var c Capturer
+	d := new(fakeTapper)
+	s, err := c.Start(d, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Start(d, "file"); !errors.Is(err, ErrActive) {
+		t.Errorf("second Start = %v, want ErrActive", err)
+	}
+	sink := newFakeSink()
+	go s.Run(sink)
+
+	pkt := []byte("out")
+	d.capture()(multitun.FromLocal, pkt)
+	pkt[0] = 'X' // the capture has its own copy
+	d.capture()(multitun.ToLocal, []byte("in"))
+	<-sink.written
+	<-sink.written
+
+	if st := c.Status(); !st.Active || st.Mode != "stream" || st.Captured != 2 || st.Dropped != 0 {
+		t.Errorf("Status = %+v", st)
+	}
+	if !c.StopActive() {
+		t.Error("StopActive reported no capture")
+	}
+	waitClosed(t, s.Done())
+
+	sink.mu.Lock()
+	if len(sink.pkts) != 2 || sink.pkts[0] != "out" || sink.pkts[1] != "in" ||
+		sink.dirs[0] != pcapng.Outbound || sink.dirs[1] != pcapng.Inbound || sink.flushes == 0 {
+		t.Errorf("sink got %q %v with %d flushes", sink.pkts, sink.dirs, sink.flushes)
+	}
+	sink.mu.Unlock()
+
+	if d.capture() != nil {
+		t.Error("capture still set after StopActive")
+	}
+	if st := c.Status(); st.Active {
+		t.Errorf("Status = %+v after StopActive", st)
+	}
+	if c.StopActive() {
+		t.Error("StopActive reported a capture after it stopped")
+	}
+	// A new capture may start.
+	s, err = c.Start(d, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Abort()
+	waitClosed(t, s.Done())
+}
+
+func TestCaptureDropsWhenFull(t *testing.T) {
+	var c Capturer
+	d := new(fakeTapper)
+	s, err := c.Start(d, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Abort()
+	// Nothing writes the packets, so the queue fills up.
+	for range QueueLen + 3 {
+		d.capture()(multitun.FromLocal, []byte("x"))
+	}
+	if st := c.Status(); st.Captured != QueueLen || st.Dropped != 3 {
+		t.Errorf("Captured, Dropped = %d, %d; want %d, 3", st.Captured, st.Dropped, QueueLen)
+	}
+}
+
+func TestCaptureStopsOnWriteError(t *testing.T) {
+	var c Capturer
+	d := new(fakeTapper)
+	s, err := c.Start(d, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newFakeSink()
+	sink.err = errors.New("disk full")
+	go s.Run(sink)
+	d.capture()(multitun.FromLocal, []byte("x"))
+	waitClosed(t, s.Done())
+	if st := c.Status(); st.Active {
+		t.Errorf("Status = %+v after a write error", st)
+	}
+	if d.capture() != nil {
+		t.Error("capture still set after a write error")
+	}
+}
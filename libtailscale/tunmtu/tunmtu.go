@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tunmtu selects the MTU of the tun device, either as configured or
+// by probing the path MTU to peers.
+package tunmtu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Min is the smallest MTU that can be configured, and the one used
+	// when nothing else is known to work. It's the minimum IPv6 MTU, so
+	// packets of that size are never too big for the tun device.
+	Min = 1280
+	// Max is the largest MTU that can be probed for.
+	Max = 9000
+	// MaxFixed is the largest MTU that can be configured without probing.
+	// Larger ones only work on paths with jumbo frames, so they must be
+	// probed for, which checks the path.
+	MaxFixed = DefaultProbeMax
+	// DefaultProbeMax is the largest MTU that probing tries: that of a
+	// tun device whose WireGuard packets fill a 1500 byte Ethernet frame.
+	DefaultProbeMax = 1500 - WireGuardOverhead
+	// WireGuardOverhead is the largest number of bytes WireGuard adds to
+	// a packet from the tun device: the IPv6 and UDP headers, and the
+	// WireGuard header and authentication tag.
+	WireGuardOverhead = 40 + 8 + 32
+
+	// probeStep is the granularity of the probed MTU.
+	probeStep = 4
+)
+
+// Setting is a configured MTU choice.
+type Setting struct {
+	// MTU is the MTU to use. When probing, it's the largest MTU tried
+	// instead, and zero means DefaultProbeMax.
+	MTU int `json:",omitzero"`
+	// Probe is whether the MTU is found by probing the path to peers.
+	Probe bool `json:",omitzero"`
+}
+
+// IsZero reports whether s is the zero Setting, which means no MTU was
+// configured.
+func (s Setting) IsZero() bool {
+	return s == Setting{}
+}
+
+func (s Setting) String() string {
+	switch {
+	case s.IsZero():
+		return "default"
+	case s.Probe && s.MTU != 0:
+		return fmt.Sprintf("probe:%d", s.MTU)
+	case s.Probe:
+		return "probe"
+	default:
+		return strconv.Itoa(s.MTU)
+	}
+}
+
+// Parse parses an MTU setting. It's either a number between Min and
+// MaxFixed, "probe" to probe the path MTU up to DefaultProbeMax, or "probe:N"
+// to probe it up to N, between Min and Max. The empty string is the zero
+// Setting.
+func Parse(s string) (Setting, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Setting{}, nil
+	}
+	var set Setting
+	if rest, ok := strings.CutPrefix(strings.ToLower(s), "probe"); ok {
+		set.Probe = true
+		if rest == "" {
+			return set, nil
+		}
+		n, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return Setting{}, fmt.Errorf("invalid MTU setting %q", s)
+		}
+		s = n
+	}
+	mtu, err := strconv.Atoi(s)
+	if err != nil {
+		return Setting{}, fmt.Errorf("invalid MTU %q", s)
+	}
+	if mtu < Min || mtu > Max {
+		return Setting{}, fmt.Errorf("MTU %d is not between %d and %d", mtu, Min, Max)
+	}
+	if !set.Probe && mtu > MaxFixed {
+		return Setting{}, fmt.Errorf("MTU %d is larger than %d, which needs the path to be checked; use \"probe:%d\"", mtu, MaxFixed, mtu)
+	}
+	set.MTU = mtu
+	return set, nil
+}
+
+// ProbeMax returns the largest MTU probed for s.
+func (s Setting) ProbeMax() int {
+	if s.MTU != 0 {
+		return s.MTU
+	}
+	return DefaultProbeMax
+}
+
+// PingFunc checks whether packets from a tun device with the given MTU reach
+// peers. It returns an error if they don't.
+type PingFunc func(ctx context.Context, mtu int) error
+
+// ErrNoPath is returned by Probe when even Min sized packets don't get
+// through.
+var ErrNoPath = errors.New("no path to peers at the minimum MTU")
+
+// Probe returns the largest MTU between Min and max for which ping succeeds,
+// rounded down to a multiple of 4. It returns Min and an error if Min itself
+// doesn't get through or ctx is done.
+func Probe(ctx context.Context, max int, ping PingFunc) (int, error) {
+	if err := ping(ctx, Min); err != nil {
+		if ctx.Err() != nil {
+			return Min, ctx.Err()
+		}
+		return Min, fmt.Errorf("%w: %w", ErrNoPath, err)
+	}
+	// Binary search for the largest MTU that gets through, assuming that
+	// if an MTU does, all smaller ones do too.
+	lo, hi := Min/probeStep, max/probeStep
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if err := ping(ctx, mid*probeStep); err == nil {
+			lo = mid
+		} else if ctx.Err() != nil {
+			return Min, ctx.Err()
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo * probeStep, nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tunmtu
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Setting
+		wantErr bool
+	}{
+		{in: "", want: Setting{}},
+		{in: "1280", want: Setting{MTU: 1280}},
+		{in: " 1420 ", want: Setting{MTU: 1420}},
+		{in: "probe", want: Setting{Probe: true}},
+		{in: "Probe:1500", want: Setting{MTU: 1500, Probe: true}},
+		{in: "1279", wantErr: true},
+		{in: "1421", wantErr: true},
+		{in: "9000", wantErr: true},
+		{in: "probe:9000", want: Setting{MTU: 9000, Probe: true}},
+		{in: "probe:9001", wantErr: true},
+		{in: "probe:100", wantErr: true},
+		{in: "probe1400", wantErr: true},
+		{in: "big", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if err == nil && !got.IsZero() {
+			if back, err := Parse(got.String()); err != nil || back != got {
+				t.Errorf("Parse(%q.String()) = %+v, %v", tt.in, back, err)
+			}
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	errTooBig := errors.New("too big")
+	for _, pathMTU := range []int{1280, 1283, 1300, 1420, 1500} {
+		var pings int
+		got, err := Probe(context.Background(), DefaultProbeMax, func(ctx context.Context, mtu int) error {
+			pings++
+			if mtu > pathMTU {
+				return errTooBig
+			}
+			return nil
+		})
+		want := min(pathMTU, DefaultProbeMax) &^ 3
+		if err != nil || got != want {
+			t.Errorf("path MTU %d: got %d, %v; want %d", pathMTU, got, err, want)
+		}
+		if pings > 7 {
+			t.Errorf("path MTU %d: %d pings", pathMTU, pings)
+		}
+	}
+}
+
+func TestProbeFailure(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	got, err := Probe(context.Background(), DefaultProbeMax, func(ctx context.Context, mtu int) error {
+		return errTimeout
+	})
+	if got != Min || !errors.Is(err, ErrNoPath) || !errors.Is(err, errTimeout) {
+		t.Errorf("got %d, %v; want %d, ErrNoPath", got, err, Min)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got, err = Probe(ctx, DefaultProbeMax, func(ctx context.Context, mtu int) error {
+		if mtu > Min {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if got != Min || !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: got %d, %v; want %d, context.Canceled", got, err, Min)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tunretry classifies failures to bring up the tun device as
+// retryable or fatal, and schedules retries of the retryable ones.
+package tunretry
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// retryableError marks an error that retrying may fix.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// Retryable returns err marked as one that retrying may fix, such as a failure
+// of VpnService.Builder.establish racing with the VPN being prepared or
+// revoked. It returns nil if err is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+// IsRetryable reports whether err, or an error it wraps, was marked by
+// Retryable. Unmarked errors, like routes or addresses that the builder
+// rejects, are fatal: they fail the same way on every attempt.
+func IsRetryable(err error) bool {
+	var re retryableError
+	return errors.As(err, &re)
+}
+
+const (
+	// DefaultInitial and DefaultMax bound the delay between retries.
+	DefaultInitial = time.Second
+	DefaultMax     = time.Minute
+	// DefaultPersistentAfter is the number of consecutive failures after
+	// which a failure is persistent.
+	DefaultPersistentAfter = 5
+	// DefaultGiveUpAfter is the number of consecutive failures after which
+	// retrying stops, about ten minutes in with the default delays.
+	DefaultGiveUpAfter = 15
+)
+
+// Backoff schedules retries with exponentially growing, jittered delays. The
+// zero value uses the defaults.
+type Backoff struct {
+	Initial         time.Duration
+	Max             time.Duration
+	PersistentAfter int
+	GiveUpAfter     int
+
+	failures int
+	last     error
+}
+
+// Fail records a failure and returns the delay before the next attempt.
+func (b *Backoff) Fail(err error) time.Duration {
+	b.failures++
+	b.last = err
+	initial, max := b.Initial, b.Max
+	if initial == 0 {
+		initial = DefaultInitial
+	}
+	if max == 0 {
+		max = DefaultMax
+	}
+	d := initial
+	for i := 1; i < b.failures && d < max; i++ {
+		d *= 2
+	}
+	d = min(d, max)
+	// Spread retries over [d/2, d) so that repeated failures of many
+	// devices don't line up.
+	return d/2 + rand.N(d/2+1)
+}
+
+// Reset records a success.
+func (b *Backoff) Reset() {
+	b.failures = 0
+	b.last = nil
+}
+
+// Failures returns the number of consecutive failures.
+func (b *Backoff) Failures() int {
+	return b.failures
+}
+
+// LastErr returns the last recorded failure, or nil after a success.
+func (b *Backoff) LastErr() error {
+	return b.last
+}
+
+// Persistent reports whether enough consecutive failures were recorded to
+// tell the user about them.
+func (b *Backoff) Persistent() bool {
+	n := b.PersistentAfter
+	if n == 0 {
+		n = DefaultPersistentAfter
+	}
+	return b.failures >= n
+}
+
+// Exhausted reports whether enough consecutive failures were recorded to
+// stop retrying.
+func (b *Backoff) Exhausted() bool {
+	n := b.GiveUpAfter
+	if n == 0 {
+		n = DefaultGiveUpAfter
+	}
+	return b.failures >= n
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tunretry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	base := errors.New("establish returned null")
+	err := fmt.Errorf("updateTUN: %w", Retryable(base))
+	if !IsRetryable(err) {
+		t.Error("wrapped retryable error is not retryable")
+	}
+	if !errors.Is(err, base) {
+		t.Error("retryable error doesn't wrap its cause")
+	}
+	if err.Error() != "updateTUN: establish returned null" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	if IsRetryable(base) {
+		t.Error("unmarked error is retryable")
+	}
+	if Retryable(nil) != nil {
+		t.Error("Retryable(nil) != nil")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, PersistentAfter: 3, GiveUpAfter: 5}
+	wantMax := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, m := range wantMax {
+		m *= time.Second
+		d := b.Fail(errors.New("fail"))
+		if d < m/2 || d > m {
+			t.Errorf("failure %d: delay %v not in [%v, %v]", i+1, d, m/2, m)
+		}
+		if got, want := b.Persistent(), i+1 >= 3; got != want {
+			t.Errorf("failure %d: Persistent = %v, want %v", i+1, got, want)
+		}
+		if got, want := b.Exhausted(), i+1 >= 5; got != want {
+			t.Errorf("failure %d: Exhausted = %v, want %v", i+1, got, want)
+		}
+	}
+	if b.Failures() != len(wantMax) || b.LastErr() == nil {
+		t.Errorf("Failures = %d, LastErr = %v", b.Failures(), b.LastErr())
+	}
+	b.Reset()
+	if b.Failures() != 0 || b.LastErr() != nil || b.Persistent() || b.Exhausted() {
+		t.Errorf("after Reset: Failures = %d, LastErr = %v, Persistent = %v", b.Failures(), b.LastErr(), b.Persistent())
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	var b Backoff
+	for range 20 {
+		if d := b.Fail(errors.New("fail")); d > DefaultMax {
+			t.Fatalf("delay %v exceeds %v", d, DefaultMax)
+		}
+	}
+	if !b.Persistent() || !b.Exhausted() {
+		t.Error("not persistent and exhausted after 20 failures")
+	}
+}
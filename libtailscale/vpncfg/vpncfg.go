@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package vpncfg compares VPN configs by what VpnService.Builder applies, so
+// that changes Android can't see don't re-establish the VPN.
+package vpncfg
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Config is what the builder applies of a router and DNS config.
+type Config struct {
+	Routes []netip.Prefix
+	// LocalRoutes are the routes excluded from Routes.
+	LocalRoutes   []netip.Prefix
+	Addrs         []netip.Prefix
+	Nameservers   []netip.Addr
+	SearchDomains []string
+	MTU           int
+}
+
+// Normalize returns c with its routes masked, loopback local routes (which
+// the builder can't exclude) removed, search domains without their trailing
+// dot, and all lists sorted and deduplicated.
+func (c Config) Normalize() Config {
+	n := Config{
+		Routes:        normPrefixes(c.Routes, true),
+		LocalRoutes:   normPrefixes(c.LocalRoutes, true),
+		Addrs:         normPrefixes(c.Addrs, false),
+		Nameservers:   slices.Compact(slices.SortedFunc(slices.Values(c.Nameservers), netip.Addr.Compare)),
+		SearchDomains: make([]string, 0, len(c.SearchDomains)),
+		MTU:           c.MTU,
+	}
+	n.LocalRoutes = slices.DeleteFunc(n.LocalRoutes, func(p netip.Prefix) bool { return p.Addr().IsLoopback() })
+	for _, d := range c.SearchDomains {
+		n.SearchDomains = append(n.SearchDomains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	slices.Sort(n.SearchDomains)
+	n.SearchDomains = slices.Compact(n.SearchDomains)
+	return n
+}
+
+// normPrefixes returns ps sorted and deduplicated, masked if mask is set.
+// Addresses aren't masked, since the builder applies the address itself.
+func normPrefixes(ps []netip.Prefix, mask bool) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(ps))
+	for _, p := range ps {
+		if mask {
+			p = p.Masked()
+		}
+		out = append(out, p)
+	}
+	slices.SortFunc(out, comparePrefix)
+	return slices.Compact(out)
+}
+
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Bits(), b.Bits())
+}
+
+// Diff returns the differences between the normalized forms of old and new,
+// one human-readable line per field that changed. It returns nil if they're
+// equivalent.
+func Diff(old, new Config) []string {
+	old, new = old.Normalize(), new.Normalize()
+	var diff []string
+	add := func(field, d string) {
+		if d != "" {
+			diff = append(diff, field+": "+d)
+		}
+	}
+	add("routes", diffSorted(old.Routes, new.Routes, comparePrefix))
+	add("local routes", diffSorted(old.LocalRoutes, new.LocalRoutes, comparePrefix))
+	add("addresses", diffSorted(old.Addrs, new.Addrs, comparePrefix))
+	add("nameservers", diffSorted(old.Nameservers, new.Nameservers, netip.Addr.Compare))
+	add("search domains", diffSorted(old.SearchDomains, new.SearchDomains, strings.Compare))
+	if old.MTU != new.MTU {
+		add("MTU", fmt.Sprintf("%d -> %d", old.MTU, new.MTU))
+	}
+	return diff
+}
+
+// Equal reports whether a and b apply the same VPN config.
+func Equal(a, b Config) bool {
+	return len(Diff(a, b)) == 0
+}
+
+// maxListed is the number of added or removed elements listed by diffSorted
+// before summarizing.
+const maxListed = 8
+
+// diffSorted returns the elements added to and removed from the sorted list
+// old to make the sorted list new, as "+a +b -c", or "" if they're equal.
+func diffSorted[T any](old, new []T, compare func(a, b T) int) string {
+	var added, removed []string
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case j == len(new) || i < len(old) && compare(old[i], new[j]) < 0:
+			removed = append(removed, "-"+fmt.Sprint(old[i]))
+			i++
+		case i == len(old) || compare(old[i], new[j]) > 0:
+			added = append(added, "+"+fmt.Sprint(new[j]))
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return strings.Join(append(summarize(added), summarize(removed)...), " ")
+}
+
+func summarize(list []string) []string {
+	if len(list) <= maxListed {
+		return list
+	}
+	return append(list[:maxListed:maxListed], fmt.Sprintf("(%d more)", len(list)-maxListed))
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vpncfg
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, s := range ss {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}
+
+func addrs(ss ...string) []netip.Addr {
+	var as []netip.Addr
+	for _, s := range ss {
+		as = append(as, netip.MustParseAddr(s))
+	}
+	return as
+}
+
+func base() Config {
+	return Config{
+		Routes:        prefixes("100.64.0.0/10", "fd7a:115c:a1e0::/48", "10.1.2.3/8"),
+		LocalRoutes:   prefixes("192.168.1.0/24"),
+		Addrs:         prefixes("100.101.102.103/32", "fd7a:115c:a1e0::1/128"),
+		Nameservers:   addrs("100.100.100.100"),
+		SearchDomains: []string{"tail1234.ts.net."},
+		MTU:           1280,
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	c := base()
+	for name, mod := range map[string]func(*Config){
+		"reordered routes": func(c *Config) {
+			c.Routes = prefixes("fd7a:115c:a1e0::/48", "10.0.0.0/8", "100.64.0.0/10")
+		},
+		"duplicate route": func(c *Config) { c.Routes = append(c.Routes, netip.MustParsePrefix("100.64.0.0/10")) },
+		"loopback local route": func(c *Config) {
+			c.LocalRoutes = prefixes("192.168.1.0/24", "127.0.0.0/8", "::1/128")
+		},
+		"search domain without dot": func(c *Config) { c.SearchDomains = []string{"TAIL1234.ts.net"} },
+	} {
+		d := base()
+		mod(&d)
+		if diff := Diff(c, d); diff != nil {
+			t.Errorf("%s: Diff = %q, want none", name, diff)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		mod  func(*Config)
+		want []string
+	}{
+		{"route added", func(c *Config) { c.Routes = append(c.Routes, netip.MustParsePrefix("0.0.0.0/0")) }, []string{"routes: +0.0.0.0/0"}},
+		{"local route removed", func(c *Config) { c.LocalRoutes = nil }, []string{"local routes: -192.168.1.0/24"}},
+		{"address changed", func(c *Config) { c.Addrs = prefixes("100.101.102.104/32", "fd7a:115c:a1e0::1/128") }, []string{"addresses: +100.101.102.104/32 -100.101.102.103/32"}},
+		{"nameserver and MTU", func(c *Config) { c.Nameservers = nil; c.MTU = 1500 }, []string{"nameservers: -100.100.100.100", "MTU: 1280 -> 1500"}},
+		{"search domain", func(c *Config) { c.SearchDomains = []string{"example.com"} }, []string{"search domains: +example.com -tail1234.ts.net"}},
+	} {
+		c := base()
+		tt.mod(&c)
+		if got := Diff(base(), c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Diff = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSummarized(t *testing.T) {
+	var c Config
+	for i := range 20 {
+		c.Routes = append(c.Routes, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16))
+	}
+	got := Diff(Config{}, c)
+	want := "routes: +10.0.0.0/16 +10.1.0.0/16 +10.2.0.0/16 +10.3.0.0/16 +10.4.0.0/16 +10.5.0.0/16 +10.6.0.0/16 +10.7.0.0/16 (12 more)"
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("Diff = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeDoesNotModify(t *testing.T) {
+	c := base()
+	before := fmt.Sprint(c)
+	c.Normalize()
+	if after := fmt.Sprint(c); after != before {
+		t.Errorf("Normalize modified its receiver: %s -> %s", before, after)
+	}
+	if !Equal(c, c.Normalize()) {
+		t.Error("config not equal to its normalized form")
+	}
+}
@@ -96,6 +96,13 @@ func (vf *VPNFacade) Close() error {
 	return vf.SetBoth(nil, nil) // TODO: check if makes sense
 }
 
+// config returns the last router and DNS configs set by the engine.
+func (vf *VPNFacade) config() (*router.Config, *dns.OSConfig) {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	return vf.rcfg, vf.dcfg
+}
+
 // ReconfigureVPN is the method value passed to wgengine.Config.ReconfigureVPN.
 func (vf *VPNFacade) ReconfigureVPN() error {
 	vf.mu.Lock()
@@ -0,0 +1,203 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/tailscale/tailscale-android/libtailscale/livesetting"
+	"github.com/tailscale/tailscale-android/libtailscale/mdmpolicy"
+	"github.com/tailscale/tailscale-android/libtailscale/vpnopts"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/pkey"
+)
+
+// The Android-specific policy settings for the VPN builder options. They take
+// precedence over the user's settings, each on its own.
+const (
+	httpProxyPolicy           = pkey.Key(mdmpolicy.HTTPProxy)           // host:port
+	httpProxyExclusionsPolicy = pkey.Key(mdmpolicy.HTTPProxyExclusions) // comma-separated hosts
+	httpProxyPACPolicy        = pkey.Key(mdmpolicy.HTTPProxyPACURL)
+	allowVPNBypassPolicy      = pkey.Key(mdmpolicy.AllowVPNBypass)
+	addressFamiliesPolicy     = pkey.Key(mdmpolicy.AllowedAddressFamilies) // in the format of vpnopts.ParseFamilies
+)
+
+// vpnOptions holds the VPN builder options, resolved from the policy settings
+// and the user's settings.
+type vpnOptions struct {
+	a *App
+	*livesetting.Value[vpnOptionsStatus]
+}
+
+func newVPNOptions(a *App) *vpnOptions {
+	o := &vpnOptions{a: a}
+	o.Value = newPolicySetting(a, "VPN options", o.resolve, vpnOptionsStatus.equal)
+	return o
+}
+
+// resolve returns the options, and those set by policy.
+func (o *vpnOptions) resolve() vpnOptionsStatus {
+	user, err := o.readUser()
+	if err != nil {
+		log.Printf("VPN options: reading the user's settings: %v", err)
+	}
+	opts, managed := vpnopts.Resolve(o.readPolicy(), user)
+	return vpnOptionsStatus{Options: opts, Managed: managed}
+}
+
+// readPolicy returns the options set by policy. Invalid values are logged,
+// reported by the policy store, and treated as unset.
+func (o *vpnOptions) readPolicy() vpnopts.Settings {
+	var s vpnopts.Settings
+	if v, ok := o.readPolicyString(httpProxyPolicy); ok {
+		s.HTTPProxy = &v
+	}
+	if v, ok := o.readPolicyString(httpProxyExclusionsPolicy); ok {
+		s.ProxyExclusions = vpnopts.ParseExclusions(v)
+	}
+	if v, ok := o.readPolicyString(httpProxyPACPolicy); ok {
+		s.PACURL = &v
+	}
+	if v, ok := o.readPolicyString(addressFamiliesPolicy); ok {
+		f, _ := vpnopts.ParseFamilies(v) // validated by ReadString
+		s.Families = &f
+	}
+	s.AllowBypass = o.readPolicyBool(allowVPNBypassPolicy)
+	return s
+}
+
+func (o *vpnOptions) readPolicyString(key pkey.Key) (string, bool) {
+	v, err := o.a.policyStore.ReadString(key)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("VPN options: policy %q: %v", key, err)
+		}
+		return "", false
+	}
+	return v, true
+}
+
+func (o *vpnOptions) readPolicyBool(key pkey.Key) *bool {
+	v, err := o.a.policyStore.ReadBoolean(key)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("VPN options: policy %q: %v", key, err)
+		}
+		return nil
+	}
+	return &v
+}
+
+// readUser returns the user's settings.
+func (o *vpnOptions) readUser() (vpnopts.Settings, error) {
+	var s vpnopts.Settings
+	b, err := o.a.store.read(vpnOptionsPrefKey)
+	if err != nil || len(b) == 0 {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return vpnopts.Settings{}, err
+	}
+	return s, s.Validate()
+}
+
+// setUser replaces the user's settings. The zero Settings clears them.
+func (o *vpnOptions) setUser(s vpnopts.Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	var b []byte
+	if !s.IsZero() {
+		var err error
+		if b, err = json.Marshal(s); err != nil {
+			return err
+		}
+	}
+	if err := o.a.store.write(vpnOptionsPrefKey, b); err != nil {
+		return err
+	}
+	o.Load()
+	return nil
+}
+
+// applyOptions applies opts to builder.
+func applyOptions(builder VPNServiceBuilder, opts vpnopts.Options) error {
+	switch {
+	case opts.PACURL != "":
+		if err := builder.SetHTTPProxyPAC(opts.PACURL); err != nil {
+			return fmt.Errorf("setting PAC URL: %w", err)
+		}
+	case opts.HTTPProxy != "":
+		host, port, err := vpnopts.SplitProxy(opts.HTTPProxy)
+		if err != nil {
+			return err
+		}
+		if err := builder.SetHTTPProxy(host, int32(port), strings.Join(opts.ProxyExclusions, ",")); err != nil {
+			return fmt.Errorf("setting HTTP proxy: %w", err)
+		}
+	}
+	if opts.AllowBypass {
+		if err := builder.AllowBypass(); err != nil {
+			return err
+		}
+	}
+	if opts.Families&vpnopts.IPv4 != 0 {
+		if err := builder.AllowFamily(syscall.AF_INET); err != nil {
+			return err
+		}
+	}
+	if opts.Families&vpnopts.IPv6 != 0 {
+		if err := builder.AllowFamily(syscall.AF_INET6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vpnOptionsStatus is the VPN builder options to apply, and the names of
+// those set by policy.
+type vpnOptionsStatus struct {
+	Options vpnopts.Options
+	Managed []string `json:",omitempty"`
+}
+
+func (s vpnOptionsStatus) equal(t vpnOptionsStatus) bool {
+	return s.Options.Equal(t.Options) && slices.Equal(s.Managed, t.Managed)
+}
+
+// serveVPNOptions serves the VPN builder options:
+//
+//   - GET returns the options in use and those set by policy.
+//   - PUT replaces the user's settings with the vpnopts.Settings in the
+//     request body. Options set by policy are stored but have no effect.
+//   - DELETE clears the user's settings.
+func (a *App) serveVPNOptions(w http.ResponseWriter, r *http.Request) {
+	o := a.vpnOptions
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, o.Get())
+	case http.MethodPut, http.MethodDelete:
+		var s vpnopts.Settings
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := o.setUser(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET, PUT or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package vpnopts holds the VpnService.Builder options that aren't derived
+// from the router and DNS configs: the HTTP proxy, whether apps may bypass
+// the VPN, and which address families bypass it when it has no routes for
+// them.
+package vpnopts
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Families is a set of IP address families.
+type Families uint8
+
+const (
+	IPv4 Families = 1 << iota
+	IPv6
+
+	// NoFamilies is the empty set, written as "none".
+	NoFamilies Families = 0
+	// AllFamilies is IPv4 and IPv6.
+	AllFamilies = IPv4 | IPv6
+)
+
+func (f Families) String() string {
+	switch f {
+	case NoFamilies:
+		return "none"
+	case IPv4:
+		return "ipv4"
+	case IPv6:
+		return "ipv6"
+	default:
+		return "ipv4,ipv6"
+	}
+}
+
+// ParseFamilies parses a comma-separated list of "ipv4" and "ipv6", or
+// "none" for the empty set.
+func ParseFamilies(s string) (Families, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "none" {
+		return NoFamilies, nil
+	}
+	var f Families
+	for _, v := range strings.Split(s, ",") {
+		switch strings.TrimSpace(v) {
+		case "ipv4":
+			f |= IPv4
+		case "ipv6":
+			f |= IPv6
+		default:
+			return 0, fmt.Errorf("invalid address family %q in %q", v, s)
+		}
+	}
+	return f, nil
+}
+
+func (f Families) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *Families) UnmarshalText(b []byte) error {
+	v, err := ParseFamilies(string(b))
+	if err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
+// Options are the options applied to a VpnService.Builder.
+type Options struct {
+	// HTTPProxy is the host:port of an HTTP proxy published to apps, or
+	// empty for none.
+	HTTPProxy string `json:",omitempty"`
+	// ProxyExclusions are hosts that apps reach without HTTPProxy.
+	ProxyExclusions []string `json:",omitempty"`
+	// PACURL is the URL of a proxy auto-config file published to apps, or
+	// empty for none. It takes precedence over HTTPProxy.
+	PACURL string `json:",omitempty"`
+	// AllowBypass is whether apps may bind their sockets to other networks,
+	// bypassing the VPN.
+	AllowBypass bool
+	// Families are the address families whose traffic bypasses the VPN
+	// when it has no addresses or routes of that family, rather than being
+	// blocked.
+	Families Families
+}
+
+// Default returns the options used when nothing is configured: no proxy, no
+// bypass, and both address families allowed, so that IPv4 or
+// IPv6 traffic isn't blocked on tailnets without addresses of that family.
+func Default() Options {
+	return Options{Families: AllFamilies}
+}
+
+// Equal reports whether o and p are the same options.
+func (o Options) Equal(p Options) bool {
+	return o.HTTPProxy == p.HTTPProxy &&
+		slices.Equal(o.ProxyExclusions, p.ProxyExclusions) &&
+		o.PACURL == p.PACURL &&
+		o.AllowBypass == p.AllowBypass &&
+		o.Families == p.Families
+}
+
+// Settings are options as configured by policy or by the user. Nil fields
+// are unset.
+type Settings struct {
+	HTTPProxy       *string   `json:",omitempty"`
+	ProxyExclusions []string  `json:",omitempty"`
+	PACURL          *string   `json:",omitempty"`
+	AllowBypass     *bool     `json:",omitempty"`
+	Families        *Families `json:",omitempty"`
+}
+
+// IsZero reports whether no option is set in s.
+func (s Settings) IsZero() bool {
+	return s.HTTPProxy == nil && s.ProxyExclusions == nil && s.PACURL == nil &&
+		s.AllowBypass == nil && s.Families == nil
+}
+
+// Validate reports whether the proxy settings of s are well-formed.
+func (s Settings) Validate() error {
+	if s.HTTPProxy != nil && *s.HTTPProxy != "" {
+		if _, _, err := SplitProxy(*s.HTTPProxy); err != nil {
+			return err
+		}
+	}
+	if s.PACURL != nil && *s.PACURL != "" {
+		if err := ValidatePACURL(*s.PACURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SplitProxy splits an HTTP proxy address into its host and port.
+func SplitProxy(s string) (host string, port int, err error) {
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid HTTP proxy %q: %w", s, err)
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("invalid HTTP proxy %q", s)
+	}
+	return host, port, nil
+}
+
+// ValidatePACURL reports whether s is an absolute http(s) URL.
+func ValidatePACURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid PAC URL %q: %w", s, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("PAC URL %q is not an absolute http(s) URL", s)
+	}
+	return nil
+}
+
+// ParseExclusions parses a comma-separated list of hosts excluded from the
+// HTTP proxy.
+func ParseExclusions(s string) []string {
+	var out []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// Resolve returns the options selected by policy and user settings. Each
+// option set by policy takes precedence over the user's, which takes
+// precedence over Default. Managed lists the options set by policy, by
+// their field names.
+func Resolve(policy, user Settings) (opts Options, managed []string) {
+	opts = Default()
+	resolve(&opts.HTTPProxy, policy.HTTPProxy, user.HTTPProxy, "HTTPProxy", &managed)
+	resolve(&opts.PACURL, policy.PACURL, user.PACURL, "PACURL", &managed)
+	resolve(&opts.AllowBypass, policy.AllowBypass, user.AllowBypass, "AllowBypass", &managed)
+	resolve(&opts.Families, policy.Families, user.Families, "Families", &managed)
+	switch {
+	case policy.ProxyExclusions != nil:
+		opts.ProxyExclusions = policy.ProxyExclusions
+		managed = append(managed, "ProxyExclusions")
+	case user.ProxyExclusions != nil:
+		opts.ProxyExclusions = user.ProxyExclusions
+	}
+	if len(opts.ProxyExclusions) == 0 {
+		opts.ProxyExclusions = nil
+	}
+	return opts, managed
+}
+
+func resolve[T any](dst *T, policy, user *T, name string, managed *[]string) {
+	switch {
+	case policy != nil:
+		*dst = *policy
+		*managed = append(*managed, name)
+	case user != nil:
+		*dst = *user
+	}
+}
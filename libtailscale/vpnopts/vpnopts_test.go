@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vpnopts
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseFamilies(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Families
+		wantErr bool
+	}{
+		{in: "ipv4", want: IPv4},
+		{in: "IPv6", want: IPv6},
+		{in: "ipv4, ipv6", want: AllFamilies},
+		{in: "none", want: NoFamilies},
+		{in: "", wantErr: true},
+		{in: "ipx", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFamilies(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFamilies(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseFamilies(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if err == nil {
+			if back, _ := ParseFamilies(got.String()); back != got {
+				t.Errorf("ParseFamilies(%q) = %v, doesn't round-trip", got.String(), back)
+			}
+		}
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+	tests := []struct {
+		s       Settings
+		wantErr bool
+	}{
+		{s: Settings{}},
+		{s: Settings{HTTPProxy: ptr("")}},
+		{s: Settings{HTTPProxy: ptr("proxy.example.com:3128")}},
+		{s: Settings{HTTPProxy: ptr("[fd7a::1]:8080")}},
+		{s: Settings{HTTPProxy: ptr("proxy.example.com")}, wantErr: true},
+		{s: Settings{HTTPProxy: ptr(":3128")}, wantErr: true},
+		{s: Settings{HTTPProxy: ptr("proxy:70000")}, wantErr: true},
+		{s: Settings{PACURL: ptr("https://example.com/proxy.pac")}},
+		{s: Settings{PACURL: ptr("file:///proxy.pac")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.s.Validate(); (err != nil) != tt.wantErr {
+			j, _ := json.Marshal(tt.s)
+			t.Errorf("%s: Validate() = %v, wantErr %v", j, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	proxy, userProxy := "proxy:3128", "user:8080"
+	yes, no := true, false
+	v6 := IPv6
+
+	opts, managed := Resolve(Settings{}, Settings{})
+	if !opts.Equal(Default()) || managed != nil {
+		t.Errorf("Resolve(empty) = %+v, %q; want defaults", opts, managed)
+	}
+
+	opts, managed = Resolve(
+		Settings{HTTPProxy: &proxy, AllowBypass: &no},
+		Settings{HTTPProxy: &userProxy, ProxyExclusions: []string{"a.example"}, AllowBypass: &yes, Families: &v6},
+	)
+	want := Options{
+		HTTPProxy:       proxy,
+		ProxyExclusions: []string{"a.example"},
+		Families:        IPv6,
+	}
+	if !opts.Equal(want) {
+		t.Errorf("Resolve = %+v, want %+v", opts, want)
+	}
+	if want := []string{"HTTPProxy", "AllowBypass"}; !reflect.DeepEqual(managed, want) {
+		t.Errorf("managed = %q, want %q", managed, want)
+	}
+
+	// An empty exclusion list set by policy clears the user's.
+	opts, _ = Resolve(Settings{ProxyExclusions: []string{}}, Settings{ProxyExclusions: []string{"a.example"}})
+	if opts.ProxyExclusions != nil {
+		t.Errorf("ProxyExclusions = %q, want none", opts.ProxyExclusions)
+	}
+}
+
+func TestSettingsJSON(t *testing.T) {
+	fam := IPv4
+	in := Settings{Families: &fam}
+	j, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(j), `{"Families":"ipv4"}`; got != want {
+		t.Errorf("Marshal = %s, want %s", got, want)
+	}
+	var out Settings
+	if err := json.Unmarshal(j, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package vpnplan records the calls made to a VpnService.Builder as a plan,
+// and keeps a history of the plans applied.
+package vpnplan
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+)
+
+// Builder is the part of VpnService.Builder that configures the VPN, before
+// it's established. It matches libtailscale.VPNServiceBuilder.
+type Builder interface {
+	SetMTU(int32) error
+	AddDNSServer(string) error
+	AddSearchDomain(string) error
+	AddRoute(string, int32) error
+	ExcludeRoute(string, int32) error
+	AddAddress(string, int32) error
+	AddAllowedApplication(string) error
+	AddDisallowedApplication(string) error
+	SetHTTPProxy(string, int32, string) error
+	SetHTTPProxyPAC(string) error
+	AllowBypass() error
+	AllowFamily(int32) error
+}
+
+// Plan is the configuration of a VPN, as applied to a Builder.
+type Plan struct {
+	// SDK is the Android SDK level the plan is for, and ExcludeMode
+	// whether local routes are excluded with ExcludeRoute (Android 13 and
+	// later) rather than subtracted from the routes.
+	SDK         int
+	ExcludeMode bool
+
+	MTU             int
+	Addresses       []string `json:",omitempty"`
+	Routes          []string `json:",omitempty"`
+	ExcludedRoutes  []string `json:",omitempty"`
+	DNSServers      []string `json:",omitempty"`
+	SearchDomains   []string `json:",omitempty"`
+	AllowedApps     []string `json:",omitempty"`
+	DisallowedApps  []string `json:",omitempty"`
+	HTTPProxy       string   `json:",omitempty"`
+	ProxyExclusions string   `json:",omitempty"`
+	PACURL          string   `json:",omitempty"`
+	AllowBypass     bool     `json:",omitempty"`
+	Families        []string `json:",omitempty"`
+
+	// Aggregation is how the routes were aggregated to fit the number of
+	// routes Android allows, if they were, DroppedExclusions the local
+	// routes ignored, and OverIncluded the addresses routed through the
+	// VPN only because of it.
+	Aggregation       string   `json:",omitempty"`
+	DroppedExclusions []string `json:",omitempty"`
+	OverIncluded      []string `json:",omitempty"`
+
+	// Errors are the Builder calls that failed.
+	Errors []string `json:",omitempty"`
+}
+
+// SetAggregation records the routes aggregated by the route calculation
+// res, if any.
+func (p *Plan) SetAggregation(res *rangescalc.Result) {
+	if res == nil || res.Aggregation == "" {
+		return
+	}
+	p.Aggregation = string(res.Aggregation)
+	for _, pfx := range res.DroppedExclusions {
+		p.DroppedExclusions = append(p.DroppedExclusions, pfx.String())
+	}
+	for _, pfx := range res.Affected {
+		p.OverIncluded = append(p.OverIncluded, pfx.String())
+	}
+}
+
+// Recorder is a Builder that records the calls made to it in Plan, and
+// passes them on to Next, unless it's nil. Calls that fail are recorded in
+// Plan.Errors instead.
+type Recorder struct {
+	Next Builder
+	Plan Plan
+}
+
+// call calls f on r.Next, and records the call with record if it succeeds.
+func (r *Recorder) call(desc string, f func(Builder) error, record func()) error {
+	if r.Next != nil {
+		if err := f(r.Next); err != nil {
+			r.Plan.Errors = append(r.Plan.Errors, fmt.Sprintf("%s: %v", desc, err))
+			return err
+		}
+	}
+	record()
+	return nil
+}
+
+func prefix(addr string, bits int32) string {
+	return addr + "/" + strconv.Itoa(int(bits))
+}
+
+func (r *Recorder) SetMTU(mtu int32) error {
+	return r.call(fmt.Sprintf("SetMTU(%d)", mtu), func(b Builder) error { return b.SetMTU(mtu) },
+		func() { r.Plan.MTU = int(mtu) })
+}
+
+func (r *Recorder) AddDNSServer(s string) error {
+	return r.call("AddDNSServer("+s+")", func(b Builder) error { return b.AddDNSServer(s) },
+		func() { r.Plan.DNSServers = append(r.Plan.DNSServers, s) })
+}
+
+func (r *Recorder) AddSearchDomain(s string) error {
+	return r.call("AddSearchDomain("+s+")", func(b Builder) error { return b.AddSearchDomain(s) },
+		func() { r.Plan.SearchDomains = append(r.Plan.SearchDomains, s) })
+}
+
+func (r *Recorder) AddRoute(addr string, bits int32) error {
+	p := prefix(addr, bits)
+	return r.call("AddRoute("+p+")", func(b Builder) error { return b.AddRoute(addr, bits) },
+		func() { r.Plan.Routes = append(r.Plan.Routes, p) })
+}
+
+func (r *Recorder) ExcludeRoute(addr string, bits int32) error {
+	p := prefix(addr, bits)
+	return r.call("ExcludeRoute("+p+")", func(b Builder) error { return b.ExcludeRoute(addr, bits) },
+		func() { r.Plan.ExcludedRoutes = append(r.Plan.ExcludedRoutes, p) })
+}
+
+func (r *Recorder) AddAddress(addr string, bits int32) error {
+	p := prefix(addr, bits)
+	return r.call("AddAddress("+p+")", func(b Builder) error { return b.AddAddress(addr, bits) },
+		func() { r.Plan.Addresses = append(r.Plan.Addresses, p) })
+}
+
+func (r *Recorder) AddAllowedApplication(pkg string) error {
+	return r.call("AddAllowedApplication("+pkg+")", func(b Builder) error { return b.AddAllowedApplication(pkg) },
+		func() { r.Plan.AllowedApps = append(r.Plan.AllowedApps, pkg) })
+}
+
+func (r *Recorder) AddDisallowedApplication(pkg string) error {
+	return r.call("AddDisallowedApplication("+pkg+")", func(b Builder) error { return b.AddDisallowedApplication(pkg) },
+		func() { r.Plan.DisallowedApps = append(r.Plan.DisallowedApps, pkg) })
+}
+
+func (r *Recorder) SetHTTPProxy(host string, port int32, exclusions string) error {
+	hp := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return r.call("SetHTTPProxy("+hp+")", func(b Builder) error { return b.SetHTTPProxy(host, port, exclusions) },
+		func() { r.Plan.HTTPProxy, r.Plan.ProxyExclusions = hp, exclusions })
+}
+
+func (r *Recorder) SetHTTPProxyPAC(url string) error {
+	return r.call("SetHTTPProxyPAC("+url+")", func(b Builder) error { return b.SetHTTPProxyPAC(url) },
+		func() { r.Plan.PACURL = url })
+}
+
+func (r *Recorder) AllowBypass() error {
+	return r.call("AllowBypass()", func(b Builder) error { return b.AllowBypass() },
+		func() { r.Plan.AllowBypass = true })
+}
+
+func (r *Recorder) AllowFamily(family int32) error {
+	name := "AF(" + strconv.Itoa(int(family)) + ")"
+	switch family {
+	case syscall.AF_INET:
+		name = "ipv4"
+	case syscall.AF_INET6:
+		name = "ipv6"
+	}
+	return r.call("AllowFamily("+name+")", func(b Builder) error { return b.AllowFamily(family) },
+		func() { r.Plan.Families = append(r.Plan.Families, name) })
+}
+
+// Applied is a plan that was applied to the VPN.
+type Applied struct {
+	At   time.Time
+	Plan Plan
+	// Err is the error establishing the VPN, if it failed.
+	Err string `json:",omitempty"`
+}
+
+// historyLen is the number of plans kept by a History.
+const historyLen = 16
+
+// History holds the most recent plans applied. It's safe for concurrent use.
+type History struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	applied []Applied // oldest first, at most historyLen
+}
+
+// NewHistory returns an empty History.
+func NewHistory() *History {
+	return &History{now: time.Now}
+}
+
+// Add records that p was applied, with err the result of establishing it.
+func (h *History) Add(p Plan, err error) {
+	a := Applied{At: h.now(), Plan: p}
+	if err != nil {
+		a.Err = err.Error()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.applied) == historyLen {
+		h.applied = slices.Delete(h.applied, 0, 1)
+	}
+	h.applied = append(h.applied, a)
+}
+
+// List returns the plans applied, most recent first.
+func (h *History) List() []Applied {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := slices.Clone(h.applied)
+	slices.Reverse(l)
+	return l
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vpnplan
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	rangescalc "github.com/tailscale/tailscale-android/libtailscale/ranges_calc"
+)
+
+// fakeBuilder is a Builder that rejects the AddRoute calls and apps in bad.
+type fakeBuilder struct {
+	Recorder // for the methods not under test
+	calls    int
+	bad      string
+}
+
+func (f *fakeBuilder) AddRoute(addr string, bits int32) error {
+	f.calls++
+	if addr == f.bad {
+		return errors.New("bad address")
+	}
+	return nil
+}
+
+func (f *fakeBuilder) AddAllowedApplication(pkg string) error {
+	f.calls++
+	if pkg == f.bad {
+		return errors.New("package not found")
+	}
+	return nil
+}
+
+func TestRecorderDryRun(t *testing.T) {
+	var r Recorder
+	r.SetMTU(1280)
+	r.AddAddress("100.64.0.1", 32)
+	r.AddRoute("100.64.0.0", 10)
+	r.ExcludeRoute("192.168.1.0", 24)
+	r.AddDNSServer("100.100.100.100")
+	r.AddSearchDomain("example.ts.net")
+	r.AddDisallowedApplication("com.example")
+	r.SetHTTPProxy("proxy.example", 3128, "localhost,*.lan")
+	r.AllowFamily(syscall.AF_INET)
+	r.AllowFamily(syscall.AF_INET6)
+	r.AllowBypass()
+
+	want := Plan{
+		MTU:             1280,
+		Addresses:       []string{"100.64.0.1/32"},
+		Routes:          []string{"100.64.0.0/10"},
+		ExcludedRoutes:  []string{"192.168.1.0/24"},
+		DNSServers:      []string{"100.100.100.100"},
+		SearchDomains:   []string{"example.ts.net"},
+		DisallowedApps:  []string{"com.example"},
+		HTTPProxy:       "proxy.example:3128",
+		ProxyExclusions: "localhost,*.lan",
+		Families:        []string{"ipv4", "ipv6"},
+		AllowBypass:     true,
+	}
+	if !reflect.DeepEqual(r.Plan, want) {
+		t.Errorf("Plan = %+v\nwant %+v", r.Plan, want)
+	}
+}
+
+func TestRecorderTee(t *testing.T) {
+	next := &fakeBuilder{bad: "10.0.0.1"}
+	r := Recorder{Next: next}
+	if err := r.AddRoute("10.0.0.0", 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddRoute("10.0.0.1", 8); err == nil {
+		t.Fatal("failing call succeeded")
+	}
+	r.AddAllowedApplication("com.example")
+	if next.calls != 3 {
+		t.Errorf("calls = %d, want 3", next.calls)
+	}
+	if !reflect.DeepEqual(r.Plan.Routes, []string{"10.0.0.0/8"}) {
+		t.Errorf("Routes = %q", r.Plan.Routes)
+	}
+	if !reflect.DeepEqual(r.Plan.Errors, []string{"AddRoute(10.0.0.1/8): bad address"}) {
+		t.Errorf("Errors = %q", r.Plan.Errors)
+	}
+}
+
+func TestSetAggregation(t *testing.T) {
+	var p Plan
+	p.SetAggregation(nil)
+	p.SetAggregation(&rangescalc.Result{Calculated: 3})
+	if !reflect.DeepEqual(p, Plan{}) {
+		t.Errorf("Plan = %+v without aggregation", p)
+	}
+
+	p.SetAggregation(&rangescalc.Result{
+		Aggregation:       rangescalc.OverInclude,
+		DroppedExclusions: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")},
+		Affected:          []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("fd00::/8")},
+	})
+	want := Plan{
+		Aggregation:       string(rangescalc.OverInclude),
+		DroppedExclusions: []string{"192.168.1.0/24"},
+		OverIncluded:      []string{"10.1.0.0/16", "fd00::/8"},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Plan = %+v, want %+v", p, want)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory()
+	now := time.Unix(0, 0)
+	h.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	for i := range historyLen + 3 {
+		var err error
+		if i%2 == 1 {
+			err = errors.New("establish failed")
+		}
+		h.Add(Plan{MTU: 1280 + i}, err)
+	}
+	l := h.List()
+	if len(l) != historyLen {
+		t.Fatalf("len = %d, want %d", len(l), historyLen)
+	}
+	if l[0].Plan.MTU != 1280+historyLen+2 || l[len(l)-1].Plan.MTU != 1283 {
+		t.Errorf("List MTUs from %d to %d", l[0].Plan.MTU, l[len(l)-1].Plan.MTU)
+	}
+	if !l[0].At.After(l[1].At) || l[0].Err != "" || l[1].Err == "" {
+		t.Errorf("List = %+v", l[:2])
+	}
+}
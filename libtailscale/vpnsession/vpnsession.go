@@ -0,0 +1,244 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package vpnsession is the state machine of an Android VPN session, from the
+// VPN service being requested to the tun device being up and back.
+package vpnsession
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// State is the state of a VPN session.
+type State int
+
+const (
+	// Idle is when there's no VPN service.
+	Idle State = iota
+	// Requested is when the VPN service is running but no tun device is
+	// established, because there's no config yet or it has no addresses.
+	Requested
+	// Establishing is when the first tun device of the session, or the
+	// first since a failure, is being established.
+	Establishing
+	// Up is when a tun device is established.
+	Up
+	// Reconfiguring is when a tun device is up and is being replaced by
+	// one with a new config. If that fails, the session goes back to Up,
+	// with the error, since the previous device still carries traffic.
+	Reconfiguring
+	// Revoked is when establishing failed because the VPN permission was
+	// revoked or another VPN holds it.
+	Revoked
+	// Failed is when establishing failed for another reason.
+	Failed
+
+	numStates = iota
+)
+
+var stateNames = [numStates]string{
+	Idle:          "idle",
+	Requested:     "requested",
+	Establishing:  "establishing",
+	Up:            "up",
+	Reconfiguring: "reconfiguring",
+	Revoked:       "revoked",
+	Failed:        "failed",
+}
+
+func (s State) String() string {
+	if s < 0 || s >= numStates {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// States returns all states, in order.
+func States() []State {
+	s := make([]State, numStates)
+	for i := range s {
+		s[i] = State(i)
+	}
+	return s
+}
+
+// transitions are the valid transitions, by source state. Any state but Idle
+// can go back to Idle, when the VPN service stops.
+var transitions = [numStates][]State{
+	Idle:          {Requested},
+	Requested:     {Establishing, Idle},
+	Establishing:  {Up, Requested, Revoked, Failed, Idle},
+	Up:            {Reconfiguring, Requested, Idle},
+	Reconfiguring: {Up, Requested, Revoked, Failed, Idle},
+	Revoked:       {Establishing, Requested, Idle},
+	Failed:        {Establishing, Requested, Idle},
+}
+
+// CanTransition reports whether a session may go from one state to another.
+func CanTransition(from, to State) bool {
+	if from < 0 || from >= numStates {
+		return false
+	}
+	return slices.Contains(transitions[from], to)
+}
+
+// Transition is a change of state.
+type Transition struct {
+	From, To State
+	Reason   string
+	Err      string `json:",omitempty"`
+	At       time.Time
+}
+
+// historyLen is the number of transitions kept by a Machine.
+const historyLen = 32
+
+// Machine is the state machine of a VPN session. It's safe for concurrent use.
+type Machine struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     State
+	since     time.Time
+	history   []Transition // oldest first, at most historyLen
+	entered   [numStates]uint64
+	observers []func(Transition)
+}
+
+// New returns a Machine in the Idle state.
+func New() *Machine {
+	return &Machine{now: time.Now, since: time.Now()}
+}
+
+// State returns the current state.
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// To moves the session to state to, for the given reason and error, if any.
+// Moving to the current state does nothing. It returns an error, and stays
+// in the current state, if the transition isn't valid.
+//
+// Observers are called synchronously, in the order they were added, after
+// the state changed.
+func (m *Machine) To(to State, reason string, err error) error {
+	return m.move(func(State) (State, string) { return to, reason }, err)
+}
+
+// Establishing records that a tun device is being established, which
+// replaces the current one if the session is Up.
+func (m *Machine) Establishing() error {
+	return m.move(func(from State) (State, string) {
+		if from == Up {
+			return Reconfiguring, "config changed"
+		}
+		return Establishing, "establishing tun device"
+	}, nil)
+}
+
+// Established records the result of establishing a tun device. revoked is
+// whether it failed because the VPN permission was lost.
+//
+// When replacing a tun device fails for another reason, the previous device
+// is still attached and carries traffic with the previous config, so the
+// session goes back to Up, with the error.
+func (m *Machine) Established(err error, revoked bool) error {
+	return m.move(func(from State) (State, string) {
+		switch {
+		case err == nil:
+			return Up, "tun device established"
+		case revoked:
+			return Revoked, "VPN permission lost"
+		case from == Reconfiguring:
+			return Up, "reconfiguring failed, keeping previous tun device"
+		}
+		return Failed, "establishing failed"
+	}, err)
+}
+
+// move moves the session to the state next returns for the current one, as
+// To does.
+func (m *Machine) move(next func(from State) (to State, reason string), err error) error {
+	m.mu.Lock()
+	from := m.state
+	to, reason := next(from)
+	if from == to {
+		m.mu.Unlock()
+		return nil
+	}
+	if !CanTransition(from, to) {
+		m.mu.Unlock()
+		return fmt.Errorf("invalid VPN session transition from %v to %v (%s)", from, to, reason)
+	}
+	t := Transition{From: from, To: to, Reason: reason, At: m.now()}
+	if err != nil {
+		t.Err = err.Error()
+	}
+	m.state, m.since = to, t.At
+	m.entered[to]++
+	if len(m.history) == historyLen {
+		m.history = slices.Delete(m.history, 0, 1)
+	}
+	m.history = append(m.history, t)
+	observers := slices.Clone(m.observers)
+	m.mu.Unlock()
+
+	for _, f := range observers {
+		f(t)
+	}
+	return nil
+}
+
+// Observe calls f on every later transition.
+func (m *Machine) Observe(f func(Transition)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, f)
+}
+
+// Entered returns the number of transitions into s.
+func (m *Machine) Entered(s State) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s < 0 || s >= numStates {
+		return 0
+	}
+	return m.entered[s]
+}
+
+// Status is a snapshot of a Machine.
+type Status struct {
+	State State
+	Since time.Time
+	// Entered is the number of transitions into each state.
+	Entered map[State]uint64
+	// History are the most recent transitions, oldest first.
+	History []Transition
+}
+
+// Status returns a snapshot of m.
+func (m *Machine) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := Status{
+		State:   m.state,
+		Since:   m.since,
+		Entered: make(map[State]uint64),
+		History: slices.Clone(m.history),
+	}
+	for s, n := range m.entered {
+		if n > 0 {
+			st.Entered[State(s)] = n
+		}
+	}
+	return st
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vpnsession
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	m := New()
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	var seen []State
+	m.Observe(func(t Transition) { seen = append(seen, t.To) })
+
+	steps := []State{Requested, Establishing, Up, Reconfiguring, Failed, Establishing, Revoked, Establishing, Up, Requested, Idle}
+	for _, s := range steps {
+		now = now.Add(time.Second)
+		if err := m.To(s, "test", nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.State(); got != s {
+			t.Fatalf("State = %v, want %v", got, s)
+		}
+	}
+	if !reflect.DeepEqual(seen, steps) {
+		t.Errorf("observed %v, want %v", seen, steps)
+	}
+	st := m.Status()
+	if st.State != Idle || !st.Since.Equal(now) {
+		t.Errorf("Status = %v since %v, want idle since %v", st.State, st.Since, now)
+	}
+	if st.Entered[Establishing] != 3 || st.Entered[Up] != 2 || m.Entered(Failed) != 1 {
+		t.Errorf("Entered = %v", st.Entered)
+	}
+	if len(st.History) != len(steps) || st.History[0].From != Idle || st.History[0].To != Requested {
+		t.Errorf("History = %+v", st.History)
+	}
+}
+
+func TestReconfigureFailureKeepsUp(t *testing.T) {
+	m := New()
+	for _, s := range []State{Requested, Establishing, Up, Reconfiguring} {
+		if err := m.To(s, "test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.To(Up, "reconfiguring failed", errors.New("invalid route")); err != nil {
+		t.Fatal(err)
+	}
+	h := m.Status().History
+	if last := h[len(h)-1]; last.From != Reconfiguring || last.To != Up || last.Err != "invalid route" {
+		t.Errorf("last transition = %+v", last)
+	}
+}
+
+func TestEstablished(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		from    []State // the states leading to the one established from
+		err     error
+		revoked bool
+		want    State
+	}{
+		{name: "up", from: []State{Requested}, want: Up},
+		{name: "failed", from: []State{Requested}, err: errFailed, want: Failed},
+		{name: "revoked", from: []State{Requested}, err: errFailed, revoked: true, want: Revoked},
+		{name: "reconfigured", from: []State{Requested, Establishing, Up}, want: Up},
+		{name: "reconfiguring_failed", from: []State{Requested, Establishing, Up}, err: errFailed, want: Up},
+		{name: "reconfiguring_revoked", from: []State{Requested, Establishing, Up}, err: errFailed, revoked: true, want: Revoked},
+		{name: "after_failure", from: []State{Requested, Establishing, Failed}, want: Up},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New()
+			for _, s := range tt.from {
+				if err := m.To(s, "test", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wantEstablishing := Establishing
+			if m.State() == Up {
+				wantEstablishing = Reconfiguring
+			}
+			if err := m.Establishing(); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.State(); got != wantEstablishing {
+				t.Errorf("after Establishing, State = %v, want %v", got, wantEstablishing)
+			}
+			if err := m.Established(tt.err, tt.revoked); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.State(); got != tt.want {
+				t.Errorf("after Established, State = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidTransition(t *testing.T) {
+	m := New()
+	if err := m.To(Up, "test", nil); err == nil {
+		t.Fatal("idle to up succeeded")
+	}
+	if m.State() != Idle {
+		t.Errorf("State = %v after invalid transition", m.State())
+	}
+	// Staying in the same state is not a transition.
+	if err := m.To(Idle, "test", nil); err != nil {
+		t.Errorf("idle to idle: %v", err)
+	}
+	if len(m.Status().History) != 0 {
+		t.Error("no-op transition recorded")
+	}
+}
+
+func TestEveryStateCanStop(t *testing.T) {
+	for _, s := range States() {
+		if s != Idle && !CanTransition(s, Idle) {
+			t.Errorf("%v can't go to idle", s)
+		}
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	m := New()
+	for range historyLen {
+		m.To(Requested, "start", nil)
+		m.To(Idle, "stop", errors.New("stopped"))
+	}
+	h := m.Status().History
+	if len(h) != historyLen {
+		t.Fatalf("len(History) = %d, want %d", len(h), historyLen)
+	}
+	if last := h[len(h)-1]; last.To != Idle || last.Err != "stopped" {
+		t.Errorf("last transition = %+v", last)
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	m := New()
+	m.To(Requested, "start", nil)
+	j, err := json.Marshal(m.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		State   string
+		Entered map[string]uint64
+	}
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.State != "requested" || got.Entered["requested"] != 1 {
+		t.Errorf("JSON = %s", j)
+	}
+}